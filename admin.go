@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// what an account may do: readers only read, editors edit the pages their
+// protection lets signed in users edit, and admins edit everything and use
+// the admin tools
+const (
+	roleReader = "reader"
+	roleEditor = "editor"
+	roleAdmin  = "admin"
+)
+
+var roles = []string{roleReader, roleEditor, roleAdmin}
+
+func validRole(role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+type User struct {
+	Name string
+	Role string
+}
+
+func (u *User) IsAdmin() bool {
+	return u != nil && u.Role == roleAdmin
+}
+
+// IsReader reports whether u is signed in with an account that may not
+// edit.
+func (u *User) IsReader() bool {
+	return u != nil && u.Role == roleReader
+}
+
+// currentUser returns the signed in user, or nil for anonymous requests: the
+// configured admin, signed in through HTTP basic auth, or the account of the
+// session cookie.
+func currentUser(r *http.Request) *User {
+	if config.AdminPassword == "" {
+		return sessionUser(r)
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok ||
+		subtle.ConstantTimeCompare([]byte(user), []byte(config.AdminUser)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(password), []byte(config.AdminPassword)) != 1 {
+		return sessionUser(r)
+	}
+	return &User{Name: user, Role: roleAdmin}
+}
+
+// anonymousEditor is recorded for anonymous edits, followed by the address
+// they came from.
+const anonymousEditor = "anonymous"
+
+// editorName is the name recorded for edits made by the request, like
+// "anonymous (192.0.2.1)" when it is anonymous.
+func editorName(r *http.Request) string {
+	if u := currentUser(r); u != nil {
+		return u.Name
+	}
+	return anonymousEditor + " (" + clientIP(r) + ")"
+}
+
+// isAnonymous reports whether editor, as recorded by editorName, is not a
+// signed in user. Edits from before addresses were recorded have no name.
+func isAnonymous(editor string) bool {
+	return editor == "" || strings.HasPrefix(editor, anonymousEditor+" (")
+}
+
+// requireLogin asks the browser for credentials.
+func requireLogin(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="go-wiki admin"`)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
+
+// adminOnly guards admin tools behind HTTP basic auth using the configured
+// admin credentials, or an account with the admin role.
+func adminOnly(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if currentUser(r).IsAdmin() {
+			fn(w, r)
+			return
+		}
+		if config.AdminPassword == "" {
+			http.Error(w, "admin tools need an admin account or -admin-password", http.StatusForbidden)
+			return
+		}
+		requireLogin(w)
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAPIRevisions = 50
+	maxAPIRevisions     = 500
+	defaultAPITitles    = 10
+	maxAPITitles        = 50
+	// largest PUT body, as for forms
+	maxAPIBody = 10 << 20
+)
+
+// codes of the errors the API answers with, client errors but for
+// apiInternal
+const (
+	apiNotFound         = "not_found"
+	apiInvalid          = "invalid"
+	apiConflict         = "conflict"
+	apiPrecondition     = "precondition_failed"
+	apiUnauthorized     = "unauthorized"
+	apiForbidden        = "forbidden"
+	apiTooManyRequests  = "too_many_requests"
+	apiMethodNotAllowed = "method_not_allowed"
+	apiUnavailable      = "unavailable"
+	apiInternal         = "internal"
+)
+
+// apiError is the body of every API error response.
+type apiError struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// isAPI reports whether r is a request to the JSON API, whose errors are
+// JSON too.
+func isAPI(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/")
+}
+
+func writeAPIError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	body, _ := json.Marshal(apiError{Error: message, Code: code})
+	writeBody(w, r, status, "application/json", body)
+}
+
+// apiFail answers with the API error err stands for: missing pages are not
+// found, pages created or changed meanwhile a conflict, anything else
+// internal.
+func apiFail(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case errNotFound:
+		writeAPIError(w, r, http.StatusNotFound, apiNotFound, err.Error())
+	case errCreateConflict, errVersionConflict:
+		writeAPIError(w, r, http.StatusConflict, apiConflict, err.Error())
+	default:
+		writeAPIError(w, r, http.StatusInternalServerError, apiInternal, err.Error())
+	}
+}
+
+func apiNotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, r, http.StatusNotFound, apiNotFound, "no such endpoint")
+}
+
+// apiInt reads the optional non-negative integer parameter name of r,
+// answering a validation error if it is anything else.
+func apiInt(w http.ResponseWriter, r *http.Request, name string, def int) (int, bool) {
+	v := r.FormValue(name)
+	if v == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		writeAPIError(w, r, http.StatusBadRequest, apiInvalid, name+" must be a non-negative integer")
+		return 0, false
+	}
+	return n, true
+}
+
+// apiRevision is a revision as /api/pages/<title>/revisions returns it,
+// with the body as text.
+type apiRevision struct {
+	ID        int64     `json:"id"`
+	Author    string    `json:"author"`
+	CreatedAt time.Time `json:"created_at"`
+	Summary   string    `json:"summary"`
+	Size      int64     `json:"size"`
+	Body      string    `json:"body"`
+}
+
+// apiPage is a page as /api/pages/<title> returns it.
+type apiPage struct {
+	Title     string    `json:"title"`
+	Body      string    `json:"body,omitempty"`
+	Version   int64     `json:"version"`
+	UpdatedAt time.Time `json:"updated_at"`
+	UpdatedBy string    `json:"updated_by"`
+}
+
+// apiPageEdit is the body of a PUT to /api/pages/<title>.
+type apiPageEdit struct {
+	Body    string `json:"body"`
+	Summary string `json:"summary"`
+	// the token of a solved challenge, for anonymous saves under -captcha
+	Captcha string `json:"captcha,omitempty"`
+}
+
+// apiPagesHandler serves /api/pages/<title>, the page itself, and
+// /api/pages/<title>/revisions. The slashes of titles like Projects/GoWiki
+// are escaped as %2F.
+func apiPagesHandler(w http.ResponseWriter, r *http.Request, store PageStore) {
+	title, rest := pathTitle(r, "/api/pages/")
+	if rest != "" && rest != "revisions" {
+		apiNotFoundHandler(w, r)
+		return
+	}
+	if err := checkTitle(title); err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, apiInvalid, err.Error())
+		return
+	}
+	switch {
+	case rest == "" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		apiGetPage(w, r, title, store)
+	case rest == "" && r.Method == http.MethodPut:
+		apiPutPage(w, r, title, store)
+	case rest == "revisions" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		apiRevisions(w, r, title, store)
+	default:
+		if rest == "" {
+			w.Header().Set("Allow", "GET, HEAD, PUT")
+		} else {
+			w.Header().Set("Allow", "GET, HEAD")
+		}
+		writeAPIError(w, r, http.StatusMethodNotAllowed, apiMethodNotAllowed, "method not allowed")
+	}
+}
+
+// versionETag is the ETag of a version of a page, the one If-Match takes.
+func versionETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+func writeAPIPage(w http.ResponseWriter, r *http.Request, status int, p *Page, body string) {
+	out, err := json.Marshal(apiPage{Title: p.Title, Body: body, Version: p.Version, UpdatedAt: p.UpdatedAt, UpdatedBy: p.UpdatedBy})
+	if err != nil {
+		apiFail(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", versionETag(p.Version))
+	writeBody(w, r, status, "application/json", out)
+}
+
+func apiGetPage(w http.ResponseWriter, r *http.Request, title string, store PageStore) {
+	p, err := store.Load(title)
+	if err != nil {
+		apiFail(w, r, err)
+		return
+	}
+	writeAPIPage(w, r, http.StatusOK, p, string(p.Body))
+}
+
+// apiPutPage creates or replaces a page. If-None-Match: * only creates it,
+// If-Match only replaces it at the given version (or any, with *), each
+// answering 412 Precondition Failed otherwise.
+func apiPutPage(w http.ResponseWriter, r *http.Request, title string, store PageStore) {
+	var edit apiPageEdit
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBody)).Decode(&edit); err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, apiInvalid, "the body must be a JSON object with the page body: "+err.Error())
+		return
+	}
+	p := &Page{Title: title, Body: []byte(edit.Body), UpdatedBy: editorName(r), Summary: strings.TrimSpace(edit.Summary)}
+	if config.NormalizeBodies {
+		p.Body = normalizeText(p.Body)
+	}
+	logSubmission(r, p)
+	if v := validateSave(p); v.Failed() {
+		var msgs []string
+		for _, f := range v.Fields {
+			msgs = append(msgs, f.Message)
+		}
+		writeAPIError(w, r, http.StatusBadRequest, apiInvalid, strings.Join(msgs, " "))
+		return
+	}
+
+	stored, err := store.Stat(title)
+	if err != nil && err != errNotFound {
+		apiFail(w, r, err)
+		return
+	}
+	exists := err == nil
+	if match := r.Header.Get("If-Match"); match != "" {
+		if !exists {
+			writeAPIError(w, r, http.StatusPreconditionFailed, apiPrecondition, "the page does not exist")
+			return
+		}
+		if match != "*" {
+			version, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(match, "W/"), `"`), 10, 64)
+			if err != nil || version <= 0 {
+				writeAPIError(w, r, http.StatusBadRequest, apiInvalid, "If-Match must be * or a page version")
+				return
+			}
+			p.BaseVersion = version
+		}
+	}
+	if r.Header.Get("If-None-Match") == "*" {
+		if exists {
+			writeAPIError(w, r, http.StatusPreconditionFailed, apiPrecondition, "the page already exists")
+			return
+		}
+		p.New = true
+	}
+
+	// pages that do not exist yet are open to anyone
+	level := protectAnyone
+	if exists {
+		level = stored.Protection
+	}
+	if u := currentUser(r); !canEdit(u, level) {
+		if u == nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="go-wiki admin"`)
+			writeAPIError(w, r, http.StatusUnauthorized, apiUnauthorized, "sign in to edit this page")
+			return
+		}
+		writeAPIError(w, r, http.StatusForbidden, apiForbidden, "this page is protected")
+		return
+	}
+	if captchaFor(r) != nil {
+		ok, err := verifyCaptchaToken(r, edit.Captcha)
+		if err != nil {
+			writeAPIError(w, r, http.StatusBadGateway, apiUnavailable, "the challenge could not be checked: "+err.Error())
+			return
+		}
+		if !ok {
+			writeAPIError(w, r, http.StatusForbidden, apiForbidden, "anonymous saves need the token of a solved challenge in captcha, or sign in")
+			return
+		}
+	}
+	reason, msg, err := spamReason(r, p, store)
+	if err != nil {
+		apiFail(w, r, err)
+		return
+	}
+	if reason != "" {
+		recordRejected(r, p, reason)
+		writeAPIError(w, r, http.StatusForbidden, apiForbidden, msg)
+		return
+	}
+	if ok, reset := allowEdit(w, r); !ok {
+		writeAPIError(w, r, http.StatusTooManyRequests, apiTooManyRequests, "edit quota reached until "+reset.Format(time.RFC3339))
+		return
+	}
+
+	err = store.Save(p)
+	switch err {
+	case nil:
+	case errCreateConflict:
+		writeAPIError(w, r, http.StatusPreconditionFailed, apiPrecondition, "the page already exists")
+		return
+	case errVersionConflict:
+		writeAPIError(w, r, http.StatusPreconditionFailed, apiPrecondition, err.Error())
+		return
+	default:
+		apiFail(w, r, err)
+		return
+	}
+	status := http.StatusOK
+	if !exists {
+		status = http.StatusCreated
+	}
+	writeAPIPage(w, r, status, p, "")
+}
+
+// apiRevisions serves /api/pages/<title>/revisions: the revisions of a page
+// newest first as a JSON array, paged with limit and offset. The total is in
+// X-Total-Count and the next page, if any, in a Link header.
+func apiRevisions(w http.ResponseWriter, r *http.Request, title string, store PageStore) {
+	limit, ok := apiInt(w, r, "limit", defaultAPIRevisions)
+	if !ok {
+		return
+	}
+	if limit == 0 {
+		limit = defaultAPIRevisions
+	}
+	if limit > maxAPIRevisions {
+		limit = maxAPIRevisions
+	}
+	offset, ok := apiInt(w, r, "offset", 0)
+	if !ok {
+		return
+	}
+
+	p, err := store.Stat(title)
+	if err != nil {
+		apiFail(w, r, err)
+		return
+	}
+	revs, total, err := store.Revisions(p, limit, offset, pageFull)
+	if err != nil {
+		apiFail(w, r, err)
+		return
+	}
+
+	// an empty array rather than null for a page without revisions
+	out := make([]apiRevision, 0, len(revs))
+	for _, rev := range revs {
+		out = append(out, apiRevision{rev.ID, rev.Author, rev.CreatedAt, rev.Summary, rev.Size, string(rev.Body)})
+	}
+	body, err := json.Marshal(out)
+	if err != nil {
+		apiFail(w, r, err)
+		return
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if offset+len(revs) < total {
+		next := fmt.Sprintf("%s/api/pages/%s/revisions?limit=%d&offset=%d", config.BasePath, titleSegment(title), limit, offset+len(revs))
+		w.Header().Set("Link", `<`+next+`>; rel="next"`)
+	}
+	writeBody(w, r, http.StatusOK, "application/json", body)
+}
+
+// likeEscaper escapes the wildcards of a LIKE pattern, with \ as the escape
+// character.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// titlesWithPrefix returns up to n titles starting with prefix, in any
+// letter case, in alphabetical order.
+func titlesWithPrefix(ctx context.Context, prefix string, n int, conn db) ([]string, error) {
+	defer timeQuery("titlesWithPrefix", time.Now())
+	query := `SELECT title FROM ` + table("pages") + ` WHERE lower(title) LIKE lower($1) ESCAPE '\' ORDER BY title LIMIT $2`
+	rows, err := conn.Query(ctx, query, likeEscaper.Replace(prefix)+"%", n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var titles []string
+	for rows.Next() {
+		var t string
+		if err := rows.Scan(&t); err != nil {
+			return nil, err
+		}
+		titles = append(titles, t)
+	}
+	return titles, rows.Err()
+}
+
+// apiTitlesHandler serves /api/titles?prefix=: the titles starting with
+// prefix as a JSON array, up to limit of them, for link autocompletion.
+func apiTitlesHandler(w http.ResponseWriter, r *http.Request, store PageStore) {
+	limit, ok := apiInt(w, r, "limit", defaultAPITitles)
+	if !ok {
+		return
+	}
+	if limit == 0 {
+		limit = defaultAPITitles
+	}
+	if limit > maxAPITitles {
+		limit = maxAPITitles
+	}
+
+	// an empty array rather than null when nothing matches
+	titles := []string{}
+	if prefix := strings.TrimSpace(r.FormValue("prefix")); prefix != "" {
+		found, err := store.TitlesWithPrefix(prefix, limit)
+		if err != nil {
+			apiFail(w, r, err)
+			return
+		}
+		titles = append(titles, found...)
+	}
+	body, err := json.Marshal(titles)
+	if err != nil {
+		apiFail(w, r, err)
+		return
+	}
+	writeBody(w, r, http.StatusOK, "application/json", body)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// brokenStore is a memStore whose pages can't be read, as when the database
+// is down.
+type brokenStore struct{ *memStore }
+
+var errBroken = errors.New("the database is down")
+
+func (s brokenStore) WithContext(ctx context.Context) PageStore { return s }
+func (s brokenStore) Load(title string) (*Page, error)          { return nil, errBroken }
+func (s brokenStore) Stat(title string) (*Page, error)          { return nil, errBroken }
+
+// apiRequest sends h a request with body as its JSON body and header as
+// its headers.
+func apiRequest(h http.Handler, method, target, body string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestAPIErrors(t *testing.T) {
+	keepConfig(t)
+	config.AnonymousEdits = true
+	h := testServer(seedStore(map[string]string{"Home": "home"}))
+	tests := []struct {
+		name, method, target, body string
+		header                     []string
+		status                     int
+		code                       string
+	}{
+		{"missing page", http.MethodGet, "/api/pages/Nowhere", "", nil, http.StatusNotFound, apiNotFound},
+		{"revisions of a missing page", http.MethodGet, "/api/pages/Nowhere/revisions", "", nil, http.StatusNotFound, apiNotFound},
+		{"unknown endpoint", http.MethodGet, "/api/nothing", "", nil, http.StatusNotFound, apiNotFound},
+		{"unknown page endpoint", http.MethodGet, "/api/pages/Home/links", "", nil, http.StatusNotFound, apiNotFound},
+		{"bad title", http.MethodGet, "/api/pages/" + strings.Repeat("x", config.MaxTitleLength+1), "", nil, http.StatusBadRequest, apiInvalid},
+		{"negative limit", http.MethodGet, "/api/titles?prefix=H&limit=-1", "", nil, http.StatusBadRequest, apiInvalid},
+		{"text offset", http.MethodGet, "/api/pages/Home/revisions?offset=next", "", nil, http.StatusBadRequest, apiInvalid},
+		{"body not JSON", http.MethodPut, "/api/pages/Home", "home", nil, http.StatusBadRequest, apiInvalid},
+		{"bad If-Match", http.MethodPut, "/api/pages/Home", `{"body": "new"}`, []string{"If-Match", "latest"}, http.StatusBadRequest, apiInvalid},
+		{"stale If-Match", http.MethodPut, "/api/pages/Home", `{"body": "new"}`, []string{"If-Match", `"7"`}, http.StatusPreconditionFailed, apiPrecondition},
+		{"creating a page that exists", http.MethodPut, "/api/pages/Home", `{"body": "new"}`, []string{"If-None-Match", "*"}, http.StatusPreconditionFailed, apiPrecondition},
+		{"wrong method", http.MethodDelete, "/api/pages/Home", "", nil, http.StatusMethodNotAllowed, apiMethodNotAllowed},
+		{"wrong method for titles", http.MethodPost, "/api/titles", "", nil, http.StatusMethodNotAllowed, apiMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkAPIError(t, apiRequest(h, tt.method, tt.target, tt.body, tt.header...), tt.status, tt.code)
+		})
+	}
+
+	t.Run("broken store", func(t *testing.T) {
+		h := testServer(brokenStore{newMemStore()})
+		w := apiRequest(h, http.MethodGet, "/api/pages/Home", "")
+		if e := checkAPIError(t, w, http.StatusInternalServerError, apiInternal); e.Error != errBroken.Error() {
+			t.Errorf("the error says %q, want %q", e.Error, errBroken)
+		}
+	})
+}
+
+// TestAPIFail checks the status and code store errors are answered with.
+func TestAPIFail(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{errNotFound, http.StatusNotFound, apiNotFound},
+		{errCreateConflict, http.StatusConflict, apiConflict},
+		{errVersionConflict, http.StatusConflict, apiConflict},
+		{errBroken, http.StatusInternalServerError, apiInternal},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		apiFail(w, httptest.NewRequest(http.MethodGet, "/api/pages/Home", nil), tt.err)
+		if e := checkAPIError(t, w, tt.status, tt.code); e.Error != tt.err.Error() {
+			t.Errorf("%v is answered with the message %q", tt.err, e.Error)
+		}
+	}
+}
+
+// checkAPIError checks w is an API error of status and code with a message,
+// and returns it.
+func checkAPIError(t *testing.T, w *httptest.ResponseRecorder, status int, code string) apiError {
+	t.Helper()
+	if w.Code != status {
+		t.Errorf("got %d, want %d", w.Code, status)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("the error is %s", ct)
+	}
+	var e apiError
+	dec := json.NewDecoder(w.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&e); err != nil {
+		t.Fatalf("the error isn't an apiError: %v", err)
+	}
+	if e.Code != code || e.Error == "" {
+		t.Errorf("got code %q with message %q, want %q with a message", e.Code, e.Error, code)
+	}
+	return e
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// /archive lists every month, /archive/2024/03 a single one
+var archivePath = regexp.MustCompile("^/archive(?:/([0-9]{4})/([0-9]{2}))?/?$")
+
+type ArchiveMonth struct {
+	Month time.Time
+	Pages []*Page
+}
+
+type Archive struct {
+	Months []*ArchiveMonth
+	// set when drilling into a single month
+	Month *time.Time
+}
+
+func loadArchive(ctx context.Context, conn db, from, to *time.Time) ([]*ArchiveMonth, error) {
+	query := "SELECT date_trunc('month', created_at), id, title, created_at, updated_at FROM " + table("pages")
+	args := []interface{}{}
+	if from != nil && to != nil {
+		query += " WHERE created_at >= $1 AND created_at < $2"
+		args = append(args, *from, *to)
+	}
+	query += " ORDER BY created_at DESC"
+	rows, err := conn.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var months []*ArchiveMonth
+	for rows.Next() {
+		var month time.Time
+		p := &Page{}
+		if err := rows.Scan(&month, &p.ID, &p.Title, &p.CreatedAt, &p.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if len(months) == 0 || !months[len(months)-1].Month.Equal(month) {
+			months = append(months, &ArchiveMonth{Month: month})
+		}
+		m := months[len(months)-1]
+		m.Pages = append(m.Pages, p)
+	}
+	return months, rows.Err()
+}
+
+func archiveHandler(w http.ResponseWriter, r *http.Request, conn db) {
+	m := archivePath.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if path := strings.TrimSuffix(r.URL.Path, "/"); path != r.URL.Path {
+		redirect(w, r, path, http.StatusMovedPermanently)
+		return
+	}
+
+	archive := &Archive{}
+	var from, to *time.Time
+	if m[1] != "" {
+		year, _ := strconv.Atoi(m[1])
+		month, _ := strconv.Atoi(m[2])
+		if month < 1 || month > 12 {
+			http.NotFound(w, r)
+			return
+		}
+		start := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.Local)
+		end := start.AddDate(0, 1, 0)
+		from, to = &start, &end
+		archive.Month = &start
+	}
+
+	months, err := loadArchive(r.Context(), conn, from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	archive.Months = months
+	renderTemplate(w, r, "archive", archive)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"net/http"
+	"time"
+)
+
+// archivePage soft-deletes a page by moving it into archived_pages, whose
+// bodies are all text.
+func archivePage(ctx context.Context, title string, conn db) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := inflateBodies(ctx, tx, "title=$1", title); err != nil {
+		return err
+	}
+	query := `WITH deleted AS (DELETE FROM ` + table("pages") + ` WHERE title=$1 RETURNING id, title, body, created_at, updated_at)
+		INSERT INTO ` + table("archived_pages") + ` (page_id, title, body, created_at, updated_at)
+		SELECT id, title, body, created_at, updated_at FROM deleted`
+	tag, err := tx.Exec(ctx, query, title)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return tx.Commit(ctx)
+}
+
+// lastArchived returns when a page titled title was last archived.
+func lastArchived(ctx context.Context, title string, conn db) (time.Time, error) {
+	var at time.Time
+	query := "SELECT archived_at FROM " + table("archived_pages") + " WHERE title=$1 ORDER BY archived_at DESC, id DESC LIMIT 1"
+	err := conn.QueryRow(ctx, query, title).Scan(&at)
+	return at, err
+}
+
+// restorePage moves the last archived version of title back into pages,
+// under its old id so it gets its history back. It fails with errPageExists
+// if a page has been created under the title since.
+func restorePage(ctx context.Context, title string, conn db) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `WITH restored AS (
+			DELETE FROM ` + table("archived_pages") + ` WHERE id = (SELECT id FROM ` + table("archived_pages") + ` WHERE title=$1 ORDER BY archived_at DESC, id DESC LIMIT 1)
+			RETURNING page_id, title, body, created_at, updated_at
+		)
+		INSERT INTO ` + table("pages") + ` (id, title, body, created_at, updated_at)
+		SELECT page_id, title, body, created_at, updated_at FROM restored
+		RETURNING id, body`
+	var id int64
+	var body []byte
+	err = tx.QueryRow(ctx, query, title).Scan(&id, &body)
+	if uniqueViolation(err) {
+		return fmt.Errorf("%s: %w", title, errPageExists)
+	}
+	if err != nil {
+		return err
+	}
+	if err := syncTags(ctx, id, body, tx); err != nil {
+		return err
+	}
+	if err := syncLinks(ctx, id, title, body, tx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Delete is the data model of the delete confirmation page.
+type Delete struct {
+	Page *Page
+}
+
+// deleteLevel is the protection level deleting a page needs: at least a
+// sign in, even for pages anyone may edit.
+func deleteLevel(p *Page) string {
+	if p.Protection == protectAnyone || p.Protection == "" {
+		return protectUsers
+	}
+	return p.Protection
+}
+
+// deleteHandler asks to confirm on GET and archives the page on POST.
+func deleteHandler(w http.ResponseWriter, r *http.Request, title string, store PageStore) {
+	p, err := store.Stat(title)
+	if err == errNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !checkEdit(w, r, deleteLevel(p)) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		renderTemplate(w, r, "delete", &Delete{Page: p})
+		return
+	}
+	// errNotFound means someone else deleted it first
+	if err := store.Delete(title); err != nil && err != errNotFound {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	redirect(w, r, pagePath("view", title), http.StatusSeeOther)
+}
+
+// restoreHandler brings back the last deleted version of a page.
+func restoreHandler(w http.ResponseWriter, r *http.Request, title string, store PageStore) {
+	if !checkEdit(w, r, protectUsers) {
+		return
+	}
+	err := store.Restore(title)
+	if err == errNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if errors.Is(err, errPageExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	redirect(w, r, pagePath("view", title), http.StatusSeeOther)
+}
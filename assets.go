@@ -0,0 +1,33 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"os"
+)
+
+//go:embed templates
+var embeddedTemplates embed.FS
+
+// public/css is produced by `yarn build`; `all:` keeps the embed valid
+// (through .gitkeep) on a fresh checkout
+//
+//go:embed all:public/css
+var embeddedStatic embed.FS
+
+// templateFS returns the templates directory, from disk in dev mode and from
+// the binary otherwise.
+func templateFS() (fs.FS, error) {
+	if config.Dev {
+		return os.DirFS(config.TemplateDir), nil
+	}
+	return fs.Sub(embeddedTemplates, "templates")
+}
+
+// staticFS returns the static assets directory served under /css/.
+func staticFS() (fs.FS, error) {
+	if config.Dev {
+		return os.DirFS(config.StaticDir), nil
+	}
+	return fs.Sub(embeddedStatic, "public/css")
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// file names are kept to a safe subset so they can go in URLs and headers
+// unescaped
+var validFileName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+var errUploadQuota = errors.New("the wiki has no room left for this file")
+
+type Attachment struct {
+	Name        string
+	ContentType string
+	Size        int64
+	// SHA-256 of the content; identical uploads share one stored copy
+	Hash       string
+	UploadedBy string
+	CreatedAt  time.Time
+	// the content is in -upload-dir rather than the database
+	onDisk bool
+}
+
+type Files struct {
+	Page       *Page
+	Files      []*Attachment
+	Extensions []string
+	MaxSize    int64
+	Errors     *Validation
+}
+
+// uploadAllowed reports whether name has one of -upload-extensions.
+func uploadAllowed(name string) bool {
+	ext := strings.TrimPrefix(strings.ToLower(path.Ext(name)), ".")
+	for _, allowed := range config.UploadExtensions {
+		if ext != "" && ext == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// blobPath is where content with hash is kept under -upload-dir, a
+// directory per first two characters so none grows too large.
+func blobPath(hash string) string {
+	return filepath.Join(config.UploadDir, hash[:2], hash)
+}
+
+// writeBlob stores data under -upload-dir, through a temporary file renamed
+// into place so a half written file is never served.
+func writeBlob(hash string, data []byte) error {
+	dest := blobPath(hash)
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
+
+// storeAttachment saves data as the file name of a page, replacing any
+// file of that name. Content already stored, by any page, is not stored
+// again and does not count against -upload-quota twice. With -upload-dir
+// new content goes to disk, and the database only records it.
+func storeAttachment(ctx context.Context, pageID int64, name string, data []byte, editor string, conn db) (*Attachment, error) {
+	sum := sha256.Sum256(data)
+	a := &Attachment{Name: name, Size: int64(len(data)), Hash: hex.EncodeToString(sum[:]), UploadedBy: editor}
+	a.ContentType = mime.TypeByExtension(path.Ext(name))
+	if a.ContentType == "" {
+		a.ContentType = http.DetectContentType(data)
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var stored bool
+	query := "SELECT EXISTS (SELECT 1 FROM " + table("file_blobs") + " WHERE hash = $1)"
+	if err := tx.QueryRow(ctx, query, a.Hash).Scan(&stored); err != nil {
+		return nil, err
+	}
+	if !stored {
+		if config.UploadQuota > 0 {
+			// serialize quota checks so concurrent uploads cannot both fit
+			if _, err := tx.Exec(ctx, "LOCK TABLE "+table("file_blobs")+" IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+				return nil, err
+			}
+			var used int64
+			query := "SELECT COALESCE(sum(size), 0) FROM " + table("file_blobs")
+			if err := tx.QueryRow(ctx, query).Scan(&used); err != nil {
+				return nil, err
+			}
+			if used+a.Size > config.UploadQuota {
+				return nil, errUploadQuota
+			}
+		}
+		content := data
+		if config.UploadDir != "" {
+			if err := writeBlob(a.Hash, data); err != nil {
+				return nil, err
+			}
+			content = []byte{}
+		}
+		query := "INSERT INTO " + table("file_blobs") + " (hash, size, data, on_disk) VALUES ($1, $2, $3, $4) ON CONFLICT (hash) DO NOTHING"
+		if _, err := tx.Exec(ctx, query, a.Hash, a.Size, content, config.UploadDir != ""); err != nil {
+			return nil, err
+		}
+	}
+	query = `INSERT INTO ` + table("page_files") + ` (page_id, name, hash, content_type, uploaded_by) VALUES ($1, $2, $3, $4, NULLIF($5, ''))
+		ON CONFLICT (page_id, name) DO UPDATE SET hash = $3, content_type = $4, uploaded_by = NULLIF($5, ''), created_at = now()
+		RETURNING created_at`
+	if err := tx.QueryRow(ctx, query, pageID, name, a.Hash, a.ContentType, editor).Scan(&a.CreatedAt); err != nil {
+		return nil, err
+	}
+	// the content of a replaced file may no longer be used anywhere
+	query = "DELETE FROM " + table("file_blobs") + " b WHERE NOT EXISTS (SELECT 1 FROM " + table("page_files") + " f WHERE f.hash = b.hash) RETURNING CASE WHEN on_disk THEN hash ELSE '' END"
+	unused, err := queryStrings(ctx, tx, query)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	for _, hash := range unused {
+		if hash == "" || config.UploadDir == "" {
+			continue
+		}
+		if err := os.Remove(blobPath(hash)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("removing unused upload %s: %v", hash, err)
+		}
+	}
+	return a, nil
+}
+
+func loadAttachments(ctx context.Context, pageID int64, conn db) ([]*Attachment, error) {
+	query := `SELECT f.name, f.content_type, b.size, f.hash, COALESCE(f.uploaded_by, ''), f.created_at
+		FROM ` + table("page_files") + ` f JOIN ` + table("file_blobs") + ` b ON b.hash = f.hash
+		WHERE f.page_id = $1 ORDER BY f.name`
+	rows, err := conn.Query(ctx, query, pageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []*Attachment
+	for rows.Next() {
+		a := &Attachment{}
+		if err := rows.Scan(&a.Name, &a.ContentType, &a.Size, &a.Hash, &a.UploadedBy, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		files = append(files, a)
+	}
+	return files, rows.Err()
+}
+
+// loadAttachment returns a file of a page with its content.
+func loadAttachment(ctx context.Context, pageID int64, name string, conn db) (*Attachment, []byte, error) {
+	a := &Attachment{Name: name}
+	var data []byte
+	query := `SELECT f.content_type, b.size, f.hash, COALESCE(f.uploaded_by, ''), f.created_at, b.data, b.on_disk
+		FROM ` + table("page_files") + ` f JOIN ` + table("file_blobs") + ` b ON b.hash = f.hash
+		WHERE f.page_id = $1 AND f.name = $2`
+	err := conn.QueryRow(ctx, query, pageID, name).Scan(&a.ContentType, &a.Size, &a.Hash, &a.UploadedBy, &a.CreatedAt, &data, &a.onDisk)
+	if err != nil {
+		return nil, nil, err
+	}
+	return a, data, nil
+}
+
+// filesHandler lists the files of a page at /files/<title> and serves
+// them at /files/<title>/<name>, the slashes of titles like Projects/GoWiki
+// escaped as %2F.
+func filesHandler(w http.ResponseWriter, r *http.Request, conn db) {
+	title, name := pathTitle(r, "/files/")
+	if !validTitle.MatchString(title) {
+		http.NotFound(w, r)
+		return
+	}
+	p, err := loadPageFields(r.Context(), title, pageMeta, conn)
+	if err == pgx.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if name == "" {
+		renderFiles(w, r, http.StatusOK, p, nil, conn)
+		return
+	}
+
+	a, data, err := loadAttachment(r.Context(), p.ID, name, conn)
+	if err == pgx.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	content := io.ReadSeeker(bytes.NewReader(data))
+	if a.onDisk {
+		if config.UploadDir == "" {
+			http.Error(w, "the file is stored on disk but -upload-dir is not set", http.StatusInternalServerError)
+			return
+		}
+		f, err := os.Open(blobPath(a.Hash))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		content = f
+	}
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// uploads never run scripts on the wiki's origin
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("ETag", `"`+a.Hash+`"`)
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	http.ServeContent(w, r, a.Name, a.CreatedAt, content)
+}
+
+func renderFiles(w http.ResponseWriter, r *http.Request, status int, p *Page, v *Validation, conn db) {
+	files, err := loadAttachments(r.Context(), p.ID, conn)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f := &Files{Page: p, Files: files, Extensions: config.UploadExtensions, MaxSize: config.MaxUploadSize, Errors: v}
+	renderTemplateStatus(w, r, status, "files", f)
+}
+
+// uploadHandler adds the file posted in the file field to a page.
+func uploadHandler(w http.ResponseWriter, r *http.Request, conn db) {
+	title := canonicalTitle(strings.TrimPrefix(r.URL.Path, "/upload/"))
+	if !validTitle.MatchString(title) {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		redirect(w, r, "/files/"+titleSegment(title), http.StatusFound)
+		return
+	}
+	p, err := loadPageFields(r.Context(), title, pageMeta, conn)
+	if err == pgx.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !checkEdit(w, r, p.Protection) {
+		return
+	}
+	reject := func(status int, msg string) {
+		renderFiles(w, r, status, p, &Validation{Message: "The file was not uploaded:", Fields: []FieldError{{"file", msg}}}, conn)
+	}
+
+	// leave room for the rest of the multipart body
+	r.Body = http.MaxBytesReader(w, r.Body, config.MaxUploadSize+1<<20)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			reject(http.StatusRequestEntityTooLarge, fmt.Sprintf("Files can be at most %s.", humanSize(config.MaxUploadSize)))
+			return
+		}
+		reject(http.StatusBadRequest, "Pick a file to upload.")
+		return
+	}
+	defer file.Close()
+
+	name := path.Base(header.Filename)
+	switch {
+	case !validFileName.MatchString(name):
+		reject(http.StatusBadRequest, "File names may only contain letters, digits, dots, dashes and underscores.")
+		return
+	case !uploadAllowed(name):
+		reject(http.StatusUnsupportedMediaType, fmt.Sprintf("Only %s files can be uploaded.", strings.Join(config.UploadExtensions, ", ")))
+		return
+	case header.Size > config.MaxUploadSize:
+		reject(http.StatusRequestEntityTooLarge, fmt.Sprintf("Files can be at most %s.", humanSize(config.MaxUploadSize)))
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(file, config.MaxUploadSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if int64(len(data)) > config.MaxUploadSize {
+		reject(http.StatusRequestEntityTooLarge, fmt.Sprintf("Files can be at most %s.", humanSize(config.MaxUploadSize)))
+		return
+	}
+
+	_, err = storeAttachment(r.Context(), p.ID, name, data, editorName(r), conn)
+	if err == errUploadQuota {
+		reject(http.StatusInsufficientStorage, sentence(err.Error()))
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	redirect(w, r, "/files/"+titleSegment(title), http.StatusSeeOther)
+}
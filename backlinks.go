@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// pages listed under "What links here" on a page, and on each page of the
+// /orphans and /wanted reports
+const (
+	backlinksShown = 50
+	reportPageSize = 100
+)
+
+// linkTargets returns the titles of the other pages body links to, each
+// once.
+func linkTargets(self string, body []byte) []string {
+	var targets []string
+	seen := map[string]bool{self: true}
+	for _, link := range pageLinks(self, body) {
+		if !seen[link.Target] {
+			seen[link.Target] = true
+			targets = append(targets, link.Target)
+		}
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// syncLinks rebuilds the page_links of a page from its body, like syncTags.
+// Links are kept by title, so those to pages that don't exist yet are too.
+func syncLinks(ctx context.Context, pageID int64, title string, body []byte, conn db) error {
+	if _, err := conn.Exec(ctx, "DELETE FROM "+table("page_links")+" WHERE page_id=$1", pageID); err != nil {
+		return err
+	}
+	targets := linkTargets(title, body)
+	if len(targets) == 0 {
+		return nil
+	}
+	query := "INSERT INTO " + table("page_links") + " (page_id, target) SELECT $1, unnest($2::text[])"
+	_, err := conn.Exec(ctx, query, pageID, targets)
+	return err
+}
+
+// syncLinksTo rebuilds the page_links of every page linking to target, for
+// when their bodies were rewritten in SQL.
+func syncLinksTo(ctx context.Context, target string, conn db) error {
+	query := `SELECT id, title, ` + bodyColumns + ` FROM ` + table("pages") + `
+		WHERE id IN (SELECT page_id FROM ` + table("page_links") + ` WHERE target = $1)`
+	rows, err := conn.Query(ctx, query, target)
+	if err != nil {
+		return err
+	}
+	var pages []*Page
+	for rows.Next() {
+		p := &Page{}
+		var stored storedBody
+		if err := rows.Scan(stored.dest(&p.ID, &p.Title)...); err != nil {
+			rows.Close()
+			return err
+		}
+		if p.Body, err = stored.bytes(); err != nil {
+			rows.Close()
+			return fmt.Errorf("%s: %w", p.Title, err)
+		}
+		pages = append(pages, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, p := range pages {
+		if err := syncLinks(ctx, p.ID, p.Title, p.Body, conn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linksToPage is the SQL condition of a page_links row l pointing at the page
+// p, by its title or one it was renamed from.
+func linksToPage(l, p string) string {
+	return "(" + l + ".target = " + p + ".title OR " + l + ".target IN (SELECT a.title FROM " + table("page_aliases") + " a WHERE a.page_id = " + p + ".id))"
+}
+
+// loadBacklinks returns the titles of up to n pages linking to the page
+// titled title, alphabetically.
+func loadBacklinks(ctx context.Context, title string, n int, conn db) ([]string, error) {
+	defer timeQuery("loadBacklinks", time.Now())
+	query := `SELECT DISTINCT s.title FROM ` + table("pages") + ` t
+		JOIN ` + table("page_links") + ` l ON ` + linksToPage("l", "t") + `
+		JOIN ` + table("pages") + ` s ON s.id = l.page_id
+		WHERE t.title = $1 AND s.id <> t.id
+		ORDER BY s.title LIMIT $2`
+	return queryStrings(ctx, conn, query, title, n)
+}
+
+// Backlinks is the data model of "What links here" on the view page.
+type Backlinks struct {
+	Titles []string
+	// set when there are more than backlinksShown
+	More bool
+}
+
+// viewBacklinks gathers "What links here" for p. It is only a footnote of
+// the page, so a failure is logged and leaves it out.
+func viewBacklinks(p *Page, store PageStore) *Backlinks {
+	titles, err := store.Backlinks(p.Title, backlinksShown+1)
+	if err != nil {
+		log.Printf("loading the backlinks of %s: %v", p.Title, err)
+		return nil
+	}
+	b := &Backlinks{Titles: titles}
+	if len(titles) > backlinksShown {
+		b.Titles, b.More = titles[:backlinksShown], true
+	}
+	return b
+}
+
+// loadOrphans returns up to limit pages no other page links to, after
+// skipping offset, alphabetically and without their bodies.
+func loadOrphans(ctx context.Context, limit, offset int, conn db) ([]*Page, error) {
+	defer timeQuery("loadOrphans", time.Now())
+	query := `SELECT p.title, p.updated_at FROM ` + table("pages") + ` p
+		WHERE NOT EXISTS (SELECT 1 FROM ` + table("page_links") + ` l WHERE l.page_id <> p.id AND ` + linksToPage("l", "p") + `)
+		ORDER BY p.title LIMIT $1 OFFSET $2`
+	rows, err := conn.Query(ctx, query, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pages []*Page
+	for rows.Next() {
+		p := &Page{}
+		if err := rows.Scan(&p.Title, &p.UpdatedAt); err != nil {
+			return nil, err
+		}
+		pages = append(pages, p)
+	}
+	return pages, rows.Err()
+}
+
+// WantedPage is a title pages link to that no page has.
+type WantedPage struct {
+	Title string
+	// number of pages linking to it, and the first few of them
+	Count   int
+	Sources []string
+}
+
+// linking pages listed for each wanted page
+const wantedSources = 5
+
+// loadWanted returns up to limit titles linked to without a page, most
+// linked first, after skipping offset.
+func loadWanted(ctx context.Context, limit, offset int, conn db) ([]*WantedPage, error) {
+	defer timeQuery("loadWanted", time.Now())
+	query := `SELECT l.target, count(*), (array_agg(s.title ORDER BY s.title))[1:$3]
+		FROM ` + table("page_links") + ` l JOIN ` + table("pages") + ` s ON s.id = l.page_id
+		WHERE NOT EXISTS (SELECT 1 FROM ` + table("pages") + ` p WHERE p.title = l.target)
+			AND NOT EXISTS (SELECT 1 FROM ` + table("page_aliases") + ` a WHERE a.title = l.target)
+		GROUP BY l.target
+		ORDER BY count(*) DESC, l.target LIMIT $1 OFFSET $2`
+	rows, err := conn.Query(ctx, query, limit, offset, wantedSources)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var wanted []*WantedPage
+	for rows.Next() {
+		w := &WantedPage{}
+		if err := rows.Scan(&w.Title, &w.Count, &w.Sources); err != nil {
+			return nil, err
+		}
+		wanted = append(wanted, w)
+	}
+	return wanted, rows.Err()
+}
+
+type Orphans struct {
+	Pages []*Page
+	// current page of the report, counted from 1, and its neighbours; 0
+	// when there is none
+	Number int
+	Prev   int
+	Next   int
+}
+
+// orphansHandler lists the pages nothing links to, which readers can only
+// find by searching.
+func orphansHandler(w http.ResponseWriter, r *http.Request, conn db) {
+	o := &Orphans{Number: pageNumber(r)}
+	// one more than shown tells whether there is a next page
+	pages, err := loadOrphans(r.Context(), reportPageSize+1, (o.Number-1)*reportPageSize, conn)
+	if err != nil {
+		renderFailed(w, err)
+		return
+	}
+	if len(pages) > reportPageSize {
+		pages, o.Next = pages[:reportPageSize], o.Number+1
+	}
+	o.Pages = pages
+	if o.Number > 1 {
+		o.Prev = o.Number - 1
+	}
+	renderTemplate(w, r, "orphans", o)
+}
+
+type Wanted struct {
+	Pages []*WantedPage
+	// current page of the report, counted from 1, and its neighbours; 0
+	// when there is none
+	Number int
+	Prev   int
+	Next   int
+}
+
+// wantedHandler lists the pages linked to that don't exist yet.
+func wantedHandler(w http.ResponseWriter, r *http.Request, conn db) {
+	wp := &Wanted{Number: pageNumber(r)}
+	pages, err := loadWanted(r.Context(), reportPageSize+1, (wp.Number-1)*reportPageSize, conn)
+	if err != nil {
+		renderFailed(w, err)
+		return
+	}
+	if len(pages) > reportPageSize {
+		pages, wp.Next = pages[:reportPageSize], wp.Number+1
+	}
+	wp.Pages = pages
+	if wp.Number > 1 {
+		wp.Prev = wp.Number - 1
+	}
+	renderTemplate(w, r, "wanted", wp)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const backupPrefix = "gowiki-"
+
+// runBackups writes a backup every interval until ctx is done.
+func runBackups(ctx context.Context, dir string, interval time.Duration, keep int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			path, n, err := backup(ctx, dir)
+			if err != nil {
+				log.Printf("backup failed: %v", err)
+				continue
+			}
+			log.Printf("backup of %d pages written to %s", n, path)
+			if err := pruneBackups(dir, keep); err != nil {
+				log.Printf("pruning backups: %v", err)
+			}
+		}
+	}
+}
+
+// backup exports all pages into a timestamped zip in dir. It uses its own
+// connection so it never shares one with request handlers, without the
+// statement timeout since the export streams every page in one query.
+func backup(ctx context.Context, dir string) (string, int, error) {
+	conn, err := connectDB(ctx, 0)
+	if err != nil {
+		return "", 0, err
+	}
+	defer conn.Close(context.Background())
+
+	name := backupPrefix + time.Now().UTC().Format("20060102T150405Z") + ".zip"
+	path := filepath.Join(dir, name)
+	// write under a temporary name so a failed run never looks like a backup
+	tmp, err := os.CreateTemp(dir, ".backup-*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := exportPages(ctx, tmp, conn)
+	if err != nil {
+		tmp.Close()
+		return "", 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", 0, err
+	}
+	return path, n, os.Rename(tmp.Name(), path)
+}
+
+// pruneBackups removes all but the newest keep backups in dir.
+func pruneBackups(dir string, keep int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var backups []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), backupPrefix) && strings.HasSuffix(e.Name(), ".zip") {
+			backups = append(backups, e.Name())
+		}
+	}
+	// timestamped names sort oldest first
+	sort.Strings(backups)
+	for len(backups) > keep {
+		if err := os.Remove(filepath.Join(dir, backups[0])); err != nil {
+			return fmt.Errorf("removing %s: %v", backups[0], err)
+		}
+		log.Printf("removed old backup %s", backups[0])
+		backups = backups[1:]
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// withBasePath serves h under -base-path, so the handlers and validPath
+// see the same paths as without one. Anything outside the prefix is not
+// the wiki's.
+func withBasePath(h http.Handler, base string) http.Handler {
+	if base == "" {
+		return h
+	}
+	strip := http.StripPrefix(base, h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == base:
+			http.Redirect(w, r, base+"/", http.StatusMovedPermanently)
+		case strings.HasPrefix(r.URL.Path, base+"/"):
+			strip.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// redirect is http.Redirect for a path of the wiki, like /view/Page, which
+// it puts under -base-path.
+func redirect(w http.ResponseWriter, r *http.Request, path string, code int) {
+	http.Redirect(w, r, config.BasePath+path, code)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestBasePath serves the wiki under /wiki and checks the static assets,
+// redirects, links and cookies are all under it.
+func TestBasePath(t *testing.T) {
+	keepConfig(t)
+	config.BasePath = "/wiki"
+	config.AnonymousEdits = true
+	// static assets from disk, as the embedded ones are built separately
+	config.Dev = true
+	config.StaticDir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(config.StaticDir, "index.css"), []byte("body {}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h := testServer(seedStore(map[string]string{"Home": "See [[Other Page]]."}))
+
+	if w := request(h, http.MethodGet, "/wiki/css/index.css", nil); w.Code != http.StatusOK || w.Body.String() != "body {}" {
+		t.Errorf("the stylesheet under the base path got %d: %q", w.Code, w.Body)
+	}
+	for _, path := range []string{"/css/index.css", "/view/Home", "/wikipedia/view/Home"} {
+		if w := request(h, http.MethodGet, path, nil); w.Code != http.StatusNotFound {
+			t.Errorf("%s, outside the base path, got %d", path, w.Code)
+		}
+	}
+
+	redirects := []struct {
+		method, path string
+		form         url.Values
+		status       int
+		location     string
+	}{
+		{http.MethodGet, "/wiki", nil, http.StatusMovedPermanently, "/wiki/"},
+		{http.MethodGet, "/wiki/all", nil, http.StatusMovedPermanently, "/wiki/index?sort=title"},
+		{http.MethodGet, "/wiki/view/Other%20Page", nil, http.StatusMovedPermanently, "/wiki/view/Other_Page"},
+		{http.MethodGet, "/wiki/view/Home/", nil, http.StatusMovedPermanently, "/wiki/view/Home"},
+		{http.MethodPost, "/wiki/save/Other_Page", url.Values{"body": {"Other."}}, http.StatusSeeOther, "/wiki/view/Other_Page"},
+	}
+	for _, tt := range redirects {
+		w := request(h, tt.method, tt.path, tt.form)
+		if w.Code != tt.status || w.Header().Get("Location") != tt.location {
+			t.Errorf("%s %s got %d to %q, want %d to %q", tt.method, tt.path, w.Code, w.Header().Get("Location"), tt.status, tt.location)
+		}
+	}
+
+	w := request(h, http.MethodGet, "/wiki/view/Home", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("the page got %d", w.Code)
+	}
+	body := w.Body.String()
+	for _, link := range []string{`href="/wiki/css/index.css"`, `href="/wiki/view/Other_Page"`, `href="/wiki/edit/Home"`, `action="/wiki/search"`} {
+		if !strings.Contains(body, link) {
+			t.Errorf("the page has no %s", link)
+		}
+	}
+	// the edit form gives the browser its CSRF cookie
+	w = request(h, http.MethodGet, "/wiki/edit/Home", nil)
+	if len(w.Result().Cookies()) == 0 {
+		t.Error("the edit form set no cookie")
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Path != "/wiki/" {
+			t.Errorf("cookie %s has path %q, want /wiki/", c.Name, c.Path)
+		}
+	}
+}
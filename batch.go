@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+)
+
+type pageOp int
+
+const (
+	opSave pageOp = iota
+	opArchive
+	opRelink
+)
+
+// PageWrite is one change in a PageStore.Apply batch, made with saveWrite,
+// archiveWrite or relinkWrite.
+type PageWrite struct {
+	op     pageOp
+	page   *Page
+	title  string
+	to     string
+	editor string
+}
+
+// saveWrite saves p.
+func saveWrite(p *Page) PageWrite {
+	return PageWrite{op: opSave, page: p}
+}
+
+// archiveWrite archives the page called title, as PageStore.Delete.
+func archiveWrite(title string) PageWrite {
+	return PageWrite{op: opArchive, title: title}
+}
+
+// relinkWrite points every [[from]] link in the wiki at to instead, as an
+// edit by editor.
+func relinkWrite(from, to, editor string) PageWrite {
+	return PageWrite{op: opRelink, title: from, to: to, editor: editor}
+}
+
+func (w PageWrite) String() string {
+	switch w.op {
+	case opSave:
+		return "saving " + w.page.Title
+	case opArchive:
+		return "archiving " + w.title
+	default:
+		return "relinking " + w.title + " to " + w.to
+	}
+}
+
+// writtenTitles lists the pages writes change, or reports that they may
+// change any page, as a relink does.
+func writtenTitles(writes []PageWrite) (titles []string, every bool) {
+	for _, w := range writes {
+		switch w.op {
+		case opSave:
+			titles = append(titles, w.page.Title)
+		case opArchive:
+			titles = append(titles, w.title)
+		case opRelink:
+			return nil, true
+		}
+	}
+	return titles, false
+}
+
+// invalidateRenders drops the cached renders that include a page changed by
+// the committed writes.
+func invalidateRenders(writes []PageWrite) {
+	titles, every := writtenTitles(writes)
+	if every {
+		renders.invalidateIncludes()
+		return
+	}
+	renders.invalidate(titles...)
+}
+
+// BatchError is returned by PageStore.Apply when a write fails; none of the
+// batch was applied.
+type BatchError struct {
+	// the failed write, nil if the commit failed
+	Write *PageWrite
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	if e.Write == nil {
+		return fmt.Sprintf("nothing was changed, committing failed: %v", e.Err)
+	}
+	return fmt.Sprintf("nothing was changed, %s failed: %v", e.Write, e.Err)
+}
+
+func (e *BatchError) Unwrap() error { return e.Err }
+
+func (s *pgStore) Apply(writes ...PageWrite) error {
+	if titles, every := writtenTitles(writes); every {
+		awaitSaves()
+	} else {
+		awaitSaves(titles...)
+	}
+	ctx := s.context()
+	tx, err := s.conn.Begin(ctx)
+	if err != nil {
+		return &BatchError{Err: err}
+	}
+	defer tx.Rollback(ctx)
+	for i, w := range writes {
+		switch w.op {
+		case opSave:
+			err = w.page.save(ctx, tx)
+		case opArchive:
+			err = notFound(archivePage(ctx, w.title, tx))
+		case opRelink:
+			_, err = rewriteLinks(ctx, w.title, w.to, w.editor, tx)
+		}
+		if err != nil {
+			return &BatchError{Write: &writes[i], Err: err}
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return &BatchError{Err: err}
+	}
+	invalidateRenders(writes)
+	announceWrites(writes)
+	if titles, every := writtenTitles(writes); every {
+		s.wrote()
+	} else if len(titles) > 0 {
+		s.wrote(titles...)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// captchaProvider is a CAPTCHA service the edit form of anonymous editors
+// can show. Its widget fills field in the form with a token the wiki
+// checks at verify.
+type captchaProvider struct {
+	script string
+	verify string
+	class  string
+	field  string
+	// origins the widget loads scripts, frames and styles from, allowed by
+	// the Content-Security-Policy
+	origins string
+}
+
+var captchaProviders = map[string]captchaProvider{
+	"hcaptcha": {
+		script:  "https://js.hcaptcha.com/1/api.js",
+		verify:  "https://api.hcaptcha.com/siteverify",
+		class:   "h-captcha",
+		field:   "h-captcha-response",
+		origins: "https://hcaptcha.com https://*.hcaptcha.com",
+	},
+	"recaptcha": {
+		script:  "https://www.google.com/recaptcha/api.js",
+		verify:  "https://www.google.com/recaptcha/api/siteverify",
+		class:   "g-recaptcha",
+		field:   "g-recaptcha-response",
+		origins: "https://www.google.com https://www.gstatic.com",
+	},
+	"turnstile": {
+		script:  "https://challenges.cloudflare.com/turnstile/v0/api.js",
+		verify:  "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+		class:   "cf-turnstile",
+		field:   "cf-turnstile-response",
+		origins: "https://challenges.cloudflare.com",
+	},
+}
+
+func captchaNames() []string {
+	names := make([]string, 0, len(captchaProviders))
+	for name := range captchaProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Captcha is the widget shown in the edit form.
+type Captcha struct {
+	Class   string
+	SiteKey string
+	Script  string
+}
+
+// captchaFor is the widget to show r in the edit form, nil for signed-in
+// users or when no provider is configured.
+func captchaFor(r *http.Request) *Captcha {
+	if config.Captcha == "" || currentUser(r) != nil {
+		return nil
+	}
+	p := captchaProviders[config.Captcha]
+	return &Captcha{Class: p.class, SiteKey: config.CaptchaSiteKey, Script: p.script}
+}
+
+var captchaClient = &http.Client{Timeout: 10 * time.Second}
+
+// verifyCaptcha asks the provider whether the token in the form of r was
+// given for a solved challenge.
+func verifyCaptcha(r *http.Request) (bool, error) {
+	return verifyCaptchaToken(r, r.PostFormValue(captchaProviders[config.Captcha].field))
+}
+
+// verifyCaptchaToken asks the provider whether token, which r came with,
+// was given for a solved challenge.
+func verifyCaptchaToken(r *http.Request, token string) (bool, error) {
+	p := captchaProviders[config.Captcha]
+	if token == "" {
+		return false, nil
+	}
+	form := url.Values{"secret": {config.CaptchaSecret}, "response": {token}, "remoteip": {clientIP(r)}}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, p.verify, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := captchaClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%s answered %s", config.Captcha, res.Status)
+	}
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	return result.Success, nil
+}
+
+// checkCaptcha rejects the save of an anonymous editor who didn't solve the
+// challenge. Signed-in users are never asked.
+func checkCaptcha(w http.ResponseWriter, r *http.Request, p *Page) bool {
+	if captchaFor(r) == nil {
+		return true
+	}
+	ok, err := verifyCaptcha(r)
+	if err != nil {
+		rejectSave(w, r, http.StatusBadGateway, p, &Validation{Message: "The challenge could not be checked: " + err.Error()})
+		return false
+	}
+	if !ok {
+		rejectSave(w, r, http.StatusBadRequest, p, &Validation{Message: "Please solve the challenge below to show you're not a robot, then save again."})
+		return false
+	}
+	return true
+}
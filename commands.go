@@ -0,0 +1,118 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// command is a subcommand of the gowiki binary. They share the flags and
+// the database pool set up by main.
+type command struct {
+	usage string
+	// number of arguments after the command name, -1 for a command that
+	// parses its own flags and arguments
+	args int
+	run  func(conn db, args []string) error
+}
+
+var commands = map[string]*command{
+	"serve":           {"serve", 0, serve},
+	"export":          {"export <file.zip>", 1, exportCommand},
+	"import":          {"import <dir|file.zip>", 1, importCommand},
+	"reindex":         {"reindex", 0, reindexCommand},
+	"prune-revisions": {"prune-revisions", 0, pruneRevisionsCommand},
+	"aggregate-views": {"aggregate-views", 0, aggregateViewsCommand},
+	"fsck":            {"fsck [-fix]", -1, fsckCommand},
+	"replace":         {"replace [-regexp] [-ns <namespace>] [-by <name>] [-apply] <find> <replacement>", -1, replaceCommand},
+	"migrate":         {"migrate", 0, migrateCommand},
+	"add-user":        {"add-user <name> <reader|editor|admin>, reading the password from stdin", 2, addUserCommand},
+}
+
+func init() {
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: %s [flags] [command]\n\nCommands (serve by default):\n", os.Args[0])
+		var names []string
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(out, "  %s\n", commands[name].usage)
+		}
+		fmt.Fprintf(out, "\nFlags:\n")
+		flag.PrintDefaults()
+	}
+}
+
+func exportCommand(conn db, args []string) error {
+	f, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	n, err := exportPages(context.Background(), f, conn)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("exported %d pages to %s\n", n, args[0])
+	return nil
+}
+
+// importCommand loads a directory of pages, or the zip of export as it
+// is.
+func importCommand(conn db, args []string) error {
+	fsys := os.DirFS(args[0])
+	if strings.HasSuffix(args[0], ".zip") {
+		zr, err := zip.OpenReader(args[0])
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		fsys = zr
+	}
+	n, err := importPages(fsys, &pgStore{conn: conn})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %d pages from %s\n", n, args[0])
+	return nil
+}
+
+func reindexCommand(conn db, args []string) error {
+	res, err := reindex(conn, func(done, total int) {
+		fmt.Printf("reindexed %d of %d pages\n", done, total)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("done: %d pages, %d tags, %d page tags, %d links\n", res.Pages, res.Tags, res.PageTags, res.Links)
+	return nil
+}
+
+func pruneRevisionsCommand(conn db, args []string) error {
+	n, err := pruneRevisions(context.Background(), 0, conn)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("deleted %d revisions\n", n)
+	return nil
+}
+
+func aggregateViewsCommand(conn db, args []string) error {
+	n, err := aggregateViews(startOfDay(time.Now()), conn)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("aggregated %d view events\n", n)
+	return nil
+}
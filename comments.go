@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"github.com/jackc/pgx/v4"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// longest comment body allowed, in bytes
+const maxCommentLength = 10000
+
+// comments listed on each page of /comments and in its feed
+const commentsPageSize = 50
+
+// threads indent no further than this, so deep replies stay readable
+const maxCommentDepth = 6
+
+// Comment is a post in the discussion of a page at /talk/{title}, replying
+// to the comment ParentID unless that is 0.
+type Comment struct {
+	ID        int64
+	PageID    int64
+	ParentID  int64
+	Author    string
+	Body      []byte
+	CreatedAt time.Time
+	// hidden by an admin; the body is only shown to admins
+	Hidden bool
+	// set when listing comments across pages
+	Title string
+	// set for the talk page: how deep it is in its thread, and the
+	// rendered body
+	Depth int
+	HTML  template.HTML
+}
+
+func loadComments(ctx context.Context, pageID int64, conn db) ([]*Comment, error) {
+	defer timeQuery("loadComments", time.Now())
+	query := "SELECT id, page_id, COALESCE(parent_id, 0), author, body, created_at, hidden, '' FROM " + table("comments") + " WHERE page_id = $1 ORDER BY id"
+	return queryComments(ctx, conn, query, pageID)
+}
+
+// loadRecentComments returns up to limit comments that aren't hidden, on
+// pages that aren't archived, newest first, after skipping offset.
+func loadRecentComments(ctx context.Context, limit, offset int, conn db) ([]*Comment, error) {
+	defer timeQuery("loadRecentComments", time.Now())
+	query := `SELECT c.id, c.page_id, COALESCE(c.parent_id, 0), c.author, c.body, c.created_at, c.hidden, p.title
+		FROM ` + table("comments") + ` c JOIN ` + table("pages") + ` p ON p.id = c.page_id
+		WHERE NOT c.hidden ORDER BY c.id DESC LIMIT $1 OFFSET $2`
+	return queryComments(ctx, conn, query, limit, offset)
+}
+
+func queryComments(ctx context.Context, conn db, query string, args ...interface{}) ([]*Comment, error) {
+	rows, err := conn.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var comments []*Comment
+	for rows.Next() {
+		c := &Comment{}
+		if err := rows.Scan(&c.ID, &c.PageID, &c.ParentID, &c.Author, &c.Body, &c.CreatedAt, &c.Hidden, &c.Title); err != nil {
+			return nil, err
+		}
+		comments = append(comments, c)
+	}
+	return comments, rows.Err()
+}
+
+// addComment stores c, filling in its ID and time. A reply to a comment
+// that isn't on the same page stores nothing and fails with pgx.ErrNoRows.
+func addComment(ctx context.Context, c *Comment, conn db) error {
+	defer timeQuery("addComment", time.Now())
+	query := `INSERT INTO ` + table("comments") + ` (page_id, parent_id, author, body)
+		SELECT $1, NULLIF($2, 0), $3, $4
+		WHERE $2 = 0 OR EXISTS (SELECT 1 FROM ` + table("comments") + ` WHERE id = $2 AND page_id = $1)
+		RETURNING id, created_at`
+	return conn.QueryRow(ctx, query, c.PageID, c.ParentID, c.Author, c.Body).Scan(&c.ID, &c.CreatedAt)
+}
+
+// execComment runs a statement on the comment id of page pageID, failing
+// with pgx.ErrNoRows when there is no such comment.
+func execComment(ctx context.Context, conn db, query string, pageID, id int64, args ...interface{}) error {
+	tag, err := conn.Exec(ctx, query, append([]interface{}{pageID, id}, args...)...)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+func hideComment(ctx context.Context, pageID, id int64, hidden bool, conn db) error {
+	defer timeQuery("hideComment", time.Now())
+	query := "UPDATE " + table("comments") + " SET hidden = $3 WHERE page_id = $1 AND id = $2"
+	return execComment(ctx, conn, query, pageID, id, hidden)
+}
+
+// deleteComment deletes a comment along with the replies to it.
+func deleteComment(ctx context.Context, pageID, id int64, conn db) error {
+	defer timeQuery("deleteComment", time.Now())
+	query := "DELETE FROM " + table("comments") + " WHERE page_id = $1 AND id = $2"
+	return execComment(ctx, conn, query, pageID, id)
+}
+
+// threadComments orders comments, oldest first, into threads: each comment
+// is followed by its replies, with their Depth set.
+func threadComments(comments []*Comment) []*Comment {
+	replies := map[int64][]*Comment{}
+	for _, c := range comments {
+		replies[c.ParentID] = append(replies[c.ParentID], c)
+	}
+	var threaded []*Comment
+	var walk func(parent int64, depth int)
+	walk = func(parent int64, depth int) {
+		for _, c := range replies[parent] {
+			c.Depth = min(depth, maxCommentDepth)
+			threaded = append(threaded, c)
+			walk(c.ID, depth+1)
+		}
+	}
+	walk(0, 0)
+	return threaded
+}
+
+// renderComment renders the Markdown of a comment. Comments can't include
+// pages, which would let anyone post the text of a protected page.
+func renderComment(c *Comment) (template.HTML, error) {
+	return renderMarkdown(c.Body, func(title string) (template.HTML, error) {
+		return includeNotice(title, "comments can't include pages"), nil
+	})
+}
+
+type Talk struct {
+	Page     *Page
+	Comments []*Comment
+	User     *User
+	Errors   *Validation
+	// the body of a comment that couldn't be posted, to post again
+	Draft string
+}
+
+// talkHandler shows the discussion of a page and takes its posts: signed-in
+// users post comments and replies with action=post, and admins hide,
+// unhide or delete them with the action of that name.
+func talkHandler(w http.ResponseWriter, r *http.Request, title string, store PageStore) {
+	p, err := store.Stat(title)
+	if err == errNotFound {
+		if current, err := store.Resolve(title); err == nil {
+			redirect(w, r, pagePath("talk", current), http.StatusMovedPermanently)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u := currentUser(r)
+	if r.Method != http.MethodPost {
+		renderTalk(w, r, http.StatusOK, p, u, nil, "", store)
+		return
+	}
+	if u == nil {
+		a := &Account{Next: pagePath("talk", title), Error: "Log in to join the discussion.", Signups: config.Signups}
+		renderTemplateStatus(w, r, http.StatusUnauthorized, "login", a)
+		return
+	}
+	id, _ := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	action := r.FormValue("action")
+	switch action {
+	case "post":
+		c := &Comment{PageID: p.ID, Author: u.Name, Body: []byte(strings.TrimSpace(r.FormValue("body")))}
+		c.ParentID, _ = strconv.ParseInt(r.FormValue("parent"), 10, 64)
+		if config.NormalizeBodies {
+			c.Body = normalizeText(c.Body)
+		}
+		if msg := checkComment(c.Body); msg != "" {
+			v := &Validation{Message: "Your comment could not be posted:"}
+			v.add("body", msg)
+			renderTalk(w, r, http.StatusBadRequest, p, u, v, string(c.Body), store)
+			return
+		}
+		err = store.AddComment(c)
+		id = c.ID
+	case "hide", "unhide", "delete":
+		if !u.IsAdmin() {
+			http.Error(w, "only admins moderate comments", http.StatusForbidden)
+			return
+		}
+		if action == "delete" {
+			err = store.DeleteComment(p.ID, id)
+		} else {
+			err = store.SetCommentHidden(p.ID, id, action == "hide")
+		}
+	default:
+		http.Error(w, "unknown action", http.StatusBadRequest)
+		return
+	}
+	if err == errNotFound {
+		http.Error(w, "no such comment", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	target := pagePath("talk", title)
+	if action != "delete" {
+		target += "#comment-" + strconv.FormatInt(id, 10)
+	}
+	redirect(w, r, target, http.StatusSeeOther)
+}
+
+// excerpt is the start of a comment for listings, on one line.
+func excerpt(body string) string {
+	return truncate(strings.Join(strings.Fields(body), " "), maxDescription)
+}
+
+// checkComment says what is wrong with a comment body, if anything.
+func checkComment(body []byte) string {
+	if len(body) == 0 {
+		return "Write something to post."
+	}
+	if len(body) > maxCommentLength {
+		return "Comments are limited to " + humanSize(int64(maxCommentLength)) + "."
+	}
+	if err := checkText(body); err != nil {
+		return sentence(err.Error())
+	}
+	return ""
+}
+
+func renderTalk(w http.ResponseWriter, r *http.Request, status int, p *Page, u *User, v *Validation, draft string, store PageStore) {
+	comments, err := store.Comments(p.ID)
+	if err != nil {
+		renderFailed(w, err)
+		return
+	}
+	if err := acquireRender(); err != nil {
+		renderFailed(w, err)
+		return
+	}
+	defer releaseRender()
+	for _, c := range comments {
+		if c.Hidden && !u.IsAdmin() {
+			continue
+		}
+		if c.HTML, err = renderComment(c); err != nil {
+			renderFailed(w, err)
+			return
+		}
+	}
+	t := &Talk{Page: p, Comments: threadComments(comments), User: u, Errors: v, Draft: draft}
+	renderTemplateStatus(w, r, status, "talk", t)
+}
+
+type RecentComments struct {
+	Comments []*Comment
+	// current page of the listing, counted from 1, and its neighbours; 0
+	// when there is none
+	Number int
+	Prev   int
+	Next   int
+}
+
+// recentCommentsHandler lists the latest comments on every page.
+func recentCommentsHandler(w http.ResponseWriter, r *http.Request, store PageStore) {
+	rc := &RecentComments{Number: pageNumber(r)}
+	// one more than shown tells whether there is a next page
+	comments, err := store.RecentComments(commentsPageSize+1, (rc.Number-1)*commentsPageSize)
+	if err != nil {
+		renderFailed(w, err)
+		return
+	}
+	if len(comments) > commentsPageSize {
+		comments, rc.Next = comments[:commentsPageSize], rc.Number+1
+	}
+	rc.Comments = comments
+	if rc.Number > 1 {
+		rc.Prev = rc.Number - 1
+	}
+	renderTemplate(w, r, "comments", rc)
+}
+
+const atomNS = "http://www.w3.org/2005/Atom"
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title   string   `xml:"title"`
+	ID      string   `xml:"id"`
+	Link    atomLink `xml:"link"`
+	Updated string   `xml:"updated"`
+	Author  string   `xml:"author>name"`
+	Content string   `xml:"content"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name     `xml:"feed"`
+	NS      string       `xml:"xmlns,attr"`
+	Title   string       `xml:"title"`
+	ID      string       `xml:"id"`
+	Link    []atomLink   `xml:"link"`
+	Updated string       `xml:"updated"`
+	Entries []*atomEntry `xml:"entry"`
+}
+
+// commentsFeedHandler is the latest comments as an Atom feed, at
+// /comments.atom.
+func commentsFeedHandler(w http.ResponseWriter, r *http.Request, store PageStore) {
+	comments, err := store.RecentComments(commentsPageSize, 0)
+	if err != nil {
+		renderFailed(w, err)
+		return
+	}
+	base := baseURL(r)
+	feed := &atomFeed{
+		NS:    atomNS,
+		Title: "Go Wiki comments",
+		ID:    base + "/comments",
+		Link:  []atomLink{{Href: base + "/comments.atom", Rel: "self"}, {Href: base + "/comments"}},
+	}
+	// an empty feed has last changed when it is asked for
+	feed.Updated = time.Now().UTC().Format(time.RFC3339)
+	if len(comments) > 0 {
+		feed.Updated = comments[0].CreatedAt.UTC().Format(time.RFC3339)
+	}
+	for _, c := range comments {
+		href := base + pagePath("talk", c.Title) + "#comment-" + strconv.FormatInt(c.ID, 10)
+		feed.Entries = append(feed.Entries, &atomEntry{
+			Title:   "Comment by " + c.Author + " on " + c.Title,
+			ID:      href,
+			Link:    atomLink{Href: href},
+			Updated: c.CreatedAt.UTC().Format(time.RFC3339),
+			Author:  c.Author,
+			Content: string(c.Body),
+		})
+	}
+	writeXML(w, r, "application/atom+xml; charset=utf-8", feed)
+}
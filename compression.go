@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// bodyColumns are the columns of pages a body is read from: body, or body_gz
+// when the row was stored gzipped under -gzip-bodies, which leaves body
+// empty. They go last in a query, to scan into storedBody.dest.
+const bodyColumns = "body, body_gz"
+
+// storedBody is a page body as stored in bodyColumns.
+type storedBody struct {
+	text []byte
+	gz   []byte
+}
+
+// dest is the scan destinations of a row: those before it, then its
+// bodyColumns.
+func (b *storedBody) dest(before ...interface{}) []interface{} {
+	return append(before, &b.text, &b.gz)
+}
+
+// bytes is the body, gunzipped if it was stored compressed.
+func (b *storedBody) bytes() ([]byte, error) {
+	if b.gz == nil {
+		return b.text, nil
+	}
+	return gunzip(b.gz)
+}
+
+// gzip writers take hundreds of kilobytes to set up, so saves share them
+var gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+
+// compressBody is body gzipped for storing, or nil to store it as text:
+// when -gzip-bodies is off, body is shorter than it, or gzip doesn't make
+// it any smaller.
+func compressBody(body []byte) []byte {
+	if config.GzipBodies <= 0 || len(body) < config.GzipBodies {
+		return nil
+	}
+	var buf bytes.Buffer
+	zw := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(zw)
+	zw.Reset(&buf)
+	// writing to a buffer doesn't fail
+	zw.Write(body)
+	zw.Close()
+	if buf.Len() >= len(body) {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+func gunzip(gz []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(gz))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// searchVector is the SQL of the words a compressed body, the text
+// parameter param, is searched by; NULL when param is, for bodies stored
+// as text.
+func searchVector(param string) string {
+	return "to_tsvector('" + config.SearchLanguage + "', " + param + "::text)"
+}
+
+// inflateBodies locks the pages matching where, a condition on pages p with
+// args, until the transaction of conn ends, storing those that are gzipped
+// as text again. It comes before the statements that work on bodies in SQL,
+// like archiving or rewriting links, which Postgres can't gunzip for.
+func inflateBodies(ctx context.Context, conn db, where string, args ...interface{}) error {
+	rows, err := conn.Query(ctx, "SELECT p.id, p.body_gz FROM "+table("pages")+" p WHERE "+where+" FOR UPDATE", args...)
+	if err != nil {
+		return err
+	}
+	gzipped := map[int64][]byte{}
+	for rows.Next() {
+		var id int64
+		var gz []byte
+		if err := rows.Scan(&id, &gz); err != nil {
+			rows.Close()
+			return err
+		}
+		if gz != nil {
+			gzipped[id] = gz
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	query := "UPDATE " + table("pages") + " SET body = $2, body_gz = NULL, body_size = NULL, compressed = false, search_vector = NULL WHERE id = $1"
+	for id, gz := range gzipped {
+		body, err := gunzip(gz)
+		if err != nil {
+			return fmt.Errorf("page id %d: %w", id, err)
+		}
+		if _, err := conn.Exec(ctx, query, id, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestCompressBody(t *testing.T) {
+	defer func(n int) { config.GzipBodies = n }(config.GzipBodies)
+	body := bytes.Repeat([]byte("A page about [[Gophers]], with a table.\n"), 100)
+
+	tests := []struct {
+		name      string
+		threshold int
+		body      []byte
+		gzipped   bool
+	}{
+		{"off", 0, body, false},
+		{"below the threshold", len(body) + 1, body, false},
+		{"at the threshold", len(body), body, true},
+		// gzip only adds its header to a body this short
+		{"not smaller", 1, []byte("hi"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.GzipBodies = tt.threshold
+			gz := compressBody(tt.body)
+			if (gz != nil) != tt.gzipped {
+				t.Fatalf("compressBody gzipped = %v, want %v", gz != nil, tt.gzipped)
+			}
+			stored := storedBody{text: tt.body}
+			if gz != nil {
+				stored = storedBody{text: []byte{}, gz: gz}
+			}
+			got, err := stored.bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.body) {
+				t.Errorf("stored body reads back as %q, want %q", got, tt.body)
+			}
+		})
+	}
+}
+
+func TestStoredBodyCorrupt(t *testing.T) {
+	stored := storedBody{gz: []byte("not gzip")}
+	if _, err := stored.bytes(); err == nil {
+		t.Error("reading a corrupt gzipped body succeeded")
+	}
+}
+
+// BenchmarkGzipBodies measures what -gzip-bodies saves on Markdown, the
+// README standing in for a page, cut to pages of a few sizes. stored-% is
+// the size of the gzipped body against the text.
+func BenchmarkGzipBodies(b *testing.B) {
+	readme, err := os.ReadFile("README.md")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func(n int) { config.GzipBodies = n }(config.GzipBodies)
+	config.GzipBodies = 1
+	for _, size := range []int{1 << 10, 4 << 10, 16 << 10, len(readme)} {
+		body := readme[:min(size, len(readme))]
+		b.Run(fmt.Sprintf("%dB", len(body)), func(b *testing.B) {
+			b.SetBytes(int64(len(body)))
+			var gz []byte
+			for i := 0; i < b.N; i++ {
+				gz = compressBody(body)
+			}
+			b.ReportMetric(100*float64(len(gz))/float64(len(body)), "stored-%")
+		})
+	}
+}
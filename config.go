@@ -0,0 +1,725 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/jackc/pgx/v4"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	// longest query parameter accepted, in characters, 0 for no limit
+	MaxQueryLength int
+	// how searches match pages, one of searchBackends, and the Postgres text
+	// search configuration of the fts backend
+	SearchBackend  string
+	SearchLanguage string
+	// stream saves to the open editors of a page at /events/
+	PageEvents bool
+	// describe pages to search engines with schema.org JSON-LD
+	StructuredData bool
+	// open links to other sites in a new tab
+	ExternalLinksNewTab bool
+	// print the build version and exit
+	ShowVersion bool
+	// read templates and static assets from disk instead of the binary,
+	// the templates again for every request
+	Dev bool
+	// directory served under /css/
+	StaticDir string
+	// directory holding the *.html templates
+	TemplateDir string
+	// file whose text new pages start with, the built-in boilerplate when
+	// empty
+	NewPageTemplate string
+	// directory of named page templates offered at /new, one .md file each
+	PageTemplates string
+	// HTTP basic auth credentials for admin tools; admin tools are
+	// disabled while the password is empty
+	AdminUser     string
+	AdminPassword string
+	// let anonymous users edit pages open to anyone; otherwise every edit
+	// needs a sign in
+	AnonymousEdits bool
+	// let visitors create their own accounts at /signup, and how long they
+	// stay signed in
+	Signups       bool
+	SessionLength time.Duration
+	// role of the accounts created at /signup, reader or editor
+	SignupRole string
+	// normalize line endings and trailing whitespace of saved bodies
+	NormalizeBodies bool
+	// what saving a new page that someone else created meanwhile does:
+	// "conflict" shows the differences to resolve, "overwrite" replaces
+	// their version
+	NewPageConflict string
+	// order /index lists pages in when no sort is asked for, one of
+	// indexSorts
+	IndexSort string
+	// how pages as JSON hold their body, "base64" or "text", and whether
+	// they repeat the id under the "ID" key of earlier releases
+	PageJSONBody     string
+	PageJSONLegacyID bool
+	// file every save submission is logged to for abuse review, "-" for
+	// stderr, and whether the log includes the submitted bodies
+	SubmissionLog       string
+	SubmissionLogBodies bool
+	// file every request is logged to as JSON, "-" for stderr, none when
+	// empty
+	AccessLog string
+	// serve Prometheus metrics at /metrics
+	Metrics bool
+	// what viewing a missing page does: "page" renders a 404 page with a
+	// create link, "redirect" sends the user straight to the editor
+	MissingPage string
+	// headings a page needs for its table of contents to be shown, 0 to
+	// show none
+	TOCMinHeadings int
+	// title of a page whose content is shown on the missing page, the
+	// built-in message when empty or when that page doesn't exist
+	NotFoundPage string
+	// key used to sign cookies, required outside of dev mode
+	CookieSecret string
+	// regular expression a page title must match as a whole
+	TitlePattern string
+	// longest title allowed, in characters
+	MaxTitleLength int
+	// pages with a larger body are streamed instead of buffered, 0 never
+	// streams
+	StreamThreshold int
+	// how often pages past their expiry are archived, 0 to never
+	ExpiryInterval time.Duration
+	// periodic zip backups of all pages, disabled while BackupDir is empty
+	BackupDir       string
+	BackupInterval  time.Duration
+	BackupRetention int
+	// where changes to watched pages are sent: an SMTP server to email the
+	// watchers through, a URL taking JSON and a Slack incoming webhook
+	SMTPAddr      string
+	SMTPFrom      string
+	SMTPUser      string
+	SMTPPassword  string
+	NotifyWebhook string
+	NotifySlack   string
+	// address the wiki is reached at, like https://wiki.example.com,
+	// without -base-path, for links in notifications
+	SiteURL string
+	// names of the Markdown extensions to enable
+	MarkdownExtensions []string
+	// hosts iframes may be embedded from, none by default
+	IframeHosts []string
+	// chroma style fenced code blocks are highlighted in
+	HighlightStyle string
+	// file extensions that may be uploaded, the largest upload and the
+	// total size of all stored files, 0 for no limit
+	UploadExtensions []string
+	MaxUploadSize    int64
+	UploadQuota      int64
+	// directory new uploads are stored in, the database when empty
+	UploadDir string
+	// number of rendered pages kept in memory, 0 disables the cache, and
+	// how long each is kept, 0 until evicted
+	RenderCacheSize int
+	RenderCacheTTL  time.Duration
+	// pages rendered at once, 0 for no limit, and how long a render waits
+	// for its turn before the request is shed
+	MaxRenders         int
+	RenderQueueTimeout time.Duration
+	// how deep includes may nest and how many pages one render may include
+	// in all, to keep include fan-out from slowing renders down
+	MaxIncludeDepth int
+	MaxIncludes     int
+	// longest a statement of the server may run before Postgres cancels it
+	StatementTimeout time.Duration
+	// size of the database connection pool and how long its connections
+	// live, 0 for the pool's defaults
+	DBMaxConns        int
+	DBMinConns        int
+	DBMaxConnLifetime time.Duration
+	DBMaxConnIdleTime time.Duration
+	// how long after writing a page the server reads it from the primary
+	// rather than from the replica
+	ReplicaLag time.Duration
+	// connection strings of the database and of an optional read replica
+	DatabaseURL string
+	ReplicaURL  string
+	// where pages are kept, one of storeBackends, and the directory or
+	// database file of the files and sqlite stores
+	Store     string
+	StorePath string
+	// address the server listens on, like :3000 or 127.0.0.1:8080
+	Listen string
+	// certificate and key files to serve HTTPS with, or the domains to get
+	// certificates for from Let's Encrypt, kept in AutocertCache; plain
+	// HTTP when neither is set
+	TLSCert         string
+	TLSKey          string
+	AutocertDomains []string
+	AutocertCache   string
+	// address plain HTTP requests are sent on to HTTPS from, none when
+	// empty
+	RedirectHTTP string
+	// addresses and networks of the reverse proxies whose X-Forwarded-For
+	// and X-Forwarded-Proto headers are believed
+	TrustedProxies []string
+	// saves queued for the background worker recording their revisions,
+	// tags and links, 0 to write everything before a save returns, and the
+	// most saves it records in one transaction
+	SaveQueue int
+	SaveBatch int
+	// record each view with its referrer for /views
+	ViewLog bool
+	// number of most viewed pages rendered into the cache at startup
+	WarmPages int
+	// widgets shown on the home page, from homeWidgets
+	HomeWidgets []string
+	// codes of the languages pages can be translated into, the first being
+	// that of the pages themselves; translations are off with fewer than two
+	Languages []string
+	// saves allowed per user, or per IP for anonymous editors, in each
+	// window; 0 means no quota
+	EditQuota       int
+	EditQuotaWindow time.Duration
+	// requests a minute allowed per user, or per IP for anonymous clients,
+	// that only read and that change something; 0 means no limit
+	ReadRateLimit  int
+	WriteRateLimit int
+	// CAPTCHA service anonymous editors solve before saving, from
+	// captchaProviders; empty for none
+	Captcha        string
+	CaptchaSiteKey string
+	CaptchaSecret  string
+	// file of regular expressions, one a line, that saves may not add;
+	// external links anonymous edits may add, 0 for any number; and a
+	// service asked whether each save is spam, none when empty
+	SpamBlocklist         string
+	MaxAnonymousLinks     int
+	SpamClassifier        string
+	SpamClassifierTimeout time.Duration
+	// revisions kept per page beyond the newest minRevisions; 0 keeps them
+	// all
+	MaxRevisions   int
+	MaxRevisionAge time.Duration
+	// saves by the same author within this long of the latest revision
+	// replace it instead of adding one; 0 keeps every save
+	CoalesceEdits time.Duration
+	// queries running longer than this are logged, 0 disables the log
+	SlowQuery time.Duration
+	// redirect /VIEW/Page and /view/Page/ to /view/Page
+	NormalizeURLs bool
+	// keep search engines from indexing the wiki
+	NoIndex bool
+	// server timeouts, see README for the defaults
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// how long a stopping server waits for requests in flight
+	ShutdownTimeout time.Duration
+	// how often the database is pinged, 0 disables the check, and the text
+	// of the page served while it is down
+	HealthCheckInterval time.Duration
+	UnavailableMessage  string
+	// how long /readyz waits for the database to answer a ping
+	ReadyTimeout time.Duration
+	// prepended to every table name so several wikis can share a database
+	TablePrefix string
+	// apply pending schema migrations when the server starts
+	Migrate bool
+	// Postgres compression of page bodies, pglz or lz4, the column default
+	// when empty
+	BodyCompression string
+	// bodies of at least this many bytes are gzipped before they are
+	// stored, 0 for none
+	GzipBodies int
+	// path the wiki is served under, like /wiki, empty for the root
+	BasePath string
+}
+
+var config Config
+
+// a table prefix is spliced into queries, so it must be a plain identifier
+var validTablePrefix = regexp.MustCompile("^(?:[a-z_][a-z0-9_]{0,31})?$")
+
+var validBasePath = regexp.MustCompile("^(?:/[A-Za-z0-9._~-]+)*$")
+
+// table is the name of a table with the configured prefix.
+func table(name string) string {
+	return config.TablePrefix + name
+}
+
+// see README for how this was measured
+const defaultStreamThreshold = 1 << 20
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// envInt is envOr for a number, exiting like a bad flag when it isn't one.
+func envInt(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid value %q for %s: %v\n", v, key, err)
+		os.Exit(2)
+	}
+	return n
+}
+
+// envBool is envOr for a boolean, like false, for settings that are on by
+// default.
+func envBool(key string, fallback bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid value %q for %s: %v\n", v, key, err)
+		os.Exit(2)
+	}
+	return b
+}
+
+// envDuration is envOr for a duration, like 30m.
+func envDuration(key string, fallback time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid value %q for %s: %v\n", v, key, err)
+		os.Exit(2)
+	}
+	return d
+}
+
+// envUsage finds the environment variable a flag defaults to, which its
+// usage names as (env NAME).
+var envUsage = regexp.MustCompile(`\(env ([A-Z0-9_]+)\)`)
+
+// loadConfigFile sets the flags named in the TOML file at path, like
+// read-timeout = "1m", except those given on the command line or through
+// their environment variable. Lists may be arrays or comma separated.
+func loadConfigFile(path string) error {
+	var settings map[string]interface{}
+	if _, err := toml.DecodeFile(path, &settings); err != nil {
+		return fmt.Errorf("config file %s: %v", path, err)
+	}
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := flag.Lookup(name)
+		if f == nil || name == "config" || name == "version" {
+			return fmt.Errorf("config file %s: unknown setting %q", path, name)
+		}
+		if m := envUsage.FindStringSubmatch(f.Usage); given[name] || m != nil && os.Getenv(m[1]) != "" {
+			continue
+		}
+		var value string
+		switch v := settings[name].(type) {
+		case map[string]interface{}:
+			return fmt.Errorf("config file %s: %s must be a value, not a table", path, name)
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			value = strings.Join(items, ",")
+		default:
+			value = fmt.Sprint(v)
+		}
+		if err := f.Value.Set(value); err != nil {
+			return fmt.Errorf("config file %s: invalid value %q for %s: %v", path, value, name, err)
+		}
+	}
+	return nil
+}
+
+func parseConfig() {
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "TOML file of settings named like the flags; flags and environment variables override it (env CONFIG_FILE)")
+	flag.BoolVar(&config.ShowVersion, "version", false, "print the version, commit and build time and exit")
+	flag.StringVar(&config.Listen, "listen", envOr("LISTEN_ADDR", ":3000"), "address to serve the wiki on (env LISTEN_ADDR)")
+	flag.StringVar(&config.DatabaseURL, "database-url", os.Getenv("DATABASE_URL"), "Postgres connection string, the PG* environment variables filling in what it leaves out (env DATABASE_URL)")
+	flag.StringVar(&config.ReplicaURL, "database-replica-url", os.Getenv("DATABASE_REPLICA_URL"), "connection string of a read replica to load, list and search pages from (env DATABASE_REPLICA_URL)")
+	flag.StringVar(&config.Store, "store", envOr("STORE", storePostgres), "where pages are kept: postgres, files for a directory of Markdown files or sqlite; only serve runs on the last two (env STORE)")
+	flag.StringVar(&config.StorePath, "store-path", os.Getenv("STORE_PATH"), "directory of the files store or database file of the sqlite store, ./pages or ./gowiki.db when empty (env STORE_PATH)")
+	flag.BoolVar(&config.Dev, "dev", os.Getenv("DEV") != "", "read templates and static assets from disk, parsing the templates on every request (env DEV)")
+	flag.StringVar(&config.StaticDir, "static", envOr("STATIC_DIR", "./public/css"), "directory of static assets served under /css/ in dev mode (env STATIC_DIR)")
+	flag.StringVar(&config.TemplateDir, "templates", envOr("TEMPLATE_DIR", "./templates"), "directory of HTML templates in dev mode (env TEMPLATE_DIR)")
+	flag.StringVar(&config.PageTemplates, "page-templates", os.Getenv("PAGE_TEMPLATES"), "directory of Markdown page templates, like meeting.md, to start new pages from at /new (env PAGE_TEMPLATES)")
+	flag.StringVar(&config.NewPageTemplate, "new-page-template", os.Getenv("NEW_PAGE_TEMPLATE"), "file of Markdown new pages start with, {{title}} standing for the page title (env NEW_PAGE_TEMPLATE)")
+	flag.BoolVar(&config.NormalizeURLs, "normalize-urls", true, "redirect page URLs with a trailing slash or an upper case action to the canonical URL")
+	flag.BoolVar(&config.NoIndex, "noindex", os.Getenv("NOINDEX") != "", "ask search engines not to index or follow any page (env NOINDEX)")
+	flag.StringVar(&config.AdminUser, "admin-user", envOr("ADMIN_USER", "admin"), "user name for admin tools (env ADMIN_USER)")
+	flag.StringVar(&config.AdminPassword, "admin-password", os.Getenv("ADMIN_PASSWORD"), "password for admin tools, disabled when empty (env ADMIN_PASSWORD)")
+	flag.IntVar(&config.MaxQueryLength, "max-query-length", 500, "longest query parameter, like a search, in characters; longer ones get 400 Bad Request, 0 for no limit")
+	flag.StringVar(&config.SearchBackend, "search-backend", envOr("SEARCH_BACKEND", string(searchTrigram)), `how searches match pages: "trigram" for typo tolerant titles and exact text in bodies, "fts" for Postgres full text search (env SEARCH_BACKEND)`)
+	flag.StringVar(&config.SearchLanguage, "search-language", envOr("SEARCH_LANGUAGE", "english"), "Postgres text search configuration of the fts search backend, like english or simple (env SEARCH_LANGUAGE)")
+	flag.BoolVar(&config.PageEvents, "page-events", os.Getenv("PAGE_EVENTS") != "", "warn editors as soon as someone else saves the page they are editing, over Server-Sent Events (env PAGE_EVENTS)")
+	flag.BoolVar(&config.StructuredData, "structured-data", os.Getenv("STRUCTURED_DATA") != "", "describe pages to search engines with schema.org Article JSON-LD (env STRUCTURED_DATA)")
+	flag.BoolVar(&config.ExternalLinksNewTab, "external-links-new-tab", os.Getenv("EXTERNAL_LINKS_NEW_TAB") != "", "open links to other sites in a new tab (env EXTERNAL_LINKS_NEW_TAB)")
+	flag.BoolVar(&config.NormalizeBodies, "normalize-bodies", os.Getenv("NORMALIZE_BODIES") != "", "turn CRLF into LF and trim trailing whitespace from the lines of saved pages, outside fenced code (env NORMALIZE_BODIES)")
+	flag.BoolVar(&config.AnonymousEdits, "anonymous-edits", os.Getenv("ANONYMOUS_EDITS") != "", "let anonymous users edit pages that are open to anyone, recorded with their IP address (env ANONYMOUS_EDITS)")
+	flag.StringVar(&config.NewPageConflict, "new-page-conflict", envOr("NEW_PAGE_CONFLICT", "conflict"), `saving a new page someone else created meanwhile shows a "conflict" to resolve or does an "overwrite" (env NEW_PAGE_CONFLICT)`)
+	flag.StringVar(&config.IndexSort, "index-sort", envOr("INDEX_SORT", "title"), `order of the page index by default: "title", "updated", "created" or "views" (env INDEX_SORT)`)
+	flag.StringVar(&config.PageJSONBody, "page-json-body", envOr("PAGE_JSON_BODY", "base64"), `how pages viewed as JSON hold their body: "base64" as before, or "text" (env PAGE_JSON_BODY)`)
+	flag.BoolVar(&config.PageJSONLegacyID, "page-json-legacy-id", envBool("PAGE_JSON_LEGACY_ID", true), `repeat the page id under the "ID" key of earlier releases in pages viewed as JSON (env PAGE_JSON_LEGACY_ID)`)
+	flag.StringVar(&config.NotFoundPage, "not-found-page", os.Getenv("NOT_FOUND_PAGE"), "title of a wiki page shown when viewing a page that does not exist, like NotFound (env NOT_FOUND_PAGE)")
+	flag.StringVar(&config.SubmissionLog, "submission-log", os.Getenv("SUBMISSION_LOG"), `file to log every save submission to for abuse review, "-" for stderr, disabled when empty (env SUBMISSION_LOG)`)
+	flag.StringVar(&config.AccessLog, "access-log", envOr("ACCESS_LOG", "-"), `file to log every request to as JSON lines, "-" for stderr, disabled when empty (env ACCESS_LOG)`)
+	flag.BoolVar(&config.Metrics, "metrics", true, "serve request, database and page metrics for Prometheus at /metrics")
+	flag.BoolVar(&config.SubmissionLogBodies, "submission-log-bodies", false, "include the submitted page bodies in the submission log")
+	flag.IntVar(&config.TOCMinHeadings, "toc-min-headings", envInt("TOC_MIN_HEADINGS", 3), "headings a page needs to get a table of contents, 0 for none (env TOC_MIN_HEADINGS)")
+	flag.StringVar(&config.MissingPage, "missing-page", envOr("MISSING_PAGE", "page"), `viewing a missing page renders a 404 "page" or does a "redirect" to the editor (env MISSING_PAGE)`)
+	flag.BoolVar(&config.Signups, "signups", true, "let visitors create accounts at /signup; accounts can always be created with the add-user command")
+	flag.StringVar(&config.SignupRole, "signup-role", envOr("SIGNUP_ROLE", roleEditor), "role of accounts created at /signup: reader or editor (env SIGNUP_ROLE)")
+	flag.DurationVar(&config.SessionLength, "session-length", 30*24*time.Hour, "how long users stay signed in")
+	flag.StringVar(&config.CookieSecret, "cookie-secret", os.Getenv("COOKIE_SECRET"), "secret used to sign cookies, required unless -dev (env COOKIE_SECRET)")
+	flag.StringVar(&config.TitlePattern, "title-pattern", envOr("TITLE_PATTERN", defaultTitlePattern), "regular expression for allowed page titles (env TITLE_PATTERN)")
+	flag.IntVar(&config.MaxTitleLength, "max-title-length", 200, "longest page title allowed, in characters")
+	basePath := flag.String("base-path", os.Getenv("BASE_PATH"), "path to serve the wiki under, like /wiki, for sharing a host with other apps (env BASE_PATH)")
+	flag.StringVar(&config.TablePrefix, "table-prefix", os.Getenv("TABLE_PREFIX"), "prefix of every table name, e.g. team_ (env TABLE_PREFIX)")
+	flag.BoolVar(&config.Migrate, "migrate", true, "apply pending schema migrations when the server starts")
+	flag.StringVar(&config.BodyCompression, "body-compression", os.Getenv("BODY_COMPRESSION"), "compress page bodies with pglz or lz4 (Postgres 14 and later), set when migrating (env BODY_COMPRESSION)")
+	flag.IntVar(&config.GzipBodies, "gzip-bodies", envInt("GZIP_BODIES", 0), "gzip page bodies of at least this many bytes before storing them in Postgres, 0 to store them as text (env GZIP_BODIES)")
+	flag.IntVar(&config.StreamThreshold, "stream-threshold", defaultStreamThreshold, "body size in bytes above which pages are streamed, 0 to always buffer")
+	flag.StringVar(&config.SMTPAddr, "smtp-addr", os.Getenv("SMTP_ADDR"), "host:port of the SMTP server emailing changes to watched pages, disabled when empty (env SMTP_ADDR)")
+	flag.StringVar(&config.SMTPFrom, "smtp-from", os.Getenv("SMTP_FROM"), "sender address of those emails (env SMTP_FROM)")
+	flag.StringVar(&config.SMTPUser, "smtp-user", os.Getenv("SMTP_USER"), "user name to log in to the SMTP server with, none when empty (env SMTP_USER)")
+	flag.StringVar(&config.SMTPPassword, "smtp-password", os.Getenv("SMTP_PASSWORD"), "password of -smtp-user (env SMTP_PASSWORD)")
+	flag.StringVar(&config.NotifyWebhook, "notify-webhook", os.Getenv("NOTIFY_WEBHOOK"), "URL changes to watched pages are posted to as JSON (env NOTIFY_WEBHOOK)")
+	flag.StringVar(&config.NotifySlack, "notify-slack", os.Getenv("NOTIFY_SLACK"), "Slack, or compatible, incoming webhook URL changes to watched pages are posted to (env NOTIFY_SLACK)")
+	flag.StringVar(&config.SiteURL, "site-url", os.Getenv("SITE_URL"), "address the wiki is reached at, like https://wiki.example.com, for links in notifications (env SITE_URL)")
+	flag.StringVar(&config.BackupDir, "backup-dir", os.Getenv("BACKUP_DIR"), "directory for periodic backups, disabled when empty (env BACKUP_DIR)")
+	flag.DurationVar(&config.ExpiryInterval, "expiry-interval", time.Minute, "how often to archive the pages past their expires front matter time, 0 to never")
+	flag.DurationVar(&config.BackupInterval, "backup-interval", 24*time.Hour, "time between backups")
+	flag.IntVar(&config.BackupRetention, "backup-retention", 7, "number of backups to keep")
+	flag.IntVar(&config.RenderCacheSize, "render-cache-size", 256, "number of rendered pages kept in memory, 0 to disable")
+	flag.DurationVar(&config.RenderCacheTTL, "render-cache-ttl", 0, "how long a rendered page is kept in memory, 0 until it is evicted")
+	flag.IntVar(&config.MaxIncludeDepth, "max-include-depth", 5, "how deep {{include:...}} may nest")
+	flag.IntVar(&config.MaxIncludes, "max-includes", 50, "most pages one render may include, nested includes counted")
+	flag.IntVar(&config.MaxRenders, "max-renders", 2*runtime.NumCPU(), "pages rendered at once, 0 for no limit")
+	flag.DurationVar(&config.RenderQueueTimeout, "render-queue-timeout", time.Second, "how long a render waits for its turn before answering 503")
+	flag.DurationVar(&config.ReplicaLag, "replica-lag", 5*time.Second, "how long after writing a page to read it from the primary rather than the replica, when there is a replica")
+	flag.IntVar(&config.DBMaxConns, "db-max-conns", envInt("DB_MAX_CONNS", 0), "most database connections open at once, 0 for the larger of 4 and the number of CPUs (env DB_MAX_CONNS)")
+	flag.IntVar(&config.DBMinConns, "db-min-conns", envInt("DB_MIN_CONNS", 0), "database connections kept open even when idle (env DB_MIN_CONNS)")
+	flag.DurationVar(&config.DBMaxConnLifetime, "db-max-conn-lifetime", envDuration("DB_MAX_CONN_LIFETIME", 0), "how long a database connection is used before it is replaced, 0 for an hour (env DB_MAX_CONN_LIFETIME)")
+	flag.DurationVar(&config.DBMaxConnIdleTime, "db-max-conn-idle-time", envDuration("DB_MAX_CONN_IDLE_TIME", 0), "how long an idle database connection stays open, 0 for 30 minutes (env DB_MAX_CONN_IDLE_TIME)")
+	flag.DurationVar(&config.StatementTimeout, "statement-timeout", 30*time.Second, "longest a database statement of the server may run before Postgres cancels it, 0 for no limit")
+	flag.IntVar(&config.SaveQueue, "save-queue", envInt("SAVE_QUEUE", 0), "saves whose revisions, tags and links are queued to be written in the background, saves waiting while the queue is full; 0 to write them before answering (env SAVE_QUEUE)")
+	flag.IntVar(&config.SaveBatch, "save-batch", 100, "most queued saves written in one transaction")
+	flag.BoolVar(&config.ViewLog, "view-log", true, "record page views with their referrer for the admin /views pages")
+	flag.IntVar(&config.WarmPages, "warm-pages", 0, "number of most viewed pages to pre-render at startup, 0 to disable")
+	iframeHosts := flag.String("iframe-hosts", os.Getenv("IFRAME_HOSTS"), "comma separated hosts, like www.youtube.com, whose https iframes are kept in pages (env IFRAME_HOSTS)")
+	uploadExtensions := flag.String("upload-extensions", envOr("UPLOAD_EXTENSIONS", "png,jpg,jpeg,gif,webp,pdf,txt,csv"), "comma separated file extensions that can be uploaded (env UPLOAD_EXTENSIONS)")
+	flag.Int64Var(&config.MaxUploadSize, "max-upload-size", int64(envInt("MAX_UPLOAD_SIZE", 10<<20)), "largest file that can be uploaded, in bytes (env MAX_UPLOAD_SIZE)")
+	flag.Int64Var(&config.UploadQuota, "upload-quota", int64(envInt("UPLOAD_QUOTA", 1<<30)), "total bytes of uploaded files the wiki stores, 0 for no limit (env UPLOAD_QUOTA)")
+	flag.StringVar(&config.UploadDir, "upload-dir", os.Getenv("UPLOAD_DIR"), "directory to store uploaded files in instead of the database (env UPLOAD_DIR)")
+	extensions := flag.String("markdown-extensions", envOr("MARKDOWN_EXTENSIONS", defaultMarkdownExtensions), "comma separated Markdown extensions to enable, from "+strings.Join(markdownExtensionNames(), ", ")+" (env MARKDOWN_EXTENSIONS)")
+	flag.StringVar(&config.HighlightStyle, "highlight-style", envOr("HIGHLIGHT_STYLE", "github"), "chroma style fenced code blocks are highlighted in, like github, monokai or dracula (env HIGHLIGHT_STYLE)")
+	flag.IntVar(&config.MaxRevisions, "max-revisions", 0, "revisions kept per page, 0 for no limit; the last 5 are always kept")
+	flag.DurationVar(&config.MaxRevisionAge, "max-revision-age", 0, "delete revisions older than this, 0 for no limit; the last 5 are always kept")
+	flag.DurationVar(&config.CoalesceEdits, "coalesce-edits", 0, "fold saves by the same author within this long of their previous one into a single revision, 0 to disable")
+	flag.DurationVar(&config.ReadTimeout, "read-timeout", time.Minute, "time allowed to read a whole request, body included")
+	flag.DurationVar(&config.ReadHeaderTimeout, "read-header-timeout", 10*time.Second, "time allowed to read request headers")
+	flag.DurationVar(&config.WriteTimeout, "write-timeout", 2*time.Minute, "time allowed to write a response")
+	flag.DurationVar(&config.IdleTimeout, "idle-timeout", 2*time.Minute, "how long idle keep-alive connections stay open")
+	flag.DurationVar(&config.ShutdownTimeout, "shutdown-timeout", 30*time.Second, "how long to wait for requests in flight on SIGINT or SIGTERM before closing their connections")
+	flag.DurationVar(&config.HealthCheckInterval, "health-check-interval", 5*time.Second, "how often to ping the database, serving a 503 page while it is down; 0 to disable")
+	flag.DurationVar(&config.ReadyTimeout, "ready-timeout", 2*time.Second, "how long /readyz waits for the database to answer before reporting the wiki unavailable")
+	flag.StringVar(&config.UnavailableMessage, "unavailable-message", envOr("UNAVAILABLE_MESSAGE", "The wiki is down for a moment. Please try again in a few minutes."), "text of the page served while the database is down (env UNAVAILABLE_MESSAGE)")
+	flag.DurationVar(&config.SlowQuery, "slow-query", 200*time.Millisecond, "log database queries slower than this, 0 to disable")
+	flag.IntVar(&config.EditQuota, "edit-quota", 0, "saves allowed per user or IP in each -edit-quota-window, 0 for no quota")
+	flag.DurationVar(&config.EditQuotaWindow, "edit-quota-window", 24*time.Hour, "window the edit quota applies to")
+	flag.IntVar(&config.ReadRateLimit, "read-rate-limit", envInt("READ_RATE_LIMIT", 0), "GET and HEAD requests a minute allowed per user or IP, 0 for no limit (env READ_RATE_LIMIT)")
+	flag.IntVar(&config.WriteRateLimit, "write-rate-limit", envInt("WRITE_RATE_LIMIT", 60), "other requests, like saves and uploads, a minute allowed per user or IP, 0 for no limit (env WRITE_RATE_LIMIT)")
+	flag.StringVar(&config.Captcha, "captcha", os.Getenv("CAPTCHA"), "CAPTCHA anonymous editors solve before saving, one of "+strings.Join(captchaNames(), ", ")+", or empty for none (env CAPTCHA)")
+	flag.StringVar(&config.CaptchaSiteKey, "captcha-site-key", os.Getenv("CAPTCHA_SITE_KEY"), "site key of the CAPTCHA widget (env CAPTCHA_SITE_KEY)")
+	flag.StringVar(&config.CaptchaSecret, "captcha-secret", os.Getenv("CAPTCHA_SECRET"), "secret key used to verify CAPTCHA answers (env CAPTCHA_SECRET)")
+	flag.StringVar(&config.SpamBlocklist, "spam-blocklist", os.Getenv("SPAM_BLOCKLIST"), "file of regular expressions, one a line like casino\\.example, that saves may not add to a page (env SPAM_BLOCKLIST)")
+	flag.IntVar(&config.MaxAnonymousLinks, "max-anonymous-links", envInt("MAX_ANONYMOUS_LINKS", 0), "links to other sites one anonymous edit may add, 0 for no limit (env MAX_ANONYMOUS_LINKS)")
+	flag.StringVar(&config.SpamClassifier, "spam-classifier", os.Getenv("SPAM_CLASSIFIER"), "URL every save is posted to as JSON, answering {\"spam\": true} to reject it (env SPAM_CLASSIFIER)")
+	flag.DurationVar(&config.SpamClassifierTimeout, "spam-classifier-timeout", 3*time.Second, "how long to wait for the spam classifier before saving anyway")
+	flag.StringVar(&config.TLSCert, "tls-cert", os.Getenv("TLS_CERT"), "certificate file, with any intermediates, to serve HTTPS with (env TLS_CERT)")
+	flag.StringVar(&config.TLSKey, "tls-key", os.Getenv("TLS_KEY"), "private key file of -tls-cert (env TLS_KEY)")
+	autocertDomains := flag.String("autocert-domains", os.Getenv("AUTOCERT_DOMAINS"), "comma separated domains, like wiki.example.com, to serve HTTPS for with certificates from Let's Encrypt (env AUTOCERT_DOMAINS)")
+	flag.StringVar(&config.AutocertCache, "autocert-cache", envOr("AUTOCERT_CACHE", "autocert"), "directory the Let's Encrypt account and certificates are kept in (env AUTOCERT_CACHE)")
+	flag.StringVar(&config.RedirectHTTP, "redirect-http", os.Getenv("REDIRECT_HTTP"), "address, like :80, to redirect plain HTTP to HTTPS from when serving HTTPS (env REDIRECT_HTTP)")
+	trustedProxies := flag.String("trusted-proxies", os.Getenv("TRUSTED_PROXIES"), "comma separated addresses and networks, like 127.0.0.1,10.0.0.0/8, of reverse proxies whose X-Forwarded-For and X-Forwarded-Proto headers to believe (env TRUSTED_PROXIES)")
+	languages := flag.String("languages", os.Getenv("LANGUAGES"), "comma separated codes, like en,fr,de, of the languages pages can be translated into, the first being that of the pages themselves (env LANGUAGES)")
+	widgets := flag.String("home-widgets", envOr("HOME_WIDGETS", strings.Join(homeWidgets, ",")), "comma separated home page widgets, from "+strings.Join(homeWidgets, ", ")+" (env HOME_WIDGETS)")
+	flag.Parse()
+	if *configFile != "" {
+		if err := loadConfigFile(*configFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	config.MarkdownExtensions = splitList(*extensions)
+	config.HomeWidgets = splitList(*widgets)
+	config.Languages = splitList(strings.ToLower(*languages))
+	config.AutocertDomains = splitList(strings.ToLower(*autocertDomains))
+	config.TrustedProxies = splitList(*trustedProxies)
+	config.BasePath = strings.TrimRight(*basePath, "/")
+	config.IframeHosts = splitList(strings.ToLower(*iframeHosts))
+	config.UploadExtensions = splitList(strings.ToLower(*uploadExtensions))
+}
+
+// splitList splits a comma separated config value, dropping blanks.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func checkDir(name, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("%s directory %q: %v", name, path, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s directory %q is not a directory", name, path)
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	if c.NewPageConflict != "conflict" && c.NewPageConflict != "overwrite" {
+		return fmt.Errorf(`new page conflict mode %q must be "conflict" or "overwrite"`, c.NewPageConflict)
+	}
+	if _, ok := indexSorts[c.IndexSort]; !ok {
+		return fmt.Errorf(`index sort %q must be "title", "updated", "created" or "views"`, c.IndexSort)
+	}
+	if c.PageJSONBody != "base64" && c.PageJSONBody != "text" {
+		return fmt.Errorf(`page JSON body %q must be "base64" or "text"`, c.PageJSONBody)
+	}
+	if c.SignupRole != roleReader && c.SignupRole != roleEditor {
+		return fmt.Errorf(`signup role %q must be "reader" or "editor"`, c.SignupRole)
+	}
+	if c.MissingPage != "page" && c.MissingPage != "redirect" {
+		return fmt.Errorf(`missing page mode %q must be "page" or "redirect"`, c.MissingPage)
+	}
+	if err := validHomeWidgets(c.HomeWidgets); err != nil {
+		return err
+	}
+	for i, lang := range c.Languages {
+		if !validLanguage.MatchString(lang) {
+			return fmt.Errorf("language %q must be a code like fr or pt-br", lang)
+		}
+		for _, other := range c.Languages[:i] {
+			if other == lang {
+				return fmt.Errorf("language %q is listed twice", lang)
+			}
+		}
+	}
+	if !validBasePath.MatchString(c.BasePath) {
+		return fmt.Errorf("base path %q must start with / and hold only letters, digits and . _ ~ -", c.BasePath)
+	}
+	if !validTablePrefix.MatchString(c.TablePrefix) {
+		return fmt.Errorf("table prefix %q must be up to 32 lowercase letters, digits and underscores, not starting with a digit", c.TablePrefix)
+	}
+	if c.ReadTimeout <= 0 || c.ReadHeaderTimeout <= 0 || c.WriteTimeout <= 0 || c.IdleTimeout <= 0 {
+		return fmt.Errorf("server timeouts must be positive")
+	}
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return fmt.Errorf("listen address %q: %v", c.Listen, err)
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return fmt.Errorf("-tls-cert and -tls-key go together")
+	}
+	if c.TLSCert != "" && len(c.AutocertDomains) > 0 {
+		return fmt.Errorf("-tls-cert and -autocert-domains can't both be set")
+	}
+	if len(c.AutocertDomains) > 0 && c.AutocertCache == "" {
+		return fmt.Errorf("-autocert-domains needs an -autocert-cache directory")
+	}
+	if c.RedirectHTTP != "" {
+		if !c.servingTLS() {
+			return fmt.Errorf("-redirect-http needs -tls-cert or -autocert-domains")
+		}
+		if _, _, err := net.SplitHostPort(c.RedirectHTTP); err != nil {
+			return fmt.Errorf("redirect HTTP address %q: %v", c.RedirectHTTP, err)
+		}
+	}
+	if _, err := parseProxies(c.TrustedProxies); err != nil {
+		return err
+	}
+	// pgx's error repeats the string, password and all
+	if _, err := pgx.ParseConfig(c.DatabaseURL); err != nil {
+		return fmt.Errorf("database URL is not a valid Postgres connection string")
+	}
+	if _, err := pgx.ParseConfig(c.ReplicaURL); c.ReplicaURL != "" && err != nil {
+		return fmt.Errorf("replica URL is not a valid Postgres connection string")
+	}
+	switch c.Store {
+	case storePostgres:
+	case storeFiles, storeSQLite:
+		if c.ReplicaURL != "" {
+			return fmt.Errorf("a replica needs -store postgres")
+		}
+	default:
+		return fmt.Errorf("store %q must be one of %s", c.Store, strings.Join(storeBackends, ", "))
+	}
+	if c.ShutdownTimeout <= 0 {
+		return fmt.Errorf("shutdown timeout %s must be positive", c.ShutdownTimeout)
+	}
+	if c.MaxQueryLength < 0 {
+		return fmt.Errorf("max query length %d must not be negative", c.MaxQueryLength)
+	}
+	if c.SearchBackend != string(searchTrigram) && c.SearchBackend != string(searchFTS) {
+		return fmt.Errorf("search backend %q must be one of %s", c.SearchBackend, strings.Join(searchBackends, ", "))
+	}
+	if !validSearchLanguage.MatchString(c.SearchLanguage) {
+		return fmt.Errorf("search language %q must be the name of a Postgres text search configuration", c.SearchLanguage)
+	}
+	if c.ExpiryInterval < 0 {
+		return fmt.Errorf("expiry interval %v must not be negative", c.ExpiryInterval)
+	}
+	if c.ReplicaLag < 0 {
+		return fmt.Errorf("replica lag %v must not be negative", c.ReplicaLag)
+	}
+	if c.StatementTimeout < 0 || c.StatementTimeout > 0 && c.StatementTimeout < time.Millisecond {
+		return fmt.Errorf("statement timeout must be 0 or at least 1ms")
+	}
+	if c.DBMaxConns < 0 || c.DBMinConns < 0 || c.DBMaxConnLifetime < 0 || c.DBMaxConnIdleTime < 0 {
+		return fmt.Errorf("database pool settings must not be negative")
+	}
+	if c.DBMaxConns > 0 && c.DBMinConns > c.DBMaxConns {
+		return fmt.Errorf("database pool minimum of %d connections is above its maximum of %d", c.DBMinConns, c.DBMaxConns)
+	}
+	if c.SaveQueue < 0 {
+		return fmt.Errorf("save queue of %d must not be negative", c.SaveQueue)
+	}
+	if c.SaveBatch < 1 {
+		return fmt.Errorf("save batch of %d must be at least 1", c.SaveBatch)
+	}
+	if c.SubmissionLogBodies && c.SubmissionLog == "" {
+		return fmt.Errorf("submission log bodies need a -submission-log")
+	}
+	if c.HealthCheckInterval < 0 {
+		return fmt.Errorf("health check interval must not be negative")
+	}
+	if c.ReadyTimeout <= 0 {
+		return fmt.Errorf("ready timeout must be positive")
+	}
+	if c.MaxTitleLength <= 0 {
+		return fmt.Errorf("max title length must be positive")
+	}
+	if c.MaxUploadSize <= 0 || c.UploadQuota < 0 {
+		return fmt.Errorf("max upload size must be positive and the upload quota not negative")
+	}
+	if c.MaxIncludeDepth < 0 || c.MaxIncludes < 0 {
+		return fmt.Errorf("include limits must not be negative")
+	}
+	if c.MaxRenders < 0 {
+		return fmt.Errorf("max renders must not be negative")
+	}
+	if c.RenderCacheTTL < 0 {
+		return fmt.Errorf("render cache TTL must not be negative")
+	}
+	if c.MaxRevisions < 0 || c.MaxRevisionAge < 0 || c.CoalesceEdits < 0 {
+		return fmt.Errorf("revision limits must not be negative")
+	}
+	if c.EditQuota > 0 && c.EditQuotaWindow <= 0 {
+		return fmt.Errorf("edit quota window must be positive")
+	}
+	if c.SMTPAddr != "" || c.NotifyWebhook != "" || c.NotifySlack != "" {
+		if u, err := url.Parse(c.SiteURL); err != nil || u.Host == "" || u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("notifications need -site-url, like https://wiki.example.com")
+		}
+	}
+	if c.SMTPAddr != "" {
+		if _, _, err := net.SplitHostPort(c.SMTPAddr); err != nil {
+			return fmt.Errorf("smtp addr %q must be host:port", c.SMTPAddr)
+		}
+		if _, err := mail.ParseAddress(c.SMTPFrom); err != nil {
+			return fmt.Errorf("-smtp-addr needs an -smtp-from address: %v", err)
+		}
+	}
+	for _, hook := range []string{c.NotifyWebhook, c.NotifySlack} {
+		if u, err := url.Parse(hook); hook != "" && (err != nil || u.Host == "" || u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("notification webhook %q must be an http or https URL", hook)
+		}
+	}
+	if c.TOCMinHeadings < 0 {
+		return fmt.Errorf("toc min headings must not be negative")
+	}
+	if c.ReadRateLimit < 0 || c.WriteRateLimit < 0 {
+		return fmt.Errorf("rate limits must not be negative")
+	}
+	if c.Captcha != "" {
+		if _, ok := captchaProviders[c.Captcha]; !ok {
+			return fmt.Errorf("unknown CAPTCHA %q, expected one of %s", c.Captcha, strings.Join(captchaNames(), ", "))
+		}
+		if c.CaptchaSiteKey == "" || c.CaptchaSecret == "" {
+			return fmt.Errorf("-captcha needs -captcha-site-key and -captcha-secret")
+		}
+	}
+	if c.MaxAnonymousLinks < 0 {
+		return fmt.Errorf("max anonymous links must not be negative")
+	}
+	if u, err := url.Parse(c.SpamClassifier); c.SpamClassifier != "" && (err != nil || u.Host == "" || u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("spam classifier %q must be an http or https URL", c.SpamClassifier)
+	}
+	if c.SpamClassifierTimeout <= 0 {
+		return fmt.Errorf("spam classifier timeout must be positive")
+	}
+	if c.BackupDir != "" {
+		if err := checkDir("backup", c.BackupDir); err != nil {
+			return err
+		}
+		if c.BackupInterval <= 0 || c.BackupRetention < 1 {
+			return fmt.Errorf("backup interval must be positive and at least one backup must be kept")
+		}
+	}
+	if c.BodyCompression != "" && c.BodyCompression != "pglz" && c.BodyCompression != "lz4" {
+		return fmt.Errorf(`body compression %q must be "pglz" or "lz4"`, c.BodyCompression)
+	}
+	if c.GzipBodies < 0 {
+		return fmt.Errorf("gzip bodies threshold must not be negative")
+	}
+	if c.SessionLength <= 0 {
+		return fmt.Errorf("session length must be positive")
+	}
+	if !c.Dev && len(c.CookieSecret) < minCookieSecret {
+		return fmt.Errorf("cookie secret must be at least %d characters outside of dev mode", minCookieSecret)
+	}
+	// embedded assets are used outside of dev mode
+	if c.Dev {
+		if err := checkDir("static", c.StaticDir); err != nil {
+			return err
+		}
+		if err := checkDir("templates", c.TemplateDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
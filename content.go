@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// share of control characters above which a body is taken for binary data
+const maxControlRatio = 0.1
+
+var (
+	errNotUTF8    = errors.New("the text is not valid UTF-8, was a binary file pasted in?")
+	errNULBytes   = errors.New("the text contains NUL bytes, which pages cannot store")
+	errBinaryLike = errors.New("the text is mostly control characters and looks like binary data")
+)
+
+// checkText rejects bodies that look like binary data rather than text.
+func checkText(body []byte) error {
+	if !utf8.Valid(body) {
+		return errNotUTF8
+	}
+	if bytes.IndexByte(body, 0) >= 0 {
+		return errNULBytes
+	}
+	control, total := 0, 0
+	for _, r := range string(body) {
+		total++
+		if (r < 0x20 && r != '\n' && r != '\r' && r != '\t') || r == 0x7f {
+			control++
+		}
+	}
+	if total > 0 && float64(control)/float64(total) > maxControlRatio {
+		return errBinaryLike
+	}
+	return nil
+}
+
+// normalizeText turns CRLF line endings into LF and drops the whitespace at
+// the end of every line and of the text, which then ends in one newline.
+// Lines of fenced code blocks keep their trailing whitespace.
+func normalizeText(body []byte) []byte {
+	lines := bytes.Split(bytes.ReplaceAll(body, []byte("\r\n"), []byte("\n")), []byte("\n"))
+	fence := ""
+	for i, line := range lines {
+		trimmed := string(bytes.TrimLeft(line, " "))
+		switch {
+		case fence != "":
+			if strings.HasPrefix(trimmed, fence) {
+				fence = ""
+			} else {
+				continue
+			}
+		case strings.HasPrefix(trimmed, "```"):
+			fence = "```"
+		case strings.HasPrefix(trimmed, "~~~"):
+			fence = "~~~"
+		}
+		lines[i] = bytes.TrimRight(line, " \t")
+	}
+	out := bytes.TrimRight(bytes.Join(lines, []byte("\n")), " \t\n")
+	if len(out) == 0 {
+		return out
+	}
+	return append(out, '\n')
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const minCookieSecret = 32
+
+var errBadCookie = errors.New("invalid cookie signature")
+
+var devCookieKey struct {
+	once sync.Once
+	key  []byte
+}
+
+// cookieKey returns the signing key, falling back to a per-process random
+// key in dev mode so cookies simply reset on restart.
+func cookieKey() []byte {
+	if config.CookieSecret != "" {
+		return []byte(config.CookieSecret)
+	}
+	devCookieKey.once.Do(func() {
+		devCookieKey.key = make([]byte, minCookieSecret)
+		if _, err := rand.Read(devCookieKey.key); err != nil {
+			panic(err)
+		}
+	})
+	return devCookieKey.key
+}
+
+func signCookie(name, value string) string {
+	mac := hmac.New(sha256.New, cookieKey())
+	mac.Write([]byte(name + "=" + value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// setSignedCookie sets a tamper-proof cookie. It is always HttpOnly and
+// SameSite=Lax, and Secure when the request came in over HTTPS.
+func setSignedCookie(w http.ResponseWriter, r *http.Request, name, value string, maxAge int) {
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(value))
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    encoded + "." + signCookie(name, encoded),
+		Path:     config.BasePath + "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   requestScheme(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// readSignedCookie returns the value of a cookie set by setSignedCookie.
+func readSignedCookie(r *http.Request, name string) (string, error) {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return "", err
+	}
+	i := strings.LastIndexByte(c.Value, '.')
+	if i < 0 {
+		return "", errBadCookie
+	}
+	encoded, sig := c.Value[:i], c.Value[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(signCookie(name, encoded))) {
+		return "", errBadCookie
+	}
+	value, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", errBadCookie
+	}
+	return string(value), nil
+}
+
+// clearCookie removes a cookie set by setSignedCookie.
+func clearCookie(w http.ResponseWriter, r *http.Request, name string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Path:     config.BasePath + "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   requestScheme(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
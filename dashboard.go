@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// rows shown in each list of the dashboard
+const dashboardRows = 10
+
+// most locked and deleted pages the dashboard lists
+const dashboardMaxRows = 100
+
+// DeletedPage is a title with versions in the archive, for the dashboard.
+type DeletedPage struct {
+	Title string
+	// number of archived versions, and when the last one was deleted
+	Versions   int
+	ArchivedAt time.Time
+	// set when a page has the title again, so none can be restored
+	Taken bool
+}
+
+// Dashboard is the data model of /admin.
+type Dashboard struct {
+	Pages     int64
+	Revisions int64
+	Users     int64
+	Archived  int64
+	Largest   []*PageSize
+	Recent    []*Change
+	// pages only some may edit, by title
+	Locked  []*Page
+	Deleted []*DeletedPage
+	// saves turned down by the spam filters since the server started
+	Rejected []*RejectedEdit
+	Message  string
+	Error    string
+}
+
+func loadCounts(ctx context.Context, d *Dashboard, conn db) error {
+	defer timeQuery("loadCounts", time.Now())
+	query := `SELECT (SELECT count(*) FROM ` + table("pages") + `), (SELECT count(*) FROM ` + table("page_revisions") + `),
+		(SELECT count(*) FROM ` + table("users") + `), (SELECT count(*) FROM ` + table("archived_pages") + `)`
+	return conn.QueryRow(ctx, query).Scan(&d.Pages, &d.Revisions, &d.Users, &d.Archived)
+}
+
+func loadLockedPages(ctx context.Context, limit int, conn db) ([]*Page, error) {
+	defer timeQuery("loadLockedPages", time.Now())
+	query := "SELECT title, protection, updated_at FROM " + table("pages") + " WHERE protection <> $1 ORDER BY title LIMIT $2"
+	rows, err := conn.Query(ctx, query, protectAnyone, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pages []*Page
+	for rows.Next() {
+		p := &Page{}
+		if err := rows.Scan(&p.Title, &p.Protection, &p.UpdatedAt); err != nil {
+			return nil, err
+		}
+		pages = append(pages, p)
+	}
+	return pages, rows.Err()
+}
+
+// loadDeletedPages returns the titles in the archive, last deleted first.
+func loadDeletedPages(ctx context.Context, limit int, conn db) ([]*DeletedPage, error) {
+	defer timeQuery("loadDeletedPages", time.Now())
+	query := `SELECT a.title, count(*), max(a.archived_at),
+			EXISTS (SELECT 1 FROM ` + table("pages") + ` p WHERE p.title = a.title)
+		FROM ` + table("archived_pages") + ` a GROUP BY a.title ORDER BY max(a.archived_at) DESC, a.title LIMIT $1`
+	rows, err := conn.Query(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deleted []*DeletedPage
+	for rows.Next() {
+		d := &DeletedPage{}
+		if err := rows.Scan(&d.Title, &d.Versions, &d.ArchivedAt, &d.Taken); err != nil {
+			return nil, err
+		}
+		deleted = append(deleted, d)
+	}
+	return deleted, rows.Err()
+}
+
+// purgeArchived deletes every archived version of title for good, along
+// with the history and comments of those no page holds anymore. It returns
+// how many versions there were.
+func purgeArchived(ctx context.Context, title string, conn db) (int, error) {
+	defer timeQuery("purgeArchived", time.Now())
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, "DELETE FROM "+table("archived_pages")+" WHERE title = $1 RETURNING page_id", title)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	// a page restored and deleted again under another title keeps its id,
+	// and so its history
+	for _, name := range []string{"page_revisions", "comments"} {
+		query := `DELETE FROM ` + table(name) + ` t WHERE t.page_id = ANY($1)
+			AND NOT EXISTS (SELECT 1 FROM ` + table("pages") + ` p WHERE p.id = t.page_id)
+			AND NOT EXISTS (SELECT 1 FROM ` + table("archived_pages") + ` a WHERE a.page_id = t.page_id)`
+		if _, err := tx.Exec(ctx, query, ids); err != nil {
+			return 0, err
+		}
+	}
+	return len(ids), tx.Commit(ctx)
+}
+
+func renderDashboard(w http.ResponseWriter, r *http.Request, status int, d *Dashboard, conn db) {
+	ctx := r.Context()
+	err := loadCounts(ctx, d, conn)
+	if err == nil {
+		d.Largest, err = loadLargestPages(r.Context(), conn, dashboardRows)
+	}
+	if err == nil {
+		d.Recent, err = loadRecentChanges(r.Context(), dashboardRows, 0, conn)
+	}
+	if err == nil {
+		d.Locked, err = loadLockedPages(ctx, dashboardMaxRows, conn)
+	}
+	if err == nil {
+		d.Deleted, err = loadDeletedPages(ctx, dashboardMaxRows, conn)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	d.Rejected = rejectedEdits.recent()
+	renderTemplateStatus(w, r, status, "dashboard", d)
+}
+
+// dashboardHandler shows admins how the wiki is doing at /admin, and
+// purges the deleted versions of a page on POST with action=purge. Deleted
+// pages are restored through /restore/{title}.
+func dashboardHandler(w http.ResponseWriter, r *http.Request, conn db) {
+	d := &Dashboard{}
+	if r.Method != http.MethodPost {
+		renderDashboard(w, r, http.StatusOK, d, conn)
+		return
+	}
+	title := strings.TrimSpace(r.FormValue("title"))
+	if r.FormValue("action") != "purge" {
+		d.Error = "Choose something to do."
+		renderDashboard(w, r, http.StatusBadRequest, d, conn)
+		return
+	}
+	n, err := purgeArchived(r.Context(), title, conn)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n == 0 {
+		d.Error = fmt.Sprintf("%s has no deleted versions.", title)
+		renderDashboard(w, r, http.StatusNotFound, d, conn)
+		return
+	}
+	d.Message = fmt.Sprintf("Purged %d deleted versions of %s.", n, title)
+	if n == 1 {
+		d.Message = fmt.Sprintf("Purged the deleted version of %s.", title)
+	}
+	renderDashboard(w, r, http.StatusOK, d, conn)
+}
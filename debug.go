@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// number of recovered errors kept for /debug/errors
+const maxRecentErrors = 20
+
+type RecoveredError struct {
+	Time    time.Time
+	Method  string
+	Path    string
+	Message string
+	Stack   []byte
+}
+
+// errorLog is a fixed-size ring buffer of the most recent recovered panics.
+type errorLog struct {
+	mu      sync.Mutex
+	entries []*RecoveredError
+	next    int
+	panics  int64
+}
+
+var recentErrors = &errorLog{entries: make([]*RecoveredError, 0, maxRecentErrors)}
+
+func (l *errorLog) add(e *RecoveredError) {
+	atomic.AddInt64(&l.panics, 1)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.entries) < cap(l.entries) {
+		l.entries = append(l.entries, e)
+		return
+	}
+	l.entries[l.next] = e
+	l.next = (l.next + 1) % len(l.entries)
+}
+
+// recent returns the buffered errors, newest first.
+func (l *errorLog) recent() []*RecoveredError {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]*RecoveredError, 0, len(l.entries))
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		out = append(out, l.entries[(l.next+i)%len(l.entries)])
+	}
+	return out
+}
+
+func (l *errorLog) count() int64 {
+	return atomic.LoadInt64(&l.panics)
+}
+
+// recoverPanics turns a panicking handler into a 500 and records the panic.
+func recoverPanics(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				// deliberate abort, let net/http handle it
+				panic(v)
+			}
+			stack := debug.Stack()
+			log.Printf("panic serving %s %s: %v\n%s", r.Method, r.URL.Path, v, stack)
+			recentErrors.add(&RecoveredError{
+				Time:    time.Now(),
+				Method:  r.Method,
+				Path:    r.URL.Path,
+				Message: fmt.Sprint(v),
+				Stack:   stack,
+			})
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+func debugErrorsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "recovered panics: %d\n", recentErrors.count())
+	fmt.Fprintf(w, "slow queries: %d\n", atomic.LoadInt64(&slowQueries))
+	fmt.Fprintf(w, "renders in flight: %d, shed %d\n", atomic.LoadInt64(&rendersInFlight), atomic.LoadInt64(&shedRenders))
+	fmt.Fprintf(w, "dropped views: %d\n", atomic.LoadInt64(&droppedViews))
+	fmt.Fprintf(w, "dropped notifications: %d\n", atomic.LoadInt64(&droppedChanges))
+	fmt.Fprintf(w, "queued saves: %d of %d, waited for room %d times, dropped %d\n", len(saveQueue), cap(saveQueue), atomic.LoadInt64(&saveQueueFull), atomic.LoadInt64(&droppedSaves))
+	fmt.Fprintf(w, "include limits: depth %d, %d pages per render, reached %d times\n", config.MaxIncludeDepth, config.MaxIncludes, atomic.LoadInt64(&includeLimitsHit))
+	for _, e := range recentErrors.recent() {
+		fmt.Fprintf(w, "\n%s %s %s\n%s\n%s", e.Time.Format(time.RFC3339), e.Method, e.Path, e.Message, e.Stack)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"strings"
+)
+
+// unchanged lines shown around each change in a compacted diff
+const diffContext = 3
+
+// above this many line pairs the diff gives up on finding common lines and
+// shows a plain replacement, to bound the time and memory it takes
+const maxDiffCells = 4 << 20
+
+// DiffLine is one line of a line-based diff. Op is "=" for a line both
+// sides have, "-" for a removed line, "+" for an added one and "…" for a
+// run of unchanged lines left out.
+type DiffLine struct {
+	Op   string
+	Text string
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines compares a and b line by line using their longest common
+// subsequence.
+func diffLines(a, b string) []DiffLine {
+	x, y := splitLines(a), splitLines(b)
+
+	// common prefix and suffix are cheap to peel off and usually most of
+	// the page
+	var head, tail []DiffLine
+	for len(x) > 0 && len(y) > 0 && x[0] == y[0] {
+		head = append(head, DiffLine{"=", x[0]})
+		x, y = x[1:], y[1:]
+	}
+	for len(x) > 0 && len(y) > 0 && x[len(x)-1] == y[len(y)-1] {
+		tail = append(tail, DiffLine{"=", x[len(x)-1]})
+		x, y = x[:len(x)-1], y[:len(y)-1]
+	}
+
+	out := head
+	if (len(x)+1)*(len(y)+1) > maxDiffCells {
+		for _, l := range x {
+			out = append(out, DiffLine{"-", l})
+		}
+		for _, l := range y {
+			out = append(out, DiffLine{"+", l})
+		}
+	} else {
+		out = append(out, lcsDiff(x, y)...)
+	}
+	for i := len(tail) - 1; i >= 0; i-- {
+		out = append(out, tail[i])
+	}
+	return out
+}
+
+func lcsDiff(x, y []string) []DiffLine {
+	// lcs[i][j] is the length of the longest common subsequence of x[i:]
+	// and y[j:]
+	w := len(y) + 1
+	lcs := make([]int, (len(x)+1)*w)
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i*w+j] = lcs[(i+1)*w+j+1] + 1
+			} else if lcs[(i+1)*w+j] >= lcs[i*w+j+1] {
+				lcs[i*w+j] = lcs[(i+1)*w+j]
+			} else {
+				lcs[i*w+j] = lcs[i*w+j+1]
+			}
+		}
+	}
+	var out []DiffLine
+	i, j := 0, 0
+	for i < len(x) && j < len(y) {
+		switch {
+		case x[i] == y[j]:
+			out = append(out, DiffLine{"=", x[i]})
+			i++
+			j++
+		case lcs[(i+1)*w+j] >= lcs[i*w+j+1]:
+			out = append(out, DiffLine{"-", x[i]})
+			i++
+		default:
+			out = append(out, DiffLine{"+", y[j]})
+			j++
+		}
+	}
+	for ; i < len(x); i++ {
+		out = append(out, DiffLine{"-", x[i]})
+	}
+	for ; j < len(y); j++ {
+		out = append(out, DiffLine{"+", y[j]})
+	}
+	return out
+}
+
+// compactDiff keeps only the changed lines and up to context unchanged
+// lines around them, replacing each longer unchanged run with one "…" line.
+func compactDiff(lines []DiffLine, context int) []DiffLine {
+	keep := make([]bool, len(lines))
+	for i, l := range lines {
+		if l.Op == "=" {
+			continue
+		}
+		for k := i - context; k <= i+context; k++ {
+			if k >= 0 && k < len(lines) {
+				keep[k] = true
+			}
+		}
+	}
+	var out []DiffLine
+	for i, l := range lines {
+		if keep[i] {
+			out = append(out, l)
+		} else if len(out) == 0 || out[len(out)-1].Op != "…" {
+			out = append(out, DiffLine{Op: "…"})
+		}
+	}
+	return out
+}
+
+// changed reports whether a diff has any added or removed lines.
+func changed(lines []DiffLine) bool {
+	for _, l := range lines {
+		if l.Op != "=" && l.Op != "…" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Draft is a version of a page kept apart from it until its author
+// publishes it. Each account keeps at most one draft of a page.
+type Draft struct {
+	Title   string
+	Author  string
+	Summary string
+	// the version of the page the draft was started from, 0 for a page that
+	// didn't exist yet, so publishing notices saves made since
+	BaseVersion int64
+	SavedAt     time.Time
+	// only loaded for a single draft
+	Body []byte
+}
+
+func saveDraft(ctx context.Context, d *Draft, conn db) error {
+	defer timeQuery("saveDraft", time.Now())
+	query := `INSERT INTO ` + table("drafts") + ` (title, author, body, summary, base_version) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (title, author) DO UPDATE SET body = $3, summary = $4, base_version = $5, saved_at = now()
+		RETURNING saved_at`
+	return conn.QueryRow(ctx, query, d.Title, d.Author, d.Body, d.Summary, d.BaseVersion).Scan(&d.SavedAt)
+}
+
+func loadDraft(ctx context.Context, title, author string, conn db) (*Draft, error) {
+	defer timeQuery("loadDraft", time.Now())
+	query := "SELECT body, summary, base_version, saved_at FROM " + table("drafts") + " WHERE title = $1 AND author = $2"
+	d := &Draft{Title: title, Author: author}
+	err := conn.QueryRow(ctx, query, title, author).Scan(&d.Body, &d.Summary, &d.BaseVersion, &d.SavedAt)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// loadDrafts returns the drafts of title without their bodies, newest
+// first.
+func loadDrafts(ctx context.Context, title string, conn db) ([]*Draft, error) {
+	defer timeQuery("loadDrafts", time.Now())
+	query := "SELECT author, summary, base_version, saved_at FROM " + table("drafts") + " WHERE title = $1 ORDER BY saved_at DESC, author"
+	rows, err := conn.Query(ctx, query, title)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var drafts []*Draft
+	for rows.Next() {
+		d := &Draft{Title: title}
+		if err := rows.Scan(&d.Author, &d.Summary, &d.BaseVersion, &d.SavedAt); err != nil {
+			return nil, err
+		}
+		drafts = append(drafts, d)
+	}
+	return drafts, rows.Err()
+}
+
+func deleteDraft(ctx context.Context, title, author string, conn db) error {
+	defer timeQuery("deleteDraft", time.Now())
+	query := "DELETE FROM " + table("drafts") + " WHERE title = $1 AND author = $2"
+	_, err := conn.Exec(ctx, query, title, author)
+	return err
+}
+
+// moveDrafts follows a rename of a page from title to newTitle. Drafts the
+// same author already has of newTitle keep it, and the others stay behind.
+func moveDrafts(ctx context.Context, title, newTitle string, conn db) error {
+	query := `UPDATE ` + table("drafts") + ` d SET title = $2 WHERE title = $1
+		AND NOT EXISTS (SELECT 1 FROM ` + table("drafts") + ` o WHERE o.title = $2 AND o.author = d.author)`
+	_, err := conn.Exec(ctx, query, title, newTitle)
+	return err
+}
+
+// viewDrafts is the drafts of p the viewer may open from the view page:
+// their own, or every one for admins. They are only a notice on the page,
+// so a failure is logged and leaves them out.
+func viewDrafts(u *User, p *Page, store PageStore) []*Draft {
+	if u == nil {
+		return nil
+	}
+	drafts, err := store.Drafts(p.Title)
+	if err != nil {
+		log.Printf("loading the drafts of %s: %v", p.Title, err)
+		return nil
+	}
+	if u.IsAdmin() {
+		return drafts
+	}
+	for _, d := range drafts {
+		if d.Author == u.Name {
+			return []*Draft{d}
+		}
+	}
+	return nil
+}
+
+// DraftView is the data model of /draft/{title}.
+type DraftView struct {
+	Draft *Draft
+	HTML  template.HTML
+	// whether the viewer wrote the draft, and so may publish it
+	Own bool
+	// set when the page was saved after the draft was started
+	Outdated bool
+}
+
+// draftHandler shows a draft of title to its author, or to an admin with
+// ?author=, and publishes or discards it on POST with action=publish or
+// action=discard. Only the author can publish; admins may discard any.
+func draftHandler(w http.ResponseWriter, r *http.Request, title string, store PageStore) {
+	u := currentUser(r)
+	if u == nil {
+		a := &Account{Next: "/", Error: "Log in to see your drafts.", Signups: config.Signups}
+		if r.Method == http.MethodGet {
+			a.Next = r.URL.Path
+		}
+		renderTemplateStatus(w, r, http.StatusUnauthorized, "login", a)
+		return
+	}
+	author := u.Name
+	if other := r.FormValue("author"); other != "" && other != u.Name {
+		if !u.IsAdmin() {
+			http.Error(w, "drafts are only shown to their author", http.StatusForbidden)
+			return
+		}
+		author = other
+	}
+	d, err := store.Draft(title, author)
+	if err == errNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	own := author == u.Name
+	if r.Method == http.MethodPost {
+		switch r.FormValue("action") {
+		case "publish":
+			if !own {
+				http.Error(w, "only its author can publish a draft", http.StatusForbidden)
+				return
+			}
+			publishDraft(w, r, d, store)
+		case "discard":
+			if err := store.DeleteDraft(title, author); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			redirect(w, r, pagePath("view", title), http.StatusSeeOther)
+		default:
+			http.Error(w, "unknown action", http.StatusBadRequest)
+		}
+		return
+	}
+	dv := &DraftView{Draft: d, Own: own}
+	if stored, err := store.Stat(title); err == nil {
+		dv.Outdated = stored.Version != d.BaseVersion
+	} else if err != errNotFound {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else {
+		dv.Outdated = d.BaseVersion != 0
+	}
+	// drafts are seen by one person, so they skip the render cache
+	if err := acquireRender(); err != nil {
+		renderFailed(w, err)
+		return
+	}
+	dv.HTML, err = newInclusion(store).render(&Page{Title: title, Body: d.Body})
+	releaseRender()
+	if err != nil {
+		renderFailed(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "private, no-cache")
+	renderTemplate(w, r, "draft", dv)
+}
+
+// publishDraft saves d as the live version of its page, as an edit by its
+// author, and drops the draft. Saves made since the draft was started are
+// a conflict, shown in the edit form holding the draft.
+func publishDraft(w http.ResponseWriter, r *http.Request, d *Draft, store PageStore) {
+	p := &Page{Title: d.Title, Body: d.Body, UpdatedBy: editorName(r), Summary: d.Summary, FromDraft: true}
+	if d.BaseVersion > 0 {
+		p.Version, p.BaseVersion = d.BaseVersion, d.BaseVersion
+	} else {
+		p.New = config.NewPageConflict == "conflict"
+	}
+	v := validateSave(p)
+	if v.Failed() {
+		v.Message = "Your draft could not be published:"
+		rejectSave(w, r, http.StatusBadRequest, p, v)
+		return
+	}
+	level := protectAnyone
+	if stored, err := store.Stat(d.Title); err == nil {
+		level = stored.Protection
+	} else if err != errNotFound {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !checkEdit(w, r, level) || !checkQuota(w, r, p) {
+		return
+	}
+	if !savePage(w, r, p, p, store) {
+		return
+	}
+	redirect(w, r, pagePath("view", d.Title), http.StatusSeeOther)
+}
+
+// keepDraft stores the form p as the signed-in user's draft of its page
+// instead of saving it.
+func keepDraft(w http.ResponseWriter, r *http.Request, p *Page, store PageStore) {
+	u := currentUser(r)
+	if u == nil {
+		rejectSave(w, r, http.StatusUnauthorized, p, &Validation{Message: "Log in to keep drafts."})
+		return
+	}
+	if p.Section != "" {
+		rejectSave(w, r, http.StatusBadRequest, p, &Validation{Message: "Drafts hold whole pages; edit the whole page to keep one."})
+		return
+	}
+	d := &Draft{Title: p.Title, Author: u.Name, Body: p.Body, Summary: p.Summary, BaseVersion: p.BaseVersion}
+	if err := store.SaveDraft(d); err != nil {
+		rejectSave(w, r, http.StatusInternalServerError, p, &Validation{Message: "Your draft could not be kept: " + err.Error()})
+		return
+	}
+	redirect(w, r, pagePath("draft", p.Title), http.StatusSeeOther)
+}
+
+// openDraft puts the signed-in user's draft of p into the edit form, for
+// /edit/{title}?draft=1.
+func openDraft(w http.ResponseWriter, r *http.Request, p *Page, store PageStore) bool {
+	u := currentUser(r)
+	if u == nil {
+		http.NotFound(w, r)
+		return false
+	}
+	d, err := store.Draft(p.Title, u.Name)
+	if err == errNotFound {
+		http.NotFound(w, r)
+		return false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	// the form goes on from the version the draft was started at, so saving
+	// it is a conflict when the page changed since
+	p.Body, p.Summary, p.Version, p.FromDraft = d.Body, d.Summary, d.BaseVersion, true
+	p.New = d.BaseVersion == 0 && config.NewPageConflict == "conflict"
+	return true
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// interval of the comments that keep idle event streams from being cut by
+// proxies
+const eventKeepalive = 30 * time.Second
+
+// pageEvent tells the editors of a page that it changed underneath them.
+// Type is "saved", "deleted", "restored" or "renamed", to To.
+type pageEvent struct {
+	Type    string `json:"type"`
+	Title   string `json:"title"`
+	Version int64  `json:"version,omitempty"`
+	By      string `json:"by,omitempty"`
+	To      string `json:"to,omitempty"`
+}
+
+// eventHub hands page events to the streams of the page's open editors.
+// Only writes made through this process are seen.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[string]map[chan pageEvent]bool
+	// closed when the server shuts down, ending every stream
+	done chan struct{}
+}
+
+var pageEvents = &eventHub{subs: map[string]map[chan pageEvent]bool{}, done: make(chan struct{})}
+
+// subscribe returns the events of the page called title, until cancel is
+// called.
+func (h *eventHub) subscribe(title string) (events chan pageEvent, cancel func()) {
+	events = make(chan pageEvent, 8)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[title] == nil {
+		h.subs[title] = map[chan pageEvent]bool{}
+	}
+	h.subs[title][events] = true
+	return events, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subs[title], events)
+		if len(h.subs[title]) == 0 {
+			delete(h.subs, title)
+		}
+	}
+}
+
+// closeStreams ends the open streams, which would otherwise keep a shutdown
+// waiting until it times out. Browsers reconnect to the next server.
+func (h *eventHub) closeStreams() {
+	close(h.done)
+}
+
+// publish sends e to the subscribers of its page. A subscriber that is
+// behind misses it rather than holding up the write.
+func (h *eventHub) publish(e pageEvent) {
+	if !config.PageEvents {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for events := range h.subs[e.Title] {
+		select {
+		case events <- e:
+		default:
+		}
+	}
+}
+
+// announceWrites publishes the saves and archives of a committed batch.
+// Relinks may change any page and are left out.
+func announceWrites(writes []PageWrite) {
+	for _, w := range writes {
+		switch w.op {
+		case opSave:
+			pageEvents.publish(pageEvent{Type: "saved", Title: w.page.Title, Version: w.page.Version, By: w.page.UpdatedBy})
+			queueChange(w.page)
+		case opArchive:
+			pageEvents.publish(pageEvent{Type: "deleted", Title: w.title})
+		}
+	}
+}
+
+func writeEvent(w io.Writer, e pageEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+	return err
+}
+
+// eventsHandler streams the events of a page as Server-Sent Events to its
+// editor, until the client goes away. With ?version=N, the version the
+// editor was opened at, a change made before the stream opened is sent
+// straight away.
+func eventsHandler(w http.ResponseWriter, r *http.Request, title string, store PageStore) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	events, cancel := pageEvents.subscribe(title)
+	defer cancel()
+
+	var missed *pageEvent
+	if v, err := strconv.ParseInt(r.URL.Query().Get("version"), 10, 64); err == nil {
+		p, err := store.Stat(title)
+		switch {
+		case err == nil && p.Version != v:
+			missed = &pageEvent{Type: "saved", Title: title, Version: p.Version, By: p.UpdatedBy}
+		case err == errNotFound && v > 0:
+			missed = &pageEvent{Type: "deleted", Title: title}
+		case err != nil && err != errNotFound:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// -write-timeout is meant for ordinary responses, not streams
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	// stops nginx from buffering the stream
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, ": listening\n\n")
+	if missed != nil {
+		writeEvent(w, *missed)
+	}
+	f.Flush()
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-pageEvents.done:
+			return
+		case e := <-events:
+			err = writeEvent(w, e)
+		case <-keepalive.C:
+			_, err = io.WriteString(w, ": keepalive\n\n")
+		}
+		if err != nil {
+			return
+		}
+		f.Flush()
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// formats of the `expires:` front matter field; a bare date is midnight UTC
+var expiryFormats = []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02"}
+
+// pageExpiry reads the `expires:` front matter field of a body, nil when the
+// page never expires.
+func pageExpiry(body []byte) (*time.Time, error) {
+	fm, _ := parseFrontMatter(body)
+	v, ok := fm.get("expires")
+	if !ok || v == "" {
+		return nil, nil
+	}
+	for _, layout := range expiryFormats {
+		if t, err := time.Parse(layout, v); err == nil {
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("the expiry %q is not a date like 2024-12-31 or a time like 2024-12-31T18:00:00Z", v)
+}
+
+// setPageExpiry rewrites the expires front matter field of a body; an empty
+// value removes it.
+func setPageExpiry(body []byte, value string) []byte {
+	fm, rest := parseFrontMatter(body)
+	fm.set("expires", value)
+	return fm.join(rest)
+}
+
+// Expires is the expires front matter field as written, for the editor.
+func (p *Page) Expires() string {
+	fm, _ := parseFrontMatter(p.Body)
+	v, _ := fm.get("expires")
+	return v
+}
+
+// Expired reports whether the page is past its expiry and only waits for
+// runExpiry to archive it.
+func (p *Page) Expired() bool {
+	return p.ExpiresAt != nil && !p.ExpiresAt.After(time.Now())
+}
+
+// runExpiry archives expired pages every interval until ctx is done, on its
+// own connection.
+func runExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			titles, err := archiveExpired(ctx)
+			if err != nil {
+				log.Printf("archiving expired pages: %v", err)
+			}
+			if len(titles) > 0 {
+				log.Printf("archived %d expired pages: %v", len(titles), titles)
+			}
+		}
+	}
+}
+
+// archiveExpired archives every page past its expiry, as archivePage does,
+// and returns their titles. The pages are locked from the start, so a page
+// renewed by a save at the same time is either saved first and kept or
+// archived first.
+func archiveExpired(ctx context.Context) ([]string, error) {
+	conn, err := connectDB(ctx, config.StatementTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(context.Background())
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// now() is the same throughout the transaction
+	if err := inflateBodies(ctx, tx, "expires_at <= now()"); err != nil {
+		return nil, err
+	}
+	query := `WITH deleted AS (DELETE FROM ` + table("pages") + ` WHERE expires_at <= now() RETURNING id, title, body, created_at, updated_at)
+		INSERT INTO ` + table("archived_pages") + ` (page_id, title, body, created_at, updated_at)
+		SELECT id, title, body, created_at, updated_at FROM deleted
+		RETURNING title`
+	titles, err := queryStrings(ctx, tx, query)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	renders.invalidate(titles...)
+	return titles, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// exportPages writes every page as <title>.md into a zip archive, with the
+// timestamps added to the front matter. It returns the number of pages
+// written.
+func exportPages(ctx context.Context, w io.Writer, conn db) (int, error) {
+	query := "SELECT title, created_at, updated_at, " + bodyColumns + " FROM " + table("pages") + " ORDER BY title"
+	rows, err := conn.Query(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	zw := zip.NewWriter(w)
+	n := 0
+	for rows.Next() {
+		p := &Page{}
+		var stored storedBody
+		if err := rows.Scan(stored.dest(&p.Title, &p.CreatedAt, &p.UpdatedAt)...); err != nil {
+			return n, err
+		}
+		var err error
+		if p.Body, err = stored.bytes(); err != nil {
+			return n, fmt.Errorf("%s: %w", p.Title, err)
+		}
+		fm, body := parseFrontMatter(p.Body)
+		fm.set("title", p.Title)
+		fm.set("created", p.CreatedAt.UTC().Format(time.RFC3339))
+		fm.set("updated", p.UpdatedAt.UTC().Format(time.RFC3339))
+
+		f, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     p.Title + ".md",
+			Method:   zip.Deflate,
+			Modified: p.UpdatedAt,
+		})
+		if err != nil {
+			return n, err
+		}
+		if _, err := f.Write(fm.join(body)); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return n, err
+	}
+	return n, zw.Close()
+}
+
+// exportHandler downloads the zip of exportPages, for backing up the wiki
+// or moving it elsewhere with the import command. The zip is streamed as it
+// is written, so a failure midway can only abort the download.
+func exportHandler(w http.ResponseWriter, r *http.Request, conn db) {
+	name := "wiki-" + time.Now().UTC().Format("2006-01-02") + ".zip"
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodHead {
+		return
+	}
+	n, err := exportPages(r.Context(), w, conn)
+	if err != nil {
+		log.Printf("export failed after %d pages: %v", n, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// importPages saves every <title>.md file of fsys as a page, in one
+// transaction, those in subdirectories as pages under others, like
+// Projects/GoWiki.md. It reads what exportPages writes: a title in the front
+// matter wins over the file name, and the exported timestamps are dropped
+// since saving sets its own. So is the rest of what the files store adds,
+// so its directory imports the same way.
+func importPages(fsys fs.FS, store PageStore) (int, error) {
+	var names []string
+	err := fs.WalkDir(fsys, ".", func(name string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		hidden := strings.HasPrefix(e.Name(), ".") && name != "."
+		if e.IsDir() && hidden {
+			return fs.SkipDir
+		}
+		if !e.IsDir() && !hidden && strings.HasSuffix(name, ".md") {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var writes []PageWrite
+	for _, name := range names {
+		body, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return 0, err
+		}
+		fm, rest := parseFrontMatter(body)
+		title, ok := fm.get("title")
+		if !ok {
+			title = strings.TrimSuffix(name, ".md")
+		}
+		// file names written on macOS come decomposed
+		title = canonicalTitle(title)
+		if err := checkTitle(title); err != nil {
+			return 0, fmt.Errorf("%s: %v", name, err)
+		}
+		for _, key := range fileStoreKeys {
+			fm.set(key, "")
+		}
+		p := &Page{Title: title, Body: fm.join(rest)}
+		if err := checkText(p.Body); err != nil {
+			return 0, fmt.Errorf("%s: %v", name, err)
+		}
+		writes = append(writes, saveWrite(p))
+	}
+	if err := store.Apply(writes...); err != nil {
+		return 0, err
+	}
+	return len(names), nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+)
+
+const frontMatterDelim = "---"
+
+// frontMatter is the optional block of `key: value` lines between `---`
+// delimiters at the top of a page body. Lines are kept verbatim so unknown
+// keys survive a rewrite.
+type frontMatter struct {
+	lines []string
+}
+
+// parseFrontMatter splits a body into its front matter and the rest. The
+// front matter is empty when the body has none.
+func parseFrontMatter(body []byte) (*frontMatter, []byte) {
+	fm := &frontMatter{}
+	text := string(body)
+	first := strings.TrimRight(firstLine(text), "\r")
+	if first != frontMatterDelim {
+		return fm, body
+	}
+	rest := text[len(firstLine(text)):]
+	rest = strings.TrimPrefix(rest, "\n")
+	var lines []string
+	for rest != "" {
+		line := firstLine(rest)
+		rest = strings.TrimPrefix(rest[len(line):], "\n")
+		line = strings.TrimRight(line, "\r")
+		if line == frontMatterDelim {
+			fm.lines = lines
+			return fm, []byte(rest)
+		}
+		lines = append(lines, line)
+	}
+	// no closing delimiter, so it was never front matter
+	return fm, body
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+func splitField(line string) (string, string, bool) {
+	i := strings.IndexByte(line, ':')
+	if i < 0 {
+		return "", "", false
+	}
+	return strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]), true
+}
+
+func (fm *frontMatter) get(key string) (string, bool) {
+	for _, line := range fm.lines {
+		if k, v, ok := splitField(line); ok && strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// set replaces or appends key; an empty value removes it.
+func (fm *frontMatter) set(key, value string) {
+	var lines []string
+	found := false
+	for _, line := range fm.lines {
+		if k, _, ok := splitField(line); ok && strings.EqualFold(k, key) {
+			if !found && value != "" {
+				lines = append(lines, key+": "+value)
+			}
+			found = true
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if !found && value != "" {
+		lines = append(lines, key+": "+value)
+	}
+	fm.lines = lines
+}
+
+// join puts the front matter back on top of body, dropping it entirely when
+// it has no lines left.
+func (fm *frontMatter) join(body []byte) []byte {
+	if len(fm.lines) == 0 {
+		return body
+	}
+	var b bytes.Buffer
+	b.WriteString(frontMatterDelim + "\n")
+	for _, line := range fm.lines {
+		b.WriteString(line + "\n")
+	}
+	b.WriteString(frontMatterDelim + "\n")
+	b.Write(body)
+	return b.Bytes()
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// wikiLinkCandidate is anything bracketed like a [[link]], and codeSpan an
+// inline `code` span, whose brackets are never links.
+var (
+	wikiLinkCandidate = regexp.MustCompile(`\[\[([^\]\n]*)\]\]`)
+	codeSpan          = regexp.MustCompile("`[^`\n]*`")
+)
+
+// unparsedLinks lists the [[...]] in body that don't make valid links and
+// are shown as written, outside of code.
+func unparsedLinks(body []byte) []string {
+	var bad []string
+	fence := ""
+	for _, line := range strings.Split(string(body), "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		switch {
+		case fence != "":
+			if strings.HasPrefix(trimmed, fence) {
+				fence = ""
+			}
+			continue
+		case strings.HasPrefix(trimmed, "```"):
+			fence = "```"
+			continue
+		case strings.HasPrefix(trimmed, "~~~"):
+			fence = "~~~"
+			continue
+		}
+		line = codeSpan.ReplaceAllString(line, "")
+		for _, m := range wikiLinkCandidate.FindAllStringSubmatch(line, -1) {
+			if _, _, _, ok := parseWikiLink([]byte(m[1])); !ok {
+				bad = append(bad, m[0])
+			}
+		}
+	}
+	return bad
+}
+
+// fsckCheck is one invariant fsck verifies: query lists what breaks it, one
+// problem per row as text, and fix, if set, repairs all of them. inflate is
+// the condition on pages p of those whose bodies fix reads, which are first
+// stored as text if they are gzipped.
+type fsckCheck struct {
+	name    string
+	query   string
+	fix     string
+	inflate string
+}
+
+func fsckChecks() []fsckCheck {
+	return []fsckCheck{
+		{
+			name:  "pages without a revision",
+			query: "SELECT p.title FROM " + table("pages") + " p WHERE NOT EXISTS (SELECT 1 FROM " + table("page_revisions") + " r WHERE r.page_id = p.id) ORDER BY p.title",
+			// the current body is the best first revision there is
+			fix:     "INSERT INTO " + table("page_revisions") + " (page_id, body, author, created_at, summary) SELECT p.id, p.body, p.updated_by, p.updated_at, 'Recorded by fsck' FROM " + table("pages") + " p WHERE NOT EXISTS (SELECT 1 FROM " + table("page_revisions") + " r WHERE r.page_id = p.id)",
+			inflate: "NOT EXISTS (SELECT 1 FROM " + table("page_revisions") + " r WHERE r.page_id = p.id)",
+		},
+		{
+			// revisions of archived pages are kept on purpose
+			name:  "revisions of no page",
+			query: "SELECT 'page id ' || r.page_id || ', ' || count(*) || ' revisions' FROM " + table("page_revisions") + " r WHERE NOT EXISTS (SELECT 1 FROM " + table("pages") + " p WHERE p.id = r.page_id) AND NOT EXISTS (SELECT 1 FROM " + table("archived_pages") + " a WHERE a.page_id = r.page_id) GROUP BY r.page_id ORDER BY r.page_id",
+		},
+		{
+			name:  "titles differing only in case",
+			query: "SELECT string_agg(title, ', ' ORDER BY title) FROM " + table("pages") + " GROUP BY lower(title) HAVING count(*) > 1 ORDER BY lower(title)",
+		},
+	}
+}
+
+// fsck checks the invariants of the database, repairing the safe ones with
+// fix, and reports what it found. It returns the number of problems left.
+func fsck(conn db, fix bool) (int, error) {
+	ctx := context.Background()
+	left := 0
+	for _, c := range fsckChecks() {
+		problems, err := queryStrings(ctx, conn, c.query)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", c.name, err)
+		}
+		fmt.Printf("%s: %d\n", c.name, len(problems))
+		for _, p := range problems {
+			fmt.Printf("  %s\n", p)
+		}
+		if len(problems) == 0 {
+			continue
+		}
+		if fix && c.fix != "" {
+			n, err := fsckFix(ctx, c, conn)
+			if err != nil {
+				return 0, fmt.Errorf("fixing %s: %w", c.name, err)
+			}
+			fmt.Printf("  fixed %d\n", n)
+			continue
+		}
+		left += len(problems)
+	}
+
+	// links are checked in Go, with the parser pages are rendered with
+	rows, err := conn.Query(ctx, "SELECT title, "+bodyColumns+" FROM "+table("pages")+" ORDER BY title")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var bad []string
+	for rows.Next() {
+		var title string
+		var stored storedBody
+		if err := rows.Scan(stored.dest(&title)...); err != nil {
+			return 0, err
+		}
+		body, err := stored.bytes()
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", title, err)
+		}
+		for _, link := range unparsedLinks(body) {
+			bad = append(bad, title+": "+link)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	fmt.Printf("links that don't parse: %d\n", len(bad))
+	for _, b := range bad {
+		fmt.Printf("  %s\n", b)
+	}
+	return left + len(bad), nil
+}
+
+// fsckFix runs the fix of c, returning the number of rows it changed.
+func fsckFix(ctx context.Context, c fsckCheck, conn db) (int64, error) {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+	if c.inflate != "" {
+		if err := inflateBodies(ctx, tx, c.inflate); err != nil {
+			return 0, err
+		}
+	}
+	tag, err := tx.Exec(ctx, c.fix)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), tx.Commit(ctx)
+}
+
+func queryStrings(ctx context.Context, conn db, query string, args ...interface{}) ([]string, error) {
+	rows, err := conn.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+func fsckCommand(conn db, args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	fix := flags.Bool("fix", false, "repair what can be repaired safely, like recording a missing first revision")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return fmt.Errorf("unexpected arguments %q", flags.Args())
+	}
+
+	left, err := fsck(conn, *fix)
+	if err != nil {
+		return err
+	}
+	if left > 0 {
+		return fmt.Errorf("%d problems left", left)
+	}
+	fmt.Println("no problems left")
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"github.com/yuin/goldmark/ast"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Heading is a Markdown ATX heading (`## Text`) found in a page body.
+type Heading struct {
+	Level int
+	Text  string
+	// anchor id, unique within the page
+	ID string
+	// byte offsets of the heading line and of the end of its section, which
+	// runs until the next heading of the same or a higher level
+	Start int
+	End   int
+}
+
+// slugify turns heading text into an anchor id.
+func slugify(text string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(text) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "-")
+}
+
+// parseHeading returns the level and text of an ATX heading line.
+func parseHeading(line []byte) (int, string, bool) {
+	trimmed := bytes.TrimLeft(line, " ")
+	if len(line)-len(trimmed) > 3 {
+		return 0, "", false
+	}
+	level := 0
+	for level < len(trimmed) && trimmed[level] == '#' {
+		level++
+	}
+	if level == 0 || level > 6 {
+		return 0, "", false
+	}
+	rest := trimmed[level:]
+	if len(rest) > 0 && rest[0] != ' ' && rest[0] != '\t' {
+		return 0, "", false
+	}
+	return level, headingText(string(rest)), true
+}
+
+// headingText trims the spaces around the text of a heading and its
+// optional closing sequence, `## Text ##`.
+func headingText(s string) string {
+	return strings.TrimSpace(strings.TrimRight(strings.TrimSpace(s), "#"))
+}
+
+// uniqueID is the anchor id of a heading reading text, numbered after the
+// first use of the same id, as counted in seen.
+func uniqueID(seen map[string]int, text string) string {
+	id := slugify(text)
+	if id == "" {
+		id = "section"
+	}
+	if n := seen[id]; n > 0 {
+		seen[id] = n + 1
+		return id + "-" + strconv.Itoa(n)
+	}
+	seen[id] = 1
+	return id
+}
+
+// anchorIDs gives rendered headings the ids parseHeadings finds for them,
+// so the table of contents links to them. It replaces the ids goldmark
+// makes up, which drop letters outside ASCII.
+type anchorIDs struct {
+	seen map[string]int
+}
+
+func newAnchorIDs() *anchorIDs {
+	return &anchorIDs{seen: map[string]int{}}
+}
+
+func (ids *anchorIDs) Generate(value []byte, kind ast.NodeKind) []byte {
+	return []byte(uniqueID(ids.seen, headingText(string(value))))
+}
+
+func (ids *anchorIDs) Put(value []byte) {
+	ids.seen[string(value)]++
+}
+
+// parseHeadings lists the headings of a Markdown body in order, ignoring
+// its front matter and anything inside fenced code blocks.
+func parseHeadings(body []byte) []*Heading {
+	var headings []*Heading
+	seen := map[string]int{}
+	fence := ""
+	_, src := parseFrontMatter(body)
+	offset := len(body) - len(src)
+	for offset < len(body) {
+		end := bytes.IndexByte(body[offset:], '\n')
+		if end < 0 {
+			end = len(body)
+		} else {
+			end += offset + 1
+		}
+		line := bytes.TrimRight(body[offset:end], "\r\n")
+
+		trimmed := strings.TrimLeft(string(line), " ")
+		switch {
+		case fence != "":
+			if strings.HasPrefix(trimmed, fence) {
+				fence = ""
+			}
+		case strings.HasPrefix(trimmed, "```"):
+			fence = "```"
+		case strings.HasPrefix(trimmed, "~~~"):
+			fence = "~~~"
+		default:
+			if level, text, ok := parseHeading(line); ok {
+				headings = append(headings, &Heading{Level: level, Text: text, ID: uniqueID(seen, text), Start: offset})
+			}
+		}
+		offset = end
+	}
+
+	for i, h := range headings {
+		h.End = len(body)
+		for _, next := range headings[i+1:] {
+			if next.Level <= h.Level {
+				h.End = next.Start
+				break
+			}
+		}
+	}
+	return headings
+}
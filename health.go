@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// dbDown is 1 while the last health check could not reach the database.
+var dbDown int32
+
+type Unavailable struct {
+	Message string
+}
+
+// runHealthCheck pings the database every interval until ctx is done. It
+// uses its own connection so it never shares one with request handlers.
+func runHealthCheck(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var conn *pgx.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close(context.Background())
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		pingCtx, cancel := context.WithTimeout(ctx, interval)
+		err := pingDB(pingCtx, &conn)
+		cancel()
+		down := int32(0)
+		if err != nil {
+			down = 1
+		}
+		if atomic.SwapInt32(&dbDown, down) != down {
+			if err != nil {
+				log.Printf("database unavailable: %v", err)
+			} else {
+				log.Printf("database available again")
+			}
+		}
+	}
+}
+
+// pingDB pings through *conn, connecting first if needed. A failed
+// connection is closed so the next check starts afresh.
+func pingDB(ctx context.Context, conn **pgx.Conn) error {
+	if *conn == nil {
+		c, err := connectDB(ctx, config.StatementTimeout)
+		if err != nil {
+			return err
+		}
+		*conn = c
+	}
+	if err := (*conn).Ping(ctx); err != nil {
+		(*conn).Close(context.Background())
+		*conn = nil
+		return err
+	}
+	return nil
+}
+
+// requireDB answers every request but static files with a 503 page while
+// the database is unavailable, instead of letting each handler fail.
+func requireDB(h http.Handler, retryAfter time.Duration) http.Handler {
+	seconds := strconv.Itoa(int(retryAfter.Round(time.Second) / time.Second))
+	if seconds == "0" {
+		seconds = "1"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&dbDown) == 0 || strings.HasPrefix(r.URL.Path, "/css/") || r.URL.Path == "/robots.txt" || r.URL.Path == "/version" || r.URL.Path == "/metrics" || r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", seconds)
+		if isAPI(r) {
+			writeAPIError(w, r, http.StatusServiceUnavailable, apiUnavailable, config.UnavailableMessage)
+			return
+		}
+		renderTemplateStatus(w, r, http.StatusServiceUnavailable, "unavailable", &Unavailable{Message: config.UnavailableMessage})
+	})
+}
+
+// Health is the JSON answer of /healthz and /readyz.
+type Health struct {
+	Status   string `json:"status"`
+	Database string `json:"database,omitempty"`
+}
+
+func writeHealth(w http.ResponseWriter, r *http.Request, status int, h *Health) {
+	body, err := json.Marshal(h)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeBody(w, r, status, "application/json", body)
+}
+
+// healthzHandler answers as long as the process serves requests, for
+// liveness probes. It doesn't touch the database, so an outage doesn't get
+// the wiki restarted.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, r, http.StatusOK, &Health{Status: "ok"})
+}
+
+// readyzHandler pings the database through the pool, for readiness probes
+// and load balancers, and answers 503 when it doesn't reply within
+// -ready-timeout. The error is logged rather than shown to whoever asks.
+func readyzHandler(w http.ResponseWriter, r *http.Request, conn db) {
+	ctx, cancel := context.WithTimeout(r.Context(), config.ReadyTimeout)
+	defer cancel()
+	if err := pingPool(ctx, conn); err != nil {
+		log.Printf("readiness check: %v", err)
+		writeHealth(w, r, http.StatusServiceUnavailable, &Health{Status: "unavailable", Database: "unreachable"})
+		return
+	}
+	writeHealth(w, r, http.StatusOK, &Health{Status: "ok", Database: "ok"})
+}
+
+// pingPool pings over a connection of the pool, or runs a query on
+// connections that can't ping, like a transaction.
+func pingPool(ctx context.Context, conn db) error {
+	if p, ok := conn.(interface{ Ping(context.Context) error }); ok {
+		return p.Ping(ctx)
+	}
+	_, err := conn.Exec(ctx, "SELECT 1")
+	return err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// widgets the home page can show, in display order
+var homeWidgets = []string{"frontpage", "search", "recent", "popular"}
+
+// number of pages listed by the recent and popular widgets
+const homeListSize = 10
+
+type Home struct {
+	Widgets   map[string]bool
+	FrontPage template.HTML
+	Recent    []*Page
+	Popular   []*Page
+	Query     string
+	Matches   []string
+}
+
+func validHomeWidgets(names []string) error {
+	for _, name := range names {
+		found := false
+		for _, w := range homeWidgets {
+			found = found || w == name
+		}
+		if !found {
+			return fmt.Errorf("unknown home widget %q, expected one of %s", name, strings.Join(homeWidgets, ", "))
+		}
+	}
+	return nil
+}
+
+// listPagesBy returns the first n pages of namespace ns, or of all of them
+// when ns is empty, in the given order, without bodies.
+func listPagesBy(ctx context.Context, order, ns string, offset, n int, conn db) ([]*Page, error) {
+	query := "SELECT id, title, created_at, updated_at, COALESCE(updated_by, '') FROM " + table("pages") +
+		" WHERE ($2 = '' OR " + namespaceSQL + " = $2) ORDER BY " + order + " LIMIT $1 OFFSET $3"
+	rows, err := conn.Query(ctx, query, n, ns, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pages []*Page
+	for rows.Next() {
+		p := &Page{}
+		if err := rows.Scan(&p.ID, &p.Title, &p.CreatedAt, &p.UpdatedAt, &p.UpdatedBy); err != nil {
+			return nil, err
+		}
+		pages = append(pages, p)
+	}
+	return pages, rows.Err()
+}
+
+func homeHandler(w http.ResponseWriter, r *http.Request, store PageStore) {
+	// "/" also catches every path without a handler of its own
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	h := &Home{Widgets: map[string]bool{}, Query: strings.TrimSpace(r.FormValue("q"))}
+	for _, name := range config.HomeWidgets {
+		h.Widgets[name] = true
+	}
+
+	var err error
+	if h.Widgets["frontpage"] {
+		p, lerr := store.Load("FrontPage")
+		if lerr == nil {
+			h.FrontPage, err = renderPage(p, store)
+		} else if lerr != errNotFound {
+			err = lerr
+		}
+	}
+	if err == nil && h.Widgets["search"] && h.Query != "" {
+		h.Matches, err = store.Similar(h.Query, homeListSize)
+	}
+	if err == nil && h.Widgets["recent"] {
+		h.Recent, err = store.List(orderRecent, "", 0, homeListSize)
+	}
+	if err == nil && h.Widgets["popular"] {
+		h.Popular, err = store.List(orderPopular, "", 0, homeListSize)
+	}
+	if err != nil {
+		renderFailed(w, err)
+		return
+	}
+	renderTemplate(w, r, "home", h)
+}
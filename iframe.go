@@ -0,0 +1,137 @@
+package main
+
+import (
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/util"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	iframeTag       = regexp.MustCompile(`(?is)^<iframe(\s[^>]*)?>`)
+	iframeElement   = regexp.MustCompile(`(?is)<iframe(\s[^>]*)?>\s*</iframe\s*>`)
+	iframeCloseTag  = regexp.MustCompile(`(?is)^</iframe\s*>$`)
+	iframeAttribute = regexp.MustCompile(`([a-zA-Z-]+)(?:\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'=<>` + "`" + `]+)))?`)
+)
+
+// attributes kept on an allowed iframe; everything else, event handlers
+// included, is dropped
+var iframeAttributes = map[string]bool{"src": true, "width": true, "height": true, "title": true, "allow": true, "allowfullscreen": true}
+
+// iframes lets through iframes whose source is an https URL on one of
+// hosts or their subdomains. Every other raw HTML is left out, as without
+// the extension.
+type iframes struct {
+	hosts []string
+}
+
+func (e iframes) Extend(m goldmark.Markdown) {
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(util.Prioritized(e, 500)))
+}
+
+func (e iframes) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindHTMLBlock, e.renderBlock)
+	reg.Register(ast.KindRawHTML, e.renderInline)
+}
+
+func (e iframes) renderBlock(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	n := node.(*ast.HTMLBlock)
+	var raw strings.Builder
+	for i := 0; i < n.Lines().Len(); i++ {
+		line := n.Lines().At(i)
+		raw.Write(line.Value(source))
+	}
+	if n.HasClosure() {
+		raw.Write(n.ClosureLine.Value(source))
+	}
+	// the block is only kept if it holds nothing but allowed iframes
+	block := strings.TrimSpace(raw.String())
+	var out strings.Builder
+	rest := iframeElement.ReplaceAllStringFunc(block, func(el string) string {
+		if tag, ok := e.sanitize(iframeTag.FindStringSubmatch(el)[1]); ok {
+			out.WriteString(tag)
+			out.WriteString("\n")
+			return ""
+		}
+		return el
+	})
+	if out.Len() == 0 || strings.TrimSpace(rest) != "" {
+		w.WriteString("<!-- raw HTML omitted -->\n")
+		return ast.WalkSkipChildren, nil
+	}
+	w.WriteString(out.String())
+	return ast.WalkSkipChildren, nil
+}
+
+func (e iframes) renderInline(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkSkipChildren, nil
+	}
+	n := node.(*ast.RawHTML)
+	var raw strings.Builder
+	for i := 0; i < n.Segments.Len(); i++ {
+		segment := n.Segments.At(i)
+		raw.Write(segment.Value(source))
+	}
+	// an allowed opening tag is written out whole, so its closing tag is
+	// dropped along with any other raw HTML
+	if m := iframeTag.FindStringSubmatch(raw.String()); m != nil && len(m[0]) == raw.Len() {
+		if tag, ok := e.sanitize(m[1]); ok {
+			w.WriteString(tag)
+			return ast.WalkSkipChildren, nil
+		}
+	}
+	if !iframeCloseTag.MatchString(raw.String()) {
+		w.WriteString("<!-- raw HTML omitted -->")
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+// sanitize rebuilds an iframe from the attributes of its tag, or reports
+// false if its source is not allowed.
+func (e iframes) sanitize(attrs string) (string, bool) {
+	var b strings.Builder
+	allowed := false
+	for _, m := range iframeAttribute.FindAllStringSubmatch(attrs, -1) {
+		name := strings.ToLower(m[1])
+		if !iframeAttributes[name] {
+			continue
+		}
+		value := html.UnescapeString(m[2] + m[3] + m[4])
+		if name == "src" {
+			if !e.allowed(value) {
+				return "", false
+			}
+			allowed = true
+		}
+		b.WriteString(" " + name)
+		if value != "" {
+			b.WriteString(`="` + html.EscapeString(value) + `"`)
+		}
+	}
+	if !allowed {
+		return "", false
+	}
+	return `<iframe` + b.String() + ` loading="lazy" referrerpolicy="strict-origin-when-cross-origin"></iframe>`, true
+}
+
+func (e iframes) allowed(src string) bool {
+	u, err := url.Parse(src)
+	if err != nil || u.Scheme != "https" || u.User != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, h := range e.hosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
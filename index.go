@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+)
+
+// pages listed on each page of the index
+const indexPageSize = 100
+
+// indexSorts are the orders /index lists pages in, by their sort parameter.
+var indexSorts = map[string]listOrder{
+	"title":   orderTitle,
+	"updated": orderRecent,
+	"created": orderCreated,
+	"views":   orderPopular,
+}
+
+type IndexSort struct {
+	Key    string
+	Label  string
+	Active bool
+}
+
+type Index struct {
+	Pages []*Page
+	Sorts []IndexSort
+	Sort  string
+	// current page of the listing, counted from 1, and its neighbours; 0
+	// when there is none
+	Number int
+	Prev   int
+	Next   int
+}
+
+func indexHandler(w http.ResponseWriter, r *http.Request, store PageStore) {
+	sort := r.FormValue("sort")
+	if sort == "" {
+		sort = config.IndexSort
+	}
+	order, ok := indexSorts[sort]
+	if !ok {
+		http.Error(w, "unknown sort "+sort, http.StatusBadRequest)
+		return
+	}
+	idx := &Index{Sort: sort, Number: pageNumber(r)}
+	// one more than shown tells whether there is a next page
+	pages, err := store.List(order, "", (idx.Number-1)*indexPageSize, indexPageSize+1)
+	if err != nil {
+		renderFailed(w, err)
+		return
+	}
+	if len(pages) > indexPageSize {
+		pages, idx.Next = pages[:indexPageSize], idx.Number+1
+	}
+	idx.Pages = pages
+	if idx.Number > 1 {
+		idx.Prev = idx.Number - 1
+	}
+	for _, s := range []IndexSort{{Key: "title", Label: "Title"}, {Key: "updated", Label: "Last updated"}, {Key: "created", Label: "Newest"}, {Key: "views", Label: "Most viewed"}} {
+		s.Active = s.Key == sort
+		idx.Sorts = append(idx.Sorts, s)
+	}
+	renderTemplate(w, r, "index", idx)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// pageLink is a link from a page body to a page of the wiki, and possibly to
+// a heading of it.
+type pageLink struct {
+	Target   string
+	Fragment string
+}
+
+type BrokenLink struct {
+	Source   string
+	Target   string
+	Fragment string
+}
+
+type LinkReport struct {
+	MissingPages   []*BrokenLink
+	MissingAnchors []*BrokenLink
+}
+
+// parseBody parses a page body, minus its front matter, without rendering it.
+// Headings get the ids of parseHeadings.
+func parseBody(body []byte) (ast.Node, []byte) {
+	_, src := parseFrontMatter(body)
+	ctx := parser.NewContext(parser.WithIDs(newAnchorIDs()))
+	return markdown.Parser().Parse(text.NewReader(src), parser.WithContext(ctx)), src
+}
+
+// pageLinks lists the links in body that point into the wiki: [[wiki links]],
+// Markdown links to /view/Title and same-page #fragment links, which get
+// self as their target.
+func pageLinks(self string, body []byte) []pageLink {
+	doc, _ := parseBody(body)
+	var links []pageLink
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch n := n.(type) {
+		case *wikiLink:
+			links = append(links, pageLink{Target: string(n.Target), Fragment: string(n.Fragment)})
+		case *ast.Link:
+			if link, ok := parsePageURL(self, string(n.Destination)); ok {
+				links = append(links, link)
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+	return links
+}
+
+// parsePageURL reads a link destination as a link to a wiki page. Links to
+// other sites and to anything but /view/ aren't page links.
+func parsePageURL(self, dest string) (pageLink, bool) {
+	u, err := url.Parse(dest)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return pageLink{}, false
+	}
+	if u.Path == "" {
+		return pageLink{Target: self, Fragment: u.Fragment}, u.Fragment != ""
+	}
+	segment, ok := strings.CutPrefix(u.Path, config.BasePath+"/view/")
+	title := canonicalTitle(segment)
+	if !ok || !validTitle.MatchString(title) {
+		return pageLink{}, false
+	}
+	return pageLink{Target: title, Fragment: u.Fragment}, true
+}
+
+// headingIDs returns the anchor ids the rendered body gives its headings.
+func headingIDs(body []byte) map[string]bool {
+	doc, _ := parseBody(body)
+	ids := map[string]bool{}
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if _, ok := n.(*ast.Heading); ok && entering {
+			if id, ok := n.AttributeString("id"); ok {
+				if b, ok := id.([]byte); ok {
+					ids[string(b)] = true
+				}
+			}
+			return ast.WalkSkipChildren, nil
+		}
+		return ast.WalkContinue, nil
+	})
+	return ids
+}
+
+// checkLinks finds the links to pages that don't exist, and separately those
+// to headings their page doesn't have. Old titles kept as aliases count as
+// the page they now point at.
+func checkLinks(ctx context.Context, conn db) (*LinkReport, error) {
+	bodies := map[string][]byte{}
+	query := "SELECT title, " + bodyColumns + " FROM " + table("pages")
+	rows, err := conn.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var title string
+		var stored storedBody
+		if err := rows.Scan(stored.dest(&title)...); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		body, err := stored.bytes()
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("%s: %w", title, err)
+		}
+		bodies[title] = body
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	aliases := map[string]string{}
+	query = "SELECT a.title, p.title FROM " + table("page_aliases") + " a JOIN " + table("pages") + " p ON p.id = a.page_id"
+	rows, err = conn.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var alias, title string
+		if err := rows.Scan(&alias, &title); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		aliases[alias] = title
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	titles := make([]string, 0, len(bodies))
+	for title := range bodies {
+		titles = append(titles, title)
+	}
+	sort.Strings(titles)
+
+	// heading ids are only worked out for pages linked with a fragment
+	anchors := map[string]map[string]bool{}
+	rep := &LinkReport{}
+	for _, source := range titles {
+		seen := map[pageLink]bool{}
+		for _, link := range pageLinks(source, bodies[source]) {
+			if seen[link] {
+				continue
+			}
+			seen[link] = true
+			target := link.Target
+			if _, ok := bodies[target]; !ok {
+				if target, ok = aliases[target]; !ok {
+					rep.MissingPages = append(rep.MissingPages, &BrokenLink{Source: source, Target: link.Target, Fragment: link.Fragment})
+					continue
+				}
+			}
+			if link.Fragment == "" {
+				continue
+			}
+			if anchors[target] == nil {
+				anchors[target] = headingIDs(bodies[target])
+			}
+			if !anchors[target][link.Fragment] {
+				rep.MissingAnchors = append(rep.MissingAnchors, &BrokenLink{Source: source, Target: link.Target, Fragment: link.Fragment})
+			}
+		}
+	}
+	return rep, nil
+}
+
+// wikiLinkPattern matches the [[title]] links in every form, [[title|text]]
+// and [[title#section]] too, capturing what follows the title. It is valid
+// both as a Go and as a Postgres regular expression.
+func wikiLinkPattern(title string) string {
+	return `\[\[\s*` + regexp.QuoteMeta(title) + `(\s*(?:#[^\]|]*)?(?:\|[^\]]*)?)\]\]`
+}
+
+// relinkSummary is the summary of the revisions rewriteLinks makes.
+func relinkSummary(from, to string) string {
+	return "Links to " + from + " now point to " + to
+}
+
+// rewriteLinks points every [[from]] link in the wiki at to instead, as an
+// edit by editor, in one statement however many pages link to from. It
+// returns the number of pages changed. They are pruned of old revisions on
+// their next save, and gzipped again then if they were.
+func rewriteLinks(ctx context.Context, from, to, editor string, conn db) (int64, error) {
+	defer timeQuery("rewriteLinks", time.Now())
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	// regexp_replace needs the text of the gzipped bodies linking to from
+	if err := inflateBodies(ctx, tx, "id IN (SELECT page_id FROM "+table("page_links")+" WHERE target = $1)", from); err != nil {
+		return 0, err
+	}
+	// backslashes are the only special characters of a replacement
+	replacement := "[[" + strings.ReplaceAll(to, `\`, `\\`) + `\1]]`
+	query := `WITH changed AS (
+		UPDATE ` + table("pages") + ` SET body = regexp_replace(body, $1, $2, 'g'), updated_at = now(), updated_by = NULLIF($3, ''), version = version + 1
+		WHERE body ~ $1
+		RETURNING id, body
+	)
+	INSERT INTO ` + table("page_revisions") + ` (page_id, body, author, summary)
+	SELECT id, body, NULLIF($3, ''), $4 FROM changed`
+	tag, err := tx.Exec(ctx, query, wikiLinkPattern(from), replacement, editor, relinkSummary(from, to))
+	if err != nil {
+		return 0, err
+	}
+	if tag.RowsAffected() > 0 {
+		if err := syncLinksTo(ctx, from, tx); err != nil {
+			return 0, err
+		}
+	}
+	return tag.RowsAffected(), tx.Commit(ctx)
+}
+
+func brokenLinksHandler(w http.ResponseWriter, r *http.Request, conn db) {
+	rep, err := checkLinks(r.Context(), conn)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, r, "links", rep)
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	_ "modernc.org/sqlite"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// storage backends of -store
+const (
+	storePostgres = "postgres"
+	storeFiles    = "files"
+	storeSQLite   = "sqlite"
+)
+
+var storeBackends = []string{storePostgres, storeFiles, storeSQLite}
+
+// front matter keys the files store adds to each page, and import drops
+var fileStoreKeys = []string{"title", "created", "updated", "updated-by", "protection"}
+
+// pageDisk keeps the pages of a localStore between runs of the server.
+type pageDisk interface {
+	pages() ([]*Page, error)
+	put(p *Page) error
+	remove(title string) error
+	Close() error
+}
+
+// localStore serves pages from memory, like memStore, and writes every
+// page that changes through to a directory of Markdown files or an SQLite
+// database, reading them back at startup. Only pages are kept: their
+// history, drafts, comments, watches, translations and the archive of
+// deleted pages last until the server stops.
+type localStore struct {
+	*memStore
+	disk pageDisk
+	// held across a write and the flush after it, so each flush sees only
+	// the changes of its own write
+	writing sync.Mutex
+	// titles changed in memory but not yet on disk, retried on every write
+	unsaved map[string]bool
+}
+
+// openLocalStore opens the files or sqlite backend at path, or at its
+// default path when empty. It fails on the pages it couldn't read rather
+// than serving without them.
+func openLocalStore(backend, path string) (*localStore, error) {
+	var disk pageDisk
+	var err error
+	switch backend {
+	case storeFiles:
+		if path == "" {
+			path = "pages"
+		}
+		disk, err = openFileDisk(path)
+	case storeSQLite:
+		if path == "" {
+			path = "gowiki.db"
+		}
+		disk, err = openSQLiteDisk(path)
+	default:
+		err = fmt.Errorf("unknown store %q", backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	pages, err := disk.pages()
+	if err != nil {
+		disk.Close()
+		return nil, err
+	}
+	s := &localStore{memStore: newMemStore(), disk: disk, unsaved: map[string]bool{}}
+	s.seed(pages)
+	return s, nil
+}
+
+// WithContext returns s itself, not the memStore inside, so writes still
+// reach the disk.
+func (s *localStore) WithContext(ctx context.Context) PageStore { return s }
+
+func (s *localStore) Close() error { return s.disk.Close() }
+
+// pageMark is what a write can change about a page that the disk keeps
+// apart from the body, which changes the version along with it.
+type pageMark struct {
+	version    int64
+	protection string
+}
+
+func (s *localStore) marks() map[string]pageMark {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	marks := make(map[string]pageMark, len(s.pages))
+	for title, p := range s.pages {
+		marks[title] = pageMark{p.Version, p.Protection}
+	}
+	return marks
+}
+
+// write runs op on the pages in memory, then writes the ones it saved,
+// created or protected to the disk and removes the ones it deleted or
+// renamed away. A page that fails to write is retried with the next write;
+// the error is returned though op itself succeeded.
+func (s *localStore) write(op func() error) error {
+	s.writing.Lock()
+	defer s.writing.Unlock()
+	before := s.marks()
+	err := op()
+	after := s.marks()
+	for title, m := range after {
+		if old, ok := before[title]; !ok || old != m {
+			s.unsaved[title] = true
+		}
+	}
+	for title := range before {
+		if _, ok := after[title]; !ok {
+			s.unsaved[title] = true
+		}
+	}
+	if ferr := s.flush(); ferr != nil && err == nil {
+		err = ferr
+	}
+	return err
+}
+
+func (s *localStore) flush() error {
+	var failed error
+	for title := range s.unsaved {
+		p, err := s.memStore.Load(title)
+		if err == errNotFound {
+			err = s.disk.remove(title)
+		} else if err == nil {
+			err = s.disk.put(p)
+		}
+		if err != nil {
+			if failed == nil {
+				failed = fmt.Errorf("writing %s: %v", title, err)
+			}
+			continue
+		}
+		delete(s.unsaved, title)
+	}
+	return failed
+}
+
+func (s *localStore) Save(p *Page) error {
+	return s.write(func() error { return s.memStore.Save(p) })
+}
+
+func (s *localStore) Apply(writes ...PageWrite) error {
+	return s.write(func() error { return s.memStore.Apply(writes...) })
+}
+
+func (s *localStore) Delete(title string) error {
+	return s.write(func() error { return s.memStore.Delete(title) })
+}
+
+func (s *localStore) Restore(title string) error {
+	return s.write(func() error { return s.memStore.Restore(title) })
+}
+
+func (s *localStore) Rename(p *Page, newTitle, editor string) (int64, error) {
+	var n int64
+	err := s.write(func() error {
+		var err error
+		n, err = s.memStore.Rename(p, newTitle, editor)
+		return err
+	})
+	return n, err
+}
+
+func (s *localStore) SetProtection(title, level string) error {
+	return s.write(func() error { return s.memStore.SetProtection(title, level) })
+}
+
+// fileDisk keeps each page as <title>.md in a directory, in the format of
+// the export command, so the directory can be edited by hand, kept in git
+// or imported into Postgres later. Pages under others, like
+// Projects/GoWiki, are kept in subdirectories. Files are replaced whole by
+// a rename so a crash never leaves half a page.
+type fileDisk struct {
+	dir string
+}
+
+func openFileDisk(dir string) (*fileDisk, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &fileDisk{dir: dir}, nil
+}
+
+// pages reads every .md file of the directory and its subdirectories,
+// leaving out hidden ones like .git. Files added by hand, with no front
+// matter of their own, are dated by their modification time.
+func (d *fileDisk) pages() ([]*Page, error) {
+	var pages []*Page
+	err := filepath.WalkDir(d.dir, func(path string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := e.Name()
+		if e.IsDir() && path != d.dir && strings.HasPrefix(name, ".") {
+			return filepath.SkipDir
+		}
+		if e.IsDir() || !strings.HasSuffix(name, ".md") || strings.HasPrefix(name, ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(d.dir, path)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(rel)
+		body, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		// file names written on macOS come decomposed
+		p := &Page{Title: canonicalTitle(strings.TrimSuffix(name, ".md")), Protection: protectAnyone, CreatedAt: info.ModTime(), UpdatedAt: info.ModTime()}
+		if err := checkTitle(p.Title); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		fm, rest := parseFrontMatter(body)
+		if v, ok := fm.get("created"); ok {
+			if t, err := time.Parse(time.RFC3339, v); err == nil {
+				p.CreatedAt = t
+			}
+		}
+		if v, ok := fm.get("updated"); ok {
+			if t, err := time.Parse(time.RFC3339, v); err == nil {
+				p.UpdatedAt = t
+			}
+		}
+		p.UpdatedBy, _ = fm.get("updated-by")
+		if v, ok := fm.get("protection"); ok && validProtection(v) {
+			p.Protection = v
+		}
+		for _, key := range fileStoreKeys {
+			fm.set(key, "")
+		}
+		p.Body = fm.join(rest)
+		pages = append(pages, p)
+		return nil
+	})
+	return pages, err
+}
+
+// file is where the page titled title is kept.
+func (d *fileDisk) file(title string) string {
+	return filepath.Join(d.dir, filepath.FromSlash(title)+".md")
+}
+
+func (d *fileDisk) put(p *Page) error {
+	fm, body := parseFrontMatter(p.Body)
+	fm.set("title", p.Title)
+	fm.set("created", p.CreatedAt.UTC().Format(time.RFC3339))
+	fm.set("updated", p.UpdatedAt.UTC().Format(time.RFC3339))
+	fm.set("updated-by", p.UpdatedBy)
+	if p.Protection != protectAnyone {
+		fm.set("protection", p.Protection)
+	}
+
+	target := d.file(p.Title)
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(target), ".page-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(fm.join(body)); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), target)
+}
+
+// remove deletes the file of title, and the directories above it it
+// leaves empty.
+func (d *fileDisk) remove(title string) error {
+	path := d.file(title)
+	err := os.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for dir := filepath.Dir(path); dir != filepath.Clean(d.dir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (d *fileDisk) Close() error { return nil }
+
+// sqliteDisk keeps pages in one table of an SQLite database file.
+type sqliteDisk struct {
+	db *sql.DB
+}
+
+func openSQLiteDisk(path string) (*sqliteDisk, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite takes one writer at a time, and localStore only ever has one
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS pages (
+		title TEXT PRIMARY KEY,
+		body BLOB NOT NULL,
+		protection TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		updated_by TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		updated_at TEXT NOT NULL
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &sqliteDisk{db: db}, nil
+}
+
+func (d *sqliteDisk) pages() ([]*Page, error) {
+	rows, err := d.db.Query("SELECT title, body, protection, version, updated_by, created_at, updated_at FROM pages")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pages []*Page
+	for rows.Next() {
+		p := &Page{}
+		var created, updated string
+		if err := rows.Scan(&p.Title, &p.Body, &p.Protection, &p.Version, &p.UpdatedBy, &created, &updated); err != nil {
+			return nil, err
+		}
+		if p.CreatedAt, err = time.Parse(time.RFC3339Nano, created); err != nil {
+			return nil, fmt.Errorf("%s: %v", p.Title, err)
+		}
+		if p.UpdatedAt, err = time.Parse(time.RFC3339Nano, updated); err != nil {
+			return nil, fmt.Errorf("%s: %v", p.Title, err)
+		}
+		pages = append(pages, p)
+	}
+	return pages, rows.Err()
+}
+
+func (d *sqliteDisk) put(p *Page) error {
+	query := `INSERT INTO pages (title, body, protection, version, updated_by, created_at, updated_at)
+		VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7)
+		ON CONFLICT (title) DO UPDATE SET body = ?2, protection = ?3, version = ?4, updated_by = ?5, created_at = ?6, updated_at = ?7`
+	_, err := d.db.Exec(query, p.Title, p.Body, p.Protection, p.Version, p.UpdatedBy,
+		p.CreatedAt.UTC().Format(time.RFC3339Nano), p.UpdatedAt.UTC().Format(time.RFC3339Nano))
+	return err
+}
+
+func (d *sqliteDisk) remove(title string) error {
+	_, err := d.db.Exec("DELETE FROM pages WHERE title = ?1", title)
+	return err
+}
+
+func (d *sqliteDisk) Close() error { return d.db.Close() }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+// TestLocalStoreKeepsPages saves and deletes pages through the handlers on
+// each local backend, then opens it again to find them as they were left.
+func TestLocalStoreKeepsPages(t *testing.T) {
+	keepConfig(t)
+	config.AnonymousEdits = true
+	config.AdminPassword = "secret"
+	for _, backend := range []string{storeFiles, storeSQLite} {
+		t.Run(backend, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "pages")
+			if backend == storeSQLite {
+				path += ".db"
+			}
+			store, err := openLocalStore(backend, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := testServer(store)
+			for _, title := range []string{"Kept", "Projects/Sub_Page", "Gone"} {
+				w := request(h, http.MethodPost, "/save/"+title, url.Values{"body": {"Body of " + title + "."}, "new": {"1"}})
+				if w.Code != http.StatusSeeOther {
+					t.Fatalf("saving %s got %d: %s", title, w.Code, w.Body)
+				}
+			}
+			if w := adminRequest(h, http.MethodPost, "/delete/Gone", url.Values{}); w.Code != http.StatusSeeOther {
+				t.Fatalf("deleting got %d", w.Code)
+			}
+			if err := store.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			store, err = openLocalStore(backend, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			for _, title := range []string{"Kept", "Projects/Sub Page"} {
+				p, err := store.Load(title)
+				if err != nil {
+					t.Fatalf("%s: %v", title, err)
+				}
+				if want := "Body of " + titleSlug(title) + "."; string(p.Body) != want {
+					t.Errorf("%s is %q, want %q", title, p.Body, want)
+				}
+				if !isAnonymous(p.UpdatedBy) || p.Version != 1 {
+					t.Errorf("%s was last saved by %q at version %d", title, p.UpdatedBy, p.Version)
+				}
+			}
+			if _, err := store.Load("Gone"); err != errNotFound {
+				t.Errorf("the deleted page got %v, want errNotFound", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/yuin/goldmark"
+	highlighting "github.com/yuin/goldmark-highlighting/v2"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	east "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+	"html/template"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Markdown extensions that can be enabled by name
+var markdownExtensions = map[string]goldmark.Extender{
+	"table":          extension.Table,
+	"strikethrough":  extension.Strikethrough,
+	"linkify":        extension.Linkify,
+	"tasklist":       extension.TaskList,
+	"footnote":       extension.Footnote,
+	"definitionlist": extension.DefinitionList,
+	"typographer":    extension.Typographer,
+	"cjk":            extension.CJK,
+	"highlight":      highlighting.Highlighting,
+}
+
+const defaultMarkdownExtensions = "table,strikethrough,linkify,tasklist,footnote,highlight"
+
+// markdown is built once at startup from the configured extensions.
+var markdown goldmark.Markdown
+
+func markdownExtensionNames() []string {
+	names := make([]string, 0, len(markdownExtensions))
+	for name := range markdownExtensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newMarkdown builds a renderer with the named extensions enabled. Raw HTML
+// in bodies is left out of the output, except iframes from iframeHosts.
+// With newTab, links off the wiki open in a new tab. Fenced code blocks are
+// coloured in the chroma style highlightStyle if highlight is enabled.
+func newMarkdown(names, iframeHosts []string, newTab bool, highlightStyle string) (goldmark.Markdown, error) {
+	exts := []goldmark.Extender{wikiLinks{}, transclusion{}}
+	if len(iframeHosts) > 0 {
+		exts = append(exts, iframes{iframeHosts})
+	}
+	parserOpts := []parser.Option{
+		parser.WithAutoHeadingID(),
+		parser.WithASTTransformers(util.Prioritized(imageAttributes{}, 500)),
+	}
+	if newTab {
+		parserOpts = append(parserOpts, parser.WithASTTransformers(util.Prioritized(externalLinks{}, 500)))
+	}
+	for _, name := range names {
+		ext, ok := markdownExtensions[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown Markdown extension %q, expected one of %s", name, strings.Join(markdownExtensionNames(), ", "))
+		}
+		if name == "highlight" {
+			if _, ok := styles.Registry[highlightStyle]; !ok {
+				return nil, fmt.Errorf("unknown highlight style %q, expected one of %s", highlightStyle, strings.Join(styles.Names(), ", "))
+			}
+			// inline styles, so no stylesheet has to match the style
+			ext = highlighting.NewHighlighting(highlighting.WithStyle(highlightStyle))
+		}
+		exts = append(exts, ext)
+		if name == "tasklist" {
+			parserOpts = append(parserOpts, parser.WithASTTransformers(util.Prioritized(taskListClasses{}, 500)))
+		}
+	}
+	return goldmark.New(
+		goldmark.WithExtensions(exts...),
+		goldmark.WithParserOptions(parserOpts...),
+	), nil
+}
+
+// taskListClasses marks task lists and their items with the class names
+// GitHub uses, so the stylesheet can replace bullets with the checkboxes.
+type taskListClasses struct{}
+
+func (taskListClasses) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if _, ok := n.(*east.TaskCheckBox); !ok || !entering {
+			return ast.WalkContinue, nil
+		}
+		if block := n.Parent(); block != nil {
+			if item, ok := block.Parent().(*ast.ListItem); ok {
+				item.SetAttributeString("class", []byte("task-list-item"))
+				if list := item.Parent(); list != nil {
+					list.SetAttributeString("class", []byte("contains-task-list"))
+				}
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+}
+
+// imageAttributes makes every image shrink to the width of the page and
+// load lazily, so large images don't break the layout or slow the page.
+type imageAttributes struct{}
+
+func (imageAttributes) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if img, ok := n.(*ast.Image); ok && entering {
+			img.SetAttributeString("class", []byte("wiki-image"))
+			img.SetAttributeString("loading", []byte("lazy"))
+		}
+		return ast.WalkContinue, nil
+	})
+}
+
+// externalLinks makes links to other sites, and only those, open in a new
+// tab. noopener keeps the opened page from reaching back into the wiki.
+type externalLinks struct{}
+
+func (externalLinks) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		var dest []byte
+		switch n := n.(type) {
+		case *ast.Link:
+			dest = n.Destination
+		case *ast.AutoLink:
+			if n.AutoLinkType != ast.AutoLinkURL {
+				return ast.WalkContinue, nil
+			}
+			dest = n.URL(reader.Source())
+		default:
+			return ast.WalkContinue, nil
+		}
+		if isExternalURL(string(dest)) {
+			n.SetAttributeString("target", []byte("_blank"))
+			n.SetAttributeString("rel", []byte("noopener"))
+		}
+		return ast.WalkContinue, nil
+	})
+}
+
+// isExternalURL reports whether a link destination points off the wiki: an
+// absolute or protocol-relative URL with a host.
+func isExternalURL(dest string) bool {
+	u, err := url.Parse(dest)
+	return err == nil && u.Host != ""
+}
+
+// renderMarkdown turns a page body, minus its front matter, into HTML.
+// Each {{include:Title}} in it is replaced by include(Title).
+func renderMarkdown(body []byte, include func(title string) (template.HTML, error)) (template.HTML, error) {
+	doc, src := parseBody(body)
+	err := ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		inc, ok := n.(*includeBlock)
+		if !ok || !entering {
+			return ast.WalkContinue, nil
+		}
+		html, err := include(string(inc.Target))
+		inc.HTML = html
+		return ast.WalkSkipChildren, err
+	})
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := markdown.Renderer().Render(&buf, src, doc); err != nil {
+		return "", err
+	}
+	return template.HTML(buf.String()), nil
+}
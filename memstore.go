@@ -0,0 +1,858 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memStore is a PageStore kept in memory. It backs the files and sqlite
+// stores of localStore, which write its pages through to disk, and the
+// handler tests, which run without a database. Pages are copied in and out
+// so callers never share them with the store.
+type memStore struct {
+	mu     sync.Mutex
+	nextID int64
+	pages  map[string]*Page
+	views  map[int64]int64
+	// views of each page by day, as 2006-01-02
+	viewDays map[int64]map[string]int64
+	aliases  map[string]int64
+	// revisions of each page, oldest first
+	revisions map[int64][]*Revision
+	nextRevID int64
+	// archived pages, oldest first
+	archived []archivedPage
+	// drafts by title, then author
+	drafts map[string]map[string]*Draft
+	// comments on every page, oldest first
+	comments      []*Comment
+	nextCommentID int64
+	// page templates by name
+	templates map[string]*PageTemplate
+	// watchers by title, and the emails of accounts
+	watches map[string]map[string]bool
+	emails  map[string]string
+	// translations by title and language
+	translations map[string]map[string]*Page
+}
+
+type archivedPage struct {
+	page *Page
+	at   time.Time
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		pages:        map[string]*Page{},
+		views:        map[int64]int64{},
+		viewDays:     map[int64]map[string]int64{},
+		aliases:      map[string]int64{},
+		revisions:    map[int64][]*Revision{},
+		drafts:       map[string]map[string]*Draft{},
+		templates:    map[string]*PageTemplate{},
+		watches:      map[string]map[string]bool{},
+		emails:       map[string]string{},
+		translations: map[string]map[string]*Page{},
+	}
+}
+
+// seed fills s with pages kept elsewhere, each starting with one revision,
+// its body as stored.
+func (s *memStore) seed(pages []*Page) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range pages {
+		c := copyPage(p)
+		s.nextID++
+		c.ID = s.nextID
+		if c.Version == 0 {
+			c.Version = 1
+		}
+		c.ExpiresAt, _ = pageExpiry(c.Body)
+		s.pages[c.Title] = c
+		s.nextRevID++
+		s.revisions[c.ID] = []*Revision{{ID: s.nextRevID, Author: c.UpdatedBy, CreatedAt: c.UpdatedAt, Size: int64(len(c.Body)), Body: c.Body}}
+	}
+}
+
+func copyPage(p *Page) *Page {
+	c := *p
+	c.Body = append([]byte(nil), p.Body...)
+	return &c
+}
+
+// WithContext returns s itself; nothing in memory waits to be cancelled.
+func (s *memStore) WithContext(ctx context.Context) PageStore { return s }
+
+func (s *memStore) Load(title string) (*Page, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.pages[title]
+	if !ok {
+		return nil, errNotFound
+	}
+	return copyPage(p), nil
+}
+
+func (s *memStore) Stat(title string) (*Page, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.pages[title]
+	if !ok {
+		return nil, errNotFound
+	}
+	c := *p
+	c.Body = nil
+	return &c, nil
+}
+
+func (s *memStore) Save(p *Page) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.save(p, time.Now()); err != nil {
+		return err
+	}
+	renders.invalidate(p.Title)
+	pageEvents.publish(pageEvent{Type: "saved", Title: p.Title, Version: p.Version, By: p.UpdatedBy})
+	queueChange(p)
+	return nil
+}
+
+func (s *memStore) save(p *Page, now time.Time) error {
+	stored, ok := s.pages[p.Title]
+	if ok && p.New {
+		return errCreateConflict
+	}
+	if p.BaseVersion > 0 && (!ok || stored.Version != p.BaseVersion) {
+		return errVersionConflict
+	}
+	if !ok {
+		s.nextID++
+		stored = &Page{ID: s.nextID, Title: p.Title, CreatedAt: now, Protection: protectAnyone}
+		s.pages[p.Title] = stored
+	}
+	stored.Body = append([]byte(nil), p.Body...)
+	stored.ExpiresAt, _ = pageExpiry(p.Body)
+	stored.Version++
+	stored.UpdatedAt = now
+	stored.UpdatedBy = p.UpdatedBy
+	rev := &Revision{Author: p.UpdatedBy, CreatedAt: now, Summary: p.Summary, Size: int64(len(p.Body)), Body: stored.Body}
+	revs := s.revisions[stored.ID]
+	if n := len(revs); n > 0 && config.CoalesceEdits > 0 && !isAnonymous(p.UpdatedBy) &&
+		revs[n-1].Author == p.UpdatedBy && now.Sub(revs[n-1].CreatedAt) < config.CoalesceEdits {
+		rev.ID = revs[n-1].ID
+		if rev.Summary == "" {
+			rev.Summary = revs[n-1].Summary
+		}
+		// a new slice rather than a change in place, so Apply can roll back
+		revs = revs[: n-1 : n-1]
+	} else {
+		s.nextRevID++
+		rev.ID = s.nextRevID
+	}
+	s.revisions[stored.ID] = append(revs, rev)
+	p.ID, p.CreatedAt, p.UpdatedAt, p.Protection, p.Version, p.ExpiresAt = stored.ID, stored.CreatedAt, stored.UpdatedAt, stored.Protection, stored.Version, stored.ExpiresAt
+	return nil
+}
+
+// Apply works on copies of the pages and aliases and only keeps them if
+// every write succeeds.
+func (s *memStore) Apply(writes ...PageWrite) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pages, aliases := map[string]*Page{}, map[string]int64{}
+	for title, p := range s.pages {
+		pages[title] = copyPage(p)
+	}
+	for title, id := range s.aliases {
+		aliases[title] = id
+	}
+	revisions := map[int64][]*Revision{}
+	for id, revs := range s.revisions {
+		revisions[id] = revs[:len(revs):len(revs)]
+	}
+	nextID, nextRevID := s.nextID, s.nextRevID
+	archived := s.archived[:len(s.archived):len(s.archived)]
+	rollback := func() {
+		s.pages, s.aliases, s.revisions, s.archived = pages, aliases, revisions, archived
+		s.nextID, s.nextRevID = nextID, nextRevID
+	}
+
+	now := time.Now()
+	for i, w := range writes {
+		var err error
+		switch w.op {
+		case opSave:
+			err = s.save(w.page, now)
+		case opArchive:
+			err = s.archive(w.title)
+		case opRelink:
+			s.relink(w.title, w.to, w.editor, now)
+		}
+		if err != nil {
+			rollback()
+			return &BatchError{Write: &writes[i], Err: err}
+		}
+	}
+	invalidateRenders(writes)
+	announceWrites(writes)
+	return nil
+}
+
+func (s *memStore) List(order listOrder, ns string, offset, n int) ([]*Page, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var pages []*Page
+	for _, p := range s.pages {
+		if !inNamespace(p.Title, ns) {
+			continue
+		}
+		c := copyPage(p)
+		c.Body = nil
+		pages = append(pages, c)
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		a, b := pages[i], pages[j]
+		switch {
+		case order == orderRecent && !a.UpdatedAt.Equal(b.UpdatedAt):
+			return a.UpdatedAt.After(b.UpdatedAt)
+		case order == orderCreated && !a.CreatedAt.Equal(b.CreatedAt):
+			return a.CreatedAt.After(b.CreatedAt)
+		case order == orderPopular && s.views[a.ID] != s.views[b.ID]:
+			return s.views[a.ID] > s.views[b.ID]
+		}
+		return a.Title < b.Title
+	})
+	pages = pages[min(offset, len(pages)):]
+	if len(pages) > n {
+		pages = pages[:n]
+	}
+	return pages, nil
+}
+
+func (s *memStore) Delete(title string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.archive(title); err != nil {
+		return err
+	}
+	renders.invalidate(title)
+	pageEvents.publish(pageEvent{Type: "deleted", Title: title})
+	return nil
+}
+
+func (s *memStore) archive(title string) error {
+	p, ok := s.pages[title]
+	if !ok {
+		return errNotFound
+	}
+	delete(s.pages, title)
+	s.archived = append(s.archived, archivedPage{page: p, at: time.Now()})
+	for alias, id := range s.aliases {
+		if id == p.ID {
+			delete(s.aliases, alias)
+		}
+	}
+	return nil
+}
+
+func (s *memStore) Deleted(title string) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.archived) - 1; i >= 0; i-- {
+		if s.archived[i].page.Title == title {
+			return s.archived[i].at, nil
+		}
+	}
+	return time.Time{}, errNotFound
+}
+
+func (s *memStore) Restore(title string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.pages[title]; ok {
+		return fmt.Errorf("%s: %w", title, errPageExists)
+	}
+	for i := len(s.archived) - 1; i >= 0; i-- {
+		if a := s.archived[i]; a.page.Title == title {
+			// like the database, the page starts over unprotected
+			p := copyPage(a.page)
+			p.Protection, p.Version, p.ExpiresAt, p.UpdatedBy = protectAnyone, 1, nil, ""
+			s.pages[title] = p
+			s.archived = append(s.archived[:i:i], s.archived[i+1:]...)
+			renders.invalidate(title)
+			pageEvents.publish(pageEvent{Type: "restored", Title: title})
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+func (s *memStore) relink(from, to, editor string, now time.Time) int64 {
+	re := regexp.MustCompile(wikiLinkPattern(from))
+	link := []byte("[[" + strings.ReplaceAll(to, "$", "$$") + "${1}]]")
+	var n int64
+	for _, p := range s.pages {
+		if re.Match(p.Body) {
+			s.save(&Page{Title: p.Title, Body: re.ReplaceAll(p.Body, link), UpdatedBy: editor, Summary: relinkSummary(from, to)}, now)
+			n++
+		}
+	}
+	return n
+}
+
+func (s *memStore) Rename(p *Page, newTitle, editor string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.pages[newTitle]; ok {
+		return 0, fmt.Errorf("%s: %w", newTitle, errPageExists)
+	}
+	stored, ok := s.pages[p.Title]
+	if !ok {
+		return 0, errNotFound
+	}
+	delete(s.pages, p.Title)
+	delete(s.aliases, newTitle)
+	s.aliases[p.Title] = stored.ID
+	stored.Title = newTitle
+	s.pages[newTitle] = stored
+	for author, d := range s.drafts[p.Title] {
+		if _, ok := s.drafts[newTitle][author]; ok {
+			continue
+		}
+		if s.drafts[newTitle] == nil {
+			s.drafts[newTitle] = map[string]*Draft{}
+		}
+		d.Title = newTitle
+		s.drafts[newTitle][author] = d
+		delete(s.drafts[p.Title], author)
+	}
+	for account := range s.watches[p.Title] {
+		if s.watches[newTitle] == nil {
+			s.watches[newTitle] = map[string]bool{}
+		}
+		s.watches[newTitle][account] = true
+	}
+	delete(s.watches, p.Title)
+	for lang, t := range s.translations[p.Title] {
+		if _, ok := s.translations[newTitle][lang]; ok {
+			continue
+		}
+		if s.translations[newTitle] == nil {
+			s.translations[newTitle] = map[string]*Page{}
+		}
+		t.Title = newTitle
+		s.translations[newTitle][lang] = t
+		delete(s.translations[p.Title], lang)
+	}
+	n := s.relink(p.Title, newTitle, editor, time.Now())
+	renders.invalidate(p.Title, newTitle)
+	if n > 0 {
+		renders.invalidateIncludes()
+	}
+	pageEvents.publish(pageEvent{Type: "renamed", Title: p.Title, To: newTitle})
+	p.Title = newTitle
+	return n, nil
+}
+
+func (s *memStore) Resolve(title string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, ok := s.aliases[title]
+	if !ok {
+		return "", errNotFound
+	}
+	for _, p := range s.pages {
+		if p.ID == id && p.Title != title {
+			return p.Title, nil
+		}
+	}
+	return "", errNotFound
+}
+
+func (s *memStore) SetProtection(title, level string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.pages[title]
+	if !ok {
+		return errNotFound
+	}
+	p.Protection = level
+	return nil
+}
+
+// Similar matches titles containing title or contained in it, ignoring
+// case, which is close enough to trigrams for tests.
+func (s *memStore) Similar(title string, n int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	want := strings.ToLower(title)
+	var titles []string
+	for t := range s.pages {
+		l := strings.ToLower(t)
+		if strings.Contains(l, want) || strings.Contains(want, l) {
+			titles = append(titles, t)
+		}
+	}
+	sort.Strings(titles)
+	if len(titles) > n {
+		titles = titles[:n]
+	}
+	return titles, nil
+}
+
+func (s *memStore) TitlesWithPrefix(prefix string, n int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	want := strings.ToLower(prefix)
+	var titles []string
+	for t := range s.pages {
+		if strings.HasPrefix(strings.ToLower(t), want) {
+			titles = append(titles, t)
+		}
+	}
+	sort.Strings(titles)
+	if len(titles) > n {
+		titles = titles[:n]
+	}
+	return titles, nil
+}
+
+// TagNeighbours reads the tags of every body, as the memStore keeps no tag
+// index.
+func (s *memStore) TagNeighbours(tag, title string) (prev, next string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var titles []string
+	for t, p := range s.pages {
+		for _, pt := range pageTags(p.Body) {
+			if pt == tag {
+				titles = append(titles, t)
+				break
+			}
+		}
+	}
+	sort.Strings(titles)
+	i := sort.SearchStrings(titles, title)
+	if i > 0 {
+		prev = titles[i-1]
+	}
+	if i < len(titles) && titles[i] == title {
+		i++
+	}
+	if i < len(titles) {
+		next = titles[i]
+	}
+	return prev, next, nil
+}
+
+// Backlinks parses every page, as there are few pages in tests.
+func (s *memStore) Backlinks(title string, n int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	target, ok := s.pages[title]
+	if !ok {
+		return nil, nil
+	}
+	var titles []string
+	for t, p := range s.pages {
+		if p.ID == target.ID {
+			continue
+		}
+		for _, link := range linkTargets(t, p.Body) {
+			if id, ok := s.aliases[link]; link == title || ok && id == target.ID {
+				titles = append(titles, t)
+				break
+			}
+		}
+	}
+	sort.Strings(titles)
+	if len(titles) > n {
+		titles = titles[:n]
+	}
+	return titles, nil
+}
+
+func (s *memStore) Count() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pages), nil
+}
+
+func (s *memStore) SaveDraft(d *Draft) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.drafts[d.Title] == nil {
+		s.drafts[d.Title] = map[string]*Draft{}
+	}
+	c := *d
+	c.Body = append([]byte(nil), d.Body...)
+	c.SavedAt = time.Now()
+	s.drafts[d.Title][d.Author] = &c
+	d.SavedAt = c.SavedAt
+	return nil
+}
+
+func (s *memStore) Draft(title, author string) (*Draft, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.drafts[title][author]
+	if !ok {
+		return nil, errNotFound
+	}
+	c := *d
+	c.Body = append([]byte(nil), d.Body...)
+	return &c, nil
+}
+
+func (s *memStore) Drafts(title string) ([]*Draft, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var drafts []*Draft
+	for _, d := range s.drafts[title] {
+		c := *d
+		c.Body = nil
+		drafts = append(drafts, &c)
+	}
+	sort.Slice(drafts, func(i, j int) bool {
+		if !drafts[i].SavedAt.Equal(drafts[j].SavedAt) {
+			return drafts[i].SavedAt.After(drafts[j].SavedAt)
+		}
+		return drafts[i].Author < drafts[j].Author
+	})
+	return drafts, nil
+}
+
+func (s *memStore) DeleteDraft(title, author string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.drafts[title], author)
+	return nil
+}
+
+func (s *memStore) Comments(pageID int64) ([]*Comment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var comments []*Comment
+	for _, c := range s.comments {
+		if c.PageID == pageID {
+			cc := *c
+			comments = append(comments, &cc)
+		}
+	}
+	return comments, nil
+}
+
+func (s *memStore) AddComment(c *Comment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c.ParentID != 0 && s.comment(c.PageID, c.ParentID) == nil {
+		return errNotFound
+	}
+	s.nextCommentID++
+	c.ID, c.CreatedAt = s.nextCommentID, time.Now()
+	stored := *c
+	s.comments = append(s.comments, &stored)
+	return nil
+}
+
+// comment returns the stored comment id of page pageID, nil if none.
+func (s *memStore) comment(pageID, id int64) *Comment {
+	for _, c := range s.comments {
+		if c.ID == id && c.PageID == pageID {
+			return c
+		}
+	}
+	return nil
+}
+
+func (s *memStore) SetCommentHidden(pageID, id int64, hidden bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.comment(pageID, id)
+	if c == nil {
+		return errNotFound
+	}
+	c.Hidden = hidden
+	return nil
+}
+
+func (s *memStore) DeleteComment(pageID, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.comment(pageID, id) == nil {
+		return errNotFound
+	}
+	// replies come after what they reply to
+	deleted := map[int64]bool{id: true}
+	kept := s.comments[:0]
+	for _, c := range s.comments {
+		if deleted[c.ID] || deleted[c.ParentID] {
+			deleted[c.ID] = true
+			continue
+		}
+		kept = append(kept, c)
+	}
+	s.comments = kept
+	return nil
+}
+
+func (s *memStore) RecentComments(limit, offset int) ([]*Comment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	titles := map[int64]string{}
+	for t, p := range s.pages {
+		titles[p.ID] = t
+	}
+	var comments []*Comment
+	for i := len(s.comments) - 1; i >= 0; i-- {
+		c := *s.comments[i]
+		title, ok := titles[c.PageID]
+		if c.Hidden || !ok {
+			continue
+		}
+		c.Title = title
+		comments = append(comments, &c)
+	}
+	comments = comments[min(offset, len(comments)):]
+	if len(comments) > limit {
+		comments = comments[:limit]
+	}
+	return comments, nil
+}
+
+func (s *memStore) PageTemplates() ([]*PageTemplate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []*PageTemplate
+	for _, t := range s.templates {
+		c := *t
+		list = append(list, &c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+func (s *memStore) SavePageTemplate(t *PageTemplate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t.UpdatedAt = time.Now()
+	c := *t
+	c.Stored = true
+	s.templates[t.Name] = &c
+	return nil
+}
+
+func (s *memStore) DeletePageTemplate(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.templates[name]; !ok {
+		return errNotFound
+	}
+	delete(s.templates, name)
+	return nil
+}
+
+func (s *memStore) SetWatch(title, account string, watch bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !watch {
+		delete(s.watches[title], account)
+		return nil
+	}
+	if s.watches[title] == nil {
+		s.watches[title] = map[string]bool{}
+	}
+	s.watches[title][account] = true
+	return nil
+}
+
+func (s *memStore) Watchers(title string) ([]*Watcher, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var watchers []*Watcher
+	for account := range s.watches[title] {
+		watchers = append(watchers, &Watcher{Name: account, Email: s.emails[strings.ToLower(account)]})
+	}
+	sort.Slice(watchers, func(i, j int) bool { return watchers[i].Name < watchers[j].Name })
+	return watchers, nil
+}
+
+func (s *memStore) Watchlist(account string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var titles []string
+	for title, accounts := range s.watches {
+		if accounts[account] {
+			titles = append(titles, title)
+		}
+	}
+	sort.Strings(titles)
+	return titles, nil
+}
+
+// Email finds every name, as the store keeps no accounts.
+func (s *memStore) Email(account string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.emails[strings.ToLower(account)], nil
+}
+
+func (s *memStore) SetEmail(account, email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.emails[strings.ToLower(account)] = email
+	return nil
+}
+
+func (s *memStore) Translation(title, lang string) (*Page, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.translations[title][lang]
+	if !ok {
+		return nil, errNotFound
+	}
+	return copyPage(t), nil
+}
+
+func (s *memStore) Translations(title string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var langs []string
+	for lang := range s.translations[title] {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs, nil
+}
+
+func (s *memStore) SaveTranslation(p *Page) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.translations[p.Title][p.Lang]
+	if ok && p.New {
+		return errCreateConflict
+	}
+	if p.BaseVersion > 0 && (!ok || stored.Version != p.BaseVersion) {
+		return errVersionConflict
+	}
+	now := time.Now()
+	if !ok {
+		stored = &Page{Title: p.Title, Lang: p.Lang, CreatedAt: now}
+		if s.translations[p.Title] == nil {
+			s.translations[p.Title] = map[string]*Page{}
+		}
+		s.translations[p.Title][p.Lang] = stored
+	}
+	stored.Body = append([]byte(nil), p.Body...)
+	stored.Version++
+	stored.UpdatedAt, stored.UpdatedBy = now, p.UpdatedBy
+	p.Version, p.UpdatedAt = stored.Version, now
+	renders.invalidate(p.Title)
+	return nil
+}
+
+func (s *memStore) CountView(p *Page) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.views[p.ID]++
+	if s.viewDays[p.ID] == nil {
+		s.viewDays[p.ID] = map[string]int64{}
+	}
+	s.viewDays[p.ID][time.Now().UTC().Format("2006-01-02")]++
+	return nil
+}
+
+// ViewStats has no referrers, as CountView does not see the request.
+func (s *memStore) ViewStats(p *Page, days int) (*ViewStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return newViewStats(days, s.viewDays[p.ID], nil), nil
+}
+
+func (s *memStore) Revisions(p *Page, limit, offset int, fields pageFields) ([]*Revision, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := s.revisions[p.ID]
+	var revs []*Revision
+	for i := len(stored) - 1 - offset; i >= 0 && len(revs) < limit; i-- {
+		rev := *stored[i]
+		rev.Body = nil
+		if fields == pageFull {
+			rev.Body = append([]byte(nil), stored[i].Body...)
+		}
+		rev.Delta = rev.Size
+		if i > 0 {
+			rev.Delta -= stored[i-1].Size
+		}
+		revs = append(revs, &rev)
+	}
+	return revs, len(stored), nil
+}
+
+func (s *memStore) RecentChanges(limit, offset int) ([]*Change, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var changes []*Change
+	for _, p := range s.pages {
+		stored := s.revisions[p.ID]
+		for i, r := range stored {
+			rev := *r
+			rev.Body = nil
+			rev.Delta = rev.Size
+			if i > 0 {
+				rev.Delta -= stored[i-1].Size
+			}
+			changes = append(changes, &Change{Title: p.Title, Revision: &rev})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].ID > changes[j].ID })
+	changes = changes[min(offset, len(changes)):]
+	if len(changes) > limit {
+		changes = changes[:limit]
+	}
+	return changes, nil
+}
+
+func (s *memStore) Revision(p *Page, id int64) (*Revision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rev := range s.revisions[p.ID] {
+		if rev.ID == id {
+			c := *rev
+			c.Body = append([]byte(nil), rev.Body...)
+			return &c, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+// Search matches q anywhere in titles and bodies, ignoring case, whatever
+// the backend.
+func (s *memStore) Search(q, ns string, backend searchBackend, n int) ([]*Page, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	want := strings.ToLower(q)
+	var pages []*Page
+	for _, p := range s.pages {
+		if !inNamespace(p.Title, ns) {
+			continue
+		}
+		if strings.Contains(strings.ToLower(p.Title), want) || strings.Contains(strings.ToLower(string(p.Body)), want) {
+			c := copyPage(p)
+			c.Snippet = snippetAround(string(p.Body), q)
+			c.Body = nil
+			pages = append(pages, c)
+		}
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i].Title < pages[j].Title })
+	if len(pages) > n {
+		pages = pages[:n]
+	}
+	return pages, nil
+}
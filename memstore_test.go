@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMemStoreCopiesPages(t *testing.T) {
+	s := newMemStore()
+	p := &Page{Title: "Home", Body: []byte("first")}
+	if err := s.Save(p); err != nil {
+		t.Fatal(err)
+	}
+	p.Body[0] = 'F'
+	loaded, err := s.Load("Home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(loaded.Body) != "first" {
+		t.Errorf("changing the saved page changed the stored body to %q", loaded.Body)
+	}
+	loaded.Body[0] = 'F'
+	if again, _ := s.Load("Home"); string(again.Body) != "first" {
+		t.Errorf("changing a loaded page changed the stored body to %q", again.Body)
+	}
+	if _, err := s.Load("Nowhere"); err != errNotFound {
+		t.Errorf("loading a missing page got %v, want errNotFound", err)
+	}
+}
+
+func TestMemStoreConflicts(t *testing.T) {
+	s := seedStore(map[string]string{"Home": "home"})
+	if err := s.Save(&Page{Title: "Home", Body: []byte("mine"), New: true}); err != errCreateConflict {
+		t.Errorf("creating a page that exists got %v, want errCreateConflict", err)
+	}
+	if err := s.Save(&Page{Title: "Home", Body: []byte("mine"), BaseVersion: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(&Page{Title: "Home", Body: []byte("stale"), BaseVersion: 1}); err != errVersionConflict {
+		t.Errorf("saving over version 1 of a page at version 2 got %v, want errVersionConflict", err)
+	}
+	if p, _ := s.Load("Home"); string(p.Body) != "mine" || p.Version != 2 {
+		t.Errorf("the page is %q at version %d, want \"mine\" at 2", p.Body, p.Version)
+	}
+}
+
+// TestConcurrentCreates has two people create the same page at once, first
+// on the store and then through the save handler.
+func TestConcurrentCreates(t *testing.T) {
+	keepConfig(t)
+	config.AnonymousEdits = true
+	store := newMemStore()
+	h := testServer(store)
+	for _, via := range []string{"store", "handler"} {
+		t.Run(via, func(t *testing.T) {
+			title := "CreatedBy" + via
+			var start, done sync.WaitGroup
+			start.Add(1)
+			errs := make([]error, 2)
+			codes := make([]int, 2)
+			bodies := make([]string, 2)
+			for i := range errs {
+				done.Add(1)
+				go func(i int) {
+					defer done.Done()
+					body := fmt.Sprintf("Written by %d.", i)
+					start.Wait()
+					if via == "store" {
+						errs[i] = store.Save(&Page{Title: title, Body: []byte(body), New: true})
+						return
+					}
+					w := request(h, http.MethodPost, "/save/"+title, url.Values{"body": {body}, "new": {"1"}})
+					codes[i], bodies[i] = w.Code, w.Body.String()
+				}(i)
+			}
+			start.Done()
+			done.Wait()
+
+			winner := 0
+			if via == "store" {
+				if errs[0] != nil {
+					winner = 1
+				}
+				if errs[winner] != nil || errs[1-winner] != errCreateConflict {
+					t.Fatalf("the saves got %v and %v, want one nil and one errCreateConflict", errs[0], errs[1])
+				}
+			} else {
+				if codes[0] != http.StatusSeeOther {
+					winner = 1
+				}
+				if codes[winner] != http.StatusSeeOther || codes[1-winner] != http.StatusConflict {
+					t.Fatalf("the saves got %d and %d, want 303 and 409", codes[0], codes[1])
+				}
+				if !strings.Contains(bodies[1-winner], "Someone else created this page") {
+					t.Errorf("the losing save doesn't say the page was created meanwhile:\n%s", bodies[1-winner])
+				}
+			}
+			p, err := store.Load(title)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := fmt.Sprintf("Written by %d.", winner); string(p.Body) != want || p.Version != 1 {
+				t.Errorf("the page is %q at version %d, want %q at 1", p.Body, p.Version, want)
+			}
+		})
+	}
+}
+
+// TestPageLifecycle takes a page from creation to deletion and back through
+// the handlers, on a memStore.
+func TestPageLifecycle(t *testing.T) {
+	keepConfig(t)
+	config.AnonymousEdits = true
+	config.AdminPassword = "secret"
+	store := seedStore(map[string]string{"Index": "See [[Notes]]."})
+	h := testServer(store)
+
+	w := request(h, http.MethodPost, "/save/Notes", url.Values{"body": {"First notes."}, "new": {"1"}})
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/view/Notes" {
+		t.Fatalf("creating the page got %d to %q", w.Code, w.Header().Get("Location"))
+	}
+	if w = request(h, http.MethodGet, "/view/Notes", nil); !strings.Contains(w.Body.String(), "First notes.") {
+		t.Fatalf("the new page shows %d: %s", w.Code, w.Body)
+	}
+
+	w = request(h, http.MethodPost, "/save/Notes", url.Values{"body": {"Second notes."}, "base-version": {"1"}})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("editing the page got %d", w.Code)
+	}
+	// someone who opened the page before that edit
+	w = request(h, http.MethodPost, "/save/Notes", url.Values{"body": {"Stale notes."}, "base-version": {"1"}})
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "Someone else saved this page") {
+		t.Fatalf("saving over an older version got %d", w.Code)
+	}
+	if p, _ := store.Load("Notes"); string(p.Body) != "Second notes." {
+		t.Errorf("after the conflict the page is %q", p.Body)
+	}
+
+	w = adminRequest(h, http.MethodPost, "/rename/Notes", url.Values{"title": {"Minutes"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("renaming the page got %d", w.Code)
+	}
+	if w = request(h, http.MethodGet, "/view/Notes", nil); w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/view/Minutes" {
+		t.Errorf("the old title got %d to %q", w.Code, w.Header().Get("Location"))
+	}
+	if p, _ := store.Load("Index"); string(p.Body) != "See [[Minutes]]." {
+		t.Errorf("the page linking to the old title is %q", p.Body)
+	}
+
+	if w = request(h, http.MethodPost, "/delete/Minutes", url.Values{}); w.Code != http.StatusUnauthorized {
+		t.Errorf("deleting without signing in got %d", w.Code)
+	}
+	if w = adminRequest(h, http.MethodPost, "/delete/Minutes", url.Values{}); w.Code != http.StatusSeeOther {
+		t.Fatalf("deleting the page got %d", w.Code)
+	}
+	if w = request(h, http.MethodGet, "/view/Minutes", nil); w.Code != http.StatusNotFound {
+		t.Errorf("the deleted page got %d", w.Code)
+	}
+	if w = adminRequest(h, http.MethodPost, "/restore/Minutes", url.Values{}); w.Code != http.StatusSeeOther {
+		t.Fatalf("restoring the page got %d", w.Code)
+	}
+	if w = request(h, http.MethodGet, "/view/Minutes", nil); !strings.Contains(w.Body.String(), "Second notes.") {
+		t.Errorf("the restored page shows %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestIndexListsPages(t *testing.T) {
+	h := testServer(seedStore(map[string]string{"Alpha": "a", "Beta": "b", "Gamma": "c"}))
+	w := request(h, http.MethodGet, "/index", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("the index got %d", w.Code)
+	}
+	body := w.Body.String()
+	a, b, c := strings.Index(body, "/view/Alpha"), strings.Index(body, "/view/Beta"), strings.Index(body, "/view/Gamma")
+	if a < 0 || b < a || c < b {
+		t.Errorf("the index doesn't list Alpha, Beta and Gamma in order: %d, %d, %d", a, b, c)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+type Merge struct {
+	Source      string
+	Destination string
+	Error       string
+}
+
+// mergePages appends source onto destination, repoints links to source and
+// archives it, all in one transaction.
+func mergePages(source, destination, editor string, store PageStore) error {
+	src, err := store.Load(source)
+	if err != nil {
+		return fmt.Errorf("source %s: %w", source, err)
+	}
+	dst, err := store.Load(destination)
+	if err != nil {
+		return fmt.Errorf("destination %s: %w", destination, err)
+	}
+
+	dst.Body = append(dst.Body, fmt.Sprintf("\n\n## Merged from %s\n\n", source)...)
+	dst.Body = append(dst.Body, src.Body...)
+	dst.UpdatedBy = editor
+	return store.Apply(saveWrite(dst), relinkWrite(source, destination, editor), archiveWrite(source))
+}
+
+func mergeHandler(w http.ResponseWriter, r *http.Request, store PageStore) {
+	m := &Merge{Source: canonicalTitle(r.FormValue("source")), Destination: canonicalTitle(r.FormValue("destination"))}
+	if r.Method != http.MethodPost {
+		renderTemplate(w, r, "merge", m)
+		return
+	}
+
+	switch {
+	case !validTitle.MatchString(m.Source) || !validTitle.MatchString(m.Destination):
+		m.Error = "Both titles must be valid page titles."
+	case m.Source == m.Destination:
+		m.Error = "A page cannot be merged into itself."
+	}
+	if m.Error != "" {
+		renderTemplateStatus(w, r, http.StatusBadRequest, "merge", m)
+		return
+	}
+
+	err := mergePages(m.Source, m.Destination, editorName(r), store)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errNotFound) {
+			status = http.StatusNotFound
+		}
+		m.Error = err.Error()
+		renderTemplateStatus(w, r, status, "merge", m)
+		return
+	}
+	redirect(w, r, pagePath("view", m.Destination), http.StatusSeeOther)
+}
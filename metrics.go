@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// accessLog records every request as a JSON line, nil unless -access-log
+// is set.
+var accessLog *slog.Logger
+
+// metricsRegistry holds what /metrics exposes for Prometheus.
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gowiki_http_requests_total",
+		Help: "Requests answered, by method, route and status code.",
+	}, []string{"method", "route", "code"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gowiki_http_request_duration_seconds",
+		Help:    "Time taken to answer requests, by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route"})
+	queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gowiki_db_query_duration_seconds",
+		Help:    "Time taken by database queries, by the name timeQuery gives them.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"query"})
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gowiki_rate_limited_requests_total",
+		Help: "Requests turned away with a 429 by -read-rate-limit or -write-rate-limit, by kind.",
+	}, []string{"kind"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		httpRequests,
+		httpDuration,
+		queryDuration,
+		rateLimited,
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "gowiki_db_slow_queries_total",
+			Help: "Database queries that took longer than -slow-query.",
+		}, func() float64 { return float64(atomic.LoadInt64(&slowQueries)) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "gowiki_http_panics_total",
+			Help: "Requests whose handler panicked.",
+		}, func() float64 { return float64(recentErrors.count()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "gowiki_renders_in_flight",
+			Help: "Pages being rendered right now, at most -max-renders.",
+		}, func() float64 { return float64(atomic.LoadInt64(&rendersInFlight)) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "gowiki_renders_shed_total",
+			Help: "Requests answered with a 503 after waiting -render-queue-timeout for a render slot.",
+		}, func() float64 { return float64(atomic.LoadInt64(&shedRenders)) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "gowiki_save_queue_depth",
+			Help: "Saves waiting for their revisions, tags and links to be written, with -save-queue.",
+		}, func() float64 { return float64(len(saveQueue)) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "gowiki_save_queue_capacity",
+			Help: "Saves the queue of -save-queue holds before saving waits for room.",
+		}, func() float64 { return float64(cap(saveQueue)) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "gowiki_save_queue_full_total",
+			Help: "Saves that waited for room in the save queue.",
+		}, func() float64 { return float64(atomic.LoadInt64(&saveQueueFull)) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "gowiki_save_queue_dropped_total",
+			Help: "Queued saves whose revisions, tags and links could not be written.",
+		}, func() float64 { return float64(atomic.LoadInt64(&droppedSaves)) }),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+var (
+	pagesDesc         = prometheus.NewDesc("gowiki_pages", "Pages of the wiki.", nil, nil)
+	archivedPagesDesc = prometheus.NewDesc("gowiki_archived_pages", "Pages deleted or expired and kept in the archive.", nil, nil)
+)
+
+// pageCounts counts the pages when scraped, so the numbers are those of the
+// database whichever server made the changes.
+type pageCounts struct {
+	conn db
+}
+
+func (c pageCounts) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pagesDesc
+	ch <- archivedPagesDesc
+}
+
+func (c pageCounts) Collect(ch chan<- prometheus.Metric) {
+	defer timeQuery("pageCounts", time.Now())
+	var pages, archived int64
+	query := "SELECT (SELECT count(*) FROM " + table("pages") + "), (SELECT count(*) FROM " + table("archived_pages") + ")"
+	if err := c.conn.QueryRow(context.Background(), query).Scan(&pages, &archived); err != nil {
+		ch <- prometheus.NewInvalidMetric(pagesDesc, err)
+		ch <- prometheus.NewInvalidMetric(archivedPagesDesc, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(pagesDesc, prometheus.GaugeValue, float64(pages))
+	ch <- prometheus.MustNewConstMetric(archivedPagesDesc, prometheus.GaugeValue, float64(archived))
+}
+
+// metricsHandler serves the metrics in the Prometheus text format. When the
+// database is down the page counts are left out and the rest still served.
+func metricsHandler(conn db) http.Handler {
+	metricsRegistry.MustRegister(pageCounts{conn: conn})
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{ErrorHandling: promhttp.ContinueOnError})
+}
+
+// statusRecorder remembers the status and size of a response for the
+// access log and the metrics.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if sr.status == 0 && code >= 200 {
+		sr.status = code
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.size += int64(n)
+	return n, err
+}
+
+// Flush keeps event streams and streamed pages working through the
+// recorder.
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// routeOf is the pattern of the handler r goes to, like /view/, so the
+// metrics have a series per route rather than per page.
+func routeOf(r *http.Request) string {
+	path := r.URL.Path
+	if config.BasePath != "" {
+		var ok bool
+		if path, ok = strings.CutPrefix(path, config.BasePath); !ok {
+			return "other"
+		}
+	}
+	u := *r.URL
+	u.Path = path
+	_, pattern := http.DefaultServeMux.Handler(&http.Request{Method: r.Method, Host: r.Host, URL: &u})
+	if pattern == "" {
+		return "other"
+	}
+	return pattern
+}
+
+// metricMethod keeps made up methods from adding series.
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodPatch, http.MethodOptions:
+		return method
+	}
+	return "other"
+}
+
+// observeRequests counts and times every request, and writes it to the
+// access log.
+func observeRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(sr, r)
+		elapsed := time.Since(start)
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+		route := routeOf(r)
+		httpRequests.WithLabelValues(metricMethod(r.Method), route, strconv.Itoa(sr.status)).Inc()
+		httpDuration.WithLabelValues(route).Observe(elapsed.Seconds())
+		if accessLog != nil {
+			accessLog.Info("request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", sr.status,
+				"bytes", sr.size,
+				"latency_ms", float64(elapsed.Microseconds())/1000,
+				"ip", clientIP(r),
+			)
+		}
+	})
+}
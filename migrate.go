@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// migrations/NNNN_name.sql are applied in order of NNNN, each once. Table
+// and index names are written {{prefix}}name so every -table-prefix gets its
+// own.
+//
+//go:embed migrations/*.sql
+var embeddedMigrations embed.FS
+
+// backfills fill in what a migration adds from the existing pages, in the
+// same transaction, after its SQL ran.
+var backfills = map[int]func(conn db) error{
+	// page_links
+	2: func(conn db) error {
+		_, err := reindex(conn, nil)
+		return err
+	},
+}
+
+type migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// loadMigrations reads the migrations of fsys, oldest first.
+func loadMigrations(fsys fs.FS) ([]migration, error) {
+	names, err := fs.Glob(fsys, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	var migrations []migration
+	seen := map[int]string{}
+	for _, name := range names {
+		base := strings.TrimSuffix(path.Base(name), ".sql")
+		number, _, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(number)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s does not start with a version number", name)
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", other, name)
+		}
+		seen[version] = name
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		sql := strings.ReplaceAll(string(data), "{{prefix}}", config.TablePrefix)
+		migrations = append(migrations, migration{Version: version, Name: base, SQL: sql})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// migrate applies the migrations the database doesn't have yet, in one
+// transaction, and returns their names. Servers starting at once wait for
+// each other rather than both migrating.
+func migrate(ctx context.Context, conn db) ([]string, error) {
+	migrations, err := loadMigrations(embeddedMigrations)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", table("schema_migrations")); err != nil {
+		return nil, err
+	}
+	query := `CREATE TABLE IF NOT EXISTS ` + table("schema_migrations") + ` (
+		version BIGINT PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`
+	if _, err := tx.Exec(ctx, query); err != nil {
+		return nil, err
+	}
+	applied := map[int]bool{}
+	versions, err := queryStrings(ctx, tx, "SELECT version::text FROM "+table("schema_migrations"))
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range versions {
+		n, _ := strconv.Atoi(v)
+		applied[n] = true
+	}
+
+	var names []string
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+		// without arguments Exec runs every statement of the file
+		if _, err := tx.Exec(ctx, m.SQL); err != nil {
+			return nil, fmt.Errorf("migration %s: %w", m.Name, err)
+		}
+		if fill := backfills[m.Version]; fill != nil {
+			if err := fill(tx); err != nil {
+				return nil, fmt.Errorf("migration %s: %w", m.Name, err)
+			}
+		}
+		query := "INSERT INTO " + table("schema_migrations") + " (version, name) VALUES ($1, $2)"
+		if _, err := tx.Exec(ctx, query, m.Version, m.Name); err != nil {
+			return nil, err
+		}
+		names = append(names, m.Name)
+	}
+	if config.BodyCompression != "" {
+		// only changes the columns' settings, so it is cheap to repeat
+		for _, t := range []string{"pages", "archived_pages", "page_revisions"} {
+			if _, err := tx.Exec(ctx, "ALTER TABLE "+table(t)+" ALTER COLUMN body SET COMPRESSION "+config.BodyCompression); err != nil {
+				return nil, fmt.Errorf("body compression: %w", err)
+			}
+		}
+	}
+	return names, tx.Commit(ctx)
+}
+
+// migrateCommand brings the schema up to date without starting the server.
+func migrateCommand(conn db, args []string) error {
+	names, err := migrate(context.Background(), conn)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		fmt.Printf("applied %s\n", name)
+	}
+	if len(names) == 0 {
+		fmt.Println("the schema is up to date")
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+-- The schema as schema.sql created it before migrations. Every statement is
+-- idempotent, so databases set up with schema.sql migrate cleanly.
+
+CREATE TABLE IF NOT EXISTS {{prefix}}pages (
+  id BIGSERIAL PRIMARY KEY,
+  title TEXT NOT NULL UNIQUE,
+  body TEXT NOT NULL DEFAULT ''
+);
+
+ALTER TABLE {{prefix}}pages ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE {{prefix}}pages ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+CREATE INDEX IF NOT EXISTS {{prefix}}pages_created_at ON {{prefix}}pages (created_at);
+
+-- who may edit a page: anyone, users (signed in) or admins
+ALTER TABLE {{prefix}}pages ADD COLUMN IF NOT EXISTS protection TEXT NOT NULL DEFAULT 'anyone'
+  CHECK (protection IN ('anyone', 'users', 'admins'));
+
+-- name of the last editor, NULL for anonymous edits
+ALTER TABLE {{prefix}}pages ADD COLUMN IF NOT EXISTS updated_by TEXT;
+
+ALTER TABLE {{prefix}}pages ADD COLUMN IF NOT EXISTS views BIGINT NOT NULL DEFAULT 0;
+
+-- when the page is archived, from its `expires:` front matter; NULL for never
+ALTER TABLE {{prefix}}pages ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+
+-- bumped on every change to the body, for optimistic updates through the API
+ALTER TABLE {{prefix}}pages ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
+
+-- fuzzy title matching for "did you mean" suggestions
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+CREATE INDEX IF NOT EXISTS {{prefix}}pages_title_trgm ON {{prefix}}pages USING gin (title gin_trgm_ops);
+
+-- full text search with -search-backend fts; the language must match
+-- -search-language for the index to be used
+CREATE INDEX IF NOT EXISTS {{prefix}}pages_fts ON {{prefix}}pages USING gin (to_tsvector('english', title || ' ' || body));
+
+-- soft-deleted pages, kept so they can be restored
+CREATE TABLE IF NOT EXISTS {{prefix}}archived_pages (
+  id BIGSERIAL PRIMARY KEY,
+  page_id BIGINT NOT NULL,
+  title TEXT NOT NULL,
+  body TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL,
+  updated_at TIMESTAMPTZ NOT NULL,
+  archived_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS {{prefix}}archived_pages_title ON {{prefix}}archived_pages (title);
+
+-- tags come from the `tags:` front matter of a page body; page_tags is the
+-- index rebuilt on every save
+CREATE TABLE IF NOT EXISTS {{prefix}}tags (
+  id BIGSERIAL PRIMARY KEY,
+  name TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS {{prefix}}page_tags (
+  page_id BIGINT NOT NULL REFERENCES {{prefix}}pages (id) ON DELETE CASCADE,
+  tag_id BIGINT NOT NULL REFERENCES {{prefix}}tags (id) ON DELETE CASCADE,
+  PRIMARY KEY (page_id, tag_id)
+);
+
+CREATE INDEX IF NOT EXISTS {{prefix}}page_tags_tag_id ON {{prefix}}page_tags (tag_id);
+
+-- former titles of renamed pages, so old links redirect to the page
+CREATE TABLE IF NOT EXISTS {{prefix}}page_aliases (
+  title TEXT PRIMARY KEY,
+  page_id BIGINT NOT NULL REFERENCES {{prefix}}pages (id) ON DELETE CASCADE
+);
+
+-- every saved body; page_id has no foreign key so the history of an
+-- archived page is kept
+CREATE TABLE IF NOT EXISTS {{prefix}}page_revisions (
+  id BIGSERIAL PRIMARY KEY,
+  page_id BIGINT NOT NULL,
+  body TEXT NOT NULL,
+  author TEXT,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS {{prefix}}page_revisions_page_id ON {{prefix}}page_revisions (page_id, id);
+
+ALTER TABLE {{prefix}}page_revisions ADD COLUMN IF NOT EXISTS summary TEXT NOT NULL DEFAULT '';
+
+-- single page views, written in batches and folded into page_view_days
+-- once their day is over
+CREATE TABLE IF NOT EXISTS {{prefix}}page_views (
+  page_id BIGINT NOT NULL REFERENCES {{prefix}}pages (id) ON DELETE CASCADE,
+  referrer TEXT NOT NULL DEFAULT '',
+  viewed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS {{prefix}}page_views_page_id ON {{prefix}}page_views (page_id, viewed_at);
+
+-- views per page, UTC day and referrer host
+CREATE TABLE IF NOT EXISTS {{prefix}}page_view_days (
+  page_id BIGINT NOT NULL REFERENCES {{prefix}}pages (id) ON DELETE CASCADE,
+  day DATE NOT NULL,
+  referrer TEXT NOT NULL DEFAULT '',
+  views BIGINT NOT NULL,
+  PRIMARY KEY (page_id, day, referrer)
+);
+
+-- uploaded file contents, stored once however many pages use them
+CREATE TABLE IF NOT EXISTS {{prefix}}file_blobs (
+  hash TEXT PRIMARY KEY,
+  size BIGINT NOT NULL,
+  data BYTEA NOT NULL
+);
+
+-- content kept in the server's -upload-dir has an empty data
+ALTER TABLE {{prefix}}file_blobs ADD COLUMN IF NOT EXISTS on_disk BOOLEAN NOT NULL DEFAULT false;
+
+CREATE TABLE IF NOT EXISTS {{prefix}}page_files (
+  page_id BIGINT NOT NULL REFERENCES {{prefix}}pages (id) ON DELETE CASCADE,
+  name TEXT NOT NULL,
+  hash TEXT NOT NULL REFERENCES {{prefix}}file_blobs (hash),
+  content_type TEXT NOT NULL,
+  uploaded_by TEXT,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (page_id, name)
+);
+
+-- accounts signing in with a password, hashed with bcrypt
+CREATE TABLE IF NOT EXISTS {{prefix}}users (
+  id BIGSERIAL PRIMARY KEY,
+  name TEXT NOT NULL,
+  password_hash TEXT NOT NULL,
+  role TEXT NOT NULL DEFAULT 'user',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+-- names are unique whatever their case
+CREATE UNIQUE INDEX IF NOT EXISTS {{prefix}}users_name ON {{prefix}}users (lower(name));
@@ -0,0 +1,10 @@
+-- links between pages, from the [[wiki links]] and /view/ links of a page
+-- body, rebuilt on every save like page_tags; target is a title, so links to
+-- pages that don't exist yet are kept too
+CREATE TABLE IF NOT EXISTS {{prefix}}page_links (
+  page_id BIGINT NOT NULL REFERENCES {{prefix}}pages (id) ON DELETE CASCADE,
+  target TEXT NOT NULL,
+  PRIMARY KEY (page_id, target)
+);
+
+CREATE INDEX IF NOT EXISTS {{prefix}}page_links_target ON {{prefix}}page_links (target);
@@ -0,0 +1,8 @@
+-- accounts are readers, editors or admins; the accounts created before as
+-- users could edit, so they become editors
+UPDATE {{prefix}}users SET role = 'editor' WHERE role = 'user';
+
+ALTER TABLE {{prefix}}users ALTER COLUMN role SET DEFAULT 'editor';
+
+ALTER TABLE {{prefix}}users ADD CONSTRAINT {{prefix}}users_role
+  CHECK (role IN ('reader', 'editor', 'admin'));
@@ -0,0 +1,12 @@
+-- drafts of pages, one per page and account, kept apart from the page until
+-- their author publishes them; title isn't a reference so pages that don't
+-- exist yet can have drafts too
+CREATE TABLE IF NOT EXISTS {{prefix}}drafts (
+  title TEXT NOT NULL,
+  author TEXT NOT NULL,
+  body TEXT NOT NULL,
+  summary TEXT NOT NULL DEFAULT '',
+  base_version BIGINT NOT NULL DEFAULT 0,
+  saved_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (title, author)
+);
@@ -0,0 +1,14 @@
+-- the discussion of each page at /talk/<title>; page_id isn't a reference so
+-- the comments of a deleted page come back when it is restored. Deleting a
+-- comment deletes the replies to it.
+CREATE TABLE IF NOT EXISTS {{prefix}}comments (
+  id BIGSERIAL PRIMARY KEY,
+  page_id BIGINT NOT NULL,
+  parent_id BIGINT REFERENCES {{prefix}}comments (id) ON DELETE CASCADE,
+  author TEXT NOT NULL,
+  body TEXT NOT NULL,
+  hidden BOOLEAN NOT NULL DEFAULT false,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS {{prefix}}comments_page ON {{prefix}}comments (page_id, id);
@@ -0,0 +1,8 @@
+-- page templates admins keep at /templates, offered along with those of
+-- -page-templates when a new page is started
+CREATE TABLE IF NOT EXISTS {{prefix}}page_templates (
+  name TEXT PRIMARY KEY,
+  body TEXT NOT NULL,
+  updated_by TEXT NOT NULL DEFAULT '',
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,12 @@
+-- pages accounts are told about when someone else saves them; account is
+-- the name of the account, like drafts.author
+CREATE TABLE IF NOT EXISTS {{prefix}}watches (
+  title TEXT NOT NULL,
+  account TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (title, account)
+);
+CREATE INDEX IF NOT EXISTS {{prefix}}watches_account ON {{prefix}}watches (account);
+
+-- where changes to watched pages are emailed, empty for no email
+ALTER TABLE {{prefix}}users ADD COLUMN IF NOT EXISTS email TEXT NOT NULL DEFAULT '';
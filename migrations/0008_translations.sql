@@ -0,0 +1,13 @@
+-- pages in the languages of -languages other than the first, which is that
+-- of the pages themselves; title isn't a reference, like drafts.title, so a
+-- deleted page gets its translations back when restored
+CREATE TABLE IF NOT EXISTS {{prefix}}page_translations (
+  title TEXT NOT NULL,
+  lang TEXT NOT NULL,
+  body TEXT NOT NULL,
+  version BIGINT NOT NULL DEFAULT 1,
+  updated_by TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (title, lang)
+);
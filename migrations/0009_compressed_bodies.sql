@@ -0,0 +1,14 @@
+-- bodies gzipped by the server under -gzip-bodies: compressed rows leave
+-- body empty and keep it in body_gz, with body_size its size unzipped and
+-- search_vector the words searches find it by, as Postgres can't read
+-- body_gz; rows written before or with the option off keep their body as
+-- text
+ALTER TABLE {{prefix}}pages ADD COLUMN IF NOT EXISTS compressed BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE {{prefix}}pages ADD COLUMN IF NOT EXISTS body_gz BYTEA;
+ALTER TABLE {{prefix}}pages ADD COLUMN IF NOT EXISTS body_size INTEGER;
+ALTER TABLE {{prefix}}pages ADD COLUMN IF NOT EXISTS search_vector TSVECTOR;
+
+-- gzip leaves nothing for TOAST to compress
+ALTER TABLE {{prefix}}pages ALTER COLUMN body_gz SET STORAGE EXTERNAL;
+
+CREATE INDEX IF NOT EXISTS {{prefix}}pages_search_vector ON {{prefix}}pages USING gin (search_vector);
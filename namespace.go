@@ -0,0 +1,79 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Titles like eng:Onboarding belong to the eng namespace; titles without a
+// prefix belong to defaultNamespace.
+const (
+	defaultNamespace = "main"
+	namespacePattern = "[a-z0-9]+"
+	// pages listed on a namespace index
+	namespaceListSize = 500
+)
+
+var validNamespace = regexp.MustCompile("^" + namespacePattern + "$")
+
+// namespaceSQL is the namespace of the title column, as namespaceOf.
+const namespaceSQL = "CASE WHEN strpos(title, ':') > 0 THEN split_part(title, ':', 1) ELSE '" + defaultNamespace + "' END"
+
+// namespaceOf splits a title into its namespace and the rest of the title.
+func namespaceOf(title string) (ns, name string) {
+	if i := strings.IndexByte(title, ':'); i >= 0 {
+		return title[:i], title[i+1:]
+	}
+	return defaultNamespace, title
+}
+
+// inNamespace reports whether title is in ns; every title is in "".
+func inNamespace(title, ns string) bool {
+	if ns == "" {
+		return true
+	}
+	got, _ := namespaceOf(title)
+	return got == ns
+}
+
+// frontPageOf returns the title of the front page of ns.
+func frontPageOf(ns string) string {
+	if ns == defaultNamespace {
+		return "FrontPage"
+	}
+	return ns + ":FrontPage"
+}
+
+type Namespace struct {
+	Name      string
+	FrontPage string
+	HTML      template.HTML
+	Pages     []*Page
+	Limit     int
+}
+
+func namespaceHandler(w http.ResponseWriter, r *http.Request, store PageStore) {
+	ns := &Namespace{Name: strings.TrimPrefix(r.URL.Path, "/ns/"), Limit: namespaceListSize}
+	if !validNamespace.MatchString(ns.Name) {
+		http.NotFound(w, r)
+		return
+	}
+	ns.FrontPage = frontPageOf(ns.Name)
+
+	p, err := store.Load(ns.FrontPage)
+	if err == nil {
+		ns.HTML, err = renderPage(p, store)
+	} else if err == errNotFound {
+		err = nil
+	}
+	if err == nil {
+		ns.Pages, err = store.List(orderTitle, ns.Name, 0, namespaceListSize)
+	}
+	if err != nil {
+		renderFailed(w, err)
+		return
+	}
+	renderTemplate(w, r, "namespace", ns)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+)
+
+// pages listed under "Pages under this one" on a page
+const subpagesShown = 100
+
+// Crumb is one level of the breadcrumb of a page under others: the title
+// of the page at that level and the last part of it, which is shown.
+type Crumb struct {
+	Title string
+	Name  string
+}
+
+// breadcrumb returns the levels of title from the top, like Projects,
+// Projects/GoWiki and Projects/GoWiki/Design for the last, or nil for a
+// title not under any other. A namespace stays on the first level.
+func breadcrumb(title string) []*Crumb {
+	if !strings.Contains(title, "/") {
+		return nil
+	}
+	var crumbs []*Crumb
+	for i, r := range title + "/" {
+		if r != '/' {
+			continue
+		}
+		level := canonicalTitle(title[:i])
+		_, name := namespaceOf(level)
+		if j := strings.LastIndexByte(name, '/'); j >= 0 {
+			name = name[j+1:]
+		}
+		crumbs = append(crumbs, &Crumb{Title: level, Name: name})
+	}
+	return crumbs
+}
+
+// Subpages is the list of the pages under a page, like Projects/GoWiki
+// under Projects, by the rest of their titles.
+type Subpages struct {
+	Parent string
+	Names  []string
+	// set when there are more than subpagesShown
+	More bool
+}
+
+// viewSubpages gathers the pages under title, whether or not title is a
+// page itself, so a missing level of a hierarchy still lists what's
+// below. A failure is only logged and leaves them out.
+func viewSubpages(title string, store PageStore) *Subpages {
+	prefix := title + "/"
+	titles, err := store.TitlesWithPrefix(prefix, subpagesShown+1)
+	if err != nil {
+		log.Printf("loading the pages under %s: %v", title, err)
+		return nil
+	}
+	s := &Subpages{Parent: title}
+	for _, t := range titles {
+		// the prefix is matched in any letter case
+		if name, ok := strings.CutPrefix(t, prefix); ok {
+			s.Names = append(s.Names, name)
+		}
+	}
+	if len(s.Names) == 0 {
+		return nil
+	}
+	if len(s.Names) > subpagesShown {
+		s.Names, s.More = s.Names[:subpagesShown], true
+	}
+	return s
+}
+
+// TagNav links a page to the pages before and after it, by title, among
+// those tagged with Tag; either is empty at the ends.
+type TagNav struct {
+	Tag  string
+	Prev string
+	Next string
+}
+
+// viewTagNav gathers the neighbours of p in each of its tags. Like the
+// backlinks, a failure is logged and leaves them out.
+func viewTagNav(p *Page, tags []string, store PageStore) []*TagNav {
+	var nav []*TagNav
+	for _, tag := range tags {
+		prev, next, err := store.TagNeighbours(tag, p.Title)
+		if err != nil {
+			log.Printf("loading the neighbours of %s in %s: %v", p.Title, tag, err)
+			return nil
+		}
+		if prev != "" || next != "" {
+			nav = append(nav, &TagNav{Tag: tag, Prev: prev, Next: next})
+		}
+	}
+	return nav
+}
+
+// randomHandler sends the reader to a page picked at random at /random,
+// any page being as likely as another.
+func randomHandler(w http.ResponseWriter, r *http.Request, store PageStore) {
+	n, err := store.Count()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var pages []*Page
+	if n > 0 {
+		pages, err = store.List(orderTitle, "", rand.Intn(n), 1)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if len(pages) == 0 {
+		// nothing yet, or the last pages were deleted since counting them
+		http.Error(w, "There are no pages yet.", http.StatusNotFound)
+		return
+	}
+	// a new page every time, also after going back
+	w.Header().Set("Cache-Control", "no-store")
+	redirect(w, r, pagePath("view", pages[0].Title), http.StatusFound)
+}
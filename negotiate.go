@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// negotiate returns the offered media type the Accept header prefers. Ties
+// and a missing header go to the earliest offer, so list the default first.
+func negotiate(accept string, offers ...string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+	best, bestQ := offers[0], 0.0
+	for _, offer := range offers {
+		if q := acceptQuality(accept, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// acceptQuality returns the quality the Accept header gives a media type,
+// taken from its most specific matching range.
+func acceptQuality(accept, mediaType string) float64 {
+	typ, sub := mediaType, ""
+	if i := strings.IndexByte(mediaType, '/'); i >= 0 {
+		typ, sub = mediaType[:i], mediaType[i+1:]
+	}
+	q, spec := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		r := strings.ToLower(strings.TrimSpace(params[0]))
+		rt, rs := r, ""
+		if i := strings.IndexByte(r, '/'); i >= 0 {
+			rt, rs = r[:i], r[i+1:]
+		}
+		s := -1
+		switch {
+		case rt == typ && rs == sub:
+			s = 2
+		case rt == typ && rs == "*":
+			s = 1
+		case rt == "*" && rs == "*":
+			s = 0
+		}
+		if s <= spec {
+			continue
+		}
+		rq := 1.0
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					rq = v
+				}
+			}
+		}
+		q, spec = rq, s
+	}
+	return q
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	offers := []string{"text/html", "text/markdown", "application/json"}
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", "text/html"},
+		{"*/*", "text/html"},
+		{"text/html", "text/html"},
+		{"text/markdown", "text/markdown"},
+		{"application/json", "application/json"},
+		{"APPLICATION/JSON", "application/json"},
+		{"text/*", "text/html"},
+		{"text/*;q=0.5, text/markdown", "text/markdown"},
+		{"text/markdown;q=0.9, application/json", "application/json"},
+		{"application/json;q=0, */*;q=0.1", "text/html"},
+		// what browsers send
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "text/html"},
+		{"image/png", "text/html"},
+	}
+	for _, tt := range tests {
+		if got := negotiate(tt.accept, offers...); got != tt.want {
+			t.Errorf("negotiate(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+// TestViewNegotiatesFormat asks /view for each of its forms by Accept.
+func TestViewNegotiatesFormat(t *testing.T) {
+	keepConfig(t)
+	config.PageJSONBody = "text"
+	body := "# Home\n\nWelcome to the *wiki*."
+	h := testServer(seedStore(map[string]string{"Home": body}))
+	tests := []struct {
+		accept      string
+		contentType string
+	}{
+		{"", "text/html; charset=utf-8"},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "text/html; charset=utf-8"},
+		{"text/markdown", "text/markdown; charset=utf-8"},
+		{"application/json", "application/json"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/view/Home", nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Accept %q got %d", tt.accept, w.Code)
+		}
+		if got := w.Header().Get("Content-Type"); got != tt.contentType {
+			t.Errorf("Accept %q got Content-Type %q, want %q", tt.accept, got, tt.contentType)
+		}
+		if !strings.Contains(w.Header().Get("Vary"), "Accept") {
+			t.Errorf("Accept %q: the response doesn't vary by Accept", tt.accept)
+		}
+		switch tt.contentType {
+		case "text/markdown; charset=utf-8":
+			if w.Body.String() != body {
+				t.Errorf("Markdown is %q, want the body %q", w.Body, body)
+			}
+		case "application/json":
+			var p Page
+			if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+				t.Fatal(err)
+			}
+			if p.Title != "Home" || string(p.Body) != body {
+				t.Errorf("JSON page is %q with body %q", p.Title, p.Body)
+			}
+		default:
+			if !strings.Contains(w.Body.String(), "<em>wiki</em>") {
+				t.Errorf("Accept %q didn't get the rendered page", tt.accept)
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// defaultBoilerplate is what the editor starts a new page with unless
+// -new-page-template names a file.
+const defaultBoilerplate = "# {{title}}\n\n## Overview\n\n"
+
+// boilerplate is loaded once at startup.
+var boilerplate = defaultBoilerplate
+
+func loadBoilerplate(path string) (string, error) {
+	if path == "" {
+		return defaultBoilerplate, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// expandBoilerplate replaces {{title}} in text with title and {{date}} with
+// the day of now, like 2024-12-31.
+func expandBoilerplate(text, title string, now time.Time) []byte {
+	return []byte(strings.NewReplacer("{{title}}", title, "{{date}}", now.Format("2006-01-02")).Replace(text))
+}
+
+// newPageBody is the starting body of a page called title that does not
+// exist yet, the boilerplate expanded.
+func newPageBody(title string) []byte {
+	return expandBoilerplate(boilerplate, title, time.Now())
+}
+
+// PageTemplate is a named boilerplate new pages can start from at /new, like
+// "meeting" for meeting notes.
+type PageTemplate struct {
+	Name string
+	Body string
+	// set for templates kept in the database rather than -page-templates
+	Stored    bool
+	UpdatedBy string
+	UpdatedAt time.Time
+}
+
+// Label is the name as shown to users, "decision-record" as "decision record".
+func (t *PageTemplate) Label() string {
+	return strings.ReplaceAll(t.Name, "-", " ")
+}
+
+// page templates from -page-templates, by name, loaded once at startup
+var pageTemplates []*PageTemplate
+
+var validTemplateName = regexp.MustCompile(`^[a-z0-9]+(?:-[a-z0-9]+)*$`)
+
+// loadPageTemplates reads every .md file in dir as a page template named
+// after the file, meeting.md as "meeting".
+func loadPageTemplates(dir string) ([]*PageTemplate, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	// Glob sorts its matches
+	paths, err := filepath.Glob(filepath.Join(dir, "*.md"))
+	if err != nil {
+		return nil, err
+	}
+	var list []*PageTemplate
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".md")
+		if !validTemplateName.MatchString(name) {
+			return nil, fmt.Errorf("%s: template names are lowercase letters and digits, with dashes between words", path)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, &PageTemplate{Name: name, Body: string(b)})
+	}
+	return list, nil
+}
+
+func findPageTemplate(list []*PageTemplate, name string) *PageTemplate {
+	for _, t := range list {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// NewPage is the data model of the /new page.
+type NewPage struct {
+	Templates []*PageTemplate
+	Title     string
+	Template  string
+	Errors    *Validation
+}
+
+// newPageHandler offers to start a page from one of the page templates, and
+// given ?title= opens the editor on it, filled in with ?template=, or the
+// usual boilerplate without one.
+func newPageHandler(w http.ResponseWriter, r *http.Request, store PageStore) {
+	q := r.URL.Query()
+	list, err := availableTemplates(store)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	np := &NewPage{Templates: list, Title: canonicalTitle(q.Get("title")), Template: q.Get("template")}
+	if np.Title == "" && !q.Has("title") {
+		renderTemplate(w, r, "new", np)
+		return
+	}
+
+	v := &Validation{}
+	status := http.StatusBadRequest
+	t := findPageTemplate(list, np.Template)
+	if np.Template != "" && t == nil {
+		v.add("template", fmt.Sprintf("There is no template called %q.", np.Template))
+	}
+	if err := checkTitle(np.Title); err != nil {
+		v.add("title", sentence(err.Error()))
+	} else if _, err := store.Stat(np.Title); err == nil {
+		v.add("title", np.Title+" already exists, edit it instead or choose another title.")
+		status = http.StatusConflict
+	} else if err != errNotFound {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if v.Failed() {
+		np.Errors = v
+		renderTemplateStatus(w, r, status, "new", np)
+		return
+	}
+
+	p := &Page{Title: np.Title, Body: newPageBody(np.Title), New: config.NewPageConflict == "conflict"}
+	if t != nil {
+		p.Body = expandBoilerplate(t.Body, np.Title, time.Now())
+	}
+	if !checkEdit(w, r, p.Protection) {
+		return
+	}
+	renderEdit(w, r, http.StatusOK, &Edit{Page: p})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// normalizeURLs redirects variants of page URLs, like /VIEW/Page or
+// /view/Page/, to the form the routes expect. Only the action is matched
+// without regard to case since titles are case-sensitive. A redirect is
+// only sent when its target is a valid page URL, which the next request
+// then passes through unchanged, so it can't loop.
+func normalizeURLs(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		canonical := canonicalPath(r.URL.Path)
+		if _, _, ok := pageURLTitle(canonical); canonical == r.URL.Path || !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		canonicalRedirect(w, r, canonical)
+	})
+}
+
+// canonicalPath lowercases the action of a /<action>/<title> path and drops
+// trailing slashes.
+func canonicalPath(path string) string {
+	rest := strings.TrimPrefix(path, "/")
+	i := strings.IndexByte(rest, '/')
+	if i < 0 {
+		return path
+	}
+	action, title := strings.ToLower(rest[:i]), strings.TrimRight(rest[i+1:], "/")
+	for _, a := range strings.Split(pageActions, "|") {
+		if a == action {
+			return "/" + action + "/" + title
+		}
+	}
+	return path
+}
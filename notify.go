@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// pending changes the notifier may fall behind by before dropping them
+const notifyQueueSize = 256
+
+// how long a notifier may take over one notification
+const notifyTimeout = 30 * time.Second
+
+// pageChange is a save of a page, queued for its watchers.
+type pageChange struct {
+	Title   string
+	Version int64
+	By      string
+	Summary string
+}
+
+// Notification is a change told to the watchers of a page by every
+// notifier.
+type Notification struct {
+	Title   string `json:"title"`
+	URL     string `json:"url"`
+	Version int64  `json:"version"`
+	By      string `json:"by"`
+	Summary string `json:"summary,omitempty"`
+	// everyone watching the page but the editor
+	Watchers []*Watcher `json:"-"`
+}
+
+// notifier passes notifications on, by email or to another service.
+type notifier interface {
+	notify(ctx context.Context, n *Notification) error
+}
+
+// notifiers are those configured, set up at startup.
+var notifiers []notifier
+
+// changes queues saves for runNotifier; nil when no notifier is configured.
+var changes chan pageChange
+
+// number of changes dropped because the queue was full
+var droppedChanges int64
+
+func notifying() bool {
+	return changes != nil
+}
+
+// siteURL is the full address of path on the wiki, for links sent away
+// from it.
+func siteURL(path string) string {
+	return strings.TrimSuffix(config.SiteURL, "/") + config.BasePath + path
+}
+
+// newNotifiers builds the notifiers the configuration asks for.
+func newNotifiers() []notifier {
+	var list []notifier
+	if config.SMTPAddr != "" {
+		var auth smtp.Auth
+		if config.SMTPUser != "" {
+			host, _, _ := strings.Cut(config.SMTPAddr, ":")
+			auth = smtp.PlainAuth("", config.SMTPUser, config.SMTPPassword, host)
+		}
+		list = append(list, &emailNotifier{addr: config.SMTPAddr, from: config.SMTPFrom, auth: auth})
+	}
+	if config.NotifyWebhook != "" {
+		list = append(list, &webhookNotifier{url: config.NotifyWebhook})
+	}
+	if config.NotifySlack != "" {
+		list = append(list, &slackNotifier{url: config.NotifySlack})
+	}
+	return list
+}
+
+// queueChange hands a save of p to the notifier without ever holding up
+// the save.
+func queueChange(p *Page) {
+	if changes == nil {
+		return
+	}
+	select {
+	case changes <- pageChange{Title: p.Title, Version: p.Version, By: p.UpdatedBy, Summary: p.Summary}:
+	default:
+		atomic.AddInt64(&droppedChanges, 1)
+	}
+}
+
+// runNotifier tells the watchers of each queued change about it, one change
+// at a time, until ctx is done. Changes still queued then are dropped.
+func runNotifier(ctx context.Context, queue <-chan pageChange, store PageStore) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case c := <-queue:
+			dispatch(ctx, c, store)
+		}
+	}
+}
+
+func dispatch(ctx context.Context, c pageChange, store PageStore) {
+	watchers, err := store.WithContext(ctx).Watchers(c.Title)
+	if err != nil {
+		log.Printf("notifying the watchers of %s: %v", logValue(c.Title), err)
+		return
+	}
+	n := &Notification{Title: c.Title, URL: siteURL(pagePath("view", c.Title)), Version: c.Version, By: c.By, Summary: c.Summary}
+	for _, w := range watchers {
+		// nobody is told about their own saves
+		if w.Name != c.By {
+			n.Watchers = append(n.Watchers, w)
+		}
+	}
+	if len(n.Watchers) == 0 {
+		return
+	}
+	for _, nt := range notifiers {
+		nctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+		err := nt.notify(nctx, n)
+		cancel()
+		if err != nil {
+			log.Printf("notifying the watchers of %s: %v", logValue(c.Title), err)
+		}
+	}
+}
+
+// summary is the one line telling what changed, as notifications start.
+func (n *Notification) summary() string {
+	by := n.By
+	if by == "" {
+		by = anonymousEditor
+	}
+	s := fmt.Sprintf("%s saved %s", by, n.Title)
+	if n.Summary != "" {
+		s += ": " + n.Summary
+	}
+	return s
+}
+
+// emailNotifier mails each watcher who gave an address on their own, so no
+// one sees who else watches.
+type emailNotifier struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (e *emailNotifier) notify(ctx context.Context, n *Notification) error {
+	for _, w := range n.Watchers {
+		if w.Email == "" {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var msg bytes.Buffer
+		fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n", e.from, w.Email, mime.QEncoding.Encode("utf-8", "[Go Wiki] "+n.Title+" was changed"), time.Now().Format(time.RFC1123Z))
+		msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+		fmt.Fprintf(&msg, "%s\r\n\r\n%s\r\n\r\nYou watch this page. Stop at %s.\r\n", n.summary(), n.URL, siteURL("/watchlist"))
+		if err := smtp.SendMail(e.addr, e.auth, e.from, []string{w.Email}, msg.Bytes()); err != nil {
+			return fmt.Errorf("email to %s: %v", w.Name, err)
+		}
+	}
+	return nil
+}
+
+var notifyClient = &http.Client{Timeout: notifyTimeout}
+
+// postJSON posts v to url, expecting a 2xx answer.
+func postJSON(ctx context.Context, url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%s answered %s", req.URL.Host, res.Status)
+	}
+	return nil
+}
+
+// webhookNotifier posts the notification as JSON, with the names of the
+// watchers, for other services to act on.
+type webhookNotifier struct {
+	url string
+}
+
+func (h *webhookNotifier) notify(ctx context.Context, n *Notification) error {
+	names := make([]string, len(n.Watchers))
+	for i, w := range n.Watchers {
+		names[i] = w.Name
+	}
+	return postJSON(ctx, h.url, struct {
+		Event string `json:"event"`
+		*Notification
+		Watchers []string `json:"watchers"`
+	}{"saved", n, names})
+}
+
+// slackNotifier posts to a Slack incoming webhook, or anything taking the
+// same payload, like Mattermost.
+type slackNotifier struct {
+	url string
+}
+
+func (s *slackNotifier) notify(ctx context.Context, n *Notification) error {
+	// Slack links are written <url|text>, with &, < and > escaped
+	esc := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	text := fmt.Sprintf("%s <%s|view>", esc.Replace(n.summary()), esc.Replace(n.URL))
+	return postJSON(ctx, s.url, map[string]string{"text": text})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"regexp"
+	"strings"
+)
+
+var cssComment = regexp.MustCompile(`(?s)/\*.*?\*/`)
+
+// pieces of CSS that can break out of a <style> block or run script in some
+// browser; backslashes are refused too since escapes can spell any of them
+var unsafeCSS = []string{"<", "\\", "expression", "javascript:", "vbscript:", "@import", "behavior", "-moz-binding"}
+
+var errUnsafeCSS = errors.New("the page CSS may only contain plain styles, without <, backslashes, expression(), @import or script URLs")
+
+// checkPageCSS validates the `css:` front matter field of a body, which is
+// where a page keeps styles meant for that page alone.
+func checkPageCSS(body []byte) error {
+	fm, _ := parseFrontMatter(body)
+	css, ok := fm.get("css")
+	if !ok {
+		return nil
+	}
+	// comments could otherwise split a keyword in two
+	lower := strings.ToLower(cssComment.ReplaceAllString(css, ""))
+	for _, s := range unsafeCSS {
+		if strings.Contains(lower, s) {
+			return errUnsafeCSS
+		}
+	}
+	return nil
+}
+
+// pageCSS returns the custom styles of a page, or nothing if it has none or
+// they do not pass checkPageCSS.
+func pageCSS(body []byte) template.CSS {
+	if checkPageCSS(body) != nil {
+		return ""
+	}
+	fm, _ := parseFrontMatter(body)
+	css, _ := fm.get("css")
+	return template.CSS(css)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+// pageJSON is Page without its methods, so MarshalJSON and UnmarshalJSON can
+// hand the plain fields to encoding/json.
+type pageJSON Page
+
+// MarshalJSON writes the body as -page-json-body says, and the id under its
+// old "ID" key as well with -page-json-legacy-id. The tag was once malformed,
+// so earlier releases wrote the id as "ID".
+func (p *Page) MarshalJSON() ([]byte, error) {
+	out := struct {
+		*pageJSON
+		LegacyID *int64      `json:"ID,omitempty"`
+		Body     interface{} `json:"body"`
+	}{pageJSON: (*pageJSON)(p), Body: p.Body}
+	if config.PageJSONBody == "text" {
+		out.Body = string(p.Body)
+	}
+	if config.PageJSONLegacyID {
+		out.LegacyID = &p.ID
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON reads what MarshalJSON writes, taking the id from "ID" when
+// "id" is missing.
+func (p *Page) UnmarshalJSON(data []byte) error {
+	in := struct {
+		*pageJSON
+		LegacyID *int64          `json:"ID"`
+		Body     json.RawMessage `json:"body"`
+	}{pageJSON: (*pageJSON)(p)}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	if p.ID == 0 && in.LegacyID != nil {
+		p.ID = *in.LegacyID
+	}
+	p.Body = nil
+	if len(in.Body) == 0 || string(in.Body) == "null" {
+		return nil
+	}
+	if config.PageJSONBody == "text" {
+		var body string
+		if err := json.Unmarshal(in.Body, &body); err != nil {
+			return err
+		}
+		p.Body = []byte(body)
+		return nil
+	}
+	return json.Unmarshal(in.Body, &p.Body)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPageJSONRoundTrip(t *testing.T) {
+	keepConfig(t)
+	now := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	page := &Page{ID: 42, Title: "Home", Body: []byte("Welcome <home> & \"friends\".\n"), CreatedAt: now, UpdatedAt: now.Add(time.Hour), Protection: protectAnyone, UpdatedBy: "Alice", Version: 3, Summary: "not sent"}
+	for _, mode := range []string{"base64", "text"} {
+		for _, legacy := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s legacy=%v", mode, legacy), func(t *testing.T) {
+				config.PageJSONBody, config.PageJSONLegacyID = mode, legacy
+				out, err := json.Marshal(page)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var fields map[string]interface{}
+				if err := json.Unmarshal(out, &fields); err != nil {
+					t.Fatal(err)
+				}
+				if fields["id"] != 42.0 {
+					t.Errorf("id is %v in %s", fields["id"], out)
+				}
+				if id, ok := fields["ID"]; ok != legacy || (legacy && id != 42.0) {
+					t.Errorf("ID is %v in %s", id, out)
+				}
+				want := string(page.Body)
+				if mode == "base64" {
+					want = base64.StdEncoding.EncodeToString(page.Body)
+				}
+				if fields["body"] != want {
+					t.Errorf("body is %v, want %q", fields["body"], want)
+				}
+				if _, ok := fields["Summary"]; ok {
+					t.Errorf("the edit summary was sent: %s", out)
+				}
+
+				var back Page
+				if err := json.Unmarshal(out, &back); err != nil {
+					t.Fatal(err)
+				}
+				if back.ID != page.ID || back.Title != page.Title || string(back.Body) != string(page.Body) ||
+					!back.CreatedAt.Equal(page.CreatedAt) || !back.UpdatedAt.Equal(page.UpdatedAt) ||
+					back.UpdatedBy != page.UpdatedBy || back.Version != page.Version {
+					t.Errorf("%s came back as %+v", out, back)
+				}
+			})
+		}
+	}
+}
+
+// TestPageJSONLegacyID reads pages as earlier releases wrote them.
+func TestPageJSONLegacyID(t *testing.T) {
+	keepConfig(t)
+	config.PageJSONBody = "base64"
+	tests := []struct {
+		json string
+		id   int64
+		body string
+	}{
+		{`{"ID": 7, "title": "Old", "body": "aGk="}`, 7, "hi"},
+		{`{"id": 8, "ID": 7, "title": "Both", "body": "aGk="}`, 8, "hi"},
+		{`{"id": 9, "title": "New"}`, 9, ""},
+		{`{"title": "None", "body": null}`, 0, ""},
+	}
+	for _, tt := range tests {
+		var p Page
+		if err := json.Unmarshal([]byte(tt.json), &p); err != nil {
+			t.Errorf("%s: %v", tt.json, err)
+			continue
+		}
+		if p.ID != tt.id || string(p.Body) != tt.body {
+			t.Errorf("%s read as id %d and body %q, want %d and %q", tt.json, p.ID, p.Body, tt.id, tt.body)
+		}
+	}
+
+	// a body not in the form -page-json-body says is an error
+	if err := json.Unmarshal([]byte(`{"body": "not base64!"}`), new(Page)); err == nil {
+		t.Error("a text body was read as base64")
+	}
+	config.PageJSONBody = "text"
+	if err := json.Unmarshal([]byte(`{"body": [1, 2]}`), new(Page)); err == nil {
+		t.Error("a body that isn't a string was read as text")
+	}
+}
+
+// TestPageJSONLegacyIDEnv turns the legacy id off from the environment, as
+// it is on by default.
+func TestPageJSONLegacyIDEnv(t *testing.T) {
+	if !envBool("PAGE_JSON_LEGACY_ID", true) {
+		t.Error("the legacy id is off without PAGE_JSON_LEGACY_ID")
+	}
+	t.Setenv("PAGE_JSON_LEGACY_ID", "false")
+	if envBool("PAGE_JSON_LEGACY_ID", true) {
+		t.Error("PAGE_JSON_LEGACY_ID=false left the legacy id on")
+	}
+}
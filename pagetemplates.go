@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// longest stored page template allowed, in bytes
+const maxTemplateLength = 64 << 10
+
+func queryPageTemplates(ctx context.Context, conn db) ([]*PageTemplate, error) {
+	defer timeQuery("queryPageTemplates", time.Now())
+	query := "SELECT name, body, updated_by, updated_at FROM " + table("page_templates") + " ORDER BY name"
+	rows, err := conn.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []*PageTemplate
+	for rows.Next() {
+		t := &PageTemplate{Stored: true}
+		if err := rows.Scan(&t.Name, &t.Body, &t.UpdatedBy, &t.UpdatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, t)
+	}
+	return list, rows.Err()
+}
+
+func savePageTemplate(ctx context.Context, t *PageTemplate, conn db) error {
+	defer timeQuery("savePageTemplate", time.Now())
+	query := `INSERT INTO ` + table("page_templates") + ` (name, body, updated_by) VALUES ($1, $2, $3)
+		ON CONFLICT (name) DO UPDATE SET body = $2, updated_by = $3, updated_at = now()
+		RETURNING updated_at`
+	return conn.QueryRow(ctx, query, t.Name, t.Body, t.UpdatedBy).Scan(&t.UpdatedAt)
+}
+
+// deletePageTemplate fails with errNotFound when there is no template
+// called name.
+func deletePageTemplate(ctx context.Context, name string, conn db) error {
+	defer timeQuery("deletePageTemplate", time.Now())
+	tag, err := conn.Exec(ctx, "DELETE FROM "+table("page_templates")+" WHERE name = $1", name)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// availableTemplates is every template a new page can start from, those of
+// -page-templates along with the stored ones, by name. A stored template
+// replaces a file of the same name.
+func availableTemplates(store PageStore) ([]*PageTemplate, error) {
+	stored, err := store.PageTemplates()
+	if err != nil {
+		return nil, err
+	}
+	list := stored
+	for _, t := range pageTemplates {
+		if findPageTemplate(stored, t.Name) == nil {
+			list = append(list, t)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// startFromTemplate offers the templates in the editor of a page that
+// doesn't exist yet, and fills it in with ?template= when given.
+func startFromTemplate(w http.ResponseWriter, r *http.Request, e *Edit, store PageStore) bool {
+	list, err := availableTemplates(store)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	e.Templates, e.Template = list, r.URL.Query().Get("template")
+	if e.Template == "" {
+		return true
+	}
+	t := findPageTemplate(list, e.Template)
+	if t == nil {
+		e.Errors = &Validation{Message: fmt.Sprintf("There is no template called %q.", e.Template)}
+		e.Template = ""
+		renderEdit(w, r, http.StatusNotFound, e)
+		return false
+	}
+	e.Page.Body = expandBoilerplate(t.Body, e.Page.Title, time.Now())
+	return true
+}
+
+// PageTemplates is the data model of the /templates page.
+type PageTemplates struct {
+	Templates []*PageTemplate
+	// filled into the form, to change a template or try again
+	Form    *PageTemplate
+	Message string
+	Errors  *Validation
+}
+
+func renderPageTemplates(w http.ResponseWriter, r *http.Request, status int, pt *PageTemplates, store PageStore) {
+	list, err := availableTemplates(store)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	pt.Templates = list
+	if pt.Form == nil {
+		pt.Form = &PageTemplate{}
+		if t := findPageTemplate(list, r.URL.Query().Get("name")); t != nil {
+			pt.Form = t
+		}
+	}
+	renderTemplateStatus(w, r, status, "templates", pt)
+}
+
+// pageTemplatesHandler lists the page templates at /templates, filling the
+// form with ?name=, and saves one on POST, or deletes it with
+// action=delete. Templates from -page-templates can be replaced by a stored
+// one of the same name but not deleted.
+func pageTemplatesHandler(w http.ResponseWriter, r *http.Request, store PageStore) {
+	pt := &PageTemplates{}
+	if r.Method != http.MethodPost {
+		renderPageTemplates(w, r, http.StatusOK, pt, store)
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if r.FormValue("action") == "delete" {
+		err := store.DeletePageTemplate(name)
+		if err == errNotFound {
+			pt.Errors = &Validation{Message: fmt.Sprintf("There is no stored template called %q.", name)}
+			renderPageTemplates(w, r, http.StatusNotFound, pt, store)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		pt.Message = fmt.Sprintf("Deleted the %s template.", name)
+		renderPageTemplates(w, r, http.StatusOK, pt, store)
+		return
+	}
+
+	t := &PageTemplate{Name: name, Body: string(normalizeText([]byte(r.FormValue("body")))), UpdatedBy: editorName(r)}
+	v := &Validation{}
+	if !validTemplateName.MatchString(t.Name) {
+		v.add("name", "Template names are lowercase letters and digits, with dashes between words, like meeting-notes.")
+	}
+	if len(t.Body) > maxTemplateLength {
+		v.add("body", fmt.Sprintf("The template is longer than %s.", humanSize(maxTemplateLength)))
+	}
+	if v.Failed() {
+		pt.Form, pt.Errors = t, v
+		renderPageTemplates(w, r, http.StatusBadRequest, pt, store)
+		return
+	}
+	if err := store.SavePageTemplate(t); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	pt.Message = fmt.Sprintf("Saved the %s template.", t.Name)
+	renderPageTemplates(w, r, http.StatusOK, pt, store)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// previewHandler renders a draft body posted in the body field exactly as
+// the view page would render it once saved, includes and all, for the live
+// preview of the editor. Nothing is saved.
+func previewHandler(w http.ResponseWriter, r *http.Request, title string, store PageStore) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxAPIBody)
+	if err := r.ParseForm(); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p := &Page{Title: title, Body: []byte(r.PostForm.Get("body"))}
+	if config.NormalizeBodies {
+		p.Body = normalizeText(p.Body)
+	}
+	if err := checkText(p.Body); err != nil {
+		http.Error(w, sentence(err.Error()), http.StatusBadRequest)
+		return
+	}
+	// drafts change on every keystroke, so they skip the render cache but
+	// still wait for a render slot
+	if err := acquireRender(); err != nil {
+		renderFailed(w, err)
+		return
+	}
+	defer releaseRender()
+	html, err := newInclusion(store).render(p)
+	if err != nil {
+		renderFailed(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeBody(w, r, http.StatusOK, "text/html; charset=utf-8", []byte(html))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"github.com/jackc/pgx/v4"
+	"net/http"
+)
+
+// who may edit a page
+const (
+	protectAnyone = "anyone"
+	protectUsers  = "users"
+	protectAdmins = "admins"
+)
+
+var protectionLevels = []string{protectAnyone, protectUsers, protectAdmins}
+
+func validProtection(level string) bool {
+	for _, l := range protectionLevels {
+		if l == level {
+			return true
+		}
+	}
+	return false
+}
+
+// canEdit reports whether u (nil when anonymous) may edit a page with the
+// given protection level. Anonymous users may only edit at all with
+// -anonymous-edits, and readers never.
+func canEdit(u *User, level string) bool {
+	if u.IsReader() {
+		return false
+	}
+	switch level {
+	case protectAnyone, "":
+		return u != nil || config.AnonymousEdits
+	case protectUsers:
+		return u != nil
+	default:
+		return u.IsAdmin()
+	}
+}
+
+func setProtection(ctx context.Context, title, level string, conn db) error {
+	query := "UPDATE " + table("pages") + " SET protection = $2 WHERE title=$1"
+	tag, err := conn.Exec(ctx, query, title, level)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// checkEdit writes an error and returns false when the current user may not
+// edit a page with the given protection level.
+func checkEdit(w http.ResponseWriter, r *http.Request, level string) bool {
+	u := currentUser(r)
+	if canEdit(u, level) {
+		return true
+	}
+	// admins sign in through basic auth, everyone else with an account
+	if u == nil && level == protectAdmins {
+		requireLogin(w)
+		return false
+	}
+	if u == nil {
+		// a form sent without being signed in is lost either way
+		a := &Account{Next: "/", Error: "Log in to edit pages.", Signups: config.Signups}
+		if r.Method == http.MethodGet {
+			a.Next = r.URL.Path
+		}
+		renderTemplateStatus(w, r, http.StatusUnauthorized, "login", a)
+		return false
+	}
+	if u.IsReader() {
+		http.Error(w, "your account can read pages but not edit them", http.StatusForbidden)
+		return false
+	}
+	http.Error(w, "this page is protected", http.StatusForbidden)
+	return false
+}
+
+func protectHandler(w http.ResponseWriter, r *http.Request, title string, store PageStore) {
+	if r.Method != http.MethodPost {
+		redirect(w, r, pagePath("view", title), http.StatusFound)
+		return
+	}
+	if !currentUser(r).IsAdmin() {
+		requireLogin(w)
+		return
+	}
+	level := r.FormValue("protection")
+	if !validProtection(level) {
+		http.Error(w, "unknown protection level", http.StatusBadRequest)
+		return
+	}
+	err := store.SetProtection(title, level)
+	if err == errNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	redirect(w, r, pagePath("view", title), http.StatusSeeOther)
+}
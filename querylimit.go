@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"unicode/utf8"
+)
+
+// longest part of a request parameter written to the log
+const maxLoggedValue = 80
+
+// limitQueries answers 400 Bad Request to requests with a query parameter,
+// name or value, longer than -max-query-length characters, before any
+// handler or database query sees it.
+func limitQueries(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.MaxQueryLength <= 0 || r.URL.RawQuery == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		for name, values := range r.URL.Query() {
+			long := utf8.RuneCountInString(name) > config.MaxQueryLength
+			for _, v := range values {
+				long = long || utf8.RuneCountInString(v) > config.MaxQueryLength
+			}
+			if !long {
+				continue
+			}
+			log.Printf("rejected %s %s: parameter %s is longer than %d characters", r.Method, logValue(r.URL.Path), logValue(name), config.MaxQueryLength)
+			msg := fmt.Sprintf("query parameters may be at most %d characters long", config.MaxQueryLength)
+			if isAPI(r) {
+				writeAPIError(w, r, http.StatusBadRequest, apiInvalid, msg)
+				return
+			}
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// logValue makes user input safe to log: quoted, so newlines and control
+// characters can't forge log lines, and cut short.
+func logValue(s string) string {
+	if utf8.RuneCountInString(s) > maxLoggedValue {
+		s = string([]rune(s)[:maxLoggedValue]) + "..."
+	}
+	return fmt.Sprintf("%q", s)
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// number of queries that took longer than config.SlowQuery
+var slowQueries int64
+
+// timeQuery records the time the named query took for /metrics, and logs
+// it if it took longer than the slow query threshold. Call it deferred
+// with the query's start time.
+func timeQuery(name string, start time.Time) {
+	elapsed := time.Since(start)
+	queryDuration.WithLabelValues(name).Observe(elapsed.Seconds())
+	if config.SlowQuery <= 0 || elapsed < config.SlowQuery {
+		return
+	}
+	atomic.AddInt64(&slowQueries, 1)
+	slog.Warn("slow query", "query", name, "elapsed", elapsed)
+}
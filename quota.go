@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// editQuota counts saves per user or IP over a fixed window.
+type editQuota struct {
+	mu        sync.Mutex
+	limit     int
+	window    time.Duration
+	counts    map[string]*quotaCount
+	lastSweep time.Time
+}
+
+type quotaCount struct {
+	n     int
+	reset time.Time
+}
+
+func newEditQuota(limit int, window time.Duration) *editQuota {
+	return &editQuota{limit: limit, window: window, counts: map[string]*quotaCount{}}
+}
+
+var editQuotas = newEditQuota(0, 24*time.Hour)
+
+// allow records an edit by key, unless key has used up its quota, and
+// returns when its window resets.
+func (q *editQuota) allow(key string, now time.Time) (bool, time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if now.Sub(q.lastSweep) > q.window {
+		for k, c := range q.counts {
+			if !now.Before(c.reset) {
+				delete(q.counts, k)
+			}
+		}
+		q.lastSweep = now
+	}
+	c, ok := q.counts[key]
+	if !ok || !now.Before(c.reset) {
+		c = &quotaCount{reset: now.Add(q.window)}
+		q.counts[key] = c
+	}
+	if c.n >= q.limit {
+		return false, c.reset
+	}
+	c.n++
+	return true, c.reset
+}
+
+// clientIP is the address the request came from, without its port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// allowEdit counts an edit by whoever made r against their quota. Over it,
+// it sets Retry-After and returns when the quota resets.
+func allowEdit(w http.ResponseWriter, r *http.Request) (bool, time.Time) {
+	if editQuotas.limit <= 0 {
+		return true, time.Time{}
+	}
+	u := currentUser(r)
+	if u.IsAdmin() {
+		return true, time.Time{}
+	}
+	key := "ip:" + clientIP(r)
+	if u != nil {
+		key = "user:" + u.Name
+	}
+	ok, reset := editQuotas.allow(key, time.Now())
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(reset).Seconds())+1))
+	}
+	return ok, reset
+}
+
+// checkQuota records an edit against the user, or the IP of anonymous
+// editors, and rejects the save with a 429 once the quota is used up.
+// Admins are never limited.
+func checkQuota(w http.ResponseWriter, r *http.Request, p *Page) bool {
+	ok, reset := allowEdit(w, r)
+	if ok {
+		return true
+	}
+	msg := "You have reached your edit quota. You can save again after " + reset.Format("2006-01-02 15:04 MST") + "."
+	rejectSave(w, r, http.StatusTooManyRequests, p, &Validation{Message: msg})
+	return false
+}
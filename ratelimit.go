@@ -0,0 +1,108 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket per client: each holds up to burst
+// requests and refills at rate per second.
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter allows perMinute requests a minute, up to a minute's worth
+// at once. It returns nil, which allows everything, for 0.
+func newRateLimiter(perMinute int) *rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(perMinute) / 60, burst: float64(perMinute), buckets: map[string]*bucket{}}
+}
+
+var readLimits, writeLimits *rateLimiter
+
+// allow takes a token from the bucket of key, or returns how long until it
+// has one again.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// a bucket left alone for a minute is full again, the same as none
+	if now.Sub(l.lastSweep) > time.Minute {
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > time.Minute {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// isWrite tells whether r counts against the write limit rather than the
+// read one. Previews are sent as POSTs while typing but store nothing.
+func isWrite(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return !strings.HasPrefix(r.URL.Path, "/preview/")
+}
+
+// limitRates answers 429 with Retry-After to clients, a user or else an
+// IP, sending requests faster than -read-rate-limit or -write-rate-limit.
+// Admins, the stylesheets, /metrics and the health probes are never
+// limited.
+func limitRates(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l, kind := readLimits, "read"
+		if isWrite(r) {
+			l, kind = writeLimits, "write"
+		}
+		if l == nil || strings.HasPrefix(r.URL.Path, "/css/") || r.URL.Path == "/metrics" || r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		u := currentUser(r)
+		if u.IsAdmin() {
+			h.ServeHTTP(w, r)
+			return
+		}
+		key := "ip:" + clientIP(r)
+		if u != nil {
+			key = "user:" + u.Name
+		}
+		ok, retry := l.allow(key, time.Now())
+		if !ok {
+			rateLimited.WithLabelValues(kind).Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+			http.Error(w, "Too many requests. Please slow down and try again in a moment.", http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
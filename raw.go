@@ -0,0 +1,73 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// pageSource loads the body /raw and the .md download serve: the page, or
+// with ?lang= its translation, falling back to the page as the view page
+// does. It answers itself when there is nothing to serve, sending renamed
+// titles on to moved of the new title, a path not escaped yet.
+func pageSource(w http.ResponseWriter, r *http.Request, title string, store PageStore, moved func(title string) string) (*Page, bool) {
+	p, err := store.Load(title)
+	if err == errNotFound {
+		if current, err := store.Resolve(title); err == nil {
+			u := *r.URL
+			u.Path = moved(current)
+			redirect(w, r, u.String(), http.StatusMovedPermanently)
+			return nil, false
+		}
+		http.NotFound(w, r)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if p.Expired() {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	if lang := requestedLanguage(r); lang != "" {
+		t, err := store.Translation(title, lang)
+		if err != nil && err != errNotFound {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return nil, false
+		}
+		if err == nil {
+			p = withTranslation(p, t)
+		}
+	}
+	w.Header().Set("Last-Modified", p.UpdatedAt.UTC().Format(http.TimeFormat))
+	return p, true
+}
+
+// rawHandler serves the body of the page as it was written, front matter
+// and all, as plain text for curl and scripts.
+func rawHandler(w http.ResponseWriter, r *http.Request, title string, store PageStore) {
+	p, ok := pageSource(w, r, title, store, func(title string) string { return "/raw/" + titleSlug(title) })
+	if !ok {
+		return
+	}
+	writeBody(w, r, http.StatusOK, "text/plain; charset=utf-8", p.Body)
+}
+
+// downloadHandler serves /view/<title>.md, the body of title as a Markdown
+// file to save. viewHandler only sends it here when title exists and
+// <title>.md doesn't.
+func downloadHandler(w http.ResponseWriter, r *http.Request, title string, store PageStore) {
+	p, ok := pageSource(w, r, title, store, func(title string) string { return "/view/" + titleSlug(title) + ".md" })
+	if !ok {
+		return
+	}
+	// file names can't hold the slashes of pages under others
+	name := strings.ReplaceAll(titleSlug(p.Title), "/", "-") + ".md"
+	if p.Lang != "" {
+		name = strings.TrimSuffix(name, ".md") + "." + p.Lang + ".md"
+	}
+	// titles outside ASCII are encoded as RFC 2231 asks
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	writeBody(w, r, http.StatusOK, "text/markdown; charset=utf-8", p.Body)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// changes listed on each page of /recent
+const recentPageSize = 50
+
+// Change is a revision of the page titled Title.
+type Change struct {
+	Title string
+	*Revision
+}
+
+// loadRecentChanges returns up to limit revisions of the pages, newest first,
+// after skipping offset. The delta of each is against the revision of its
+// page before it, whether or not that one is listed.
+func loadRecentChanges(ctx context.Context, limit, offset int, conn db) ([]*Change, error) {
+	defer timeQuery("loadRecentChanges", time.Now())
+	query := `SELECT p.title, r.id, COALESCE(r.author, ''), r.created_at, r.summary, octet_length(r.body),
+			octet_length(r.body) - COALESCE((SELECT octet_length(prev.body) FROM ` + table("page_revisions") + ` prev
+				WHERE prev.page_id = r.page_id AND prev.id < r.id ORDER BY prev.id DESC LIMIT 1), 0)
+		FROM ` + table("page_revisions") + ` r JOIN ` + table("pages") + ` p ON p.id = r.page_id
+		ORDER BY r.id DESC LIMIT $1 OFFSET $2`
+	rows, err := conn.Query(ctx, query, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []*Change
+	for rows.Next() {
+		c := &Change{Revision: &Revision{}}
+		if err := rows.Scan(&c.Title, &c.ID, &c.Author, &c.CreatedAt, &c.Summary, &c.Size, &c.Delta); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+type RecentChanges struct {
+	Changes []*Change
+	// current page of the listing, counted from 1, and its neighbours; 0
+	// when there is none
+	Number int
+	Prev   int
+	Next   int
+}
+
+// pageNumber is the page of a paginated listing asked for, counted from 1.
+func pageNumber(r *http.Request) int {
+	if n, err := strconv.Atoi(r.FormValue("page")); err == nil && n > 1 {
+		return n
+	}
+	return 1
+}
+
+// recentHandler lists the latest saves of every page, with who made them.
+func recentHandler(w http.ResponseWriter, r *http.Request, store PageStore) {
+	rc := &RecentChanges{Number: pageNumber(r)}
+	// one more than shown tells whether there is a next page
+	changes, err := store.RecentChanges(recentPageSize+1, (rc.Number-1)*recentPageSize)
+	if err != nil {
+		renderFailed(w, err)
+		return
+	}
+	if len(changes) > recentPageSize {
+		changes, rc.Next = changes[:recentPageSize], rc.Number+1
+	}
+	rc.Changes = changes
+	if rc.Number > 1 {
+		rc.Prev = rc.Number - 1
+	}
+	renderTemplate(w, r, "recent", rc)
+}
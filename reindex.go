@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// pages between two progress reports while reindexing
+const reindexProgressEvery = 100
+
+type Reindex struct {
+	Pages int
+	Tags  int
+	// page to tag links written
+	PageTags int
+	// links between pages written
+	Links int
+}
+
+// reindex rebuilds the indexes derived from page bodies, the words of
+// gzipped ones included, in one transaction, calling progress after every
+// reindexProgressEvery pages.
+func reindex(conn db, progress func(done, total int)) (*Reindex, error) {
+	ctx := context.Background()
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, "SELECT id FROM "+table("pages")+" ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, id := range ids {
+		var title string
+		var stored storedBody
+		if err := tx.QueryRow(ctx, "SELECT title, "+bodyColumns+" FROM "+table("pages")+" WHERE id=$1", id).Scan(stored.dest(&title)...); err != nil {
+			return nil, err
+		}
+		body, err := stored.bytes()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", title, err)
+		}
+		if stored.gz != nil {
+			// in the words of the -search-language now in use
+			if _, err := tx.Exec(ctx, "UPDATE "+table("pages")+" SET search_vector = "+searchVector("$2")+" WHERE id=$1", id, body); err != nil {
+				return nil, err
+			}
+		}
+		if err := syncTags(ctx, id, body, tx); err != nil {
+			return nil, err
+		}
+		if err := syncLinks(ctx, id, title, body, tx); err != nil {
+			return nil, err
+		}
+		if progress != nil && ((i+1)%reindexProgressEvery == 0 || i+1 == len(ids)) {
+			progress(i+1, len(ids))
+		}
+	}
+	if err := pruneTags(ctx, tx); err != nil {
+		return nil, err
+	}
+
+	res := &Reindex{Pages: len(ids)}
+	query := "SELECT (SELECT count(*) FROM " + table("tags") + "), (SELECT count(*) FROM " + table("page_tags") + "), (SELECT count(*) FROM " + table("page_links") + ")"
+	if err := tx.QueryRow(ctx, query).Scan(&res.Tags, &res.PageTags, &res.Links); err != nil {
+		return nil, err
+	}
+	return res, tx.Commit(ctx)
+}
+
+// reindexHandler rebuilds the indexes, streaming progress as plain text.
+func reindexHandler(w http.ResponseWriter, r *http.Request, conn db) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "reindex with a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	flusher, _ := w.(http.Flusher)
+	res, err := reindex(conn, func(done, total int) {
+		fmt.Fprintf(w, "reindexed %d of %d pages\n", done, total)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+	if err != nil {
+		// progress may already have been sent, so the status can't change
+		fmt.Fprintf(w, "reindex failed, nothing was changed: %v\n", err)
+		return
+	}
+	fmt.Fprintf(w, "done: %d pages, %d tags, %d page tags, %d links\n", res.Pages, res.Tags, res.PageTags, res.Links)
+}
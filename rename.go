@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"net/http"
+)
+
+type Rename struct {
+	Page     *Page
+	NewTitle string
+	Error    string
+	Message  string
+}
+
+// renamePage gives p a new title and records the old one as an alias, so
+// links from outside the wiki keep working, and rewrites the [[links]] to it
+// in every page as an edit by editor. It returns the number of pages whose
+// links changed.
+func renamePage(ctx context.Context, p *Page, newTitle, editor string, conn db) (int64, error) {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := loadPageFields(ctx, newTitle, pageMeta, tx); err == nil {
+		return 0, fmt.Errorf("%s: %w", newTitle, errPageExists)
+	} else if err != pgx.ErrNoRows {
+		return 0, err
+	}
+	query := "UPDATE " + table("pages") + " SET title = $2 WHERE id = $1"
+	if _, err := tx.Exec(ctx, query, p.ID, newTitle); err != nil {
+		return 0, err
+	}
+	// aliases point at a page rather than a title, so they never chain;
+	// the new title is a real page now and stops being an alias, which
+	// also keeps a rename back and forth from looping
+	query = "DELETE FROM " + table("page_aliases") + " WHERE title = $1"
+	if _, err := tx.Exec(ctx, query, newTitle); err != nil {
+		return 0, err
+	}
+	query = "INSERT INTO " + table("page_aliases") + " (title, page_id) VALUES ($1, $2) ON CONFLICT (title) DO UPDATE SET page_id = $2"
+	if _, err := tx.Exec(ctx, query, p.Title, p.ID); err != nil {
+		return 0, err
+	}
+	n, err := rewriteLinks(ctx, p.Title, newTitle, editor, tx)
+	if err != nil {
+		return 0, err
+	}
+	if err := moveDrafts(ctx, p.Title, newTitle, tx); err != nil {
+		return 0, err
+	}
+	if err := moveWatches(ctx, p.Title, newTitle, tx); err != nil {
+		return 0, err
+	}
+	if err := moveTranslations(ctx, p.Title, newTitle, tx); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	p.Title = newTitle
+	return n, nil
+}
+
+// resolveAlias returns the current title of a page formerly called title.
+func resolveAlias(ctx context.Context, title string, conn db) (string, error) {
+	query := "SELECT p.title FROM " + table("page_aliases") + " a JOIN " + table("pages") + " p ON p.id = a.page_id WHERE a.title = $1"
+	var current string
+	err := conn.QueryRow(ctx, query, title).Scan(&current)
+	if err == nil && current == title {
+		// a page holding its own old title would redirect to itself
+		return "", pgx.ErrNoRows
+	}
+	return current, err
+}
+
+func renameHandler(w http.ResponseWriter, r *http.Request, title string, store PageStore) {
+	p, err := store.Stat(title)
+	if err == errNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !checkEdit(w, r, p.Protection) {
+		return
+	}
+
+	rn := &Rename{Page: p, NewTitle: canonicalTitle(r.FormValue("title"))}
+	if r.Method != http.MethodPost {
+		renderTemplate(w, r, "rename", rn)
+		return
+	}
+	switch err := checkTitle(rn.NewTitle); {
+	case err != nil:
+		rn.Error = "The new title is not valid: " + err.Error() + "."
+	case rn.NewTitle == title:
+		rn.Error = "The new title is the same as the current one."
+	}
+	if rn.Error != "" {
+		renderTemplateStatus(w, r, http.StatusBadRequest, "rename", rn)
+		return
+	}
+
+	oldTitle := p.Title
+	n, err := store.Rename(p, rn.NewTitle, editorName(r))
+	if errors.Is(err, errPageExists) {
+		rn.Error = err.Error()
+		renderTemplateStatus(w, r, http.StatusConflict, "rename", rn)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rn.Message = fmt.Sprintf("Renamed %s to %s and updated the links on %d pages.", oldTitle, p.Title, n)
+	rn.NewTitle = ""
+	renderTemplate(w, r, "rename", rn)
+}
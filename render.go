@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"html/template"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var templateFiles = []string{"edit.html", "view.html", "archive.html", "missing.html", "largest.html", "merge.html", "split.html", "tagtools.html", "home.html", "navbar.html", "meta.html", "rename.html", "diff.html", "errors.html", "robots.html", "history.html", "compare.html", "search.html", "report.html", "views.html", "unavailable.html", "namespace.html", "files.html", "links.html", "index.html", "new.html", "login.html", "signup.html", "recent.html", "delete.html", "orphans.html", "wanted.html", "tag.html", "tags.html", "users.html", "draft.html", "talk.html", "comments.html", "templates.html", "watchlist.html", "dashboard.html", "print.html", "replace.html", "subpages.html"}
+
+var templateFuncs = template.FuncMap{
+	"humanSize": humanSize,
+	"changed":   changed,
+	"noindex":   func() bool { return config.NoIndex },
+	"base":      func() string { return config.BasePath },
+	"namespace": func(title string) string { ns, _ := namespaceOf(title); return ns },
+	"inc":       func(i int) int { return i + 1 },
+	"escPath":   url.PathEscape,
+	"slug":      titleSlug,
+	"segment":   titleSegment,
+	"excerpt":   excerpt,
+	"events":    func() bool { return config.PageEvents },
+	"csrf":      csrfInput,
+	"nonce":     nonceAttr,
+	"watches":   notifying,
+}
+
+var templates *template.Template
+
+func parseTemplates(fsys fs.FS) (*template.Template, error) {
+	return template.New("").Funcs(templateFuncs).ParseFS(fsys, templateFiles...)
+}
+
+// currentTemplates returns the templates parsed at startup, or in dev mode
+// parses them again from disk, so a template edit shows on the next reload.
+func currentTemplates() (*template.Template, error) {
+	if !config.Dev {
+		return templates, nil
+	}
+	fsys, err := templateFS()
+	if err != nil {
+		return nil, err
+	}
+	return parseTemplates(fsys)
+}
+
+// executeTemplate renders a page template from the given set. It depends on
+// neither the database nor the response, so any view can be rendered from an
+// in-memory value into any writer.
+func executeTemplate(w io.Writer, set *template.Template, tmpl string, data interface{}) error {
+	return set.ExecuteTemplate(w, tmpl+".html", data)
+}
+
+// buffers reused across requests for rendering templates
+var bufPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func renderTemplate(w http.ResponseWriter, r *http.Request, tmpl string, data interface{}) {
+	renderTemplateStatus(w, r, http.StatusOK, tmpl, data)
+}
+
+// renderTemplateStatus executes the template into a buffer first so a
+// failing template never sends a half-written page with a 200 status. HEAD
+// requests get the same headers without the body.
+func renderTemplateStatus(w http.ResponseWriter, r *http.Request, status int, tmpl string, data interface{}) {
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufPool.Put(buf)
+
+	set, err := currentTemplates()
+	if err == nil {
+		err = executeTemplate(buf, set, tmpl, data)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// the script nonce and CSRF tokens differ on every response, so the
+	// ETag is taken before they are filled in and is weak: it promises the
+	// same page, not the same bytes
+	if w.Header().Get("ETag") == "" {
+		w.Header().Set("ETag", "W/"+etag(buf.Bytes()))
+	}
+	w.Header().Add("Vary", "Cookie")
+	out := bufPool.Get().(*bytes.Buffer)
+	out.Reset()
+	defer bufPool.Put(out)
+	(&tokenWriter{Writer: out, w: w, r: r}).Write(buf.Bytes())
+	writeBody(w, r, status, "text/html; charset=utf-8", out.Bytes())
+}
+
+// writeBody sends a complete response body with its length and ETag, unless
+// the handler set its own, leaving the body out for HEAD requests. A 200
+// response the client already has, by its ETag or Last-Modified, is sent
+// as 304 Not Modified instead.
+func writeBody(w http.ResponseWriter, r *http.Request, status int, contentType string, body []byte) {
+	h := w.Header()
+	if h.Get("ETag") == "" {
+		h.Set("ETag", etag(body))
+	}
+	if status == http.StatusOK && notModified(r, h) {
+		// the kept copy's scripts carry the nonce of its own policy
+		h.Del("Content-Security-Policy")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(body)
+}
+
+// chunk size of streamed responses
+const streamChunkSize = 32 << 10
+
+// flushWriter pushes every write out to the client.
+type flushWriter struct {
+	w http.ResponseWriter
+	f http.Flusher
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if fw.f != nil {
+		fw.f.Flush()
+	}
+	return n, err
+}
+
+// streamTemplate renders straight to the client in streamChunkSize chunks
+// instead of buffering the whole page. The status is committed before the
+// template runs, so an error half way through can only be logged; it is
+// meant for big pages where buffering costs more than that risk.
+func streamTemplate(w http.ResponseWriter, r *http.Request, status int, tmpl string, data interface{}) {
+	set, err := currentTemplates()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f, _ := w.(http.Flusher)
+	bw := bufio.NewWriterSize(flushWriter{w: w, f: f}, streamChunkSize)
+	tw := &tokenWriter{Writer: bw, w: w, r: r}
+	// the cookie of a new CSRF secret has to go out with the headers
+	tw.secret()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	err = executeTemplate(tw, set, tmpl, data)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		log.Printf("streaming %s for %s: %v", tmpl, r.URL.Path, err)
+	}
+}
+
+// renderPageTemplate buffers pages up to the configured stream threshold
+// and streams larger ones.
+func renderPageTemplate(w http.ResponseWriter, r *http.Request, tmpl string, v *View) {
+	if config.StreamThreshold > 0 && len(v.Body) > config.StreamThreshold {
+		streamTemplate(w, r, http.StatusOK, tmpl, v)
+		return
+	}
+	renderTemplate(w, r, tmpl, v)
+}
+
+// notModified reports whether a GET or HEAD request's If-None-Match, or
+// failing that its If-Modified-Since, matches the response headers h.
+func notModified(r *http.Request, h http.Header) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		tag := strings.TrimPrefix(h.Get("ETag"), "W/")
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimSpace(t)
+			if t == "*" || strings.TrimPrefix(t, "W/") == tag {
+				return true
+			}
+		}
+		return false
+	}
+	modified, err := http.ParseTime(h.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !modified.Truncate(time.Second).After(since)
+}
+
+// etag is a strong validator for a rendered response body.
+func etag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
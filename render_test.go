@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"github.com/yuin/goldmark"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var (
+	markupTag = regexp.MustCompile(`<(/?)([a-zA-Z][a-zA-Z0-9-]*)([^>]*)>`)
+	// the attributes of a tag as goldmark and html/template write them,
+	// every value in double quotes
+	markupAttrs = regexp.MustCompile(`^(?:\s+[a-zA-Z][a-zA-Z0-9:_-]*(?:="[^"<]*")?)*\s*/?$`)
+	markupAttr  = regexp.MustCompile(`\s+([a-zA-Z][a-zA-Z0-9:_-]*)(?:="([^"]*)")?`)
+	cspNonce    = regexp.MustCompile(`'nonce-([^']+)'`)
+)
+
+// unsafeMarkup reports the first thing in html that could run a script: a
+// script without nonce, an event handler attribute, a javascript: URL, or
+// a tag whose attributes were broken out of. It is "" when there is none.
+func unsafeMarkup(html, nonce string) string {
+	for _, m := range markupTag.FindAllStringSubmatch(html, -1) {
+		tag, attrs := strings.ToLower(m[2]), m[3]
+		if !markupAttrs.MatchString(attrs) {
+			return "attributes broken out of: " + m[0]
+		}
+		values := map[string]string{}
+		for _, a := range markupAttr.FindAllStringSubmatch(attrs, -1) {
+			name := strings.ToLower(a[1])
+			values[name] = a[2]
+			if strings.HasPrefix(name, "on") {
+				return "event handler: " + m[0]
+			}
+			if name == "href" || name == "src" || name == "action" || name == "formaction" {
+				if strings.HasPrefix(strings.ToLower(strings.TrimSpace(a[2])), "javascript:") {
+					return "javascript: URL: " + m[0]
+				}
+			}
+		}
+		if tag == "script" && m[1] == "" && (nonce == "" || values["nonce"] != nonce) && values["type"] != "application/ld+json" {
+			return "script: " + m[0]
+		}
+	}
+	return ""
+}
+
+func TestUnsafeMarkup(t *testing.T) {
+	tests := []struct {
+		html string
+		safe bool
+	}{
+		{`<p><a href="/view/Home" title="&#34; onmouseover">a</a></p>`, true},
+		{`<script nonce="n">run()</script>`, true},
+		{`<script>alert(1)</script>`, false},
+		{`<script nonce="guess">alert(1)</script>`, false},
+		{`<img src="x" onerror="alert(1)">`, false},
+		{`<a href=" JavaScript:alert(1)">x</a>`, false},
+		{`<a href="/view/Home" x="y"" onclick=alert(1)>a</a>`, false},
+	}
+	for _, tt := range tests {
+		if bad := unsafeMarkup(tt.html, "n"); (bad == "") != tt.safe {
+			t.Errorf("unsafeMarkup(%q) = %q, want safe %v", tt.html, bad, tt.safe)
+		}
+	}
+}
+
+// hostileBodies are page bodies trying to run a script once rendered.
+var hostileBodies = []struct {
+	name string
+	body string
+	// text that has to be in the rendered page, escaped
+	want string
+}{
+	{"script", "<script>alert(1)</script>", ""},
+	{"inline html", "hi <img src=x onerror=alert(1)> there", ""},
+	{"raw link", `<a href="javascript:alert(1)">x</a>`, ""},
+	{"javascript link", "[click](javascript:alert(1))", "click"},
+	{"javascript link in capitals", "[click](JaVaScRiPt:alert(1))", "click"},
+	{"javascript reference link", "[x]: javascript:alert(1)\n\n[click][x]", "click"},
+	{"javascript autolink", "<javascript:alert(1)>", ""},
+	{"javascript image", "![x](javascript:alert(1))", ""},
+	{"title breakout", `[a](/view/Home "\" onmouseover=\"alert(1)")`, "&#34; onmouseover"},
+	{"url breakout", `[a](</view/Home"onmouseover="alert(1)>)`, ""},
+	{"wikilink label", "[[Home|<script>alert(1)</script>]]", "&lt;script&gt;"},
+	{"wikilink label breakout", `[[Home|" onmouseover="alert(1)]]`, "onmouseover"},
+	{"wikilink target", `[[Home"><script>alert(1)</script>]]`, ""},
+	{"wikilink heading", `[[Home#"><img src=x onerror=alert(1)>]]`, "&lt;img"},
+	{"include of a hostile title", `{{include:Home"><script>alert(1)</script>}}`, ""},
+	{"heading", "# <script>alert(1)</script> title", "title"},
+	{"code", "`<script>alert(1)</script>`", "&lt;script&gt;"},
+}
+
+func TestRenderEscapesHostileBodies(t *testing.T) {
+	store := seedStore(map[string]string{"Home": "home"})
+	for _, tt := range hostileBodies {
+		t.Run(tt.name, func(t *testing.T) {
+			html, err := newInclusion(store).render(&Page{Title: "Test", Body: []byte(tt.body)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bad := unsafeMarkup(string(html), ""); bad != "" {
+				t.Errorf("rendered %q as %q, with a %s", tt.body, html, bad)
+			}
+			// goldmark writes quotes as &quot;, html/template as &#34;
+			got := strings.ReplaceAll(string(html), "&quot;", "&#34;")
+			if !strings.Contains(got, tt.want) {
+				t.Errorf("rendered %q as %q, without %q", tt.body, html, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderEscapesHostileIframes(t *testing.T) {
+	defer func(md goldmark.Markdown) { markdown = md }(markdown)
+	md, err := newMarkdown(nil, []string{"www.youtube.com"}, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	markdown = md
+	tests := []struct {
+		body string
+		want string
+	}{
+		{`<iframe src="https://www.youtube.com/embed/x" onload="alert(1)"></iframe>`, `<iframe src="https://www.youtube.com/embed/x"`},
+		{`<iframe src="javascript:alert(1)"></iframe>`, ""},
+		{`<iframe src="https://evil.example/x"></iframe>`, ""},
+		// the quotes stay inside the address
+		{`<iframe src="https://www.youtube.com/embed/x&quot; onload=&quot;alert(1)"></iframe>`, `src="https://www.youtube.com/embed/x&#34; onload=&#34;alert(1)"`},
+	}
+	for _, tt := range tests {
+		html, err := renderMarkdown([]byte(tt.body), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bad := unsafeMarkup(string(html), ""); bad != "" {
+			t.Errorf("rendered %q as %q, with a %s", tt.body, html, bad)
+		}
+		if !strings.Contains(string(html), tt.want) || tt.want == "" && strings.Contains(string(html), "<iframe") {
+			t.Errorf("rendered %q as %q, want %q", tt.body, html, tt.want)
+		}
+	}
+}
+
+func TestTemplatesEscapeHostileFields(t *testing.T) {
+	hostile := `"><script>alert(1)</script>`
+	tests := []struct {
+		tmpl string
+		data interface{}
+	}{
+		{"search", &Search{Query: hostile, Results: []*Page{{Title: "Home", Snippet: "a " + snippetStart + hostile + snippetStop}}, Limit: searchLimit}},
+		{"missing", &MissingPage{Title: "Home", Suggestions: []string{hostile}}},
+		{"history", &History{Page: &Page{Title: "Home"}, Revisions: []*Revision{{ID: 1, Author: hostile, Summary: hostile}}}},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := executeTemplate(&buf, templates, tt.tmpl, tt.data); err != nil {
+			t.Fatalf("%s: %v", tt.tmpl, err)
+		}
+		if bad := unsafeMarkup(buf.String(), nonceMarker); bad != "" {
+			t.Errorf("%s: the page has a %s", tt.tmpl, bad)
+		}
+		if !strings.Contains(buf.String(), "&lt;script&gt;") {
+			t.Errorf("%s: the hostile field isn't on the page, escaped", tt.tmpl)
+		}
+	}
+}
+
+// TestSaveThenViewNeutralizesScripts saves each hostile body through
+// saveHandler and checks no script of it runs where viewHandler shows it.
+func TestSaveThenViewNeutralizesScripts(t *testing.T) {
+	keepConfig(t)
+	config.AnonymousEdits = true
+	store := seedStore(map[string]string{"Home": "home"})
+	h := testServer(store)
+	for _, tt := range hostileBodies {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{"body": {tt.body}, "summary": {`<img src=x onerror=alert(1)>`}}
+			w := request(h, http.MethodPost, "/save/XSS_Test", form)
+			if w.Code != http.StatusSeeOther {
+				t.Fatalf("saving got %d: %s", w.Code, w.Body)
+			}
+			for _, path := range []string{"/view/XSS_Test", "/history/XSS_Test"} {
+				w = request(h, http.MethodGet, path, nil)
+				if w.Code != http.StatusOK {
+					t.Fatalf("%s got %d", path, w.Code)
+				}
+				nonce := cspNonce.FindStringSubmatch(w.Header().Get("Content-Security-Policy"))
+				if nonce == nil {
+					t.Fatalf("%s has no script nonce in its Content-Security-Policy", path)
+				}
+				if bad := unsafeMarkup(w.Body.String(), nonce[1]); bad != "" {
+					t.Errorf("%s has a %s", path, bad)
+				}
+			}
+		})
+	}
+}
+
+// TestSearchEscapesHostileQueries checks a query can't smuggle in the
+// markers the wiki replaces with the script nonce and the CSRF token.
+func TestSearchEscapesHostileQueries(t *testing.T) {
+	store := seedStore(map[string]string{"Home": "<script>alert(1)</script> and more"})
+	h := testServer(store)
+	for _, q := range []string{"<script>alert(1)</script>", "script", `<script nonce="` + nonceMarker + `">alert(1)</script>`} {
+		w := request(h, http.MethodGet, "/search?q="+url.QueryEscape(q), nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("searching %q got %d", q, w.Code)
+		}
+		nonce := cspNonce.FindStringSubmatch(w.Header().Get("Content-Security-Policy"))
+		if nonce == nil {
+			t.Fatal("no script nonce in the Content-Security-Policy")
+		}
+		if bad := unsafeMarkup(w.Body.String(), nonce[1]); bad != "" {
+			t.Errorf("searching %q: the page has a %s", q, bad)
+		}
+	}
+}
+
+// TestHeadSendsHeadersOnly checks HEAD gets the status and headers of GET,
+// with no body.
+func TestHeadSendsHeadersOnly(t *testing.T) {
+	store := seedStore(map[string]string{"Home": "# Home\n\nWelcome to the wiki."})
+	h := testServer(store)
+	tests := []struct {
+		path   string
+		status int
+		// the body is the same on every request, so its ETag is too
+		sameETag bool
+	}{
+		{"/view/Home", http.StatusOK, false},
+		{"/raw/Home", http.StatusOK, true},
+		{"/view/Home.md", http.StatusOK, true},
+		{"/robots.txt", http.StatusOK, true},
+		{"/view/Nowhere", http.StatusNotFound, false},
+	}
+	for _, tt := range tests {
+		get := request(h, http.MethodGet, tt.path, nil)
+		head := request(h, http.MethodHead, tt.path, nil)
+		if get.Code != tt.status || head.Code != tt.status {
+			t.Errorf("%s: GET got %d and HEAD %d, want %d", tt.path, get.Code, head.Code, tt.status)
+			continue
+		}
+		if head.Body.Len() != 0 {
+			t.Errorf("%s: HEAD got a body of %d bytes", tt.path, head.Body.Len())
+		}
+		for _, name := range []string{"Content-Type", "Content-Length"} {
+			if got, want := head.Header().Get(name), get.Header().Get(name); got != want {
+				t.Errorf("%s: HEAD has %s %q, GET %q", tt.path, name, got, want)
+			}
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		if head.Header().Get("ETag") == "" {
+			t.Errorf("%s: HEAD has no ETag", tt.path)
+		}
+		if tt.sameETag && head.Header().Get("ETag") != get.Header().Get("ETag") {
+			t.Errorf("%s: HEAD has ETag %q, GET %q", tt.path, head.Header().Get("ETag"), get.Header().Get("ETag"))
+		}
+	}
+}
+
+func TestHeadNotModified(t *testing.T) {
+	store := seedStore(map[string]string{"Home": "Welcome."})
+	h := testServer(store)
+	tag := request(h, http.MethodGet, "/raw/Home", nil).Header().Get("ETag")
+	r := httptest.NewRequest(http.MethodHead, "/raw/Home", nil)
+	r.Header.Set("If-None-Match", tag)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("HEAD with the ETag of the page got %d, want 304", w.Code)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"html/template"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// renderCache keeps the rendered HTML of recently viewed pages, evicting
+// the least recently used entry once full, and those older than ttl when it
+// is set.
+type renderCache struct {
+	mu    sync.Mutex
+	max   int
+	ttl   time.Duration
+	order *list.List
+	items map[string]*list.Element
+	// bumped by every invalidate, so a render that raced with a save of a
+	// page it includes isn't cached
+	gen uint64
+}
+
+type renderCacheEntry struct {
+	key  string
+	html template.HTML
+	// titles of the pages included in the render
+	deps map[string]bool
+	// zero when the entry is kept until evicted
+	expires time.Time
+}
+
+func newRenderCache(max int, ttl time.Duration) *renderCache {
+	return &renderCache{max: max, ttl: ttl, order: list.New(), items: map[string]*list.Element{}}
+}
+
+var renders = newRenderCache(0, 0)
+
+// renderKey changes whenever the page is saved, so stale renders are never
+// looked up again and simply age out. Renders that include other pages are
+// dropped by invalidate instead when one of those changes.
+func renderKey(p *Page) string {
+	key := p.Title
+	if p.Lang != "" {
+		key += "?lang=" + p.Lang
+	}
+	return key + "@" + strconv.FormatInt(p.UpdatedAt.UnixNano(), 10)
+}
+
+func (c *renderCache) get(key string) (template.HTML, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return "", false
+	}
+	entry := e.Value.(*renderCacheEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.order.Remove(e)
+		delete(c.items, key)
+		return "", false
+	}
+	c.order.MoveToFront(e)
+	return entry.html, true
+}
+
+func (c *renderCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// put caches html, rendered from pages deps as of generation gen.
+func (c *renderCache) put(key string, html template.HTML, deps map[string]bool, gen uint64) {
+	if c.max <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(deps) > 0 && gen != c.gen {
+		return
+	}
+	var expires time.Time
+	if c.ttl > 0 {
+		expires = time.Now().Add(c.ttl)
+	}
+	if e, ok := c.items[key]; ok {
+		entry := e.Value.(*renderCacheEntry)
+		entry.html, entry.deps, entry.expires = html, deps, expires
+		c.order.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.order.PushFront(&renderCacheEntry{key: key, html: html, deps: deps, expires: expires})
+	for c.order.Len() > c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*renderCacheEntry).key)
+	}
+}
+
+// invalidate drops the renders that include any of titles. It is called
+// once a write to them is committed.
+func (c *renderCache) invalidate(titles ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for key, e := range c.items {
+		entry := e.Value.(*renderCacheEntry)
+		for _, title := range titles {
+			if entry.deps[title] {
+				c.order.Remove(e)
+				delete(c.items, key)
+				break
+			}
+		}
+	}
+}
+
+// invalidateIncludes drops every render that includes another page, for
+// writes that change pages without saying which.
+func (c *renderCache) invalidateIncludes() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for key, e := range c.items {
+		if len(e.Value.(*renderCacheEntry).deps) > 0 {
+			c.order.Remove(e)
+			delete(c.items, key)
+		}
+	}
+}
+
+// renderPage returns the rendered body of p, from the cache when possible.
+// Only cache misses count against the concurrent render limit. Pages p
+// includes are loaded from store.
+func renderPage(p *Page, store PageStore) (template.HTML, error) {
+	key := renderKey(p)
+	if html, ok := renders.get(key); ok {
+		return html, nil
+	}
+	if err := acquireRender(); err != nil {
+		return "", err
+	}
+	defer releaseRender()
+	gen := renders.generation()
+	in := newInclusion(store)
+	html, err := in.render(p)
+	if err != nil {
+		return "", err
+	}
+	renders.put(key, html, in.deps, gen)
+	return html, nil
+}
+
+// warmRenderCache renders the n most viewed pages into the cache. It uses
+// its own connection as it runs alongside request handlers.
+func warmRenderCache(ctx context.Context, n int) {
+	conn, err := connectDB(ctx, config.StatementTimeout)
+	if err != nil {
+		log.Printf("warming render cache: %v", err)
+		return
+	}
+	defer conn.Close(context.Background())
+
+	query := "SELECT title, updated_at, " + bodyColumns + " FROM " + table("pages") + " ORDER BY views DESC, title LIMIT $1"
+	rows, err := conn.Query(ctx, query, n)
+	if err != nil {
+		log.Printf("warming render cache: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	var pages []*Page
+	for rows.Next() {
+		p := &Page{}
+		var stored storedBody
+		if err := rows.Scan(stored.dest(&p.Title, &p.UpdatedAt)...); err != nil {
+			log.Printf("warming render cache: %v", err)
+			return
+		}
+		if p.Body, err = stored.bytes(); err != nil {
+			log.Printf("warming render cache, %s: %v", p.Title, err)
+			continue
+		}
+		pages = append(pages, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Printf("warming render cache: %v", err)
+		return
+	}
+
+	// included pages are loaded over the same connection, so the rows
+	// have to be read first
+	store := &pgStore{conn: conn}
+	warmed := 0
+	for _, p := range pages {
+		if _, err := renderPage(p, store); err != nil {
+			log.Printf("warming render cache, %s: %v", p.Title, err)
+			continue
+		}
+		warmed++
+	}
+	log.Printf("warmed render cache with %d pages", warmed)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// withRenderCache caches renders for the duration of t.
+func withRenderCache(t *testing.T) {
+	saved := renders
+	renders = newRenderCache(16, 0)
+	t.Cleanup(func() { renders = saved })
+}
+
+// TestIncludeChainInvalidation views a page including a page including a
+// third, and saves each of those in turn.
+func TestIncludeChainInvalidation(t *testing.T) {
+	withRenderCache(t)
+	keepConfig(t)
+	config.AnonymousEdits = true
+	store := seedStore(map[string]string{
+		"Top":    "Top text.\n\n{{include:Middle}}",
+		"Middle": "Middle text.\n\n{{include:Bottom}}",
+		"Bottom": "Bottom text, first version.",
+		"Other":  "Other text.\n\n{{include:Later}}",
+	})
+	h := testServer(store)
+	view := func(title string) string {
+		t.Helper()
+		w := request(h, http.MethodGet, "/view/"+title, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("viewing %s got %d", title, w.Code)
+		}
+		return w.Body.String()
+	}
+	cached := func(title string) bool {
+		p, err := store.Load(title)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, ok := renders.get(renderKey(p))
+		return ok
+	}
+
+	if body := view("Top"); !strings.Contains(body, "Middle text.") || !strings.Contains(body, "first version") {
+		t.Fatalf("Top doesn't show the pages it includes:\n%s", body)
+	}
+	if !cached("Top") {
+		t.Fatal("Top wasn't cached")
+	}
+
+	w := request(h, http.MethodPost, "/save/Bottom", url.Values{"body": {"Bottom text, second version."}})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("saving Bottom got %d", w.Code)
+	}
+	if cached("Top") {
+		t.Error("saving Bottom, two includes down, left Top cached")
+	}
+	if body := view("Top"); !strings.Contains(body, "second version") || strings.Contains(body, "first version") {
+		t.Errorf("Top shows the old Bottom after its save:\n%s", body)
+	}
+
+	if err := store.Save(&Page{Title: "Middle", Body: []byte("Middle text alone.")}); err != nil {
+		t.Fatal(err)
+	}
+	if body := view("Top"); !strings.Contains(body, "Middle text alone.") || strings.Contains(body, "Bottom text") {
+		t.Errorf("Top still includes Bottom through the old Middle:\n%s", body)
+	}
+
+	// a page that doesn't exist yet counts too
+	if body := view("Other"); !strings.Contains(body, "was not included") {
+		t.Fatalf("Other doesn't say Later is missing:\n%s", body)
+	}
+	if err := store.Save(&Page{Title: "Later", Body: []byte("Later text.")}); err != nil {
+		t.Fatal(err)
+	}
+	if body := view("Other"); !strings.Contains(body, "Later text.") {
+		t.Errorf("creating Later left Other without it:\n%s", body)
+	}
+}
+
+// TestRenderCacheDropsRacingRenders checks a render that began before a
+// save of a page it includes is not cached.
+func TestRenderCacheDropsRacingRenders(t *testing.T) {
+	c := newRenderCache(16, 0)
+	gen := c.generation()
+	c.invalidate("Included")
+	c.put("Page@1", "stale", map[string]bool{"Included": true}, gen)
+	if _, ok := c.get("Page@1"); ok {
+		t.Error("a render from before the save of a page it includes was cached")
+	}
+	// one including nothing can't be stale
+	c.put("Plain@1", "fresh", nil, gen)
+	if _, ok := c.get("Plain@1"); !ok {
+		t.Error("a render including nothing wasn't cached")
+	}
+}
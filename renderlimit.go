@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// renderSlots bounds how many pages are rendered at once; nil means no
+// limit.
+var renderSlots chan struct{}
+
+var (
+	// number of renders running right now
+	rendersInFlight int64
+	// number of requests answered with a 503 for want of a render slot
+	shedRenders int64
+)
+
+var errRenderBusy = errors.New("too many pages are being rendered, try again shortly")
+
+func limitRenders(n int) {
+	if n > 0 {
+		renderSlots = make(chan struct{}, n)
+	}
+}
+
+// acquireRender waits up to -render-queue-timeout for a render slot.
+func acquireRender() error {
+	if renderSlots != nil {
+		select {
+		case renderSlots <- struct{}{}:
+		default:
+			t := time.NewTimer(config.RenderQueueTimeout)
+			defer t.Stop()
+			select {
+			case renderSlots <- struct{}{}:
+			case <-t.C:
+				return errRenderBusy
+			}
+		}
+	}
+	atomic.AddInt64(&rendersInFlight, 1)
+	return nil
+}
+
+func releaseRender() {
+	atomic.AddInt64(&rendersInFlight, -1)
+	if renderSlots != nil {
+		<-renderSlots
+	}
+}
+
+// renderFailed reports a failed render, shedding the request with a 503 if
+// the server was too busy to render.
+func renderFailed(w http.ResponseWriter, err error) {
+	if errors.Is(err, errRenderBusy) {
+		atomic.AddInt64(&shedRenders, 1)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
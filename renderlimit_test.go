@@ -0,0 +1,47 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestRenderLimitMetrics takes the only render slot and checks a view then
+// is shed with a 503, and that /metrics shows both.
+func TestRenderLimitMetrics(t *testing.T) {
+	keepConfig(t)
+	config.RenderQueueTimeout = time.Millisecond
+	defer func(slots chan struct{}) { renderSlots = slots }(renderSlots)
+	limitRenders(1)
+	withRenderCache(t)
+	h := testServer(seedStore(map[string]string{"Home": "home"}))
+
+	if err := acquireRender(); err != nil {
+		t.Fatal(err)
+	}
+	shed := atomic.LoadInt64(&shedRenders)
+	w := request(h, http.MethodGet, "/view/Home", nil)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("a view with no render slot free got %d", w.Code)
+	}
+	if n := atomic.LoadInt64(&shedRenders); n != shed+1 {
+		t.Errorf("%d renders were counted as shed, want 1", n-shed)
+	}
+
+	m := httptest.NewRecorder()
+	promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}).ServeHTTP(m, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, metric := range []string{"gowiki_renders_in_flight 1\n", "gowiki_renders_shed_total "} {
+		if !strings.Contains(m.Body.String(), metric) {
+			t.Errorf("/metrics has no %q", metric)
+		}
+	}
+
+	releaseRender()
+	if w := request(h, http.MethodGet, "/view/Home", nil); w.Code != http.StatusOK {
+		t.Errorf("a view once the slot was free got %d", w.Code)
+	}
+}
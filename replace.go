@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// most pages one find-and-replace may change, so its preview stays
+// readable and the batch saving them short
+const maxReplacePages = 500
+
+// pages listed at a time while looking for matches
+const replaceScanSize = 200
+
+var errTooManyReplaced = fmt.Errorf("more than %d pages match; narrow the search, e.g. to a namespace", maxReplacePages)
+
+// Replacement is a find-and-replace over the bodies of pages: Find is
+// taken as it is, or as a regular expression with Regexp, in which case
+// With may name its groups as $1 or ${name}.
+type Replacement struct {
+	Find   string
+	With   string
+	Regexp bool
+	// only the pages of this namespace, every page when empty
+	NS string
+}
+
+// ReplacedPage is a page a Replacement changes, as it is stored and with
+// the body it would get.
+type ReplacedPage struct {
+	*Page
+	NewBody []byte
+	Matches int
+	Diff    []DiffLine
+}
+
+func (rp *Replacement) compile() (*regexp.Regexp, []byte, error) {
+	if rp.Find == "" {
+		return nil, nil, errors.New("there is nothing to find")
+	}
+	if !rp.Regexp {
+		return regexp.MustCompile(regexp.QuoteMeta(rp.Find)), []byte(strings.ReplaceAll(rp.With, "$", "$$")), nil
+	}
+	re, err := regexp.Compile(rp.Find)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid regular expression: %v", err)
+	}
+	return re, []byte(rp.With), nil
+}
+
+// summary is the edit summary of the revisions a Replacement saves.
+func (rp *Replacement) summary() string {
+	s := "Replaced " + rp.Find + " with " + rp.With
+	if utf8.RuneCountInString(s) > maxSummary {
+		return "Find and replace"
+	}
+	return s
+}
+
+// findReplacements returns the pages rp changes, by title, failing with
+// errTooManyReplaced past maxReplacePages. Nothing is saved.
+func findReplacements(rp *Replacement, store PageStore) ([]*ReplacedPage, error) {
+	re, with, err := rp.compile()
+	if err != nil {
+		return nil, err
+	}
+	var found []*ReplacedPage
+	for offset := 0; ; offset += replaceScanSize {
+		listed, err := store.List(orderTitle, rp.NS, offset, replaceScanSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range listed {
+			p, err := store.Load(l.Title)
+			if err == errNotFound {
+				// deleted since it was listed
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			matches := re.FindAllIndex(p.Body, -1)
+			if len(matches) == 0 {
+				continue
+			}
+			body := re.ReplaceAll(p.Body, with)
+			if bytes.Equal(body, p.Body) {
+				continue
+			}
+			if len(found) == maxReplacePages {
+				return nil, errTooManyReplaced
+			}
+			diff := compactDiff(diffLines(string(p.Body), string(body)), diffContext)
+			found = append(found, &ReplacedPage{Page: p, NewBody: body, Matches: len(matches), Diff: diff})
+		}
+		if len(listed) < replaceScanSize {
+			return found, nil
+		}
+	}
+}
+
+// checkReplacements returns what keeps one of the new bodies of found from
+// being saved, as it would be on the edit page, or "" when none does.
+func checkReplacements(found []*ReplacedPage) string {
+	for _, f := range found {
+		if v := validateSave(&Page{Title: f.Title, Body: f.NewBody}); v.Failed() {
+			return f.Title + ": " + v.Fields[0].Message
+		}
+	}
+	return ""
+}
+
+// applyReplacements saves the new bodies of found as edits by editor, all
+// or none of them. A page saved by someone else since it was found fails
+// the batch with errVersionConflict.
+func applyReplacements(rp *Replacement, found []*ReplacedPage, editor string, store PageStore) error {
+	if msg := checkReplacements(found); msg != "" {
+		return errors.New(msg)
+	}
+	writes := make([]PageWrite, len(found))
+	for i, f := range found {
+		writes[i] = saveWrite(&Page{Title: f.Title, Body: f.NewBody, BaseVersion: f.Version, UpdatedBy: editor, Summary: rp.summary()})
+	}
+	return store.Apply(writes...)
+}
+
+// Replace is the data model of the /replace page.
+type Replace struct {
+	*Replacement
+	// the pages it changes, once previewed
+	Pages   []*ReplacedPage
+	Preview bool
+	Message string
+	Error   string
+}
+
+// replaceHandler finds and replaces text across pages at /replace. A POST
+// previews the pages it changes and their diffs; one with action=apply
+// saves them, provided they are still the ones previewed.
+func replaceHandler(w http.ResponseWriter, r *http.Request, store PageStore) {
+	rp := &Replace{Replacement: &Replacement{Find: r.FormValue("find"), With: r.FormValue("with"), Regexp: r.FormValue("regexp") != "", NS: strings.TrimSpace(r.FormValue("ns"))}}
+	if r.Method != http.MethodPost {
+		renderTemplate(w, r, "replace", rp)
+		return
+	}
+	if rp.NS != "" && !validNamespace.MatchString(rp.NS) {
+		rp.Error = fmt.Sprintf("There is no namespace called %q.", rp.NS)
+		renderTemplateStatus(w, r, http.StatusBadRequest, "replace", rp)
+		return
+	}
+	if _, _, err := rp.compile(); err != nil {
+		rp.Error = sentence(err.Error())
+		renderTemplateStatus(w, r, http.StatusBadRequest, "replace", rp)
+		return
+	}
+	found, err := findReplacements(rp.Replacement, store)
+	if err == errTooManyReplaced {
+		rp.Error = sentence(err.Error())
+		renderTemplateStatus(w, r, http.StatusBadRequest, "replace", rp)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rp.Pages, rp.Preview = found, true
+	if r.FormValue("action") != "apply" {
+		renderTemplate(w, r, "replace", rp)
+		return
+	}
+
+	if !samePreview(r.Form["page"], found) {
+		rp.Error = "Pages changed since the preview. Check the changes below again before replacing."
+		renderTemplateStatus(w, r, http.StatusConflict, "replace", rp)
+		return
+	}
+	if msg := checkReplacements(found); msg != "" {
+		rp.Error = msg
+		renderTemplateStatus(w, r, http.StatusBadRequest, "replace", rp)
+		return
+	}
+	err = applyReplacements(rp.Replacement, found, editorName(r), store)
+	if errors.Is(err, errVersionConflict) {
+		rp.Error = "A page was saved while replacing, so nothing was changed. Check the changes below again."
+		renderTemplateStatus(w, r, http.StatusConflict, "replace", rp)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rp.Pages, rp.Preview = nil, false
+	rp.Message = fmt.Sprintf("Replaced %d matches on %d pages.", countMatches(found), len(found))
+	renderTemplate(w, r, "replace", rp)
+}
+
+// samePreview tells whether the pages previewed, posted as "version title",
+// are exactly found at the same versions.
+func samePreview(previewed []string, found []*ReplacedPage) bool {
+	if len(previewed) != len(found) {
+		return false
+	}
+	versions := map[string]int64{}
+	for _, p := range previewed {
+		v, title, ok := strings.Cut(p, " ")
+		n, err := strconv.ParseInt(v, 10, 64)
+		if !ok || err != nil {
+			return false
+		}
+		versions[title] = n
+	}
+	for _, f := range found {
+		if v, ok := versions[f.Title]; !ok || v != f.Version {
+			return false
+		}
+	}
+	return true
+}
+
+func countMatches(found []*ReplacedPage) int {
+	n := 0
+	for _, f := range found {
+		n += f.Matches
+	}
+	return n
+}
+
+// replaceCommand finds and replaces text across pages from the command
+// line, printing the diffs and saving them only with -apply.
+func replaceCommand(conn db, args []string) error {
+	flags := flag.NewFlagSet("replace", flag.ExitOnError)
+	rp := &Replacement{}
+	flags.BoolVar(&rp.Regexp, "regexp", false, "take the text to find as a regular expression, the replacement naming its groups as $1")
+	flags.StringVar(&rp.NS, "ns", "", "only change pages of this namespace")
+	apply := flags.Bool("apply", false, "save the changes instead of only printing them")
+	by := flags.String("by", config.AdminUser, "editor the new revisions are saved by")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return fmt.Errorf("expected the text to find and its replacement")
+	}
+	rp.Find, rp.With = flags.Arg(0), flags.Arg(1)
+
+	store := &pgStore{conn: conn}
+	found, err := findReplacements(rp, store)
+	if err != nil {
+		return err
+	}
+	for _, f := range found {
+		fmt.Printf("== %s (%d)\n", f.Title, f.Matches)
+		for _, l := range f.Diff {
+			if l.Op == "…" {
+				fmt.Println("…")
+			} else {
+				fmt.Printf("%s %s\n", strings.Replace(l.Op, "=", " ", 1), l.Text)
+			}
+		}
+	}
+	if !*apply {
+		fmt.Printf("%d matches on %d pages; run again with -apply to replace them\n", countMatches(found), len(found))
+		return nil
+	}
+	if err := applyReplacements(rp, found, *by, store); err != nil {
+		return err
+	}
+	fmt.Printf("replaced %d matches on %d pages\n", countMatches(found), len(found))
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// recentWrites remembers which pages this server wrote lately, so reading
+// them back goes to the primary until the replica has caught up. A write
+// that may change any page, like relinking, holds back every read.
+type recentWrites struct {
+	mu     sync.Mutex
+	window time.Duration
+	titles map[string]time.Time
+	all    time.Time
+}
+
+func newRecentWrites(window time.Duration) *recentWrites {
+	return &recentWrites{window: window, titles: map[string]time.Time{}}
+}
+
+// wrote records writes to titles, or to every page when there are none.
+func (rw *recentWrites) wrote(titles ...string) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	now := time.Now()
+	if len(titles) == 0 {
+		rw.all = now
+		rw.titles = map[string]time.Time{}
+		return
+	}
+	for t, at := range rw.titles {
+		if now.Sub(at) > rw.window {
+			delete(rw.titles, t)
+		}
+	}
+	for _, t := range titles {
+		rw.titles[t] = now
+	}
+}
+
+// fresh reports whether title was written too recently to trust the
+// replica with it. An empty title asks about any page, for listings.
+func (rw *recentWrites) fresh(title string) bool {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	latest := rw.all
+	if title == "" {
+		for _, at := range rw.titles {
+			if at.After(latest) {
+				latest = at
+			}
+		}
+	} else if at := rw.titles[title]; at.After(latest) {
+		latest = at
+	}
+	return time.Since(latest) <= rw.window
+}
+
+// reader is the connection to read title from: the replica, if there is
+// one and title wasn't just written.
+func (s *pgStore) reader(title string) db {
+	if s.replica == nil || s.written.fresh(title) {
+		return s.conn
+	}
+	return s.replica
+}
+
+// wrote notes writes to titles for reader, every page when there are none.
+func (s *pgStore) wrote(titles ...string) {
+	if s.replica != nil {
+		s.written.wrote(titles...)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"github.com/jackc/pgconn"
+	"io"
+	"net"
+	"time"
+)
+
+// attempts at a write before giving up, and the delay before the first
+// retry; it doubles after each one
+const (
+	maxAttempts  = 3
+	retryBackoff = 50 * time.Millisecond
+)
+
+// transient reports whether err is a failure that may go away on its own:
+// serialization failures, deadlocks and network errors. Constraint
+// violations and other errors from the server are not retried.
+func transient(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "40001" || pgErr.Code == "40P01"
+	}
+	if pgconn.SafeToRetry(err) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retryTransient runs fn until it succeeds, fails with an error that is not
+// transient, or runs out of attempts, and returns the last error.
+func retryTransient(fn func() error) error {
+	delay := retryBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil || attempt == maxAttempts || !transient(err) {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
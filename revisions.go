@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// pruning never leaves a page with fewer revisions than this
+const minRevisions = 5
+
+// revisions per page of /history
+const historyPageSize = 25
+
+// longest edit summary accepted, in characters
+const maxSummary = 200
+
+type Revision struct {
+	ID        int64
+	Author    string
+	CreatedAt time.Time
+	// optional edit summary given when saving
+	Summary string
+	// body size in bytes and its change from the previous revision
+	Size  int64
+	Delta int64
+	// only loaded for a single revision or with pageFull
+	Body []byte
+}
+
+// recordRevision stores the body p was just saved with as a new revision
+// made at, or in the latest one when its author saved it less than
+// -coalesce-edits before. Anonymous saves are never folded together as
+// they may come from different people. The time is passed in rather than
+// taken from the database clock, since the save queue may write the
+// revision some time after the save.
+func recordRevision(ctx context.Context, p *Page, at time.Time, conn db) error {
+	if config.CoalesceEdits > 0 && !isAnonymous(p.UpdatedBy) {
+		// the window restarts with every folded save; an empty summary
+		// keeps the one already there
+		query := `UPDATE ` + table("page_revisions") + ` SET body = $2, created_at = $6, summary = CASE WHEN $4 = '' THEN summary ELSE $4 END
+			WHERE id = (SELECT max(id) FROM ` + table("page_revisions") + ` WHERE page_id = $1)
+			AND author = $3 AND created_at > $6::timestamptz - make_interval(secs => $5)`
+		tag, err := conn.Exec(ctx, query, p.ID, p.Body, p.UpdatedBy, p.Summary, config.CoalesceEdits.Seconds(), at)
+		if err != nil || tag.RowsAffected() > 0 {
+			return err
+		}
+	}
+	query := "INSERT INTO " + table("page_revisions") + " (page_id, body, author, summary, created_at) VALUES ($1, $2, NULLIF($3, ''), $4, $5)"
+	_, err := conn.Exec(ctx, query, p.ID, p.Body, p.UpdatedBy, p.Summary, at)
+	return err
+}
+
+// pruneRevisions deletes the revisions of a page, or of every page when
+// pageID is 0, that are beyond -max-revisions or older than
+// -max-revision-age, always keeping the newest minRevisions. It returns
+// the number of revisions deleted.
+func pruneRevisions(ctx context.Context, pageID int64, conn db) (int64, error) {
+	if config.MaxRevisions <= 0 && config.MaxRevisionAge <= 0 {
+		return 0, nil
+	}
+	var cutoff *time.Time
+	if config.MaxRevisionAge > 0 {
+		t := time.Now().Add(-config.MaxRevisionAge)
+		cutoff = &t
+	}
+	query := `DELETE FROM ` + table("page_revisions") + ` WHERE id IN (
+		SELECT id FROM (
+			SELECT id, created_at, row_number() OVER (PARTITION BY page_id ORDER BY id DESC) AS n
+			FROM ` + table("page_revisions") + ` WHERE $1 = 0 OR page_id = $1
+		) ranked
+		WHERE n > $2 AND (($3 > 0 AND n > $3) OR created_at < $4::timestamptz)
+	)`
+	tag, err := conn.Exec(ctx, query, pageID, minRevisions, config.MaxRevisions, cutoff)
+	return tag.RowsAffected(), err
+}
+
+// loadRevisions returns up to limit revisions of a page, newest first,
+// skipping the newest offset, and how many revisions the page has. Bodies
+// are only read with pageFull.
+func loadRevisions(ctx context.Context, pageID int64, limit, offset int, fields pageFields, conn db) ([]*Revision, int, error) {
+	var total int
+	query := "SELECT count(*) FROM " + table("page_revisions") + " WHERE page_id = $1"
+	if err := conn.QueryRow(ctx, query, pageID).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	// the delta is computed over the whole history before paging, so the
+	// oldest revision on a page still has one
+	body := ""
+	if fields == pageFull {
+		body = ", body"
+	}
+	query = `SELECT id, author, created_at, summary, size, size - COALESCE(lag(size) OVER (ORDER BY id), 0)` + body + `
+		FROM (SELECT id, COALESCE(author, '') AS author, created_at, summary, octet_length(body) AS size` + body + `
+			FROM ` + table("page_revisions") + ` WHERE page_id = $1) r
+		ORDER BY id DESC LIMIT $2 OFFSET $3`
+	rows, err := conn.Query(ctx, query, pageID, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var revs []*Revision
+	for rows.Next() {
+		rev := &Revision{}
+		dest := []interface{}{&rev.ID, &rev.Author, &rev.CreatedAt, &rev.Summary, &rev.Size, &rev.Delta}
+		if fields == pageFull {
+			dest = append(dest, &rev.Body)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, 0, err
+		}
+		revs = append(revs, rev)
+	}
+	return revs, total, rows.Err()
+}
+
+// loadRevision returns one revision of a page with its body.
+func loadRevision(ctx context.Context, pageID, id int64, conn db) (*Revision, error) {
+	rev := &Revision{ID: id}
+	query := "SELECT COALESCE(author, ''), created_at, summary, body FROM " + table("page_revisions") + " WHERE page_id = $1 AND id = $2"
+	err := conn.QueryRow(ctx, query, pageID, id).Scan(&rev.Author, &rev.CreatedAt, &rev.Summary, &rev.Body)
+	if err != nil {
+		return nil, err
+	}
+	rev.Size = int64(len(rev.Body))
+	return rev, nil
+}
+
+type History struct {
+	Page      *Page
+	Revisions []*Revision
+	// current page of the listing, counted from 1, and its neighbours; 0
+	// when there is none
+	Number int
+	Pages  int
+	Prev   int
+	Next   int
+}
+
+func historyHandler(w http.ResponseWriter, r *http.Request, title string, store PageStore) {
+	p, err := store.Stat(title)
+	if err == errNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h := &History{Page: p, Number: pageNumber(r)}
+	revs, total, err := store.Revisions(p, historyPageSize, (h.Number-1)*historyPageSize, pageMeta)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.Revisions = revs
+	h.Pages = (total + historyPageSize - 1) / historyPageSize
+	if h.Number > 1 {
+		h.Prev = h.Number - 1
+	}
+	if h.Number < h.Pages {
+		h.Next = h.Number + 1
+	}
+	renderTemplate(w, r, "history", h)
+}
+
+type Compare struct {
+	Page *Page
+	From *Revision
+	To   *Revision
+	Diff []DiffLine
+}
+
+// diffHandler compares two revisions of a page, given by the from and to
+// revision IDs.
+func diffHandler(w http.ResponseWriter, r *http.Request, title string, store PageStore) {
+	p, err := store.Stat(title)
+	if err == errNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fromID, ferr := strconv.ParseInt(r.FormValue("from"), 10, 64)
+	toID, terr := strconv.ParseInt(r.FormValue("to"), 10, 64)
+	if ferr != nil || terr != nil {
+		http.Error(w, "pick two revisions to compare", http.StatusBadRequest)
+		return
+	}
+	c := &Compare{Page: p}
+	c.From, err = store.Revision(p, fromID)
+	if err == nil {
+		c.To, err = store.Revision(p, toID)
+	}
+	if err == errNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c.Diff = compactDiff(diffLines(string(c.From.Body), string(c.To.Body)), diffContext)
+	renderTemplate(w, r, "compare", c)
+}
+
+// viewRevision shows the revision given by ?rev= in place of the current
+// body of p. Old revisions skip the render cache, which is kept for the
+// pages people read.
+func viewRevision(w http.ResponseWriter, r *http.Request, p *Page, store PageStore) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("rev"), 10, 64)
+	if err != nil {
+		http.Error(w, "no such revision", http.StatusBadRequest)
+		return
+	}
+	rev, err := store.Revision(p, id)
+	if err == errNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	old := *p
+	old.Body, old.UpdatedAt, old.UpdatedBy = rev.Body, rev.CreatedAt, rev.Author
+	if err := acquireRender(); err != nil {
+		renderFailed(w, err)
+		return
+	}
+	html, err := newInclusion(store).render(&old)
+	releaseRender()
+	if err != nil {
+		renderFailed(w, err)
+		return
+	}
+	v := newView(r, &old, html)
+	v.Revision = rev
+	// the current version is the one to describe
+	v.StructuredData = ""
+	renderPageTemplate(w, r, "view", v)
+}
+
+// revertSummary is the summary of the revision a revert to rev makes.
+func revertSummary(rev *Revision) string {
+	by := rev.Author
+	if by == "" {
+		by = "anonymous"
+	}
+	return "Reverted to the revision of " + rev.CreatedAt.Format("2006-01-02 15:04") + " by " + by
+}
+
+// revertHandler saves the revision given by rev as the current body of the
+// page, as an edit by the user. It fails if the page changed since it was
+// loaded rather than undo that change unseen.
+func revertHandler(w http.ResponseWriter, r *http.Request, title string, store PageStore) {
+	p, err := store.Load(title)
+	if err == errNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !checkEdit(w, r, p.Protection) {
+		return
+	}
+	id, err := strconv.ParseInt(r.FormValue("rev"), 10, 64)
+	if err != nil {
+		http.Error(w, "no such revision", http.StatusBadRequest)
+		return
+	}
+	rev, err := store.Revision(p, id)
+	if err == errNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.Body, p.UpdatedBy, p.Summary, p.BaseVersion = rev.Body, editorName(r), revertSummary(rev), p.Version
+	// rules may have changed since the revision was saved
+	if v := validateSave(p); v.Failed() {
+		http.Error(w, "This revision can't be restored: "+v.Fields[0].Message, http.StatusBadRequest)
+		return
+	}
+	if ok, reset := allowEdit(w, r); !ok {
+		http.Error(w, "You have reached your edit quota. You can save again after "+reset.Format("2006-01-02 15:04 MST")+".", http.StatusTooManyRequests)
+		return
+	}
+	err = store.Save(p)
+	if err == errVersionConflict {
+		http.Error(w, "The page changed while you were reverting it; look at its history again.", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	redirect(w, r, pagePath("view", title), http.StatusSeeOther)
+}
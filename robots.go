@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net/http"
+)
+
+const (
+	robotsDisallow = "User-agent: *\nDisallow: /\n"
+	robotsAllow    = "User-agent: *\nAllow: /\n"
+)
+
+// robotsHandler tells crawlers to stay away from a -noindex wiki, and
+// where the sitemap of any other is.
+func robotsHandler(w http.ResponseWriter, r *http.Request) {
+	body := robotsAllow + "Sitemap: " + baseURL(r) + "/sitemap.xml\n"
+	if config.NoIndex {
+		body = robotsDisallow
+	}
+	writeBody(w, r, http.StatusOK, "text/plain; charset=utf-8", []byte(body))
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"hash/fnv"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// how long the save queue waits before writing a batch again after
+	// the database failed it, and how many times it tries on shutdown
+	saveRetryInterval = 5 * time.Second
+	saveFinalAttempts = 3
+	// locks the titles of saves being queued are spread over
+	saveLockStripes = 64
+)
+
+// saveQueue queues saved pages for runSaveQueue to record their revisions,
+// tags and links; nil while saves write everything at once. It is kept in
+// memory only: what it holds is written out on shutdown, but a crash loses
+// it, up to -save-queue saves whose pages are stored without their history.
+var saveQueue chan *Page
+
+var (
+	// number of saves that had to wait for room in the queue
+	saveQueueFull int64
+	// number of saves whose revision, tags and links were never written
+	droppedSaves int64
+)
+
+// saveLocks keep two saves of one page from queueing in another order than
+// their rows were written in, so the revisions of a page are recorded in
+// the order it was saved. Titles share a lock by their hash.
+var saveLocks [saveLockStripes]sync.Mutex
+
+func saveLock(title string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(title)))
+	return &saveLocks[h.Sum32()%saveLockStripes]
+}
+
+// pendingSaves counts the queued saves of each page, for the writes that
+// have to wait for them.
+type pendingSaves struct {
+	mu     sync.Mutex
+	done   *sync.Cond
+	titles map[string]int
+	n      int
+}
+
+var queuedSaves = newPendingSaves()
+
+func newPendingSaves() *pendingSaves {
+	ps := &pendingSaves{titles: map[string]int{}}
+	ps.done = sync.NewCond(&ps.mu)
+	return ps
+}
+
+func (ps *pendingSaves) add(title string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.titles[strings.ToLower(title)]++
+	ps.n++
+}
+
+func (ps *pendingSaves) remove(pages []*Page) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, p := range pages {
+		key := strings.ToLower(p.Title)
+		if ps.titles[key]--; ps.titles[key] == 0 {
+			delete(ps.titles, key)
+		}
+		ps.n--
+	}
+	ps.done.Broadcast()
+}
+
+// wait returns once none of titles, or no page at all when there are none,
+// has a save queued.
+func (ps *pendingSaves) wait(titles ...string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for ps.pending(titles) {
+		ps.done.Wait()
+	}
+}
+
+func (ps *pendingSaves) pending(titles []string) bool {
+	if len(titles) == 0 {
+		return ps.n > 0
+	}
+	for _, t := range titles {
+		if ps.titles[strings.ToLower(t)] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// awaitSaves holds back a write that moves or rewrites pages, like a
+// delete or a rename, until their queued saves are recorded, so it doesn't
+// archive a page without its last revision or relink a page the queue
+// then syncs again from its old body. With no titles it waits for every
+// queued save.
+func awaitSaves(titles ...string) {
+	if saveQueue != nil {
+		queuedSaves.wait(titles...)
+	}
+}
+
+// queueSave writes the row of p, which is what readers of the page see and
+// where conflicts show, and queues recording its revision, tags and links.
+// When the queue is full it waits for room, so a worker that falls behind
+// slows saving down instead of the queue growing without bound.
+func queueSave(ctx context.Context, p *Page, conn db) error {
+	lock := saveLock(p.Title)
+	lock.Lock()
+	defer lock.Unlock()
+	err := retryTransient(func() error {
+		defer timeQuery("save", time.Now())
+		return p.writeRow(ctx, conn)
+	})
+	if err != nil {
+		return err
+	}
+	// the copy carries the time the row was written at, which its
+	// revision is dated with however long it waits
+	queued := *p
+	queuedSaves.add(p.Title)
+	select {
+	case saveQueue <- &queued:
+	default:
+		atomic.AddInt64(&saveQueueFull, 1)
+		saveQueue <- &queued
+	}
+	return nil
+}
+
+// runSaveQueue records the queued saves until ctx is done, then whatever is
+// still queued. The saves waiting when it gets to them are written in one
+// transaction of up to -save-batch, so a busy wiki commits once for many
+// saves. A batch the database fails is kept and tried again, holding the
+// queue back meanwhile. It uses its own connection, as runViewLog does.
+func runSaveQueue(ctx context.Context, queue <-chan *Page) {
+	sw := &saveWriter{}
+	defer sw.close()
+	for {
+		if len(sw.batch) == 0 {
+			select {
+			case <-ctx.Done():
+				sw.finish(queue)
+				return
+			case p := <-queue:
+				sw.batch = append(sw.batch, p)
+			}
+		}
+		sw.fill(queue)
+		err := sw.write(ctx)
+		if err == nil {
+			continue
+		}
+		log.Printf("save queue: writing %d saves, %d more waiting: %v", len(sw.batch), len(queue), err)
+		select {
+		case <-ctx.Done():
+			sw.finish(queue)
+			return
+		case <-time.After(saveRetryInterval):
+		}
+	}
+}
+
+// saveWriter is the connection of runSaveQueue and the batch it is writing.
+type saveWriter struct {
+	conn  *pgx.Conn
+	batch []*Page
+}
+
+// fill adds the saves waiting in queue to the batch, up to -save-batch.
+func (sw *saveWriter) fill(queue <-chan *Page) {
+	for len(sw.batch) < config.SaveBatch && len(queue) > 0 {
+		sw.batch = append(sw.batch, <-queue)
+	}
+}
+
+// write records the batch and tells the watchers about its saves, now that
+// their revisions are there to diff. The batch is kept when it fails.
+func (sw *saveWriter) write(ctx context.Context) error {
+	if sw.conn == nil {
+		conn, err := connectDB(ctx, config.StatementTimeout)
+		if err != nil {
+			return err
+		}
+		sw.conn = conn
+	}
+	if err := writeSaves(ctx, sw.batch, sw.conn); err != nil {
+		// a broken connection is replaced on the next attempt
+		sw.close()
+		return err
+	}
+	queuedSaves.remove(sw.batch)
+	for _, p := range sw.batch {
+		queueChange(p)
+	}
+	sw.batch = sw.batch[:0]
+	return nil
+}
+
+// finish records what is still queued once the server has stopped serving,
+// so nothing more comes in. A batch the database still fails after
+// saveFinalAttempts is dropped and logged by title: the pages are saved,
+// only their revisions, tags and links are missing.
+func (sw *saveWriter) finish(queue <-chan *Page) {
+	for len(sw.batch) > 0 || len(queue) > 0 {
+		sw.fill(queue)
+		var err error
+		for attempt := 1; attempt <= saveFinalAttempts; attempt++ {
+			if err = sw.write(context.Background()); err == nil {
+				break
+			}
+			log.Printf("save queue: writing %d saves: %v", len(sw.batch), err)
+			time.Sleep(retryBackoff)
+		}
+		if err != nil {
+			for _, p := range sw.batch {
+				log.Printf("save queue: dropped the revision of %s at version %d", logValue(p.Title), p.Version)
+			}
+			atomic.AddInt64(&droppedSaves, int64(len(sw.batch)))
+			queuedSaves.remove(sw.batch)
+			sw.batch = sw.batch[:0]
+		}
+	}
+}
+
+func (sw *saveWriter) close() {
+	if sw.conn != nil {
+		sw.conn.Close(context.Background())
+		sw.conn = nil
+	}
+}
+
+// writeSaves records batch in one transaction, each save in a savepoint so
+// one the database turns down, like that of a page deleted since, is
+// dropped without the others. Any other failure fails the whole batch.
+func writeSaves(ctx context.Context, batch []*Page, conn db) error {
+	defer timeQuery("saveBatch", time.Now())
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	for _, p := range batch {
+		sp, err := tx.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		err = p.record(ctx, sp)
+		var pgErr *pgconn.PgError
+		if err != nil && errors.As(err, &pgErr) && !transient(err) {
+			if err := sp.Rollback(ctx); err != nil {
+				return err
+			}
+			log.Printf("save queue: dropped the revision of %s at version %d: %v", logValue(p.Title), p.Version, err)
+			atomic.AddInt64(&droppedSaves, 1)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := sp.Commit(ctx); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
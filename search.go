@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// most results shown, and exported, for one search
+const searchLimit = 50
+
+// searchBackend is how searchPages matches pages.
+type searchBackend string
+
+const (
+	// titles resembling the query, typos included, and bodies containing it
+	searchTrigram searchBackend = "trigram"
+	// Postgres full text search of titles and bodies, matching other forms
+	// of the words, ranked by relevance
+	searchFTS searchBackend = "fts"
+)
+
+var searchBackends = []string{string(searchTrigram), string(searchFTS)}
+
+// validSearchLanguage matches the names of Postgres text search
+// configurations, which are put in the query as they are.
+var validSearchLanguage = regexp.MustCompile("^[a-z_]+$")
+
+// searchFor picks the backend of a search request: the configured one,
+// unless fuzzy=1 asks for typo tolerant trigram matching.
+func searchFor(r *http.Request) searchBackend {
+	if r.FormValue("fuzzy") == "1" {
+		return searchTrigram
+	}
+	return searchBackend(config.SearchBackend)
+}
+
+// snippetStart and snippetStop surround the matches in a Page.Snippet.
+// Control characters can't be typed into a body, so they are never confused
+// with its text.
+const (
+	snippetStart = "\x02"
+	snippetStop  = "\x03"
+)
+
+// snippetContext is about how many characters of the body trigram search
+// results show either side of the match.
+const snippetContext = 100
+
+// markMatches surrounds each occurrence of q in s, ignoring case, with
+// snippetStart and snippetStop.
+func markMatches(s, q string) string {
+	if q == "" {
+		return s
+	}
+	re := regexp.MustCompile("(?i)" + regexp.QuoteMeta(q))
+	return re.ReplaceAllStringFunc(s, func(m string) string { return snippetStart + m + snippetStop })
+}
+
+// snippetAround is the text of body around the first occurrence of q, or its
+// beginning if q isn't in it, with the matches marked.
+func snippetAround(body, q string) string {
+	start := 0
+	if i := strings.Index(strings.ToLower(body), strings.ToLower(q)); i >= 0 && q != "" {
+		start = max(i-snippetContext, 0)
+	}
+	end := min(start+2*snippetContext+len(q), len(body))
+	// don't cut a character in two
+	for start > 0 && !utf8.RuneStart(body[start]) {
+		start--
+	}
+	for end < len(body) && !utf8.RuneStart(body[end]) {
+		end++
+	}
+	return markMatches(body[start:end], q)
+}
+
+// SnippetHTML is the snippet of a search result with its matches
+// highlighted.
+func (p *Page) SnippetHTML() template.HTML {
+	s := template.HTMLEscapeString(strings.TrimSpace(p.Snippet))
+	s = strings.ReplaceAll(s, snippetStart, "<mark>")
+	s = strings.ReplaceAll(s, snippetStop, "</mark>")
+	return template.HTML(s)
+}
+
+// searchPages returns pages matching q with backend, best first, without
+// their bodies but with a snippet of the text around the match.
+func searchPages(ctx context.Context, q, ns string, backend searchBackend, limit int, conn db) ([]*Page, error) {
+	defer timeQuery("searchPages", time.Now())
+	// the snippet is the body around the match, marked once read; gzipped
+	// bodies, whose body is empty, match by their search_vector and are
+	// read whole for it
+	query := `SELECT id, title, created_at, updated_at, COALESCE(updated_by, ''),
+			substr(body, greatest(strpos(lower(body), lower($1)) - ` + strconv.Itoa(snippetContext) + `, 1), ` + strconv.Itoa(2*snippetContext) + ` + length($1)), body_gz
+		FROM ` + table("pages") + `
+		WHERE (title % $1 OR strpos(lower(body), lower($1)) > 0 OR search_vector @@ plainto_tsquery('` + config.SearchLanguage + `', $1)) AND ($3 = '' OR ` + namespaceSQL + ` = $3)
+		ORDER BY similarity(title, $1) DESC, updated_at DESC LIMIT $2`
+	if backend == searchFTS {
+		// the same expression as the index of the initial migration, so it
+		// is used; for a gzipped body it is the title alone
+		doc := "to_tsvector('" + config.SearchLanguage + "', title || ' ' || body)"
+		tsquery := "websearch_to_tsquery('" + config.SearchLanguage + "', $1)"
+		// ts_headline marks the words matched in any of their forms
+		headline := "ts_headline('" + config.SearchLanguage + "', body, " + tsquery + ", 'StartSel=" + snippetStart + ", StopSel=" + snippetStop + ", MaxWords=35, MinWords=15')"
+		query = `SELECT id, title, created_at, updated_at, COALESCE(updated_by, ''), ` + headline + `, body_gz FROM ` + table("pages") + `
+			WHERE (` + doc + ` @@ ` + tsquery + ` OR search_vector @@ ` + tsquery + `) AND ($3 = '' OR ` + namespaceSQL + ` = $3)
+			ORDER BY ts_rank(COALESCE(` + doc + ` || search_vector, ` + doc + `), ` + tsquery + `) DESC, updated_at DESC LIMIT $2`
+	}
+	rows, err := conn.Query(ctx, query, q, limit, ns)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pages []*Page
+	for rows.Next() {
+		p := &Page{}
+		var gz []byte
+		if err := rows.Scan(&p.ID, &p.Title, &p.CreatedAt, &p.UpdatedAt, &p.UpdatedBy, &p.Snippet, &gz); err != nil {
+			return nil, err
+		}
+		switch {
+		case gz != nil:
+			body, err := gunzip(gz)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", p.Title, err)
+			}
+			p.Snippet = snippetAround(string(body), q)
+		case backend != searchFTS:
+			p.Snippet = markMatches(p.Snippet, q)
+		}
+		pages = append(pages, p)
+	}
+	return pages, rows.Err()
+}
+
+type Search struct {
+	Query string
+	// namespace searched, empty for all of them
+	Namespace string
+	// trigram matching was asked for over full text search
+	Fuzzy   bool
+	FTS     bool
+	Results []*Page
+	Limit   int
+}
+
+func searchHandler(w http.ResponseWriter, r *http.Request, store PageStore) {
+	s := &Search{Query: strings.TrimSpace(r.FormValue("q")), Namespace: r.FormValue("ns"), Limit: searchLimit}
+	s.Fuzzy = r.FormValue("fuzzy") == "1"
+	s.FTS = config.SearchBackend == string(searchFTS)
+	if s.Query != "" {
+		var err error
+		s.Results, err = store.Search(s.Query, s.Namespace, searchFor(r), searchLimit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	renderTemplate(w, r, "search", s)
+}
+
+// Report is every result of a search in one document.
+type Report struct {
+	Query string
+	// links back to the wiki are absolute since the report is downloaded
+	BaseURL  string
+	Sections []*ReportSection
+}
+
+type ReportSection struct {
+	Page *Page
+	HTML template.HTML
+}
+
+// baseURL is the scheme and host the request was made to.
+func baseURL(r *http.Request) string {
+	return requestScheme(r) + "://" + r.Host + config.BasePath
+}
+
+var unsafeFilename = regexp.MustCompile(`[^a-zA-Z0-9]+`)
+
+// searchExportHandler downloads the pages matching a search as one
+// Markdown (format=markdown) or HTML document, a section per page headed
+// by its title and linking back to it.
+func searchExportHandler(w http.ResponseWriter, r *http.Request, store PageStore) {
+	q := strings.TrimSpace(r.FormValue("q"))
+	if q == "" {
+		http.Error(w, "nothing to export without a search", http.StatusBadRequest)
+		return
+	}
+	format := r.FormValue("format")
+	if format != "markdown" && format != "html" {
+		http.Error(w, `format must be "markdown" or "html"`, http.StatusBadRequest)
+		return
+	}
+	results, err := store.Search(q, r.FormValue("ns"), searchFor(r), searchLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rep := &Report{Query: q, BaseURL: baseURL(r)}
+	var md bytes.Buffer
+	fmt.Fprintf(&md, "# Search results for %q\n", q)
+	for _, res := range results {
+		p, err := store.Load(res.Title)
+		if err == errNotFound {
+			// deleted since the search ran
+			continue
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if format == "html" {
+			html, err := renderPage(p, store)
+			if err != nil {
+				renderFailed(w, err)
+				return
+			}
+			rep.Sections = append(rep.Sections, &ReportSection{Page: p, HTML: html})
+			continue
+		}
+		_, body := parseFrontMatter(p.Body)
+		fmt.Fprintf(&md, "\n## [%s](%s%s)\n\n%s\n", p.Title, rep.BaseURL, pagePath("view", p.Title), bytes.TrimSpace(body))
+	}
+
+	name := "search-" + strings.Trim(unsafeFilename.ReplaceAllString(q, "-"), "-")
+	if name == "search-" {
+		name = "search-results"
+	}
+	if format == "html" {
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.html"`)
+		renderTemplate(w, r, "report", rep)
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.md"`)
+	writeBody(w, r, http.StatusOK, "text/markdown; charset=utf-8", md.Bytes())
+}
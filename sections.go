@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+)
+
+// sectionBounds returns the byte range of section n of body: 0 is the text
+// before the first heading, n the section of the nth heading, subsections
+// included.
+func sectionBounds(body []byte, n int) (start, end int, ok bool) {
+	headings := parseHeadings(body)
+	switch {
+	case n == 0 && len(headings) == 0:
+		return 0, len(body), true
+	case n == 0:
+		return 0, headings[0].Start, true
+	case n < 0 || n > len(headings):
+		return 0, 0, false
+	}
+	h := headings[n-1]
+	return h.Start, h.End, true
+}
+
+// sectionHash identifies the text of a section as it was opened in the
+// editor, to find it again when saving.
+func sectionHash(text []byte) string {
+	sum := sha256.Sum256(text)
+	return hex.EncodeToString(sum[:])
+}
+
+// spliceSection replaces body[start:end] with text, keeping text on lines of
+// its own.
+func spliceSection(body []byte, start, end int, text []byte) []byte {
+	out := append([]byte(nil), body[:start]...)
+	out = append(out, text...)
+	if end < len(body) && len(text) > 0 && text[len(text)-1] != '\n' {
+		out = append(out, '\n')
+	}
+	return append(out, body[end:]...)
+}
+
+// openSection narrows p, as loaded for the editor, to the section asked
+// for, if any. It answers the request itself and returns false when there
+// is no such section.
+func openSection(w http.ResponseWriter, r *http.Request, p *Page) bool {
+	s := r.FormValue("section")
+	if s == "" {
+		return true
+	}
+	n, err := strconv.Atoi(s)
+	start, end, ok := sectionBounds(p.Body, n)
+	if err != nil || !ok {
+		http.Error(w, "no such section", http.StatusNotFound)
+		return false
+	}
+	p.Body = p.Body[start:end]
+	p.Section = s
+	p.SectionBase = sectionHash(p.Body)
+	return true
+}
+
+// mergeSection puts the section p holds back into the stored page. Sections
+// shift when headings are added or removed above, so the section is found
+// by its text as opened, trying its old number first. If that text is gone,
+// someone changed the section meanwhile: v reports the conflict and p is
+// made ready to be shown again with diff, so that saving it replaces their
+// version of the section.
+func mergeSection(p *Page, store PageStore) (body []byte, v *Validation, diff []DiffLine, err error) {
+	stored, err := loadVariant(store, p.Title, p.Lang)
+	if err == errNotFound {
+		err = nil
+		stored = &Page{}
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	n, _ := strconv.Atoi(p.Section)
+	if start, end, ok := sectionBounds(stored.Body, n); ok && sectionHash(stored.Body[start:end]) == p.SectionBase {
+		return spliceSection(stored.Body, start, end, p.Body), nil, nil, nil
+	}
+	for i := range parseHeadings(stored.Body) {
+		if start, end, _ := sectionBounds(stored.Body, i+1); sectionHash(stored.Body[start:end]) == p.SectionBase {
+			return spliceSection(stored.Body, start, end, p.Body), nil, nil, nil
+		}
+	}
+
+	if start, end, ok := sectionBounds(stored.Body, n); ok {
+		theirs := stored.Body[start:end]
+		p.SectionBase, p.Version = sectionHash(theirs), stored.Version
+		v = &Validation{Message: "Someone else changed this section while you were editing it. Below is how your text differs from theirs; saving again replaces their version of the section with yours, so merge their changes in first."}
+		return nil, v, compactDiff(diffLines(string(theirs), string(p.Body)), diffContext), nil
+	}
+	// the section is gone: carry on as an edit of the whole page
+	yours := p.Body
+	p.Body = append([]byte(nil), stored.Body...)
+	if len(p.Body) > 0 {
+		p.Body = append(bytes.TrimRight(p.Body, "\n"), "\n\n"...)
+	}
+	p.Body = append(p.Body, yours...)
+	p.Section, p.SectionBase, p.Version = "", "", stored.Version
+	v = &Validation{Message: "The section you edited was removed from the page meanwhile. Your text has been added at the end of the page below; move it where it belongs and save again."}
+	return nil, v, compactDiff(diffLines(string(stored.Body), string(p.Body)), diffContext), nil
+}
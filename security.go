@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// name of the cookie holding the secret the CSRF tokens of a browser are
+// made from, and of the form field carrying a token
+const (
+	csrfCookie = "csrf"
+	csrfField  = "csrf"
+)
+
+const csrfSecretSize = 32
+
+// Templates write these markers where the CSRF token and the script nonce
+// go, and tokenWriter fills them in for the request at hand. Page bodies
+// can't hold NUL bytes and the templates escape the ones anywhere else, so
+// only the markers come out as is.
+const (
+	csrfMarker  = "\x00csrf\x00"
+	nonceMarker = "\x00nonce\x00"
+)
+
+// csrfInput is the hidden field every form posted to the wiki starts with.
+func csrfInput() template.HTML {
+	return template.HTML(`<input type="hidden" name="` + csrfField + `" value="` + csrfMarker + `">`)
+}
+
+// nonceAttr is the attribute of the inline scripts of templates.
+func nonceAttr() template.HTMLAttr {
+	return template.HTMLAttr(`nonce="` + nonceMarker + `"`)
+}
+
+// csrfSecret returns the CSRF secret of the browser, giving it one if it
+// has none yet. The cookie lasts as long as the browser session.
+func csrfSecret(w http.ResponseWriter, r *http.Request) []byte {
+	if value, err := readSignedCookie(r, csrfCookie); err == nil {
+		if secret, err := base64.RawURLEncoding.DecodeString(value); err == nil && len(secret) == csrfSecretSize {
+			return secret
+		}
+	}
+	secret := make([]byte, csrfSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	setSignedCookie(w, r, csrfCookie, base64.RawURLEncoding.EncodeToString(secret), 0)
+	return secret
+}
+
+// maskToken makes a token of secret that differs on every page, so neither
+// styles picking at form fields nor compression can find it out across
+// requests: a random pad followed by the secret xored with it.
+func maskToken(secret []byte) string {
+	token := make([]byte, 2*len(secret))
+	if _, err := rand.Read(token[:len(secret)]); err != nil {
+		panic(err)
+	}
+	for i, b := range secret {
+		token[len(secret)+i] = b ^ token[i]
+	}
+	return base64.RawURLEncoding.EncodeToString(token)
+}
+
+// validToken tells whether token was made by maskToken of secret.
+func validToken(secret []byte, token string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(b) != 2*csrfSecretSize {
+		return false
+	}
+	pad, masked := b[:csrfSecretSize], b[csrfSecretSize:]
+	for i := range masked {
+		masked[i] ^= pad[i]
+	}
+	return subtle.ConstantTimeCompare(masked, secret) == 1
+}
+
+// crossSiteCapable tells whether r was sent by a browser, which would send
+// the cookies and credentials of the wiki along with a form posted from
+// another site. Browsers mark their requests with Sec-Fetch-Site or, for
+// a POST, Origin; scripts calling the wiki send neither and can't be
+// tricked into such a request.
+func crossSiteCapable(r *http.Request) bool {
+	return r.Header.Get("Sec-Fetch-Site") != "" || r.Header.Get("Origin") != ""
+}
+
+// requireCSRFToken refuses the forms posted by browsers without the token
+// of the page they came from, in the csrf field or an X-CSRF-Token header.
+// Browsers can only send other methods across sites after asking the wiki,
+// which never agrees.
+func requireCSRFToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !crossSiteCapable(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token := r.Header.Get("X-CSRF-Token")
+		if token == "" {
+			var err error
+			if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "multipart/form-data" {
+				// the same limit as uploadHandler, which finds the form
+				// parsed
+				r.Body = http.MaxBytesReader(w, r.Body, config.MaxUploadSize+1<<20)
+				err = r.ParseMultipartForm(32 << 20)
+			} else {
+				err = r.ParseForm()
+			}
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			token = r.PostForm.Get(csrfField)
+		}
+		if !validToken(csrfSecret(w, r), token) {
+			http.Error(w, "The form has expired or was sent from another site. Go back, reload the page and try again.", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type nonceKey struct{}
+
+// scriptNonce is the nonce the Content-Security-Policy of the response lets
+// inline scripts run with.
+func scriptNonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(nonceKey{}).(string)
+	return nonce
+}
+
+// contentSecurityPolicy only runs the wiki's own scripts, those of its
+// templates carrying nonce, and only frames the -iframe-hosts. Page bodies
+// may link images from anywhere and their highlighted code is styled
+// inline. The -captcha widget may load what it needs from its origins.
+func contentSecurityPolicy(nonce string) string {
+	var frames []string
+	for _, host := range config.IframeHosts {
+		frames = append(frames, "https://"+host)
+	}
+	captcha := ""
+	if config.Captcha != "" {
+		captcha = " " + captchaProviders[config.Captcha].origins
+		frames = append(frames, captchaProviders[config.Captcha].origins)
+	}
+	if len(frames) == 0 {
+		frames = []string{"'none'"}
+	}
+	return "default-src 'self'" + captcha + "; script-src 'self' 'nonce-" + nonce + "'" + captcha + "; style-src 'self' 'unsafe-inline'" + captcha + "; img-src * data:; " +
+		"frame-src " + strings.Join(frames, " ") + "; object-src 'none'; base-uri 'self'; form-action 'self'; frame-ancestors 'none'"
+}
+
+// securityHeaders keeps pages of the wiki from being framed by other sites,
+// responses from being sniffed as another type, and scripts other than the
+// wiki's own from running. Handlers may set a stricter policy of their own.
+func securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+		nonce := base64.StdEncoding.EncodeToString(b)
+		h := w.Header()
+		h.Set("Content-Security-Policy", contentSecurityPolicy(nonce))
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("X-Content-Type-Options", "nosniff")
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), nonceKey{}, nonce)))
+	})
+}
+
+// tokenWriter fills in the markers as a template writes them. The output of
+// each template action comes in a single Write, so no marker is split. The
+// CSRF secret is read, or made, on the first form; for a response whose
+// headers are sent before the template runs, call secret first.
+type tokenWriter struct {
+	io.Writer
+	w    http.ResponseWriter
+	r    *http.Request
+	seed []byte
+}
+
+func (tw *tokenWriter) secret() []byte {
+	if tw.seed == nil {
+		tw.seed = csrfSecret(tw.w, tw.r)
+	}
+	return tw.seed
+}
+
+func (tw *tokenWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if bytes.IndexByte(p, 0) >= 0 {
+		p = bytes.ReplaceAll(p, []byte(nonceMarker), []byte(scriptNonce(tw.r)))
+		for bytes.Contains(p, []byte(csrfMarker)) {
+			p = bytes.Replace(p, []byte(csrfMarker), []byte(maskToken(tw.secret())), 1)
+		}
+	}
+	if _, err := tw.Writer.Write(p); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// most URLs one sitemap may hold; larger wikis get a sitemap index
+const sitemapSize = 50000
+
+const sitemapNS = "http://www.sitemaps.org/schemas/sitemap/0.9"
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type urlSet struct {
+	XMLName xml.Name      `xml:"urlset"`
+	NS      string        `xml:"xmlns,attr"`
+	URLs    []*sitemapURL `xml:"url"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name      `xml:"sitemapindex"`
+	NS       string        `xml:"xmlns,attr"`
+	Sitemaps []*sitemapURL `xml:"sitemap"`
+}
+
+// countPages counts the pages of the wiki.
+func countPages(ctx context.Context, conn db) (int, error) {
+	defer timeQuery("countPages", time.Now())
+	var n int
+	err := conn.QueryRow(ctx, "SELECT count(*) FROM "+table("pages")).Scan(&n)
+	return n, err
+}
+
+// sitemapHandler lists every page with when it last changed for search
+// engines, at /sitemap.xml. Past sitemapSize pages it lists the sitemaps
+// of sitemapSize pages each instead, at /sitemap.xml?page=N. A -noindex
+// wiki has none.
+func sitemapHandler(w http.ResponseWriter, r *http.Request, store PageStore) {
+	if config.NoIndex {
+		http.NotFound(w, r)
+		return
+	}
+	if !r.URL.Query().Has("page") {
+		n, err := store.Count()
+		if err != nil {
+			renderFailed(w, err)
+			return
+		}
+		if n > sitemapSize {
+			idx := &sitemapIndex{NS: sitemapNS}
+			for i := 1; (i-1)*sitemapSize < n; i++ {
+				idx.Sitemaps = append(idx.Sitemaps, &sitemapURL{Loc: baseURL(r) + "/sitemap.xml?page=" + strconv.Itoa(i)})
+			}
+			writeXML(w, r, "application/xml; charset=utf-8", idx)
+			return
+		}
+	}
+	number := pageNumber(r)
+	pages, err := store.List(orderTitle, "", (number-1)*sitemapSize, sitemapSize)
+	if err != nil {
+		renderFailed(w, err)
+		return
+	}
+	if len(pages) == 0 && number > 1 {
+		http.NotFound(w, r)
+		return
+	}
+	set := &urlSet{NS: sitemapNS}
+	for _, p := range pages {
+		set.URLs = append(set.URLs, &sitemapURL{
+			Loc:     baseURL(r) + pagePath("view", p.Title),
+			LastMod: p.UpdatedAt.UTC().Format(time.RFC3339),
+		})
+	}
+	writeXML(w, r, "application/xml; charset=utf-8", set)
+}
+
+// writeXML sends doc as an XML document of contentType.
+func writeXML(w http.ResponseWriter, r *http.Request, contentType string, doc interface{}) {
+	body, err := xml.Marshal(doc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeBody(w, r, http.StatusOK, contentType, append([]byte(xml.Header), body...))
+}
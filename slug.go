@@ -0,0 +1,89 @@
+package main
+
+import (
+	"golang.org/x/text/unicode/norm"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Titles may hold spaces, which page URLs write as underscores, so
+// "Meeting Notes 2024" is at /view/Meeting_Notes_2024. Titles can't hold
+// underscores of their own, and compileTitlePattern refuses patterns that
+// would allow them.
+
+// canonicalTitle is the title meant by a title as typed or as found in a
+// URL: underscores stand for spaces, runs of spaces count as one and
+// letters are composed, so "Café" and "Café" are the same page.
+func canonicalTitle(s string) string {
+	s = strings.ReplaceAll(s, "_", " ")
+	return norm.NFC.String(strings.Join(strings.Fields(s), " "))
+}
+
+// titleSlug is how title appears in page URLs, before escaping.
+func titleSlug(title string) string {
+	return strings.ReplaceAll(title, " ", "_")
+}
+
+// pagePath is the path of the action page of title, like
+// /view/Meeting_Notes_2024, escaped for a URL. The slashes of pages under
+// others stay as they are, /view/Projects/GoWiki.
+func pagePath(action, title string) string {
+	parts := strings.Split(titleSlug(title), "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return "/" + action + "/" + strings.Join(parts, "/")
+}
+
+// titleSegment is title escaped as one segment of a path, slashes and all,
+// for URLs like /files/<title>/<name> that go on after the title.
+func titleSegment(title string) string {
+	return url.PathEscape(titleSlug(title))
+}
+
+// pathTitle cuts the escaped path of r after prefix into the title of
+// titleSegment and the rest, both unescaped.
+func pathTitle(r *http.Request, prefix string) (title, rest string) {
+	segment, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.EscapedPath(), prefix), "/")
+	if s, err := url.PathUnescape(segment); err == nil {
+		segment = s
+	}
+	if s, err := url.PathUnescape(rest); err == nil {
+		rest = s
+	}
+	return canonicalTitle(segment), rest
+}
+
+// pageURLTitle is the title a page URL of action names, with ok unset when
+// the path is no such URL or the title isn't valid.
+func pageURLTitle(path string) (action, title string, ok bool) {
+	rest, found := strings.CutPrefix(path, "/")
+	if !found {
+		return "", "", false
+	}
+	action, segment, found := strings.Cut(rest, "/")
+	if !found {
+		return "", "", false
+	}
+	for _, a := range strings.Split(pageActions, "|") {
+		if a == action {
+			title = canonicalTitle(segment)
+			return action, title, validTitle.MatchString(title)
+		}
+	}
+	return "", "", false
+}
+
+// canonicalRedirect sends a client to path, unescaped, the canonical form
+// of the page URL it asked for. Form posts keep their method and body.
+func canonicalRedirect(w http.ResponseWriter, r *http.Request, path string) {
+	u := *r.URL
+	u.Path = path
+	u.RawPath = ""
+	status := http.StatusMovedPermanently
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		status = http.StatusPermanentRedirect
+	}
+	redirect(w, r, u.String(), status)
+}
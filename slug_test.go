@@ -0,0 +1,49 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestCanonicalTitle(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"Meeting_Notes_2024", "Meeting Notes 2024"},
+		{"  Meeting   Notes ", "Meeting Notes"},
+		{"Meeting__Notes", "Meeting Notes"},
+		{"Café", "Café"},
+		{"Projects/Go_Wiki", "Projects/Go Wiki"},
+	}
+	for _, tt := range tests {
+		if got := canonicalTitle(tt.in); got != tt.want {
+			t.Errorf("canonicalTitle(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+	if got := pagePath("view", "Projects/Meeting Notes?"); got != "/view/Projects/Meeting_Notes%3F" {
+		t.Errorf("the path of the page is %q", got)
+	}
+}
+
+// TestTitlePatternRefusesUnderscores checks a -title-pattern letting titles
+// hold an underscore, which no page URL could reach, is refused.
+func TestTitlePatternRefusesUnderscores(t *testing.T) {
+	defer func(re *regexp.Regexp) { validTitle = re }(validTitle)
+	tests := []struct {
+		pattern string
+		ok      bool
+	}{
+		{defaultTitlePattern, true},
+		{`[A-Za-z0-9 ]+`, true},
+		{`[\p{L} ]+`, true},
+		{`[A-Za-z_]+`, false},
+		{`\w+`, false},
+		{`[^/]+`, false},
+		{`.+`, false},
+		{`(?:Draft_)?[A-Z][a-z]+`, false},
+		{`[[:word:]]+`, false},
+	}
+	for _, tt := range tests {
+		if err := compileTitlePattern(tt.pattern); (err == nil) != tt.ok {
+			t.Errorf("compileTitlePattern(%q) = %v, want ok %v", tt.pattern, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// number of rejected edits kept for the dashboard
+const maxRejectedEdits = 50
+
+// spamBlocklist holds the patterns of -spam-blocklist, none when it is empty.
+var spamBlocklist []*regexp.Regexp
+
+// externalLink matches the addresses of other sites in a body, written as
+// a Markdown link or bare.
+var externalLink = regexp.MustCompile(`(?i)\bhttps?://[^\s<>"'()\[\]]+`)
+
+var spamClient = &http.Client{}
+
+// loadBlocklist reads the regular expressions of the file at path, one a
+// line. Blank lines and lines starting with # are skipped; a plain address
+// like example.com is a regular expression matching itself closely enough.
+func loadBlocklist(path string) ([]*regexp.Regexp, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []*regexp.Regexp
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		re, err := regexp.Compile("(?i)" + line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, scanner.Err()
+}
+
+// RejectedEdit is a save the spam filters turned down, for admins to review.
+type RejectedEdit struct {
+	Time   time.Time
+	Title  string
+	Editor string
+	Reason string
+}
+
+// rejectedLog is a fixed-size ring buffer of the most recent rejected edits.
+type rejectedLog struct {
+	mu      sync.Mutex
+	entries []*RejectedEdit
+	next    int
+}
+
+var rejectedEdits = &rejectedLog{entries: make([]*RejectedEdit, 0, maxRejectedEdits)}
+
+func (l *rejectedLog) add(e *RejectedEdit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.entries) < cap(l.entries) {
+		l.entries = append(l.entries, e)
+		return
+	}
+	l.entries[l.next] = e
+	l.next = (l.next + 1) % len(l.entries)
+}
+
+// recent returns the rejected edits, newest first.
+func (l *rejectedLog) recent() []*RejectedEdit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]*RejectedEdit, 0, len(l.entries))
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		out = append(out, l.entries[(l.next+i)%len(l.entries)])
+	}
+	return out
+}
+
+// added returns what re matches in body that it doesn't in old, each once,
+// so pages already holding a match can still be edited.
+func added(re *regexp.Regexp, body, old []byte) []string {
+	before := map[string]bool{}
+	for _, m := range re.FindAll(old, -1) {
+		before[strings.ToLower(string(m))] = true
+	}
+	var found []string
+	for _, m := range re.FindAll(body, -1) {
+		s := strings.ToLower(string(m))
+		if !before[s] {
+			before[s] = true
+			found = append(found, string(m))
+		}
+	}
+	return found
+}
+
+// spamVerdict is what the classifier of -spam-classifier answers.
+type spamVerdict struct {
+	Spam   bool   `json:"spam"`
+	Reason string `json:"reason"`
+}
+
+// classifySpam posts the edit to the classifier, which answers with a
+// spamVerdict, giving up after -spam-classifier-timeout.
+func classifySpam(r *http.Request, p *Page) (*spamVerdict, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), config.SpamClassifierTimeout)
+	defer cancel()
+	body, err := json.Marshal(map[string]interface{}{
+		"title":     p.Title,
+		"body":      string(p.Body),
+		"summary":   p.Summary,
+		"editor":    p.UpdatedBy,
+		"ip":        clientIP(r),
+		"anonymous": currentUser(r) == nil,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.SpamClassifier, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := spamClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered %s", req.URL.Host, res.Status)
+	}
+	v := &spamVerdict{}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// spamReason tells why p, submitted by r, looks like spam, for the logs,
+// and what to tell the editor, both "" when it passes every filter. The
+// blocklist and the link limit only look at what the edit adds to the
+// stored page. A classifier that fails is only logged, so its outages
+// don't stop every edit.
+func spamReason(r *http.Request, p *Page, store PageStore) (reason, message string, err error) {
+	if len(spamBlocklist) == 0 && config.MaxAnonymousLinks == 0 && config.SpamClassifier == "" {
+		return "", "", nil
+	}
+	var old []byte
+	stored, err := loadVariant(store, p.Title, p.Lang)
+	if err == nil {
+		old = stored.Body
+	} else if err != errNotFound {
+		return "", "", err
+	}
+	for _, re := range spamBlocklist {
+		if m := added(re, p.Body, old); len(m) > 0 {
+			return "blocklist " + re.String(), fmt.Sprintf("Your changes add %s, which isn't allowed on this wiki, so they were not saved.", m[0]), nil
+		}
+	}
+	if config.MaxAnonymousLinks > 0 && currentUser(r) == nil {
+		if n := len(added(externalLink, p.Body, old)); n > config.MaxAnonymousLinks {
+			msg := fmt.Sprintf("Anonymous edits may add at most %d links to other sites and yours adds %d. Log in to add more, or remove some and save again.", config.MaxAnonymousLinks, n)
+			return fmt.Sprintf("%d links added", n), msg, nil
+		}
+	}
+	if config.SpamClassifier != "" {
+		v, err := classifySpam(r, p)
+		if err != nil {
+			log.Printf("classifying the edit of %s: %v", p.Title, err)
+			return "", "", nil
+		}
+		if v.Spam {
+			reason := "classifier"
+			if v.Reason != "" {
+				reason += ": " + v.Reason
+			}
+			return reason, "Your changes look like spam to the wiki's filter, so they were not saved. If they aren't, ask an administrator for help.", nil
+		}
+	}
+	return "", "", nil
+}
+
+// checkSpam rejects the save of p when a spam filter turns it down.
+func checkSpam(w http.ResponseWriter, r *http.Request, p *Page, store PageStore) bool {
+	reason, msg, err := spamReason(r, p, store)
+	if err != nil {
+		rejectSave(w, r, http.StatusInternalServerError, p, &Validation{Message: "Your changes could not be saved: " + err.Error()})
+		return false
+	}
+	if reason == "" {
+		return true
+	}
+	recordRejected(r, p, reason)
+	rejectSave(w, r, http.StatusForbidden, p, &Validation{Message: msg})
+	return false
+}
+
+// recordRejected records a save of p the spam filters turned down for
+// reason, for the dashboard, the submission log and the server log.
+func recordRejected(r *http.Request, p *Page, reason string) {
+	log.Printf("rejected an edit of %s by %s: %s", p.Title, p.UpdatedBy, reason)
+	rejectedEdits.add(&RejectedEdit{Time: time.Now(), Title: p.Title, Editor: p.UpdatedBy, Reason: reason})
+	if submissionLog != nil {
+		submissionLog.Warn("save rejected", "title", p.Title, "ip", clientIP(r), "editor", p.UpdatedBy, "reason", reason)
+	}
+}
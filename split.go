@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+type Split struct {
+	Page     *Page
+	Headings []*Heading
+	Heading  int
+	NewTitle string
+	Error    string
+}
+
+var errPageExists = errors.New("page already exists")
+
+// splitSection moves the content under heading h of p into a new page and
+// leaves a link to it under the heading.
+func splitSection(p *Page, h *Heading, newTitle, editor string, store PageStore) error {
+	if _, err := store.Stat(newTitle); err == nil {
+		return fmt.Errorf("%s: %w", newTitle, errPageExists)
+	} else if err != errNotFound {
+		return err
+	}
+
+	// keep the heading line itself in the original page
+	contentStart := h.End
+	if i := bytes.IndexByte(p.Body[h.Start:h.End], '\n'); i >= 0 {
+		contentStart = h.Start + i + 1
+	}
+	section := bytes.TrimSpace(p.Body[contentStart:h.End])
+
+	sub := &Page{Title: newTitle, Body: section, UpdatedBy: editor}
+
+	var body []byte
+	body = append(body, p.Body[:contentStart]...)
+	body = append(body, fmt.Sprintf("\nSee [[%s]].\n\n", newTitle)...)
+	body = append(body, p.Body[h.End:]...)
+	p.Body = body
+	p.UpdatedBy = editor
+	return store.Apply(saveWrite(sub), saveWrite(p))
+}
+
+func splitHandler(w http.ResponseWriter, r *http.Request, title string, store PageStore) {
+	p, err := store.Load(title)
+	if err == errNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !checkEdit(w, r, p.Protection) {
+		return
+	}
+
+	s := &Split{Page: p, Headings: parseHeadings(p.Body), Heading: -1, NewTitle: canonicalTitle(r.FormValue("title"))}
+	if r.Method != http.MethodPost {
+		renderTemplate(w, r, "split", s)
+		return
+	}
+
+	if i, err := strconv.Atoi(r.FormValue("heading")); err == nil && i >= 0 && i < len(s.Headings) {
+		s.Heading = i
+	}
+	switch err := checkTitle(s.NewTitle); {
+	case s.Heading < 0:
+		s.Error = "Pick the heading to split at."
+	case err != nil:
+		s.Error = "The new page needs a valid title: " + err.Error() + "."
+	}
+	if s.Error != "" {
+		renderTemplateStatus(w, r, http.StatusBadRequest, "split", s)
+		return
+	}
+
+	err = splitSection(p, s.Headings[s.Heading], s.NewTitle, editorName(r), store)
+	if errors.Is(err, errPageExists) {
+		s.Error = err.Error()
+		renderTemplateStatus(w, r, http.StatusConflict, "split", s)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	redirect(w, r, pagePath("view", title), http.StatusSeeOther)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultLargestPages = 20
+	maxLargestPages     = 100
+)
+
+// PageSize is the size of a page body, and what it takes to store once
+// Postgres has compressed it.
+type PageSize struct {
+	Title  string
+	Size   int64
+	Stored int64
+}
+
+type LargestPages struct {
+	Pages []*PageSize
+	Limit int
+	// every page
+	Total *PageSize
+}
+
+// humanSize formats a byte count like 1.5 KiB.
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+const (
+	// size of a body, gzipped or not, and what it takes to store
+	bodySizeSQL   = "COALESCE(body_size, octet_length(body))"
+	storedSizeSQL = "pg_column_size(body) + COALESCE(pg_column_size(body_gz), 0)"
+)
+
+func loadLargestPages(ctx context.Context, conn db, limit int) ([]*PageSize, error) {
+	// octet_length counts bytes rather than characters
+	query := "SELECT title, " + bodySizeSQL + ", " + storedSizeSQL + " FROM " + table("pages") + " ORDER BY " + bodySizeSQL + " DESC, title LIMIT $1"
+	rows, err := conn.Query(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pages []*PageSize
+	for rows.Next() {
+		p := &PageSize{}
+		if err := rows.Scan(&p.Title, &p.Size, &p.Stored); err != nil {
+			return nil, err
+		}
+		pages = append(pages, p)
+	}
+	return pages, rows.Err()
+}
+
+func loadTotalSize(ctx context.Context, conn db) (*PageSize, error) {
+	total := &PageSize{}
+	query := "SELECT COALESCE(sum(" + bodySizeSQL + "), 0), COALESCE(sum(" + storedSizeSQL + "), 0) FROM " + table("pages")
+	err := conn.QueryRow(ctx, query).Scan(&total.Size, &total.Stored)
+	return total, err
+}
+
+func largestPagesHandler(w http.ResponseWriter, r *http.Request, conn db) {
+	limit := defaultLargestPages
+	if n, err := strconv.Atoi(r.FormValue("n")); err == nil && n > 0 {
+		limit = n
+	}
+	if limit > maxLargestPages {
+		limit = maxLargestPages
+	}
+
+	pages, err := loadLargestPages(r.Context(), conn, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	total, err := loadTotalSize(r.Context(), conn)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, r, "largest", &LargestPages{Pages: pages, Limit: limit, Total: total})
+}
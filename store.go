@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+// errNotFound is what a PageStore returns for a page that does not exist.
+var errNotFound = errors.New("page not found")
+
+// listOrder is an order PageStore.List can return pages in.
+type listOrder string
+
+const (
+	orderRecent  listOrder = "updated_at DESC, title"
+	orderPopular listOrder = "views DESC, title"
+	orderTitle   listOrder = "title"
+	orderCreated listOrder = "created_at DESC, title"
+)
+
+// PageStore is the storage behind the page handlers. pgStore keeps pages
+// in Postgres; memStore keeps them in memory so handlers can run without a
+// database.
+type PageStore interface {
+	// WithContext returns the store with its queries tied to ctx, so they
+	// are cancelled along with the request.
+	WithContext(ctx context.Context) PageStore
+	Load(title string) (*Page, error)
+	// Stat is Load without the body, for when only the existence or the
+	// metadata of a page matter.
+	Stat(title string) (*Page, error)
+	Save(p *Page) error
+	// Apply makes every write in one transaction, or none of them and
+	// returns a *BatchError.
+	Apply(writes ...PageWrite) error
+	// List returns up to n pages of namespace ns in order, after skipping
+	// offset, without their bodies. An empty ns lists every namespace.
+	List(order listOrder, ns string, offset, n int) ([]*Page, error)
+	// Count returns the number of pages.
+	Count() (int, error)
+	// Delete archives a page.
+	Delete(title string) error
+	// Deleted returns when a page titled title was last archived.
+	Deleted(title string) (time.Time, error)
+	// Restore brings back the last archived version of title, failing with
+	// errPageExists if the title has been taken since.
+	Restore(title string) error
+	// Rename gives p a new title, keeping the old one as an alias, and
+	// points the links to it at the new title as an edit by editor. It
+	// returns how many pages had their links changed, and fails with
+	// errPageExists when the new title is taken.
+	Rename(p *Page, newTitle, editor string) (int64, error)
+	// Resolve returns the current title of a page that was renamed from
+	// title.
+	Resolve(title string) (string, error)
+	SetProtection(title, level string) error
+	// Similar returns up to n existing titles resembling title, best first.
+	Similar(title string, n int) ([]string, error)
+	// TitlesWithPrefix returns up to n titles starting with prefix, in any
+	// letter case, alphabetically.
+	TitlesWithPrefix(prefix string, n int) ([]string, error)
+	// Backlinks returns the titles of up to n other pages linking to title,
+	// or to a title it was renamed from, alphabetically.
+	Backlinks(title string, n int) ([]string, error)
+	// TagNeighbours returns the titles right before and after title,
+	// alphabetically, among the pages tagged with tag, "" at either end.
+	TagNeighbours(tag, title string) (prev, next string, err error)
+	// SaveDraft keeps d as its author's draft of its page, replacing any
+	// draft they kept before.
+	SaveDraft(d *Draft) error
+	// Draft returns the draft of title by author with its body.
+	Draft(title, author string) (*Draft, error)
+	// Drafts returns every draft of title without their bodies, newest
+	// first.
+	Drafts(title string) ([]*Draft, error)
+	DeleteDraft(title, author string) error
+	// Comments returns the comments on the page pageID, oldest first.
+	Comments(pageID int64) ([]*Comment, error)
+	// AddComment posts c, filling in its ID and time, and fails with
+	// errNotFound when it replies to a comment not on its page.
+	AddComment(c *Comment) error
+	SetCommentHidden(pageID, id int64, hidden bool) error
+	// DeleteComment deletes a comment of the page pageID and the replies
+	// to it.
+	DeleteComment(pageID, id int64) error
+	// RecentComments returns up to limit comments on every page, newest
+	// first, after skipping offset, leaving out hidden ones and those of
+	// archived pages.
+	RecentComments(limit, offset int) ([]*Comment, error)
+	// PageTemplates returns the templates for new pages kept in the
+	// database, by name.
+	PageTemplates() ([]*PageTemplate, error)
+	// SavePageTemplate stores t, replacing the template of the same name.
+	SavePageTemplate(t *PageTemplate) error
+	DeletePageTemplate(name string) error
+	// SetWatch makes account watch title, or stop with watch unset.
+	SetWatch(title, account string, watch bool) error
+	// Watchers returns who watches title, by name, with their emails.
+	Watchers(title string) ([]*Watcher, error)
+	// Watchlist returns the titles account watches, alphabetically.
+	Watchlist(account string) ([]string, error)
+	// Email returns where changes are emailed to account, and SetEmail
+	// changes it; both fail with errNotFound for names without an account.
+	Email(account string) (string, error)
+	SetEmail(account, email string) error
+	// Translation returns the translation of title into lang, with only
+	// its body and who saved it when; see withTranslation.
+	Translation(title, lang string) (*Page, error)
+	// Translations returns the languages title is translated into, in
+	// order of their codes.
+	Translations(title string) ([]string, error)
+	// SaveTranslation saves p as the translation of its page into p.Lang,
+	// checking p.New and p.BaseVersion as Save does.
+	SaveTranslation(p *Page) error
+	CountView(p *Page) error
+	// Revisions returns up to limit revisions of p, newest first, after
+	// skipping offset, and the total number of revisions. Bodies are only
+	// included with pageFull.
+	Revisions(p *Page, limit, offset int, fields pageFields) ([]*Revision, int, error)
+	// Revision returns a revision of p with its body.
+	Revision(p *Page, id int64) (*Revision, error)
+	// RecentChanges returns up to limit revisions of every page, newest
+	// first, after skipping offset. Revisions of archived pages are left
+	// out.
+	RecentChanges(limit, offset int) ([]*Change, error)
+	// Search returns up to n pages of namespace ns matching q with backend,
+	// best first, without their bodies. An empty ns searches every
+	// namespace.
+	Search(q, ns string, backend searchBackend, n int) ([]*Page, error)
+	// ViewStats counts the views of p on each of the last days days.
+	ViewStats(p *Page, days int) (*ViewStats, error)
+}
+
+// pgStore is the PageStore of a Postgres database.
+type pgStore struct {
+	conn db
+	// replica, if set, answers page loads, listings and searches, but for
+	// the pages in written
+	replica db
+	written *recentWrites
+	// set by WithContext, background otherwise
+	ctx context.Context
+}
+
+func notFound(err error) error {
+	if err == pgx.ErrNoRows {
+		return errNotFound
+	}
+	return err
+}
+
+func (s *pgStore) WithContext(ctx context.Context) PageStore {
+	c := *s
+	c.ctx = ctx
+	return &c
+}
+
+func (s *pgStore) context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+func (s *pgStore) Load(title string) (*Page, error) {
+	p, err := loadPage(s.context(), title, s.reader(title))
+	return p, notFound(err)
+}
+
+func (s *pgStore) Stat(title string) (*Page, error) {
+	p, err := loadPageFields(s.context(), title, pageMeta, s.reader(title))
+	return p, notFound(err)
+}
+
+func (s *pgStore) Save(p *Page) error {
+	if saveQueue != nil {
+		if err := queueSave(s.context(), p, s.conn); err != nil {
+			return err
+		}
+	} else if err := p.save(s.context(), s.conn); err != nil {
+		return err
+	}
+	s.wrote(p.Title)
+	renders.invalidate(p.Title)
+	pageEvents.publish(pageEvent{Type: "saved", Title: p.Title, Version: p.Version, By: p.UpdatedBy})
+	if saveQueue == nil {
+		// queued saves are passed on once their revision is written
+		queueChange(p)
+	}
+	return nil
+}
+
+func (s *pgStore) List(order listOrder, ns string, offset, n int) ([]*Page, error) {
+	return listPagesBy(s.context(), string(order), ns, offset, n, s.reader(""))
+}
+
+func (s *pgStore) Count() (int, error) {
+	return countPages(s.context(), s.reader(""))
+}
+
+func (s *pgStore) Delete(title string) error {
+	awaitSaves(title)
+	if err := archivePage(s.context(), title, s.conn); err != nil {
+		return notFound(err)
+	}
+	s.wrote(title)
+	renders.invalidate(title)
+	pageEvents.publish(pageEvent{Type: "deleted", Title: title})
+	return nil
+}
+
+func (s *pgStore) Deleted(title string) (time.Time, error) {
+	at, err := lastArchived(s.context(), title, s.reader(title))
+	return at, notFound(err)
+}
+
+func (s *pgStore) Restore(title string) error {
+	awaitSaves(title)
+	if err := restorePage(s.context(), title, s.conn); err != nil {
+		return notFound(err)
+	}
+	s.wrote(title)
+	renders.invalidate(title)
+	pageEvents.publish(pageEvent{Type: "restored", Title: title})
+	return nil
+}
+
+func (s *pgStore) Rename(p *Page, newTitle, editor string) (int64, error) {
+	oldTitle := p.Title
+	// the pages linking to the old title are relinked as well
+	awaitSaves()
+	n, err := renamePage(s.context(), p, newTitle, editor, s.conn)
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		s.wrote()
+	} else {
+		s.wrote(oldTitle, newTitle)
+	}
+	renders.invalidate(oldTitle, newTitle)
+	if n > 0 {
+		// the relinked pages may be included anywhere
+		renders.invalidateIncludes()
+	}
+	pageEvents.publish(pageEvent{Type: "renamed", Title: oldTitle, To: newTitle})
+	return n, nil
+}
+
+func (s *pgStore) Resolve(title string) (string, error) {
+	current, err := resolveAlias(s.context(), title, s.conn)
+	return current, notFound(err)
+}
+
+func (s *pgStore) SetProtection(title, level string) error {
+	if err := setProtection(s.context(), title, level, s.conn); err != nil {
+		return notFound(err)
+	}
+	s.wrote(title)
+	return nil
+}
+
+func (s *pgStore) Similar(title string, n int) ([]string, error) {
+	return similarTitles(s.context(), title, s.conn, n)
+}
+
+func (s *pgStore) TitlesWithPrefix(prefix string, n int) ([]string, error) {
+	return titlesWithPrefix(s.context(), prefix, n, s.conn)
+}
+
+func (s *pgStore) Backlinks(title string, n int) ([]string, error) {
+	return loadBacklinks(s.context(), title, n, s.reader(""))
+}
+
+func (s *pgStore) TagNeighbours(tag, title string) (string, string, error) {
+	return tagNeighbours(s.context(), tag, title, s.reader(""))
+}
+
+func (s *pgStore) SaveDraft(d *Draft) error {
+	return saveDraft(s.context(), d, s.conn)
+}
+
+// Draft reads from the primary, as its author comes to it right after
+// saving it.
+func (s *pgStore) Draft(title, author string) (*Draft, error) {
+	d, err := loadDraft(s.context(), title, author, s.conn)
+	return d, notFound(err)
+}
+
+func (s *pgStore) Drafts(title string) ([]*Draft, error) {
+	return loadDrafts(s.context(), title, s.conn)
+}
+
+func (s *pgStore) DeleteDraft(title, author string) error {
+	return deleteDraft(s.context(), title, author, s.conn)
+}
+
+func (s *pgStore) Comments(pageID int64) ([]*Comment, error) {
+	return loadComments(s.context(), pageID, s.conn)
+}
+
+func (s *pgStore) AddComment(c *Comment) error {
+	return notFound(addComment(s.context(), c, s.conn))
+}
+
+func (s *pgStore) SetCommentHidden(pageID, id int64, hidden bool) error {
+	return notFound(hideComment(s.context(), pageID, id, hidden, s.conn))
+}
+
+func (s *pgStore) DeleteComment(pageID, id int64) error {
+	return notFound(deleteComment(s.context(), pageID, id, s.conn))
+}
+
+func (s *pgStore) RecentComments(limit, offset int) ([]*Comment, error) {
+	return loadRecentComments(s.context(), limit, offset, s.reader(""))
+}
+
+// PageTemplates reads from the primary, so the templates page shows a
+// change right after it is saved.
+func (s *pgStore) PageTemplates() ([]*PageTemplate, error) {
+	return queryPageTemplates(s.context(), s.conn)
+}
+
+func (s *pgStore) SavePageTemplate(t *PageTemplate) error {
+	return savePageTemplate(s.context(), t, s.conn)
+}
+
+func (s *pgStore) DeletePageTemplate(name string) error {
+	return deletePageTemplate(s.context(), name, s.conn)
+}
+
+func (s *pgStore) SetWatch(title, account string, watch bool) error {
+	return setWatch(s.context(), title, account, watch, s.conn)
+}
+
+func (s *pgStore) Watchers(title string) ([]*Watcher, error) {
+	return loadWatchers(s.context(), title, s.conn)
+}
+
+func (s *pgStore) Watchlist(account string) ([]string, error) {
+	return loadWatchlist(s.context(), account, s.conn)
+}
+
+func (s *pgStore) Email(account string) (string, error) {
+	email, err := loadEmail(s.context(), account, s.conn)
+	return email, notFound(err)
+}
+
+func (s *pgStore) SetEmail(account, email string) error {
+	return notFound(setEmail(s.context(), account, email, s.conn))
+}
+
+func (s *pgStore) Translation(title, lang string) (*Page, error) {
+	t, err := loadTranslation(s.context(), title, lang, s.conn)
+	return t, notFound(err)
+}
+
+func (s *pgStore) Translations(title string) ([]string, error) {
+	return loadTranslations(s.context(), title, s.conn)
+}
+
+func (s *pgStore) SaveTranslation(p *Page) error {
+	if err := saveTranslation(s.context(), p, s.conn); err != nil {
+		return err
+	}
+	// the pages including this one in its language
+	renders.invalidate(p.Title)
+	return nil
+}
+
+func (s *pgStore) CountView(p *Page) error {
+	query := "UPDATE " + table("pages") + " SET views = views + 1 WHERE id=$1"
+	_, err := s.conn.Exec(s.context(), query, p.ID)
+	return err
+}
+
+func (s *pgStore) Revisions(p *Page, limit, offset int, fields pageFields) ([]*Revision, int, error) {
+	return loadRevisions(s.context(), p.ID, limit, offset, fields, s.conn)
+}
+
+func (s *pgStore) RecentChanges(limit, offset int) ([]*Change, error) {
+	return loadRecentChanges(s.context(), limit, offset, s.reader(""))
+}
+
+func (s *pgStore) Revision(p *Page, id int64) (*Revision, error) {
+	rev, err := loadRevision(s.context(), p.ID, id, s.conn)
+	return rev, notFound(err)
+}
+
+func (s *pgStore) ViewStats(p *Page, days int) (*ViewStats, error) {
+	return loadViewStats(s.context(), p.ID, days, s.conn)
+}
+
+func (s *pgStore) Search(q, ns string, backend searchBackend, n int) ([]*Page, error) {
+	return searchPages(s.context(), q, ns, backend, n, s.reader(""))
+}
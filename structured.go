@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/yuin/goldmark/ast"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// longest description and headline put in structured data, as search
+// engines cut them there anyway
+const (
+	maxDescription = 160
+	maxHeadline    = 110
+)
+
+// pageDescription is the text of the first paragraph of body, cut short,
+// to describe the page.
+func pageDescription(body []byte) string {
+	doc, src := parseBody(body)
+	var b strings.Builder
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if b.Len() > 0 {
+			return ast.WalkStop, nil
+		}
+		if para, ok := n.(*ast.Paragraph); ok && entering {
+			ast.Walk(para, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+				if t, ok := n.(*ast.Text); ok && entering {
+					b.Write(t.Segment.Value(src))
+					if t.SoftLineBreak() || t.HardLineBreak() {
+						b.WriteByte(' ')
+					}
+				}
+				return ast.WalkContinue, nil
+			})
+			return ast.WalkStop, nil
+		}
+		return ast.WalkContinue, nil
+	})
+	return truncate(strings.Join(strings.Fields(b.String()), " "), maxDescription)
+}
+
+// truncate cuts s to at most n characters, at a word if it can.
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	cut := string([]rune(s)[:n-1])
+	if i := strings.LastIndexByte(cut, ' '); i > len(cut)/2 {
+		cut = cut[:i]
+	}
+	return cut + "…"
+}
+
+type articleAuthor struct {
+	Type string `json:"@type"`
+	Name string `json:"name"`
+}
+
+// article is a schema.org Article, as JSON-LD.
+type article struct {
+	Context       string         `json:"@context"`
+	Type          string         `json:"@type"`
+	Headline      string         `json:"headline"`
+	Description   string         `json:"description,omitempty"`
+	URL           string         `json:"url"`
+	DatePublished string         `json:"datePublished"`
+	DateModified  string         `json:"dateModified"`
+	Author        *articleAuthor `json:"author,omitempty"`
+}
+
+// structuredData describes p as a schema.org Article for the view page
+// head, empty unless -structured-data is on. Anonymous editors are left out
+// rather than publishing their address.
+func structuredData(r *http.Request, p *Page) template.JS {
+	if !config.StructuredData {
+		return ""
+	}
+	a := article{
+		Context:       "https://schema.org",
+		Type:          "Article",
+		Headline:      truncate(p.Title, maxHeadline),
+		Description:   pageDescription(p.Body),
+		URL:           baseURL(r) + pagePath("view", p.Title),
+		DatePublished: p.CreatedAt.UTC().Format(time.RFC3339),
+		DateModified:  p.UpdatedAt.UTC().Format(time.RFC3339),
+	}
+	if p.UpdatedBy != "" && !isAnonymous(p.UpdatedBy) {
+		a.Author = &articleAuthor{Type: "Person", Name: p.UpdatedBy}
+	}
+	// Marshal escapes <, > and &, so the JSON can't end the script element
+	out, err := json.Marshal(a)
+	if err != nil {
+		return ""
+	}
+	return template.JS(out)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var ldJSON = regexp.MustCompile(`(?s)<script type="application/ld\+json">(.*?)</script>`)
+
+// viewArticle views title and returns the fields of its JSON-LD, or nil if
+// it has none.
+func viewArticle(t *testing.T, h http.Handler, title string) map[string]interface{} {
+	t.Helper()
+	w := request(h, http.MethodGet, "/view/"+title, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("viewing %s got %d", title, w.Code)
+	}
+	blocks := ldJSON.FindAllStringSubmatch(w.Body.String(), -1)
+	if len(blocks) == 0 {
+		return nil
+	}
+	if len(blocks) > 1 {
+		t.Errorf("%s has %d JSON-LD blocks", title, len(blocks))
+	}
+	var a map[string]interface{}
+	if err := json.Unmarshal([]byte(blocks[0][1]), &a); err != nil {
+		t.Fatalf("the JSON-LD of %s doesn't parse: %v\n%s", title, err, blocks[0][1])
+	}
+	return a
+}
+
+func TestStructuredData(t *testing.T) {
+	keepConfig(t)
+	config.StructuredData = true
+	store := seedStore(map[string]string{
+		"Home":   "# Welcome\n\nThe first paragraph,\nover two lines.\n\nThe second.",
+		"Tricky": "Ends here `</script><script>alert(1)</script>` & more.",
+	})
+	anon := &Page{Title: "Anonymous", Body: []byte("Edited by nobody in particular."), UpdatedBy: anonymousEditor + " (192.0.2.1)"}
+	if err := store.Save(anon); err != nil {
+		t.Fatal(err)
+	}
+	h := testServer(store)
+
+	a := viewArticle(t, h, "Home")
+	if a == nil {
+		t.Fatal("the page has no JSON-LD")
+	}
+	p, _ := store.Load("Home")
+	want := map[string]string{
+		"@context":      "https://schema.org",
+		"@type":         "Article",
+		"headline":      "Home",
+		"description":   "The first paragraph, over two lines.",
+		"url":           "http://example.com/view/Home",
+		"datePublished": p.CreatedAt.UTC().Format(time.RFC3339),
+		"dateModified":  p.UpdatedAt.UTC().Format(time.RFC3339),
+	}
+	for field, value := range want {
+		if a[field] != value {
+			t.Errorf("%s is %v, want %q", field, a[field], value)
+		}
+	}
+	for _, field := range []string{"datePublished", "dateModified"} {
+		if _, err := time.Parse(time.RFC3339, a[field].(string)); err != nil {
+			t.Errorf("%s isn't an ISO 8601 date: %v", field, err)
+		}
+	}
+	author, _ := a["author"].(map[string]interface{})
+	if author["@type"] != "Person" || author["name"] != "Alice" {
+		t.Errorf("the author is %v, want the Person Alice", a["author"])
+	}
+
+	if a := viewArticle(t, h, "Anonymous"); a == nil || a["author"] != nil {
+		t.Errorf("the page last edited anonymously has the author %v", a["author"])
+	}
+	// viewArticle parsing it means the script wasn't ended early
+	if a := viewArticle(t, h, "Tricky"); a == nil || !strings.Contains(a["description"].(string), "</script>") {
+		t.Errorf("the description of a page quoting a script tag is %v", a)
+	}
+
+	config.StructuredData = false
+	if a := viewArticle(t, h, "Home"); a != nil {
+		t.Errorf("without -structured-data the page has JSON-LD: %v", a)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"exactly ten", 11, "exactly ten"},
+		{"cut at a word boundary", 12, "cut at a…"},
+		{"unbreakablewordhere", 10, "unbreakab…"},
+		{"éèêëēėęàâä", 5, "éèêë…"},
+	}
+	for _, tt := range tests {
+		if got := truncate(tt.s, tt.n); got != tt.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// submissionLog records every save submission for abuse review, nil unless
+// -submission-log is set.
+var submissionLog *slog.Logger
+
+// openJSONLog logs to the file at path, appending to it, or to stderr for
+// "-". Entries are JSON lines.
+func openJSONLog(path string) (*slog.Logger, error) {
+	out := os.Stderr
+	if path != "-" {
+		// bodies and addresses are personal data, so only the wiki's
+		// user reads them
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		out = f
+	}
+	return slog.New(slog.NewJSONHandler(out, nil)), nil
+}
+
+// logSubmission records a save of p submitted by r, whether or not it goes
+// on to be saved. The body itself is only logged with
+// -submission-log-bodies; its hash and size always are.
+func logSubmission(r *http.Request, p *Page) {
+	if submissionLog == nil {
+		return
+	}
+	sum := sha256.Sum256(p.Body)
+	attrs := []interface{}{
+		"title", p.Title,
+		"ip", clientIP(r),
+		"editor", p.UpdatedBy,
+		"size", len(p.Body),
+		"sha256", hex.EncodeToString(sum[:]),
+	}
+	if config.SubmissionLogBodies {
+		attrs = append(attrs, "body", string(p.Body))
+	}
+	submissionLog.Info("save submitted", attrs...)
+}
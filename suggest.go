@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"time"
+)
+
+// number of "did you mean" suggestions shown for a missing page
+const maxSuggestions = 5
+
+type MissingPage struct {
+	Title       string
+	Suggestions []string
+	// the rendered -not-found-page, shown instead of the built-in message
+	HTML template.HTML
+	// set when the page exists but has expired
+	Expired *time.Time
+	// when the page was last deleted, if it was, so it can be restored
+	Deleted *time.Time
+	// the pages under the title, for a hierarchy without a page at its top
+	Subpages *Subpages
+}
+
+// similarTitles returns existing titles close to title using trigram
+// similarity (pg_trgm), best match first.
+func similarTitles(ctx context.Context, title string, conn db, limit int) ([]string, error) {
+	defer timeQuery("similarTitles", time.Now())
+	query := "SELECT title FROM " + table("pages") + " WHERE title % $1 ORDER BY similarity(title, $1) DESC, title LIMIT $2"
+	rows, err := conn.Query(ctx, query, title, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var titles []string
+	for rows.Next() {
+		var t string
+		if err := rows.Scan(&t); err != nil {
+			return nil, err
+		}
+		titles = append(titles, t)
+	}
+	return titles, rows.Err()
+}
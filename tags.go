@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// normalizeTags lowercases, trims and de-duplicates tag names, keeping their
+// order.
+func normalizeTags(tags []string) []string {
+	var out []string
+	seen := map[string]bool{}
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		out = append(out, t)
+	}
+	return out
+}
+
+// pageTags reads the `tags: a, b` front matter field of a body.
+func pageTags(body []byte) []string {
+	fm, _ := parseFrontMatter(body)
+	v, ok := fm.get("tags")
+	if !ok {
+		return nil
+	}
+	v = strings.TrimSuffix(strings.TrimPrefix(v, "["), "]")
+	return normalizeTags(strings.Split(v, ","))
+}
+
+// TagList is the tags of the page as the editor shows them.
+func (p *Page) TagList() string {
+	return strings.Join(pageTags(p.Body), ", ")
+}
+
+// setPageTags rewrites the tags front matter field of a body.
+func setPageTags(body []byte, tags []string) []byte {
+	fm, rest := parseFrontMatter(body)
+	fm.set("tags", strings.Join(normalizeTags(tags), ", "))
+	return fm.join(rest)
+}
+
+// syncTags rebuilds the page_tags index of one page from its body.
+func syncTags(ctx context.Context, pageID int64, body []byte, conn db) error {
+	tags := pageTags(body)
+	if _, err := conn.Exec(ctx, "DELETE FROM "+table("page_tags")+" WHERE page_id=$1", pageID); err != nil {
+		return err
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	if _, err := conn.Exec(ctx, "INSERT INTO "+table("tags")+" (name) SELECT unnest($1::text[]) ON CONFLICT (name) DO NOTHING", tags); err != nil {
+		return err
+	}
+	query := "INSERT INTO " + table("page_tags") + " (page_id, tag_id) SELECT $1, id FROM " + table("tags") + " WHERE name = ANY($2)"
+	_, err := conn.Exec(ctx, query, pageID, tags)
+	return err
+}
+
+// pruneTags drops tags no page uses anymore.
+func pruneTags(ctx context.Context, conn db) error {
+	query := "DELETE FROM " + table("tags") + " t WHERE NOT EXISTS (SELECT 1 FROM " + table("page_tags") + " pt WHERE pt.tag_id = t.id)"
+	_, err := conn.Exec(ctx, query)
+	return err
+}
+
+func taggedTitles(ctx context.Context, tag string, conn db) ([]string, error) {
+	query := `SELECT p.title FROM ` + table("pages") + ` p
+		JOIN ` + table("page_tags") + ` pt ON pt.page_id = p.id
+		JOIN ` + table("tags") + ` t ON t.id = pt.tag_id
+		WHERE t.name = $1 ORDER BY p.title`
+	rows, err := conn.Query(ctx, query, tag)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var titles []string
+	for rows.Next() {
+		var title string
+		if err := rows.Scan(&title); err != nil {
+			return nil, err
+		}
+		titles = append(titles, title)
+	}
+	return titles, rows.Err()
+}
+
+// retag applies fn to the tags of every page tagged with tag, saving the
+// rewritten bodies in one transaction. It returns the number of pages
+// changed.
+func retag(ctx context.Context, tag, editor string, fn func([]string) []string, conn db) (int, error) {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	titles, err := taggedTitles(ctx, tag, tx)
+	if err != nil {
+		return 0, err
+	}
+	for _, title := range titles {
+		p, err := loadPage(ctx, title, tx)
+		if err != nil {
+			return 0, err
+		}
+		p.Body = setPageTags(p.Body, fn(pageTags(p.Body)))
+		p.UpdatedBy = editor
+		if err := p.save(ctx, tx); err != nil {
+			return 0, err
+		}
+	}
+	if err := pruneTags(ctx, tx); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	renders.invalidate(titles...)
+	return len(titles), nil
+}
+
+func renameTag(ctx context.Context, from, to, editor string, conn db) (int, error) {
+	return retag(ctx, from, editor, func(tags []string) []string {
+		for i, t := range tags {
+			if t == from {
+				tags[i] = to
+			}
+		}
+		return tags
+	}, conn)
+}
+
+func deleteTag(ctx context.Context, name, editor string, conn db) (int, error) {
+	return retag(ctx, name, editor, func(tags []string) []string {
+		var kept []string
+		for _, t := range tags {
+			if t != name {
+				kept = append(kept, t)
+			}
+		}
+		return kept
+	}, conn)
+}
+
+type TagTools struct {
+	Tags    []string
+	From    string
+	To      string
+	Message string
+	Error   string
+}
+
+func allTags(ctx context.Context, conn db) ([]string, error) {
+	rows, err := conn.Query(ctx, "SELECT name FROM "+table("tags")+" ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tags = append(tags, name)
+	}
+	return tags, rows.Err()
+}
+
+func renderTagTools(w http.ResponseWriter, r *http.Request, status int, t *TagTools, conn db) {
+	tags, err := allTags(r.Context(), conn)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	t.Tags = tags
+	renderTemplateStatus(w, r, status, "tagtools", t)
+}
+
+func renameTagHandler(w http.ResponseWriter, r *http.Request, conn db) {
+	t := &TagTools{From: r.FormValue("from"), To: r.FormValue("to")}
+	if r.Method != http.MethodPost {
+		renderTagTools(w, r, http.StatusOK, t, conn)
+		return
+	}
+	from, to := normalizeTags([]string{t.From}), normalizeTags([]string{t.To})
+	if len(from) == 0 || len(to) == 0 || strings.Contains(to[0], ",") {
+		t.Error = "Give both the current and the new tag name."
+		renderTagTools(w, r, http.StatusBadRequest, t, conn)
+		return
+	}
+	n, err := renameTag(r.Context(), from[0], to[0], editorName(r), conn)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	t.Message = fmt.Sprintf("Renamed %q to %q on %d pages.", from[0], to[0], n)
+	renderTagTools(w, r, http.StatusOK, t, conn)
+}
+
+func deleteTagHandler(w http.ResponseWriter, r *http.Request, conn db) {
+	t := &TagTools{From: r.FormValue("name")}
+	if r.Method != http.MethodPost {
+		renderTagTools(w, r, http.StatusOK, t, conn)
+		return
+	}
+	name := normalizeTags([]string{t.From})
+	if len(name) == 0 {
+		t.Error = "Give the tag to delete."
+		renderTagTools(w, r, http.StatusBadRequest, t, conn)
+		return
+	}
+	n, err := deleteTag(r.Context(), name[0], editorName(r), conn)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	t.Message = fmt.Sprintf("Removed %q from %d pages.", name[0], n)
+	t.From = ""
+	renderTagTools(w, r, http.StatusOK, t, conn)
+}
+
+// taggedPages returns up to limit pages tagged with tag, alphabetically and
+// without their bodies, after skipping offset.
+func taggedPages(ctx context.Context, tag string, limit, offset int, conn db) ([]*Page, error) {
+	defer timeQuery("taggedPages", time.Now())
+	query := `SELECT p.title, p.updated_at FROM ` + table("pages") + ` p
+		JOIN ` + table("page_tags") + ` pt ON pt.page_id = p.id
+		JOIN ` + table("tags") + ` t ON t.id = pt.tag_id
+		WHERE t.name = $1 ORDER BY p.title LIMIT $2 OFFSET $3`
+	rows, err := conn.Query(ctx, query, tag, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pages []*Page
+	for rows.Next() {
+		p := &Page{}
+		if err := rows.Scan(&p.Title, &p.UpdatedAt); err != nil {
+			return nil, err
+		}
+		pages = append(pages, p)
+	}
+	return pages, rows.Err()
+}
+
+// tagNeighbours returns the titles right before and after title among the
+// pages tagged with tag, "" at the ends.
+func tagNeighbours(ctx context.Context, tag, title string, conn db) (prev, next string, err error) {
+	defer timeQuery("tagNeighbours", time.Now())
+	tagged := `SELECT p.title FROM ` + table("pages") + ` p
+		JOIN ` + table("page_tags") + ` pt ON pt.page_id = p.id
+		JOIN ` + table("tags") + ` t ON t.id = pt.tag_id
+		WHERE t.name = $1 AND p.title `
+	query := `SELECT COALESCE((` + tagged + `< $2 ORDER BY p.title DESC LIMIT 1), ''),
+		COALESCE((` + tagged + `> $2 ORDER BY p.title LIMIT 1), '')`
+	err = conn.QueryRow(ctx, query, tag, title).Scan(&prev, &next)
+	return prev, next, err
+}
+
+type TaggedPages struct {
+	Tag   string
+	Pages []*Page
+	// current page of the list, counted from 1, and its neighbours; 0 when
+	// there is none
+	Number int
+	Prev   int
+	Next   int
+}
+
+// tagHandler lists the pages under the tag /tag/{name}.
+func tagHandler(w http.ResponseWriter, r *http.Request, conn db) {
+	name := normalizeTags([]string{strings.TrimPrefix(r.URL.Path, "/tag/")})
+	if len(name) == 0 {
+		redirect(w, r, "/tags", http.StatusFound)
+		return
+	}
+	t := &TaggedPages{Tag: name[0], Number: pageNumber(r)}
+	// one more than shown tells whether there is a next page
+	pages, err := taggedPages(r.Context(), t.Tag, reportPageSize+1, (t.Number-1)*reportPageSize, conn)
+	if err != nil {
+		renderFailed(w, err)
+		return
+	}
+	if len(pages) > reportPageSize {
+		pages, t.Next = pages[:reportPageSize], t.Number+1
+	}
+	t.Pages = pages
+	if t.Number > 1 {
+		t.Prev = t.Number - 1
+	}
+	status := http.StatusOK
+	if len(pages) == 0 && t.Number == 1 {
+		status = http.StatusNotFound
+	}
+	renderTemplateStatus(w, r, status, "tag", t)
+}
+
+// TagCount is a tag of the tag cloud.
+type TagCount struct {
+	Name  string
+	Pages int
+	// Bulma size class, larger for the tags of more pages
+	Size string
+}
+
+// tagCounts returns every tag with the number of pages it is on,
+// alphabetically.
+func tagCounts(ctx context.Context, conn db) ([]*TagCount, error) {
+	defer timeQuery("tagCounts", time.Now())
+	query := `SELECT t.name, count(*) FROM ` + table("tags") + ` t
+		JOIN ` + table("page_tags") + ` pt ON pt.tag_id = t.id
+		GROUP BY t.name ORDER BY t.name`
+	rows, err := conn.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []*TagCount
+	for rows.Next() {
+		t := &TagCount{}
+		if err := rows.Scan(&t.Name, &t.Pages); err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+	return tags, rows.Err()
+}
+
+// sizeTags sizes the tags in thirds of the largest count.
+func sizeTags(tags []*TagCount) {
+	most := 0
+	for _, t := range tags {
+		most = max(most, t.Pages)
+	}
+	if most <= 1 {
+		return
+	}
+	for _, t := range tags {
+		switch {
+		case 3*t.Pages > 2*most:
+			t.Size = "is-large"
+		case 3*t.Pages > most:
+			t.Size = "is-medium"
+		}
+	}
+}
+
+// tagCloudHandler shows every tag, sized by how many pages it is on.
+func tagCloudHandler(w http.ResponseWriter, r *http.Request, conn db) {
+	tags, err := tagCounts(r.Context(), conn)
+	if err != nil {
+		renderFailed(w, err)
+		return
+	}
+	sizeTags(tags)
+	renderTemplate(w, r, "tags", tags)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/crypto/acme/autocert"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies holds the networks of -trusted-proxies, none when it is
+// empty.
+var trustedProxies []*net.IPNet
+
+// parseProxies parses addresses like 10.0.0.1 and networks like
+// 10.0.0.0/8, a single address standing for a network of its own.
+func parseProxies(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxy %q is not an IP address or network", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q is not an IP address or network", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func trustedProxy(ip net.IP) bool {
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type schemeKey struct{}
+
+// requestScheme is "https" when r came in over TLS, to the wiki or to a
+// trusted proxy in front of it, and "http" otherwise.
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if scheme, ok := r.Context().Value(schemeKey{}).(string); ok {
+		return scheme
+	}
+	return "http"
+}
+
+// forwardedFor is the client a request from a trusted proxy was made by:
+// the last address of X-Forwarded-For that isn't a trusted proxy itself,
+// since each proxy appends the address it got the request from, or nil
+// when there is none.
+func forwardedFor(r *http.Request) net.IP {
+	var hops []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	var client net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		client = ip
+		if !trustedProxy(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// fromProxies takes the client address and scheme of requests from the
+// trusted proxies from their X-Forwarded-For and X-Forwarded-Proto headers,
+// so the logs, rate limits, quotas and cookies see the client rather than
+// the proxy. The headers of anyone else are ignored: clients can send
+// whatever they like.
+func fromProxies(next http.Handler) http.Handler {
+	if len(trustedProxies) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !trustedProxy(net.ParseIP(clientIP(r))) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+		if proto = strings.ToLower(strings.TrimSpace(proto)); proto == "http" || proto == "https" {
+			ctx = context.WithValue(ctx, schemeKey{}, proto)
+		}
+		r = r.WithContext(ctx)
+		if ip := forwardedFor(r); ip != nil {
+			r.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// servingTLS tells whether the wiki serves HTTPS itself, from -tls-cert or
+// through -autocert-domains.
+func (c *Config) servingTLS() bool {
+	return c.TLSCert != "" || len(c.AutocertDomains) > 0
+}
+
+// listen serves srv until it is shut down: over plain HTTP, or over HTTPS
+// with the certificate of -tls-cert or ones Let's Encrypt issues for
+// -autocert-domains, which also answers its challenges at -redirect-http
+// while sending everything else there on to HTTPS.
+func listen(srv *http.Server) error {
+	if !config.servingTLS() {
+		return srv.ListenAndServe()
+	}
+	var redirect http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if _, port, _ := net.SplitHostPort(config.Listen); port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+	if len(config.AutocertDomains) > 0 {
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(config.AutocertDomains...),
+			Cache:      autocert.DirCache(config.AutocertCache),
+		}
+		srv.TLSConfig = m.TLSConfig()
+		redirect = m.HTTPHandler(redirect)
+	}
+	if config.RedirectHTTP != "" {
+		l, err := net.Listen("tcp", config.RedirectHTTP)
+		if err != nil {
+			return err
+		}
+		plain := &http.Server{Handler: redirect, ReadHeaderTimeout: config.ReadHeaderTimeout}
+		srv.RegisterOnShutdown(func() { plain.Close() })
+		go func() {
+			if err := plain.Serve(l); err != http.ErrServerClosed {
+				log.Printf("redirecting HTTP to HTTPS: %v", err)
+			}
+		}()
+	}
+	return srv.ListenAndServeTLS(config.TLSCert, config.TLSKey)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strconv"
+)
+
+// TOCEntry is a line of the table of contents of a page.
+type TOCEntry struct {
+	*Heading
+	// the number of its section for the editor, from sectionBounds
+	Section int
+	// how far it is indented, 0 for the highest level on the page
+	Depth int
+}
+
+// tableOfContents lists headings for the top of the view page once there
+// are -toc-min-headings of them. A `toc: true` or `toc: false` line in the
+// front matter of body shows or hides it whatever their number.
+func tableOfContents(body []byte, headings []*Heading) []*TOCEntry {
+	show := config.TOCMinHeadings > 0 && len(headings) >= config.TOCMinHeadings
+	fm, _ := parseFrontMatter(body)
+	if v, ok := fm.get("toc"); ok {
+		if b, err := strconv.ParseBool(v); err == nil {
+			show = b
+		}
+	}
+	if !show || len(headings) == 0 {
+		return nil
+	}
+	top := headings[0].Level
+	for _, h := range headings {
+		top = min(top, h.Level)
+	}
+	toc := make([]*TOCEntry, len(headings))
+	for i, h := range headings {
+		toc[i] = &TOCEntry{Heading: h, Section: i + 1, Depth: h.Level - top}
+	}
+	return toc
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+	"html/template"
+	"sync/atomic"
+)
+
+// number of includes left out for going over -max-include-depth or
+// -max-includes, shown at /debug/errors
+var includeLimitsHit int64
+
+// includeBlock is an {{include:Title}} line, replaced by the rendered body
+// of Title.
+type includeBlock struct {
+	ast.BaseBlock
+	Target []byte
+	// filled in by renderMarkdown before the document is rendered
+	HTML template.HTML
+}
+
+var kindInclude = ast.NewNodeKind("Include")
+
+func (n *includeBlock) Kind() ast.NodeKind { return kindInclude }
+
+func (n *includeBlock) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Target": string(n.Target)}, nil)
+}
+
+type includeParser struct{}
+
+func (includeParser) Trigger() []byte { return []byte{'{'} }
+
+func (includeParser) Open(parent ast.Node, reader text.Reader, pc parser.Context) (ast.Node, parser.State) {
+	line, segment := reader.PeekLine()
+	inner, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("{{include:"))
+	if !ok {
+		return nil, parser.NoChildren
+	}
+	target, ok := bytes.CutSuffix(inner, []byte("}}"))
+	target = []byte(canonicalTitle(string(target)))
+	if !ok || !validTitle.Match(target) {
+		return nil, parser.NoChildren
+	}
+	// like a thematic break, stop at the newline so the next line is parsed
+	// afresh
+	reader.Advance(segment.Len() - 1)
+	return &includeBlock{Target: target}, parser.NoChildren
+}
+
+func (includeParser) Continue(node ast.Node, reader text.Reader, pc parser.Context) parser.State {
+	return parser.Close
+}
+
+func (includeParser) Close(node ast.Node, reader text.Reader, pc parser.Context) {}
+
+func (includeParser) CanInterruptParagraph() bool { return true }
+
+func (includeParser) CanAcceptIndentedLine() bool { return false }
+
+type includeRenderer struct{}
+
+func (includeRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(kindInclude, func(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if entering {
+			w.WriteString(string(n.(*includeBlock).HTML))
+		}
+		return ast.WalkSkipChildren, nil
+	})
+}
+
+// transclusion renders {{include:Title}} lines, alone on their line, as the
+// body of Title. The included page is rendered in full, its own includes
+// too, within -max-include-depth and -max-includes.
+type transclusion struct{}
+
+func (transclusion) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(parser.WithBlockParsers(util.Prioritized(includeParser{}, 150)))
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(util.Prioritized(includeRenderer{}, 500)))
+}
+
+// inclusion is the state of one top-level render: the pages being rendered,
+// innermost last, to stop include loops, every title the result depends on,
+// so saving any of them can drop it from the render cache, how many pages
+// have been included so far, and the language of the top-level page, which
+// included pages are shown in when translated into it.
+type inclusion struct {
+	store    PageStore
+	stack    []string
+	deps     map[string]bool
+	included int
+	lang     string
+}
+
+func newInclusion(store PageStore) *inclusion {
+	return &inclusion{store: store, deps: map[string]bool{}}
+}
+
+func (in *inclusion) render(p *Page) (template.HTML, error) {
+	if len(in.stack) == 0 {
+		in.lang = p.Lang
+	}
+	in.stack = append(in.stack, p.Title)
+	defer func() { in.stack = in.stack[:len(in.stack)-1] }()
+	return renderMarkdown(p.Body, in.include)
+}
+
+// include renders the page title is to be replaced with. Missing pages, loops
+// and includes past the limits render as a notice in its place.
+func (in *inclusion) include(title string) (template.HTML, error) {
+	// a missing page counts too, so creating it refreshes the includer
+	in.deps[title] = true
+	for _, t := range in.stack {
+		if t == title {
+			return includeNotice(title, "it is already being included"), nil
+		}
+	}
+	// the stack holds the top-level page too
+	if len(in.stack) > config.MaxIncludeDepth {
+		atomic.AddInt64(&includeLimitsHit, 1)
+		return includeNotice(title, fmt.Sprintf("include limit reached, it would be nested more than %d deep", config.MaxIncludeDepth)), nil
+	}
+	if in.included >= config.MaxIncludes {
+		atomic.AddInt64(&includeLimitsHit, 1)
+		return includeNotice(title, fmt.Sprintf("include limit reached, this page already includes %d others", config.MaxIncludes)), nil
+	}
+	in.included++
+	p, err := in.store.Load(title)
+	if err == errNotFound {
+		// an old title kept by a rename includes the page it now names
+		var current string
+		if current, err = in.store.Resolve(title); err == nil {
+			in.deps[current] = true
+			p, err = in.store.Load(current)
+		}
+	}
+	if err == errNotFound {
+		return includeNotice(title, "it does not exist"), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if p.Expired() {
+		return includeNotice(title, "it has expired"), nil
+	}
+	if in.lang != "" {
+		t, err := in.store.Translation(p.Title, in.lang)
+		if err == nil {
+			p = withTranslation(p, t)
+		} else if err != errNotFound {
+			return "", err
+		}
+	}
+	return in.render(p)
+}
+
+func includeNotice(title, reason string) template.HTML {
+	href := template.HTMLEscapeString(config.BasePath + pagePath("view", title))
+	return template.HTML(`<p class="include-notice"><a href="` + href + `">` + template.HTMLEscapeString(title) + `</a> was not included: ` + template.HTMLEscapeString(reason) + ".</p>\n")
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// language codes of -languages, like fr or pt-br
+var validLanguage = regexp.MustCompile(`^[a-z]{2,3}(?:-[a-z0-9]{2,8})*$`)
+
+// loadTranslation returns the translation of title into lang as a page of
+// its own: its body and who last saved it, with nothing of the page.
+func loadTranslation(ctx context.Context, title, lang string, conn db) (*Page, error) {
+	defer timeQuery("loadTranslation", time.Now())
+	query := "SELECT body, version, updated_by, created_at, updated_at FROM " + table("page_translations") + " WHERE title = $1 AND lang = $2"
+	t := &Page{Title: title, Lang: lang}
+	err := conn.QueryRow(ctx, query, title, lang).Scan(&t.Body, &t.Version, &t.UpdatedBy, &t.CreatedAt, &t.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// loadTranslations returns the languages title is translated into, in
+// order of their codes.
+func loadTranslations(ctx context.Context, title string, conn db) ([]string, error) {
+	defer timeQuery("loadTranslations", time.Now())
+	rows, err := conn.Query(ctx, "SELECT lang FROM "+table("page_translations")+" WHERE title = $1 ORDER BY lang", title)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var langs []string
+	for rows.Next() {
+		var lang string
+		if err := rows.Scan(&lang); err != nil {
+			return nil, err
+		}
+		langs = append(langs, lang)
+	}
+	return langs, rows.Err()
+}
+
+// saveTranslation writes t the way Page.write writes a page: failing with
+// errCreateConflict when t.New and it exists, and with errVersionConflict
+// when it is no longer at t.BaseVersion.
+func saveTranslation(ctx context.Context, t *Page, conn db) error {
+	defer timeQuery("saveTranslation", time.Now())
+	query := "INSERT INTO " + table("page_translations") + " (title, lang, body, updated_by) VALUES ($1, $2, $3, $4)"
+	args := []interface{}{t.Title, t.Lang, t.Body, t.UpdatedBy}
+	switch {
+	case t.BaseVersion > 0:
+		query = "UPDATE " + table("page_translations") + " SET body = $3, updated_by = $4, updated_at = now(), version = version + 1 WHERE title = $1 AND lang = $2 AND version = $5"
+		args = append(args, t.BaseVersion)
+	case !t.New:
+		query += " ON CONFLICT (title, lang) DO UPDATE SET body = $3, updated_by = $4, updated_at = now(), version = " + table("page_translations") + ".version + 1"
+	}
+	err := conn.QueryRow(ctx, query+" RETURNING version, updated_at", args...).Scan(&t.Version, &t.UpdatedAt)
+	if t.New && uniqueViolation(err) {
+		return errCreateConflict
+	}
+	if t.BaseVersion > 0 && err == pgx.ErrNoRows {
+		return errVersionConflict
+	}
+	return err
+}
+
+// moveTranslations follows a rename of a page from title to newTitle.
+// Translations newTitle already has keep it, and the others stay behind.
+func moveTranslations(ctx context.Context, title, newTitle string, conn db) error {
+	defer timeQuery("moveTranslations", time.Now())
+	query := `UPDATE ` + table("page_translations") + ` t SET title = $2 WHERE title = $1
+		AND NOT EXISTS (SELECT 1 FROM ` + table("page_translations") + ` o WHERE o.title = $2 AND o.lang = t.lang)`
+	_, err := conn.Exec(ctx, query, title, newTitle)
+	return err
+}
+
+// translating reports whether pages can be translated at all, which takes
+// a language besides that of the pages.
+func translating() bool {
+	return len(config.Languages) > 1
+}
+
+// requestedLanguage is the translation the lang parameter of r asks for, or
+// "" for the page itself: when there is none, or it names the language of
+// the pages or one not in -languages.
+func requestedLanguage(r *http.Request) string {
+	lang := r.FormValue("lang")
+	if !translating() || lang == config.Languages[0] {
+		return ""
+	}
+	for _, l := range config.Languages[1:] {
+		if l == lang {
+			return lang
+		}
+	}
+	return ""
+}
+
+// variantPath is pagePath for the translation of title into lang, or the
+// page itself for "".
+func variantPath(action, title, lang string) string {
+	if lang == "" {
+		return pagePath(action, title)
+	}
+	return pagePath(action, title) + "?lang=" + lang
+}
+
+// withTranslation returns p with the body, and who saved it when, of its
+// translation t. The rest, like who may edit it, is that of the page.
+func withTranslation(p, t *Page) *Page {
+	c := *p
+	c.Lang, c.Body, c.Version, c.UpdatedBy, c.UpdatedAt = t.Lang, t.Body, t.Version, t.UpdatedBy, t.UpdatedAt
+	return &c
+}
+
+// loadVariant loads the translation of title into lang, along with the page,
+// or just the page for "".
+func loadVariant(store PageStore, title, lang string) (*Page, error) {
+	p, err := store.Load(title)
+	if err != nil || lang == "" {
+		return p, err
+	}
+	t, err := store.Translation(title, lang)
+	if err != nil {
+		return nil, err
+	}
+	return withTranslation(p, t), nil
+}
+
+// saveVariant saves p, as the translation of p.Lang when set.
+func saveVariant(store PageStore, p *Page) error {
+	if p.Lang == "" {
+		return store.Save(p)
+	}
+	return store.SaveTranslation(p)
+}
+
+// Language is an entry of the language switcher of the view page.
+type Language struct {
+	Code string
+	// set for the language of the pages themselves, viewed without ?lang=
+	Default bool
+	// set for the language shown
+	Current bool
+}
+
+// viewLanguages lists the languages p can be read in, for the switcher:
+// that of the pages and those of -languages it is translated into, in that
+// order. It is empty for pages without translations. The switcher is a nicety, so a failure is logged
+// and leaves it out.
+func viewLanguages(p *Page, store PageStore) []*Language {
+	if !translating() {
+		return nil
+	}
+	langs, err := store.Translations(p.Title)
+	if err != nil {
+		log.Printf("loading the translations of %s: %v", logValue(p.Title), err)
+		return nil
+	}
+	list := []*Language{{Code: config.Languages[0], Default: true, Current: p.Lang == ""}}
+	for _, lang := range config.Languages[1:] {
+		for _, l := range langs {
+			if l == lang {
+				list = append(list, &Language{Code: lang, Current: lang == p.Lang})
+			}
+		}
+	}
+	if len(list) == 1 {
+		return nil
+	}
+	return list
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// name of the cookie holding the session of a signed in user
+const sessionCookie = "session"
+
+const minPasswordLength = 8
+
+// validUserName matches the names accounts may have. Spaces and brackets are
+// left out so no one can pass for an anonymous editor.
+var validUserName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,40}$`)
+
+var (
+	errUserExists     = errors.New("that name is taken")
+	errBadCredentials = errors.New("wrong name or password")
+)
+
+// dummyHash is compared against when signing in with an unknown name, so
+// that takes as long as a wrong password and doesn't tell names apart.
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+	return hash
+})
+
+// checkNewUser returns what is wrong with an account to be created, if
+// anything.
+func checkNewUser(name, password string) error {
+	if !validUserName.MatchString(name) {
+		return errors.New("names are 1 to 40 letters, digits and . _ -")
+	}
+	if strings.EqualFold(name, config.AdminUser) || strings.EqualFold(name, anonymousEditor) {
+		return errUserExists
+	}
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("passwords are at least %d characters", minPasswordLength)
+	}
+	// bcrypt ignores anything past 72 bytes
+	if len(password) > 72 {
+		return errors.New("passwords are at most 72 bytes")
+	}
+	return nil
+}
+
+// createUser adds an account with a bcrypt hash of password.
+func createUser(ctx context.Context, name, password, role string, conn db) (*User, error) {
+	if err := checkNewUser(name, password); err != nil {
+		return nil, err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	query := "INSERT INTO " + table("users") + " (name, password_hash, role) VALUES ($1, $2, $3)"
+	if _, err := conn.Exec(ctx, query, name, string(hash), role); err != nil {
+		if uniqueViolation(err) {
+			return nil, errUserExists
+		}
+		return nil, err
+	}
+	return &User{Name: name, Role: role}, nil
+}
+
+// authenticate returns the user name and password belong to, or
+// errBadCredentials.
+func authenticate(ctx context.Context, name, password string, conn db) (*User, error) {
+	u := &User{}
+	var hash string
+	query := "SELECT name, role, password_hash FROM " + table("users") + " WHERE lower(name) = lower($1)"
+	err := conn.QueryRow(ctx, query, name).Scan(&u.Name, &u.Role, &hash)
+	if err == pgx.ErrNoRows {
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return nil, errBadCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return nil, errBadCredentials
+	}
+	return u, nil
+}
+
+// startSession signs u in for -session-length. The signed cookie holds the
+// name, role and end of the session; with a database the role is looked up
+// again on each request, so role changes apply at once on every server.
+func startSession(w http.ResponseWriter, r *http.Request, u *User) {
+	expires := time.Now().Add(config.SessionLength)
+	value := u.Name + "\n" + u.Role + "\n" + strconv.FormatInt(expires.Unix(), 10)
+	setSignedCookie(w, r, sessionCookie, value, int(config.SessionLength.Seconds()))
+}
+
+// sessionDB is where the roles of signed in users are looked up, nil
+// without a database.
+var sessionDB db
+
+type sessionKey struct{}
+
+// sessionLookup is the user of a request as the users table has it, looked
+// up the first time the request asks.
+type sessionLookup struct {
+	once sync.Once
+	user *User
+}
+
+// withSessions lets the requests to next look up the role of their user
+// once each, however many times they ask who is signed in.
+func withSessions(next http.Handler) http.Handler {
+	if sessionDB == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionKey{}, &sessionLookup{})))
+	})
+}
+
+// sessionUser returns the user signed in by the session cookie, or nil.
+// Under withSessions the role is the one the account has now, and an
+// account no longer in the users table is signed out.
+func sessionUser(r *http.Request) *User {
+	u := cookieUser(r)
+	if u == nil {
+		return nil
+	}
+	l, ok := r.Context().Value(sessionKey{}).(*sessionLookup)
+	if !ok {
+		return u
+	}
+	l.once.Do(func() {
+		role, err := userRole(r.Context(), u.Name, sessionDB)
+		if err == pgx.ErrNoRows {
+			return
+		}
+		if err != nil {
+			// treated as signed out, which never grants more than the
+			// cookie did
+			log.Printf("looking up the role of %s: %v", u.Name, err)
+			return
+		}
+		l.user = &User{Name: u.Name, Role: role}
+	})
+	return l.user
+}
+
+// cookieUser returns the user of the session cookie, with the role it was
+// signed in with, or nil.
+func cookieUser(r *http.Request) *User {
+	value, err := readSignedCookie(r, sessionCookie)
+	if err != nil {
+		return nil
+	}
+	fields := strings.Split(value, "\n")
+	if len(fields) != 3 {
+		return nil
+	}
+	expires, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		return nil
+	}
+	u := &User{Name: fields[0], Role: fields[1]}
+	if u.Role == "user" {
+		// sessions started before there were roles
+		u.Role = roleEditor
+	}
+	return u
+}
+
+func userRole(ctx context.Context, name string, conn db) (string, error) {
+	defer timeQuery("userRole", time.Now())
+	var role string
+	query := "SELECT role FROM " + table("users") + " WHERE lower(name) = lower($1)"
+	err := conn.QueryRow(ctx, query, name).Scan(&role)
+	return role, err
+}
+
+// Account is the data model of the login and signup pages.
+type Account struct {
+	// signed in user, if any
+	User *User
+	Name string
+	// path to go back to once signed in
+	Next    string
+	Error   string
+	Signups bool
+}
+
+// nextPath is where to send the user once signed in: next if it is a path
+// within the wiki, the home page otherwise.
+func nextPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func loginHandler(w http.ResponseWriter, r *http.Request, conn db) {
+	a := &Account{User: currentUser(r), Name: r.FormValue("name"), Next: nextPath(r.FormValue("next")), Signups: config.Signups}
+	if r.Method != http.MethodPost {
+		renderTemplate(w, r, "login", a)
+		return
+	}
+	u, err := authenticate(r.Context(), a.Name, r.FormValue("password"), conn)
+	if err == errBadCredentials {
+		a.Error = "Wrong name or password."
+		renderTemplateStatus(w, r, http.StatusUnauthorized, "login", a)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	startSession(w, r, u)
+	redirect(w, r, a.Next, http.StatusSeeOther)
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	clearCookie(w, r, sessionCookie)
+	redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func signupHandler(w http.ResponseWriter, r *http.Request, conn db) {
+	if !config.Signups {
+		http.Error(w, "signups are closed", http.StatusForbidden)
+		return
+	}
+	a := &Account{User: currentUser(r), Name: r.FormValue("name"), Next: nextPath(r.FormValue("next")), Signups: true}
+	if r.Method != http.MethodPost {
+		renderTemplate(w, r, "signup", a)
+		return
+	}
+	password := r.FormValue("password")
+	if err := checkNewUser(a.Name, password); err != nil {
+		a.Error = "The account can't be created: " + err.Error() + "."
+		renderTemplateStatus(w, r, http.StatusBadRequest, "signup", a)
+		return
+	}
+	if password != r.FormValue("confirm") {
+		a.Error = "The passwords don't match."
+		renderTemplateStatus(w, r, http.StatusBadRequest, "signup", a)
+		return
+	}
+	u, err := createUser(r.Context(), a.Name, password, config.SignupRole, conn)
+	if err == errUserExists {
+		a.Error = "The account can't be created: " + err.Error() + "."
+		renderTemplateStatus(w, r, http.StatusConflict, "signup", a)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	startSession(w, r, u)
+	redirect(w, r, a.Next, http.StatusSeeOther)
+}
+
+// addUserCommand creates an account, reading its password from the first
+// line of standard input so it stays out of the shell history.
+func addUserCommand(conn db, args []string) error {
+	name, role := args[0], args[1]
+	if !validRole(role) {
+		return fmt.Errorf("role %q must be one of %s", role, strings.Join(roles, ", "))
+	}
+	fmt.Fprintf(os.Stderr, "password for %s: ", name)
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		return err
+	}
+	if _, err := createUser(context.Background(), name, strings.TrimRight(password, "\r\n"), role, conn); err != nil {
+		return err
+	}
+	fmt.Printf("created %s %s\n", role, name)
+	return nil
+}
+
+// UserAccount is a row of the /users page.
+type UserAccount struct {
+	Name      string
+	Role      string
+	CreatedAt time.Time
+}
+
+func listUsers(ctx context.Context, conn db) ([]*UserAccount, error) {
+	defer timeQuery("listUsers", time.Now())
+	query := "SELECT name, role, created_at FROM " + table("users") + " ORDER BY lower(name)"
+	rows, err := conn.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*UserAccount
+	for rows.Next() {
+		u := &UserAccount{}
+		if err := rows.Scan(&u.Name, &u.Role, &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// setUserRole gives the account name role, returning the name as stored.
+func setUserRole(ctx context.Context, name, role string, conn db) (string, error) {
+	query := "UPDATE " + table("users") + " SET role = $2 WHERE lower(name) = lower($1) RETURNING name"
+	err := conn.QueryRow(ctx, query, name, role).Scan(&name)
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// Users is the data model of the /users page.
+type Users struct {
+	Users   []*UserAccount
+	Roles   []string
+	Message string
+	Error   string
+}
+
+func renderUsers(w http.ResponseWriter, r *http.Request, status int, u *Users, conn db) {
+	users, err := listUsers(r.Context(), conn)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u.Users, u.Roles = users, roles
+	renderTemplateStatus(w, r, status, "users", u)
+}
+
+// usersHandler lists the accounts and lets admins change their roles.
+func usersHandler(w http.ResponseWriter, r *http.Request, conn db) {
+	u := &Users{}
+	if r.Method != http.MethodPost {
+		renderUsers(w, r, http.StatusOK, u, conn)
+		return
+	}
+	name, role := r.FormValue("name"), r.FormValue("role")
+	switch {
+	case !validRole(role):
+		u.Error = "Choose one of the roles."
+	case strings.EqualFold(name, currentUser(r).Name):
+		// so the wiki can't be left without an admin by accident
+		u.Error = "You can't change your own role."
+	}
+	if u.Error != "" {
+		renderUsers(w, r, http.StatusBadRequest, u, conn)
+		return
+	}
+	name, err := setUserRole(r.Context(), name, role, conn)
+	if err == pgx.ErrNoRows {
+		u.Error = "There is no such account."
+		renderUsers(w, r, http.StatusNotFound, u, conn)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u.Message = fmt.Sprintf("%s now has the %s role.", name, role)
+	renderUsers(w, r, http.StatusOK, u, conn)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Validation collects everything wrong with a submitted form so it can be
+// reported at once: a general message and errors tied to form fields.
+type Validation struct {
+	Message string
+	Fields  []FieldError
+}
+
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (v *Validation) add(field, msg string) {
+	v.Fields = append(v.Fields, FieldError{field, msg})
+}
+
+// Failed reports whether anything was wrong. It is safe on a nil
+// Validation, which templates get when there was nothing to report.
+func (v *Validation) Failed() bool {
+	return v != nil && (v.Message != "" || len(v.Fields) > 0)
+}
+
+// Has reports whether field has an error, for highlighting it.
+func (v *Validation) Has(field string) bool {
+	if v == nil {
+		return false
+	}
+	for _, f := range v.Fields {
+		if f.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// sentence turns a lowercase error message into one for the user.
+func sentence(msg string) string {
+	r, n := utf8.DecodeRuneInString(msg)
+	msg = string(unicode.ToUpper(r)) + msg[n:]
+	if !strings.HasSuffix(msg, ".") && !strings.HasSuffix(msg, "?") {
+		msg += "."
+	}
+	return msg
+}
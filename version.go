@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at build time with
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%FT%TZ)"
+//
+// Without it commit falls back to the revision the Go toolchain recorded of
+// the checkout, if any.
+var (
+	version   = "dev"
+	commit    string
+	buildTime string
+)
+
+// BuildInfo is what /version and -version report.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+func buildInfo() BuildInfo {
+	b := BuildInfo{Version: version, Commit: commit, BuildTime: buildTime, GoVersion: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok && b.Commit == "" {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				b.Commit = s.Value
+			}
+		}
+	}
+	return b
+}
+
+func (b BuildInfo) String() string {
+	s := "gowiki " + b.Version
+	if b.Commit != "" {
+		s += " (" + b.Commit + ")"
+	}
+	if b.BuildTime != "" {
+		s += " built " + b.BuildTime
+	}
+	return fmt.Sprintf("%s with %s", s, b.GoVersion)
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := json.Marshal(buildInfo())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeBody(w, r, http.StatusOK, "application/json", body)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// view events are buffered and written in batches
+	viewQueueSize     = 4096
+	viewBatchSize     = 500
+	viewFlushInterval = 10 * time.Second
+	// events of past days are folded into daily counts this often
+	viewAggregateInterval = time.Hour
+
+	defaultViewDays = 30
+	maxViewDays     = 366
+	viewReferrers   = 10
+)
+
+type viewEvent struct {
+	PageID   int64
+	Referrer string
+	At       time.Time
+}
+
+// viewLog queues view events for runViewLog; nil while views are not
+// logged.
+var viewLog chan viewEvent
+
+// number of view events dropped because the queue was full
+var droppedViews int64
+
+// logView queues a view of p without ever blocking the request.
+func logView(p *Page, r *http.Request) {
+	if viewLog == nil {
+		return
+	}
+	select {
+	case viewLog <- viewEvent{p.ID, referrerHost(r), time.Now()}:
+	default:
+		atomic.AddInt64(&droppedViews, 1)
+	}
+}
+
+// referrerHost keeps only the host of the Referer header, so the daily
+// counts stay small and no query strings are stored.
+func referrerHost(r *http.Request) string {
+	u, err := url.Parse(r.Referer())
+	if err != nil {
+		return ""
+	}
+	host := strings.ToLower(u.Hostname())
+	if len(host) > 255 {
+		return ""
+	}
+	return host
+}
+
+// runViewLog writes queued view events until ctx is done, then whatever is
+// still queued, and regularly
+// aggregates the events of past days. It uses its own connection so it
+// never shares one with request handlers.
+func runViewLog(ctx context.Context, events <-chan viewEvent) {
+	flush := time.NewTicker(viewFlushInterval)
+	defer flush.Stop()
+	aggregate := time.NewTicker(viewAggregateInterval)
+	defer aggregate.Stop()
+
+	var conn *pgx.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close(context.Background())
+		}
+	}()
+	connect := func(ctx context.Context) bool {
+		if conn != nil {
+			return true
+		}
+		var err error
+		if conn, err = connectDB(ctx, config.StatementTimeout); err != nil {
+			log.Printf("view log: %v", err)
+			conn = nil
+		}
+		return conn != nil
+	}
+	var batch []viewEvent
+	write := func(ctx context.Context) {
+		if len(batch) == 0 || !connect(ctx) {
+			return
+		}
+		if err := writeViews(ctx, batch, conn); err != nil {
+			// a broken connection is replaced on the next write; the
+			// batch is dropped rather than growing without bound
+			log.Printf("writing %d view events: %v", len(batch), err)
+			conn.Close(context.Background())
+			conn = nil
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			// the server has stopped serving, so what is queued is all
+			// there is; it is written in full rather than dropped
+			for len(events) > 0 {
+				batch = append(batch, <-events)
+			}
+			write(context.Background())
+			return
+		case e := <-events:
+			batch = append(batch, e)
+			if len(batch) >= viewBatchSize {
+				write(ctx)
+			}
+		case <-flush.C:
+			write(ctx)
+		case <-aggregate.C:
+			if !connect(ctx) {
+				continue
+			}
+			if _, err := aggregateViews(startOfDay(time.Now()), conn); err != nil {
+				log.Printf("aggregating views: %v", err)
+			}
+		}
+	}
+}
+
+func writeViews(ctx context.Context, events []viewEvent, conn *pgx.Conn) error {
+	rows := make([][]interface{}, len(events))
+	for i, e := range events {
+		rows[i] = []interface{}{e.PageID, e.Referrer, e.At}
+	}
+	_, err := conn.CopyFrom(ctx, pgx.Identifier{table("page_views")}, []string{"page_id", "referrer", "viewed_at"}, pgx.CopyFromRows(rows))
+	return err
+}
+
+// startOfDay returns midnight UTC of the day of t.
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// aggregateViews folds the view events before the given time into daily
+// counts per page and referrer and deletes them. It returns the number of
+// events folded.
+func aggregateViews(before time.Time, conn db) (int64, error) {
+	ctx := context.Background()
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	query := "INSERT INTO " + table("page_view_days") + " (page_id, day, referrer, views)" +
+		" SELECT page_id, (viewed_at AT TIME ZONE 'UTC')::date, referrer, count(*) FROM " + table("page_views") +
+		" WHERE viewed_at < $1 GROUP BY 1, 2, 3" +
+		" ON CONFLICT (page_id, day, referrer) DO UPDATE SET views = " + table("page_view_days") + ".views + EXCLUDED.views"
+	if _, err := tx.Exec(ctx, query, before); err != nil {
+		return 0, err
+	}
+	tag, err := tx.Exec(ctx, "DELETE FROM "+table("page_views")+" WHERE viewed_at < $1", before)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), tx.Commit(ctx)
+}
+
+type ViewDay struct {
+	Day   time.Time
+	Views int64
+}
+
+type Referrer struct {
+	Host  string
+	Views int64
+}
+
+type ViewStats struct {
+	Page      *Page
+	Days      []*ViewDay
+	Total     int64
+	Max       int64
+	Referrers []*Referrer
+}
+
+// newViewStats lays out counts, keyed by day as 2006-01-02, over the days
+// days up to today, including the days without views.
+func newViewStats(days int, counts map[string]int64, refs []*Referrer) *ViewStats {
+	stats := &ViewStats{Referrers: refs}
+	since := viewsSince(days)
+	for i := 0; i < days; i++ {
+		d := &ViewDay{Day: since.AddDate(0, 0, i)}
+		d.Views = counts[d.Day.Format("2006-01-02")]
+		stats.Total += d.Views
+		if d.Views > stats.Max {
+			stats.Max = d.Views
+		}
+		stats.Days = append(stats.Days, d)
+	}
+	return stats
+}
+
+// viewsSince returns the first of the last days days, today included.
+func viewsSince(days int) time.Time {
+	return startOfDay(time.Now()).AddDate(0, 0, 1-days)
+}
+
+// loadViewStats counts the views of a page over the last days days, from
+// the daily counts and the events not aggregated yet.
+func loadViewStats(ctx context.Context, pageID int64, days int, conn db) (*ViewStats, error) {
+	since := viewsSince(days)
+	views := "SELECT day, referrer, views FROM " + table("page_view_days") + " WHERE page_id=$1 AND day >= $2::date" +
+		" UNION ALL SELECT (viewed_at AT TIME ZONE 'UTC')::date, referrer, count(*) FROM " + table("page_views") +
+		" WHERE page_id=$1 AND viewed_at >= $3 GROUP BY 1, 2"
+
+	rows, err := conn.Query(ctx, "SELECT day, sum(views)::bigint FROM ("+views+") v GROUP BY day", pageID, since, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := map[string]int64{}
+	for rows.Next() {
+		var day time.Time
+		var n int64
+		if err := rows.Scan(&day, &n); err != nil {
+			return nil, err
+		}
+		counts[day.Format("2006-01-02")] = n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = conn.Query(ctx, "SELECT referrer, sum(views)::bigint FROM ("+views+") v WHERE referrer <> '' GROUP BY referrer ORDER BY 2 DESC, referrer LIMIT $4", pageID, since, since, viewReferrers)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var refs []*Referrer
+	for rows.Next() {
+		ref := &Referrer{}
+		if err := rows.Scan(&ref.Host, &ref.Views); err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return newViewStats(days, counts, refs), nil
+}
+
+func viewsHandler(w http.ResponseWriter, r *http.Request, title string, store PageStore) {
+	p, err := store.Stat(title)
+	if err == errNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	days := defaultViewDays
+	if n, err := strconv.Atoi(r.FormValue("days")); err == nil && n > 0 {
+		days = n
+	}
+	if days > maxViewDays {
+		days = maxViewDays
+	}
+
+	stats, err := store.ViewStats(p, days)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	stats.Page = p
+	renderTemplate(w, r, "views", stats)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// Watcher is an account told about changes to a page.
+type Watcher struct {
+	Name string
+	// empty unless they gave one at /watchlist
+	Email string
+}
+
+func setWatch(ctx context.Context, title, account string, watch bool, conn db) error {
+	defer timeQuery("setWatch", time.Now())
+	query := "INSERT INTO " + table("watches") + " (title, account) VALUES ($1, $2) ON CONFLICT DO NOTHING"
+	if !watch {
+		query = "DELETE FROM " + table("watches") + " WHERE title = $1 AND account = $2"
+	}
+	_, err := conn.Exec(ctx, query, title, account)
+	return err
+}
+
+// loadWatchers returns who watches title, by name. Accounts only kept by
+// the admin password have no row in users and so no email.
+func loadWatchers(ctx context.Context, title string, conn db) ([]*Watcher, error) {
+	defer timeQuery("loadWatchers", time.Now())
+	query := `SELECT w.account, COALESCE(u.email, '') FROM ` + table("watches") + ` w
+		LEFT JOIN ` + table("users") + ` u ON lower(u.name) = lower(w.account)
+		WHERE w.title = $1 ORDER BY w.account`
+	rows, err := conn.Query(ctx, query, title)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var watchers []*Watcher
+	for rows.Next() {
+		w := &Watcher{}
+		if err := rows.Scan(&w.Name, &w.Email); err != nil {
+			return nil, err
+		}
+		watchers = append(watchers, w)
+	}
+	return watchers, rows.Err()
+}
+
+func loadWatchlist(ctx context.Context, account string, conn db) ([]string, error) {
+	defer timeQuery("loadWatchlist", time.Now())
+	query := "SELECT title FROM " + table("watches") + " WHERE account = $1 ORDER BY title"
+	rows, err := conn.Query(ctx, query, account)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var titles []string
+	for rows.Next() {
+		var title string
+		if err := rows.Scan(&title); err != nil {
+			return nil, err
+		}
+		titles = append(titles, title)
+	}
+	return titles, rows.Err()
+}
+
+func loadEmail(ctx context.Context, account string, conn db) (string, error) {
+	defer timeQuery("loadEmail", time.Now())
+	var email string
+	query := "SELECT email FROM " + table("users") + " WHERE lower(name) = lower($1)"
+	err := conn.QueryRow(ctx, query, account).Scan(&email)
+	return email, err
+}
+
+// setEmail fails with pgx.ErrNoRows for names without an account.
+func setEmail(ctx context.Context, account, email string, conn db) error {
+	defer timeQuery("setEmail", time.Now())
+	tag, err := conn.Exec(ctx, "UPDATE "+table("users")+" SET email = $2 WHERE lower(name) = lower($1)", account, email)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// moveWatches follows a rename of a page from title to newTitle. Those
+// already watching newTitle keep that one watch.
+func moveWatches(ctx context.Context, title, newTitle string, conn db) error {
+	defer timeQuery("moveWatches", time.Now())
+	query := `INSERT INTO ` + table("watches") + ` (title, account, created_at)
+		SELECT $2, account, created_at FROM ` + table("watches") + ` WHERE title = $1
+		ON CONFLICT DO NOTHING`
+	if _, err := conn.Exec(ctx, query, title, newTitle); err != nil {
+		return err
+	}
+	_, err := conn.Exec(ctx, "DELETE FROM "+table("watches")+" WHERE title = $1", title)
+	return err
+}
+
+// isWatching tells whether u watches p, for the button on the view page.
+// A failure is only logged and shows the page unwatched.
+func isWatching(u *User, p *Page, store PageStore) bool {
+	if u == nil || !notifying() {
+		return false
+	}
+	watchers, err := store.Watchers(p.Title)
+	if err != nil {
+		log.Printf("loading the watchers of %s: %v", p.Title, err)
+		return false
+	}
+	for _, w := range watchers {
+		if w.Name == u.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// watchHandler starts watching the page, or stops with watch=0, for the
+// signed-in user, and goes back to it.
+func watchHandler(w http.ResponseWriter, r *http.Request, title string, store PageStore) {
+	u := currentUser(r)
+	if u == nil {
+		renderTemplateStatus(w, r, http.StatusUnauthorized, "login", &Account{Next: pagePath("view", title), Error: "Log in to watch pages.", Signups: config.Signups})
+		return
+	}
+	if err := store.SetWatch(title, u.Name, r.FormValue("watch") != "0"); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	redirect(w, r, pagePath("view", title), http.StatusSeeOther)
+}
+
+// Watchlist is the data model of the /watchlist page.
+type Watchlist struct {
+	Titles  []string
+	Email   string
+	Message string
+	Error   string
+	// whether changes are emailed at all
+	Mail bool
+}
+
+// watchlistHandler lists the pages the signed-in user watches and sets
+// the address changes to them are emailed to on POST.
+func watchlistHandler(w http.ResponseWriter, r *http.Request, store PageStore) {
+	u := currentUser(r)
+	if u == nil {
+		a := &Account{Next: "/watchlist", Error: "Log in to see the pages you watch.", Signups: config.Signups}
+		renderTemplateStatus(w, r, http.StatusUnauthorized, "login", a)
+		return
+	}
+	wl := &Watchlist{Mail: config.SMTPAddr != ""}
+	status := http.StatusOK
+	if r.Method == http.MethodPost {
+		email := strings.TrimSpace(r.FormValue("email"))
+		if a, err := mail.ParseAddress(email); email != "" && (err != nil || a.Address != email) {
+			wl.Error, status = "That isn't an email address.", http.StatusBadRequest
+		} else if err := store.SetEmail(u.Name, email); err == errNotFound {
+			wl.Error, status = "Only accounts can be sent email.", http.StatusBadRequest
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if email == "" {
+			wl.Message = "Changes won't be emailed to you anymore."
+		} else {
+			wl.Message = "Changes to the pages you watch are emailed to " + email + "."
+		}
+	}
+	titles, err := store.Watchlist(u.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	email, err := store.Email(u.Name)
+	if err != nil && err != errNotFound {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	wl.Titles, wl.Email = titles, email
+	renderTemplateStatus(w, r, status, "watchlist", wl)
+}
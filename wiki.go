@@ -2,117 +2,1154 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
 	"html/template"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
 )
 
-// valid path with title
-var validPath = regexp.MustCompile("^/(edit|save|view)/([a-zA-Z0-9]+)$")
+// characters allowed in titles unless configured otherwise, with an
+// optional namespace: prefix: letters and digits of any script, and spaces
+// and a little punctuation after the first, in parts separated by slashes
+// for pages under others, like Projects/GoWiki
+const defaultTitlePattern = "(?:" + namespacePattern + `:)?` + titlePart + "(?:/" + titlePart + ")*"
+
+const titlePart = `[\p{L}\p{N}][\p{L}\p{M}\p{N} ',.()-]*`
+
+// actions routed through makeHandler as /<action>/{title...}, the title
+// taking up the rest of the path, slashes and all
+const pageActions = "edit|save|view|split|protect|rename|history|diff|views|events|revert|delete|restore|preview|draft|talk|watch|raw"
+
+// valid title on its own, for titles submitted through forms
+var validTitle = regexp.MustCompile("^(?:" + defaultTitlePattern + ")$")
+
+// checkTitle reports what is wrong with a title for a new or saved page:
+// it must be non-empty, at most -max-title-length characters and match the
+// title pattern.
+func checkTitle(title string) error {
+	switch {
+	case title == "":
+		return errors.New("the title is empty")
+	case utf8.RuneCountInString(title) > config.MaxTitleLength:
+		return fmt.Errorf("the title is longer than %d characters", config.MaxTitleLength)
+	case !validTitle.MatchString(title):
+		return errors.New("the title contains characters that are not allowed")
+	}
+	return nil
+}
+
+// compileTitlePattern swaps the allowed title pattern used for routing and
+// for validating submitted titles. Patterns that allow an underscore are
+// refused, since page URLs write spaces as underscores and no URL could
+// reach a title holding one.
+func compileTitlePattern(pattern string) error {
+	title, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return fmt.Errorf("title pattern %q: %v", pattern, err)
+	}
+	if re, err := syntax.Parse(pattern, syntax.Perl); err == nil && matchesUnderscore(re) {
+		return fmt.Errorf("title pattern %q allows underscores, which page URLs use for spaces", pattern)
+	}
+	validTitle = title
+	return nil
+}
+
+// matchesUnderscore reports whether any part of re can match an underscore.
+func matchesUnderscore(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return true
+	case syntax.OpLiteral:
+		for _, r := range re.Rune {
+			if r == '_' {
+				return true
+			}
+		}
+	case syntax.OpCharClass:
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			if re.Rune[i] <= '_' && '_' <= re.Rune[i+1] {
+				return true
+			}
+		}
+	}
+	for _, sub := range re.Sub {
+		if matchesUnderscore(sub) {
+			return true
+		}
+	}
+	return false
+}
 
 type Page struct {
-	ID    int64  `json:id`
-	Title string `json:"title"`
-	Body  []byte `json:"body"`
+	ID        int64     `json:"id"`
+	Title     string    `json:"title"`
+	Body      []byte    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// language of the translation the page holds, empty for the page itself
+	Lang string `json:"lang,omitempty"`
+	// who may edit the page, one of protectionLevels
+	Protection string `json:"protection"`
+	// name of the last editor, empty for anonymous edits
+	UpdatedBy string `json:"updated_by"`
+	// edit summary of the save in progress, stored with its revision
+	Summary string `json:"-"`
+	// set when the page was opened in the editor before it existed, so
+	// saving fails with errCreateConflict if someone created it meanwhile
+	New bool `json:"-"`
+	// number of the section being edited, from sectionBounds, empty when
+	// editing the whole page, and the sectionHash of its text as opened
+	Section     string `json:"-"`
+	SectionBase string `json:"-"`
+	// counts the changes to the body
+	Version int64 `json:"version"`
+	// when the page expires and is archived, nil for never; kept in sync
+	// with the expires front matter field
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// version the save in progress was based on, if any, so saving fails
+	// with errVersionConflict if the page changed meanwhile
+	BaseVersion int64 `json:"-"`
+	// set when the form holds the editor's draft, which saving drops
+	FromDraft bool `json:"-"`
+	// text of the body around what a search matched, set on search results
+	// only, with the matches between snippetStart and snippetStop
+	Snippet string `json:"-"`
+}
+
+var (
+	errCreateConflict  = errors.New("someone else created the page meanwhile")
+	errVersionConflict = errors.New("the page has changed since that version")
+)
+
+// uniqueViolation reports whether err is Postgres refusing a duplicate key.
+func uniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+// View is the data model of the view page.
+type View struct {
+	*Page
+	// rendered body
+	HTML             template.HTML
+	User             *User
+	ProtectionLevels []string
+	// metadata shown by the meta partial
+	Words int
+	Tags  []string
+	// styles from the page's front matter, empty for most pages
+	CSS template.CSS
+	// headings whose sections can be edited on their own
+	Sections []*Heading
+	// the table of contents, empty for pages with few headings
+	Contents []*TOCEntry
+	// schema.org JSON-LD of the page, with -structured-data
+	StructuredData template.JS
+	// the old revision shown instead of the current body, from ?rev=
+	Revision *Revision
+	// pages linking here, only on the view page
+	Backlinks *Backlinks
+	// the levels above a page under others, like Projects for
+	// Projects/GoWiki, the pages under it, and its neighbours in each of
+	// its tags, only on the view page
+	Breadcrumb []*Crumb
+	Subpages   *Subpages
+	TagNav     []*TagNav
+	// first paragraph and full address of the page, for search engines and
+	// link previews
+	Description string
+	URL         string
+	// drafts of the page the viewer may open, only on the view page
+	Drafts []*Draft
+	// whether the viewer watches the page, only on the view page
+	Watching bool
+	// the languages of the switcher, and the one asked for with ?lang= when
+	// the page isn't translated into it, so it is shown as it is
+	Languages []*Language
+	Fallback  string
+}
+
+// newView gathers what the page templates and their meta partial show
+// about a page.
+func newView(r *http.Request, p *Page, html template.HTML) *View {
+	_, body := parseFrontMatter(p.Body)
+	sections := parseHeadings(p.Body)
+	return &View{
+		Page:             p,
+		HTML:             html,
+		User:             currentUser(r),
+		ProtectionLevels: protectionLevels,
+		Words:            len(strings.Fields(string(body))),
+		Tags:             pageTags(p.Body),
+		CSS:              pageCSS(p.Body),
+		Sections:         sections,
+		Contents:         tableOfContents(p.Body, sections),
+		StructuredData:   structuredData(r, p),
+		Description:      pageDescription(p.Body),
+		URL:              baseURL(r) + pagePath("view", p.Title),
+	}
 }
 
-var templates = template.Must(template.ParseFiles("templates/edit.html", "templates/view.html", "templates/navbar.html"))
+// db is satisfied by *pgxpool.Pool, *pgx.Conn and pgx.Tx so page queries
+// can run on the server's pool, a worker's own connection or inside a
+// transaction.
+type db interface {
+	Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
 
-func (p *Page) save(conn *pgx.Conn) error {
-	query := "INSERT INTO pages (title, body) VALUES ($1, $2) ON CONFLICT ON CONSTRAINT title DO UPDATE SET body = $2"
-	_, err := conn.Exec(context.Background(), query, p.Title, p.Body)
+// connectDB opens a connection to -database-url on which Postgres cancels
+// any statement running longer than statementTimeout, 0 for no limit. It
+// is for background workers, which keep a connection of their own.
+func connectDB(ctx context.Context, statementTimeout time.Duration) (*pgx.Conn, error) {
+	cfg, err := pgx.ParseConfig(config.DatabaseURL)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	setStatementTimeout(cfg, statementTimeout)
+	return pgx.ConnectConfig(ctx, cfg)
 }
 
-func loadPage(title string, conn *pgx.Conn) (*Page, error) {
-	var id int64
-	var body []byte
-	query := "SELECT id, body FROM pages WHERE title=$1"
-	err := conn.QueryRow(context.Background(), query, title).Scan(&id, &body)
+// connectPool opens a pool of connections to the database at url, sized by
+// the -db-* flags, for requests and commands to share. Statements are held
+// to statementTimeout as with connectDB.
+func connectPool(ctx context.Context, url string, statementTimeout time.Duration) (*pgxpool.Pool, error) {
+	cfg, err := pgxpool.ParseConfig(url)
 	if err != nil {
 		return nil, err
 	}
-	return &Page{ID: id, Title: title, Body: body}, nil
+	setStatementTimeout(cfg.ConnConfig, statementTimeout)
+	// left at 0 the pool keeps its own defaults, or settings in the URL
+	if config.DBMaxConns > 0 {
+		cfg.MaxConns = int32(config.DBMaxConns)
+	}
+	if config.DBMinConns > 0 {
+		cfg.MinConns = int32(config.DBMinConns)
+	}
+	if config.DBMaxConnLifetime > 0 {
+		cfg.MaxConnLifetime = config.DBMaxConnLifetime
+	}
+	if config.DBMaxConnIdleTime > 0 {
+		cfg.MaxConnIdleTime = config.DBMaxConnIdleTime
+	}
+	return pgxpool.ConnectConfig(ctx, cfg)
 }
 
-func makeHandler(fn func(http.ResponseWriter, *http.Request, string, *pgx.Conn), conn *pgx.Conn) http.HandlerFunc {
+func setStatementTimeout(cfg *pgx.ConnConfig, statementTimeout time.Duration) {
+	if statementTimeout > 0 {
+		// sent with the startup message, so it holds from the first query
+		// and again on every reconnect
+		cfg.RuntimeParams["statement_timeout"] = strconv.FormatInt(statementTimeout.Milliseconds(), 10)
+	}
+}
+
+// save writes the page, retrying transient failures. Inside a transaction
+// a failure aborts the whole transaction, so it is left to the caller.
+func (p *Page) save(ctx context.Context, conn db) error {
+	if _, nested := conn.(pgx.Tx); nested {
+		return p.write(ctx, conn)
+	}
+	return retryTransient(func() error { return p.write(ctx, conn) })
+}
+
+func (p *Page) write(ctx context.Context, conn db) error {
+	defer timeQuery("save", time.Now())
+	// a nested Begin on a transaction is a savepoint
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if err := p.writeRow(ctx, tx); err != nil {
+		return err
+	}
+	if err := p.record(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// writeRow writes the row of the page itself, setting its ID, version and
+// time, and tells version and create conflicts apart.
+func (p *Page) writeRow(ctx context.Context, conn db) error {
+	// checked by validateSave, so an error here leaves the page unexpiring
+	p.ExpiresAt, _ = pageExpiry(p.Body)
+	// a gzipped body goes in body_gz, $5, with its text, $6, only for its
+	// size and search_vector
+	body, gz, plain := p.Body, compressBody(p.Body), []byte(nil)
+	if gz != nil {
+		body, plain = []byte{}, p.Body
+	}
+	columns := "body_gz = $5, body_size = octet_length($6::text), compressed = $5::bytea IS NOT NULL, search_vector = " + searchVector("$6")
+	query := "INSERT INTO " + table("pages") + " (title, body, updated_by, expires_at, body_gz, body_size, compressed, search_vector) VALUES ($1, $2, NULLIF($3, ''), $4, $5, octet_length($6::text), $5::bytea IS NOT NULL, " + searchVector("$6") + ")"
+	args := []interface{}{p.Title, body, p.UpdatedBy, p.ExpiresAt, gz, plain}
+	switch {
+	case p.BaseVersion > 0:
+		query = "UPDATE " + table("pages") + " SET body = $2, " + columns + ", updated_at = now(), updated_by = NULLIF($3, ''), expires_at = $4, version = version + 1 WHERE title = $1 AND version = $7"
+		args = append(args, p.BaseVersion)
+	case !p.New:
+		query += " ON CONFLICT (title) DO UPDATE SET body = $2, " + columns + ", updated_at = now(), updated_by = NULLIF($3, ''), expires_at = $4, version = " + table("pages") + ".version + 1"
+	}
+	err := conn.QueryRow(ctx, query+" RETURNING id, version, updated_at", args...).Scan(&p.ID, &p.Version, &p.UpdatedAt)
+	if p.New && uniqueViolation(err) {
+		// two people created the page at once and the other was first
+		return errCreateConflict
+	}
+	if p.BaseVersion > 0 && err == pgx.ErrNoRows {
+		return errVersionConflict
+	}
+	return err
+}
+
+// record writes what a save keeps besides the page row: its tags, its links
+// and its revision, dated when the row was written, pruning the revisions
+// past the limits.
+func (p *Page) record(ctx context.Context, conn db) error {
+	if err := syncTags(ctx, p.ID, p.Body, conn); err != nil {
+		return err
+	}
+	if err := syncLinks(ctx, p.ID, p.Title, p.Body, conn); err != nil {
+		return err
+	}
+	if err := recordRevision(ctx, p, p.UpdatedAt, conn); err != nil {
+		return err
+	}
+	_, err := pruneRevisions(ctx, p.ID, conn)
+	return err
+}
+
+// pageFields picks what loadPageFields reads of a page.
+type pageFields int
+
+const (
+	// everything but the body, for existence checks and metadata
+	pageMeta pageFields = iota
+	pageFull
+)
+
+func loadPage(ctx context.Context, title string, conn db) (*Page, error) {
+	return loadPageFields(ctx, title, pageFull, conn)
+}
+
+// loadPageFields loads a page, leaving out its body unless fields is
+// pageFull. Bodies can be megabytes, so checks that only need the ID or
+// protection should not read them.
+func loadPageFields(ctx context.Context, title string, fields pageFields, conn db) (*Page, error) {
+	p := &Page{Title: title}
+	columns := "id, created_at, updated_at, protection, COALESCE(updated_by, ''), version, expires_at"
+	dest := []interface{}{&p.ID, &p.CreatedAt, &p.UpdatedAt, &p.Protection, &p.UpdatedBy, &p.Version, &p.ExpiresAt}
+	name := "loadPageMeta"
+	var body storedBody
+	if fields == pageFull {
+		columns += ", " + bodyColumns
+		dest = body.dest(dest...)
+		name = "loadPage"
+	}
+	defer timeQuery(name, time.Now())
+	query := "SELECT " + columns + " FROM " + table("pages") + " WHERE title=$1"
+	if err := conn.QueryRow(ctx, query, title).Scan(dest...); err != nil {
+		return nil, err
+	}
+	if fields == pageFull {
+		var err error
+		if p.Body, err = body.bytes(); err != nil {
+			return nil, fmt.Errorf("%s: %w", title, err)
+		}
+	}
+	return p, nil
+}
+
+// makeHandler serves the pages routed as /<action>/{title...}, sending other
+// spellings of a title, like Meeting%20Notes for Meeting_Notes, to the
+// canonical URL.
+func makeHandler(fn func(http.ResponseWriter, *http.Request, string, PageStore), store PageStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		m := validPath.FindStringSubmatch(r.URL.Path)
-		if m == nil {
+		segment := r.PathValue("title")
+		title := canonicalTitle(segment)
+		if !validTitle.MatchString(title) {
 			http.NotFound(w, r)
 			return
 		}
-		fn(w, r, m[2], conn)
+		// the pattern alone lets through titles of any length
+		if err := checkTitle(title); err != nil {
+			http.Error(w, sentence(err.Error()), http.StatusBadRequest)
+			return
+		}
+		if segment != titleSlug(title) {
+			canonicalRedirect(w, r, strings.TrimSuffix(r.URL.Path, segment)+titleSlug(title))
+			return
+		}
+		fn(w, r, title, store.WithContext(r.Context()))
+	}
+}
+
+// allowMethods answers requests made with any method but methods with a
+// 405 listing the allowed ones.
+func allowMethods(h http.HandlerFunc, methods ...string) http.HandlerFunc {
+	allow := strings.Join(methods, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, m := range methods {
+			if r.Method == m {
+				h(w, r)
+				return
+			}
+		}
+		w.Header().Set("Allow", allow)
+		if isAPI(r) {
+			writeAPIError(w, r, http.StatusMethodNotAllowed, apiMethodNotAllowed, "method not allowed")
+			return
+		}
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func makeStoreHandler(fn func(http.ResponseWriter, *http.Request, PageStore), store PageStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fn(w, r, store.WithContext(r.Context()))
 	}
 }
 
-func renderTemplate(w http.ResponseWriter, tmpl string, p *Page) {
-	err := templates.ExecuteTemplate(w, tmpl+".html", p)
+func makeConnHandler(fn func(http.ResponseWriter, *http.Request, db), conn db) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fn(w, r, conn)
+	}
+}
+
+func viewHandler(w http.ResponseWriter, r *http.Request, title string, store PageStore) {
+	p, err := store.Load(title)
+	if err == errNotFound {
+		// a page called X.md itself wins over the download of X, and with
+		// neither there is the missing page of X.md
+		if base, ok := strings.CutSuffix(title, ".md"); ok {
+			if _, err := store.Stat(base); err != errNotFound {
+				downloadHandler(w, r, base, store)
+				return
+			}
+		}
+		if current, err := store.Resolve(title); err == nil {
+			u := *r.URL
+			u.Path = "/view/" + titleSlug(current)
+			redirect(w, r, u.String(), http.StatusMovedPermanently)
+			return
+		}
+		missingHandler(w, r, title, store)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if p.Expired() {
+		// gone for readers, though not archived yet
+		renderTemplateStatus(w, r, http.StatusNotFound, "missing", &MissingPage{Title: title, Expired: p.ExpiresAt})
+		return
+	}
+	if r.URL.Query().Has("rev") {
+		viewRevision(w, r, p, store)
+		return
+	}
+	fallback := ""
+	if lang := requestedLanguage(r); lang != "" {
+		t, err := store.Translation(title, lang)
+		if err == errNotFound {
+			fallback = lang
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else {
+			p = withTranslation(p, t)
+		}
+	}
+	// a failure only costs a view so it is logged rather than failing the
+	// request
+	if r.Method != http.MethodHead {
+		if err := store.CountView(p); err != nil {
+			log.Printf("counting view of page %d: %v", p.ID, err)
+		}
+		logView(p, r)
+	}
+	w.Header().Add("Vary", "Accept")
+	// only the source changes with nothing but a save; the other forms also
+	// show the protection level, and the HTML page who is signed in and the
+	// pages linking here, so they are revalidated by their ETag
+	switch negotiate(r.Header.Get("Accept"), "text/html", "text/markdown", "application/json") {
+	case "text/markdown":
+		w.Header().Set("Last-Modified", p.UpdatedAt.UTC().Format(http.TimeFormat))
+		writeBody(w, r, http.StatusOK, "text/markdown; charset=utf-8", p.Body)
+	case "application/json":
+		body, err := json.Marshal(p)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeBody(w, r, http.StatusOK, "application/json", body)
+	default:
+		html, err := renderPage(p, store)
+		if err != nil {
+			renderFailed(w, err)
+			return
+		}
+		v := newView(r, p, html)
+		v.URL = baseURL(r) + variantPath("view", p.Title, p.Lang)
+		if r.URL.Query().Get("print") == "1" {
+			renderPageTemplate(w, r, "print", v)
+			return
+		}
+		v.Backlinks = viewBacklinks(p, store)
+		v.Breadcrumb, v.Subpages = breadcrumb(p.Title), viewSubpages(p.Title, store)
+		v.TagNav = viewTagNav(p, v.Tags, store)
+		v.Drafts = viewDrafts(v.User, p, store)
+		v.Watching = isWatching(v.User, p, store)
+		v.Languages, v.Fallback = viewLanguages(p, store), fallback
+		renderPageTemplate(w, r, "view", v)
+	}
+}
+
+func missingHandler(w http.ResponseWriter, r *http.Request, title string, store PageStore) {
+	if config.MissingPage == "redirect" {
+		redirect(w, r, pagePath("edit", title), http.StatusFound)
+		return
+	}
+	suggestions, err := store.Similar(title, maxSuggestions)
+	if err != nil {
+		// suggestions are a nicety, the create link still works without them
+		log.Printf("similar titles for %s: %v", logValue(title), err)
+	}
+	m := &MissingPage{Title: title, Suggestions: suggestions, Subpages: viewSubpages(title, store)}
+	if at, err := store.Deleted(title); err == nil {
+		m.Deleted = &at
+	} else if err != errNotFound {
+		log.Printf("deletion of %s: %v", logValue(title), err)
+	}
+	if config.NotFoundPage != "" && config.NotFoundPage != title {
+		// editors can write the message themselves; without the page the
+		// built-in one is shown
+		fallback, err := store.Load(config.NotFoundPage)
+		if err == nil {
+			m.HTML, err = renderPage(fallback, store)
+		}
+		if err != nil && err != errNotFound {
+			log.Printf("not found page %q: %v", config.NotFoundPage, err)
+		}
+	}
+	renderTemplateStatus(w, r, http.StatusNotFound, "missing", m)
+}
+
+// Edit is the data model of the edit form. On a rejected save it carries
+// the submitted page back so the user's changes are not lost.
+type Edit struct {
+	Page   *Page
+	Errors *Validation
+	// set when previewing the submitted body against the stored one
+	Preview bool
+	Diff    []DiffLine
+	// the stored page, shown next to the form when it changed meanwhile
+	Theirs *Page
+	// the challenge anonymous editors solve with -captcha
+	Captcha *Captcha
+	// the templates a page that doesn't exist yet can start from, and the
+	// one it was filled in with
+	Templates []*PageTemplate
+	Template  string
+}
+
+func renderEdit(w http.ResponseWriter, r *http.Request, status int, e *Edit) {
+	e.Captcha = captchaFor(r)
+	renderTemplateStatus(w, r, status, "edit", e)
+}
+
+func editHandler(w http.ResponseWriter, r *http.Request, title string, store PageStore) {
+	p, err := store.Load(title)
+	missing := err == errNotFound
+	if missing {
+		p = &Page{Title: title, Body: newPageBody(title), New: config.NewPageConflict == "conflict"}
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if lang := requestedLanguage(r); lang != "" {
+		if missing {
+			http.Error(w, "Only pages that exist can be translated.", http.StatusNotFound)
+			return
+		}
+		t, err := store.Translation(title, lang)
+		if err == errNotFound {
+			// a new translation starts from the text it translates
+			t = &Page{Lang: lang, Body: p.Body}
+			p.New = config.NewPageConflict == "conflict"
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		p = withTranslation(p, t)
+	}
+	if !checkEdit(w, r, p.Protection) {
+		return
+	}
+	if !openSection(w, r, p) {
+		return
+	}
+	if p.Lang == "" && r.URL.Query().Has("draft") && !openDraft(w, r, p, store) {
+		return
+	}
+	e := &Edit{Page: p}
+	if missing && !p.FromDraft && !startFromTemplate(w, r, e, store) {
+		return
+	}
+	renderEdit(w, r, http.StatusOK, e)
+}
+
+// rejectSave re-renders the edit form with the submitted body and what was
+// wrong with it.
+func rejectSave(w http.ResponseWriter, r *http.Request, status int, p *Page, v *Validation) {
+	renderEdit(w, r, status, &Edit{Page: p, Errors: v})
 }
 
-func viewHandler(w http.ResponseWriter, r *http.Request, title string, conn *pgx.Conn) {
-	p, err := loadPage(title, conn)
+// createConflict shows the edit form again when p was written as a new page
+// but someone else created it first, with what p changes of their version.
+// Saving the form again makes p an ordinary edit of theirs.
+func createConflict(w http.ResponseWriter, r *http.Request, p *Page, store PageStore) {
+	theirs, err := loadVariant(store, p.Title, p.Lang)
 	if err != nil {
-		http.Redirect(w, r, "/edit/"+title, http.StatusFound)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !checkEdit(w, r, theirs.Protection) {
 		return
 	}
-	renderTemplate(w, "view", p)
+	p.New, p.Version = false, theirs.Version
+	diff := diffLines(string(theirs.Body), string(p.Body))
+	v := &Validation{Message: "Someone else created this page while you were writing it. Below is how your text differs from theirs; saving again replaces their version with yours, so merge their changes in first."}
+	renderEdit(w, r, http.StatusConflict, &Edit{Page: p, Errors: v, Preview: true, Diff: compactDiff(diff, diffContext), Theirs: theirs})
 }
 
-func editHandler(w http.ResponseWriter, r *http.Request, title string, conn *pgx.Conn) {
-	p, err := loadPage(title, conn)
+// editConflict shows the edit form again when the page was saved by someone
+// else after p was opened, with their version and what p changes of it.
+// Saving the form again replaces their version with p.
+func editConflict(w http.ResponseWriter, r *http.Request, p *Page, store PageStore) {
+	theirs, err := loadVariant(store, p.Title, p.Lang)
+	if err == errNotFound {
+		p.New, p.Version = true, 0
+		v := &Validation{Message: "Someone deleted this page while you were editing it. Saving again creates it anew with your text."}
+		renderEdit(w, r, http.StatusConflict, &Edit{Page: p, Errors: v})
+		return
+	}
 	if err != nil {
-		p = &Page{Title: title}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	renderTemplate(w, "edit", p)
+	if !checkEdit(w, r, theirs.Protection) {
+		return
+	}
+	p.Version = theirs.Version
+	diff := diffLines(string(theirs.Body), string(p.Body))
+	v := &Validation{Message: "Someone else saved this page while you were editing it. Their version is below, with how your text differs from it; saving again replaces their version with yours, so merge their changes in first."}
+	renderEdit(w, r, http.StatusConflict, &Edit{Page: p, Errors: v, Preview: true, Diff: compactDiff(diff, diffContext), Theirs: theirs})
 }
 
-func saveHandler(w http.ResponseWriter, r *http.Request, title string, conn *pgx.Conn) {
+// previewDiff shows the edit form again with the changes p makes to the
+// stored page, instead of saving it.
+func previewDiff(w http.ResponseWriter, r *http.Request, p *Page, store PageStore) {
+	var old []byte
+	stored, err := loadVariant(store, p.Title, p.Lang)
+	if err == nil {
+		old = stored.Body
+		// a section is compared with the section as it now stands
+		if n, err := strconv.Atoi(p.Section); err == nil {
+			if start, end, ok := sectionBounds(old, n); ok {
+				old = old[start:end]
+			}
+		}
+	} else if err != errNotFound {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	diff := diffLines(string(old), string(p.Body))
+	renderEdit(w, r, http.StatusOK, &Edit{Page: p, Preview: true, Diff: compactDiff(diff, diffContext)})
+}
+
+// validateSave checks the title, summary and body of a page being saved.
+func validateSave(p *Page) *Validation {
+	v := &Validation{}
+	if err := checkTitle(p.Title); err != nil {
+		v.add("title", sentence(err.Error()))
+	}
+	if utf8.RuneCountInString(p.Summary) > maxSummary {
+		v.add("summary", fmt.Sprintf("The edit summary is longer than %d characters.", maxSummary))
+	}
+	if err := checkText(p.Body); err != nil {
+		v.add("body", sentence(err.Error()))
+	} else if err := checkPageCSS(p.Body); err != nil {
+		v.add("body", sentence(err.Error()))
+	}
+	if _, err := pageExpiry(p.Body); err != nil {
+		v.add("expires", sentence(err.Error()))
+	}
+	return v
+}
+
+func saveHandler(w http.ResponseWriter, r *http.Request, title string, store PageStore) {
 	body := r.FormValue("body")
-	p := &Page{Title: title, Body: []byte(body)}
-	err := p.save(conn)
-	if err != nil {
+	p := &Page{Title: title, Lang: requestedLanguage(r), Body: []byte(body), UpdatedBy: editorName(r), Summary: strings.TrimSpace(r.FormValue("summary")), New: r.FormValue("new") != "", FromDraft: r.FormValue("from-draft") != ""}
+	if s := r.FormValue("section"); s != "" {
+		if _, err := strconv.Atoi(s); err != nil {
+			http.Error(w, "no such section", http.StatusBadRequest)
+			return
+		}
+		p.Section, p.SectionBase = s, r.FormValue("section-base")
+	} else {
+		// only a changed field overrides the front matter, which may have
+		// been edited instead
+		if expires := strings.TrimSpace(r.FormValue("expires")); expires != r.FormValue("expires-was") {
+			p.Body = setPageExpiry(p.Body, expires)
+		}
+		if tags := r.FormValue("tags"); tags != r.FormValue("tags-was") {
+			p.Body = setPageTags(p.Body, strings.Split(tags, ","))
+		}
+	}
+	// the version the form was opened at goes back into the form if the
+	// save is rejected. Whole page saves fail once it isn't current;
+	// sections are checked by mergeSection instead.
+	if v, err := strconv.ParseInt(r.FormValue("base-version"), 10, 64); err == nil && v > 0 {
+		p.Version = v
+		if p.Section == "" {
+			p.BaseVersion = v
+		}
+	}
+	if config.NormalizeBodies {
+		p.Body = normalizeText(p.Body)
+	}
+	if r.URL.Query().Get("preview-diff") == "" {
+		logSubmission(r, p)
+	}
+	v := validateSave(p)
+	if v.Failed() {
+		v.Message = "Your changes could not be saved:"
+		rejectSave(w, r, http.StatusBadRequest, p, v)
+		return
+	}
+	// pages that do not exist yet are open to anyone
+	level := protectAnyone
+	if stored, err := store.Stat(title); err == nil {
+		level = stored.Protection
+	} else if err == errNotFound && p.Lang != "" {
+		http.Error(w, "Only pages that exist can be translated.", http.StatusNotFound)
+		return
+	} else if err != errNotFound {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	http.Redirect(w, r, "/view/"+title, http.StatusFound)
+	if !checkEdit(w, r, level) {
+		return
+	}
+	if r.URL.Query().Get("preview-diff") != "" {
+		previewDiff(w, r, p, store)
+		return
+	}
+	if r.FormValue("draft") != "" {
+		if p.Lang != "" {
+			http.Error(w, "Translations can't be kept as drafts.", http.StatusBadRequest)
+			return
+		}
+		keepDraft(w, r, p, store)
+		return
+	}
+	if !checkCaptcha(w, r, p) || !checkSpam(w, r, p, store) || !checkQuota(w, r, p) {
+		return
+	}
+	save := p
+	if p.Section != "" {
+		body, v, diff, err := mergeSection(p, store)
+		if err != nil {
+			rejectSave(w, r, http.StatusInternalServerError, p, &Validation{Message: "Your changes could not be saved: " + err.Error()})
+			return
+		}
+		if v != nil {
+			renderEdit(w, r, http.StatusConflict, &Edit{Page: p, Errors: v, Preview: true, Diff: diff})
+			return
+		}
+		// the form goes on holding the section should saving fail
+		whole := *p
+		whole.Body, whole.Section, whole.SectionBase = body, "", ""
+		save = &whole
+	}
+	if !savePage(w, r, p, save, store) {
+		return
+	}
+	// 303 makes the browser follow up with a GET instead of re-posting
+	redirect(w, r, variantPath("view", title, p.Lang), http.StatusSeeOther)
+}
+
+// savePage writes save, the whole page or translation of the form p,
+// answering a conflict or a failure with the form again, and drops the
+// draft p came from. It returns false when the response has been written.
+func savePage(w http.ResponseWriter, r *http.Request, p, save *Page, store PageStore) bool {
+	err := saveVariant(store, save)
+	if err == errCreateConflict {
+		createConflict(w, r, p, store)
+		return false
+	}
+	if err == errVersionConflict {
+		editConflict(w, r, p, store)
+		return false
+	}
+	if err != nil {
+		rejectSave(w, r, http.StatusInternalServerError, p, &Validation{Message: "Your changes could not be saved: " + err.Error()})
+		return false
+	}
+	if u := currentUser(r); p.FromDraft && u != nil {
+		// the page is saved either way; a draft left behind can be
+		// discarded by hand
+		if err := store.DeleteDraft(p.Title, u.Name); err != nil {
+			log.Printf("dropping the draft of %s by %s: %v", logValue(p.Title), logValue(u.Name), err)
+		}
+	}
+	return true
 }
 
 func main() {
-	fmt.Fprintf(os.Stdout, "Starting do wiki...\n")
-	// Initiate DB connection
-	conn, err := pgx.Connect(context.Background(), os.Getenv("DATABASE_URL"))
+	parseConfig()
+	if config.ShowVersion {
+		fmt.Println(buildInfo())
+		return
+	}
+	if err := config.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		os.Exit(1)
+	}
+	if err := compileTitlePattern(config.TitlePattern); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		os.Exit(1)
+	}
+	md, err := newMarkdown(config.MarkdownExtensions, config.IframeHosts, config.ExternalLinksNewTab, config.HighlightStyle)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		os.Exit(1)
+	}
+	markdown = md
+
+	name, args := "serve", flag.Args()
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := commands[name]
+	if !ok || cmd.args >= 0 && len(args) != cmd.args {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// the files and sqlite stores live inside the server, leaving nothing
+	// for the other commands to work on
+	if config.Store != storePostgres {
+		if name != "serve" {
+			fmt.Fprintf(os.Stderr, "%s works on Postgres only, not on -store %s\n", name, config.Store)
+			os.Exit(2)
+		}
+		if err := serve(nil, args); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Initiate DB connection. Only the server is held to the statement
+	// timeout; commands like export and reindex are run by hand and may
+	// legitimately take longer.
+	var statementTimeout time.Duration
+	if name == "serve" {
+		statementTimeout = config.StatementTimeout
+	}
+	pool, err := connectPool(context.Background(), config.DatabaseURL, statementTimeout)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Unable to connect to database: %v\n", err)
 		os.Exit(1)
 	}
-	defer conn.Close(context.Background())
+	err = cmd.run(pool, args)
+	pool.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		os.Exit(1)
+	}
+}
 
-	// Serve files in `public/css` directory
-	fs := http.FileServer(http.Dir("./public/css"))
-	http.Handle("/css/", http.StripPrefix("/css/", fs))
+// serve runs the wiki's HTTP server.
+func serve(conn db, args []string) error {
+	fmt.Fprintf(os.Stdout, "Starting do wiki...\n")
+	log.Printf("running %s", buildInfo())
+	if config.Migrate && conn != nil {
+		names, err := migrate(context.Background(), conn)
+		if err != nil {
+			return fmt.Errorf("unable to migrate the schema: %v", err)
+		}
+		for _, name := range names {
+			log.Printf("applied migration %s", name)
+		}
+	}
+	if !config.AnonymousEdits && !config.Signups && config.AdminPassword == "" {
+		log.Printf("anonymous edits and signups are off and no admin password is set, so only existing accounts can edit pages")
+	}
+	renders = newRenderCache(config.RenderCacheSize, config.RenderCacheTTL)
+	editQuotas = newEditQuota(config.EditQuota, config.EditQuotaWindow)
+	readLimits, writeLimits = newRateLimiter(config.ReadRateLimit), newRateLimiter(config.WriteRateLimit)
+	limitRenders(config.MaxRenders)
 
-	// Wiki actions
-	http.HandleFunc("/view/", makeHandler(viewHandler, conn))
-	http.HandleFunc("/edit/", makeHandler(editHandler, conn))
-	http.HandleFunc("/save/", makeHandler(saveHandler, conn))
+	tmplFS, err := templateFS()
+	if err != nil {
+		return fmt.Errorf("unable to load templates: %v", err)
+	}
+	templates, err = parseTemplates(tmplFS)
+	if err != nil {
+		return fmt.Errorf("unable to parse templates: %v", err)
+	}
+	boilerplate, err = loadBoilerplate(config.NewPageTemplate)
+	if err != nil {
+		return fmt.Errorf("unable to load the new page template: %v", err)
+	}
+	pageTemplates, err = loadPageTemplates(config.PageTemplates)
+	if err != nil {
+		return fmt.Errorf("unable to load the page templates: %v", err)
+	}
+	if trustedProxies, err = parseProxies(config.TrustedProxies); err != nil {
+		return err
+	}
+	spamBlocklist, err = loadBlocklist(config.SpamBlocklist)
+	if err != nil {
+		return fmt.Errorf("unable to load the spam blocklist: %v", err)
+	}
+	if config.UploadDir != "" {
+		if err := os.MkdirAll(config.UploadDir, 0o755); err != nil {
+			return fmt.Errorf("unable to create the upload directory: %v", err)
+		}
+	}
+	if config.SubmissionLog != "" {
+		if submissionLog, err = openJSONLog(config.SubmissionLog); err != nil {
+			return fmt.Errorf("unable to open the submission log: %v", err)
+		}
+	}
+	if config.AccessLog != "" {
+		if accessLog, err = openJSONLog(config.AccessLog); err != nil {
+			return fmt.Errorf("unable to open the access log: %v", err)
+		}
+	}
+
+	// background work stops once the last request is done, so the view
+	// events of requests drained on shutdown are still written
+	workers, stopWorkers := context.WithCancel(context.Background())
+	var running sync.WaitGroup
+	start := func(work func(ctx context.Context)) {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			work(workers)
+		}()
+	}
+	defer running.Wait()
+	defer stopWorkers()
+
+	// these connect to the database on their own
+	if conn != nil {
+		if config.WarmPages > 0 && config.RenderCacheSize > 0 {
+			start(func(ctx context.Context) { warmRenderCache(ctx, config.WarmPages) })
+		}
+		if config.ViewLog {
+			viewLog = make(chan viewEvent, viewQueueSize)
+			start(func(ctx context.Context) { runViewLog(ctx, viewLog) })
+		}
+		if config.SaveQueue > 0 {
+			saveQueue = make(chan *Page, config.SaveQueue)
+			start(func(ctx context.Context) { runSaveQueue(ctx, saveQueue) })
+		}
+		if config.ExpiryInterval > 0 {
+			start(func(ctx context.Context) { runExpiry(ctx, config.ExpiryInterval) })
+		}
+		if config.BackupDir != "" {
+			start(func(ctx context.Context) {
+				runBackups(ctx, config.BackupDir, config.BackupInterval, config.BackupRetention)
+			})
+		}
+	}
+
+	// static assets (`public/css`)
+	static, err := staticFS()
+	if err != nil {
+		return fmt.Errorf("unable to load static assets: %v", err)
+	}
+
+	var store PageStore
+	if conn == nil {
+		local, err := openLocalStore(config.Store, config.StorePath)
+		if err != nil {
+			return fmt.Errorf("unable to open the %s store: %v", config.Store, err)
+		}
+		defer local.Close()
+		store = local
+	} else {
+		pg := &pgStore{conn: conn}
+		if config.ReplicaURL != "" {
+			replica, err := connectPool(context.Background(), config.ReplicaURL, config.StatementTimeout)
+			if err != nil {
+				return fmt.Errorf("unable to connect to the replica: %v", err)
+			}
+			defer replica.Close()
+			pg.replica, pg.written = replica, newRecentWrites(config.ReplicaLag)
+		}
+		store = pg
+	}
+	if notifiers = newNotifiers(); len(notifiers) > 0 {
+		changes = make(chan pageChange, notifyQueueSize)
+		start(func(ctx context.Context) { runNotifier(ctx, changes, store) })
+	}
 
-	// redirect to home page
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		http.Redirect(w, r, "/view/FrontPage", http.StatusFound)
-	})
+	routes(http.DefaultServeMux, static, store, conn)
 
 	fmt.Fprintf(os.Stdout, "Up and running!\n")
-	log.Fatal(http.ListenAndServe(":3000", nil))
+	var handler http.Handler = limitQueries(http.DefaultServeMux)
+	if config.NormalizeURLs {
+		handler = normalizeURLs(handler)
+	}
+	if config.HealthCheckInterval > 0 && conn != nil {
+		start(func(ctx context.Context) { runHealthCheck(ctx, config.HealthCheckInterval) })
+		handler = requireDB(handler, config.HealthCheckInterval)
+	}
+	handler = withSessions(securityHeaders(limitRates(requireCSRFToken(handler))))
+	handler = withBasePath(handler, config.BasePath)
+	srv := &http.Server{
+		Addr:              config.Listen,
+		Handler:           fromProxies(observeRequests(recoverPanics(handler))),
+		ReadTimeout:       config.ReadTimeout,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+	srv.RegisterOnShutdown(pageEvents.closeStreams)
+
+	stopping, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	served := make(chan error, 1)
+	go func() { served <- listen(srv) }()
+	select {
+	case err := <-served:
+		return err
+	case <-stopping.Done():
+	}
+	// a second signal kills the server at once
+	stop()
+	log.Printf("shutting down, waiting up to %s for requests in flight", config.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		srv.Close()
+		return fmt.Errorf("requests still running after %s were cut off", config.ShutdownTimeout)
+	}
+	log.Printf("shut down")
+	return nil
+}
+
+// routes registers the pages and tools of the wiki on mux, serving pages
+// from store and the static assets from static. The tools working on the
+// database itself are left out when conn is nil, as under the files and
+// sqlite stores.
+func routes(mux *http.ServeMux, static fs.FS, store PageStore, conn db) {
+	mux.Handle("/css/", http.StripPrefix("/css/", http.FileServer(http.FS(static))))
+	mux.HandleFunc("/robots.txt", robotsHandler)
+
+	// Wiki actions
+	mux.HandleFunc("/view/{title...}", allowMethods(makeHandler(viewHandler, store), http.MethodGet, http.MethodHead))
+	mux.HandleFunc("/raw/{title...}", allowMethods(makeHandler(rawHandler, store), http.MethodGet, http.MethodHead))
+	mux.HandleFunc("/edit/{title...}", allowMethods(makeHandler(editHandler, store), http.MethodGet, http.MethodHead))
+	mux.HandleFunc("/save/{title...}", allowMethods(makeHandler(saveHandler, store), http.MethodPost))
+	mux.HandleFunc("/preview/{title...}", allowMethods(makeHandler(previewHandler, store), http.MethodPost))
+	mux.HandleFunc("/draft/{title...}", allowMethods(makeHandler(draftHandler, store), http.MethodGet, http.MethodHead, http.MethodPost))
+	mux.HandleFunc("/talk/{title...}", allowMethods(makeHandler(talkHandler, store), http.MethodGet, http.MethodHead, http.MethodPost))
+	mux.HandleFunc("/watch/{title...}", allowMethods(makeHandler(watchHandler, store), http.MethodPost))
+	mux.HandleFunc("/split/{title...}", makeHandler(splitHandler, store))
+	mux.HandleFunc("/protect/{title...}", makeHandler(protectHandler, store))
+	mux.HandleFunc("/rename/{title...}", makeHandler(renameHandler, store))
+	mux.HandleFunc("/history/{title...}", allowMethods(makeHandler(historyHandler, store), http.MethodGet, http.MethodHead))
+	mux.HandleFunc("/diff/{title...}", allowMethods(makeHandler(diffHandler, store), http.MethodGet, http.MethodHead))
+	mux.HandleFunc("/revert/{title...}", allowMethods(makeHandler(revertHandler, store), http.MethodPost))
+	mux.HandleFunc("/delete/{title...}", allowMethods(makeHandler(deleteHandler, store), http.MethodGet, http.MethodHead, http.MethodPost))
+	mux.HandleFunc("/restore/{title...}", allowMethods(makeHandler(restoreHandler, store), http.MethodPost))
+	if config.PageEvents {
+		mux.HandleFunc("/events/{title...}", allowMethods(makeHandler(eventsHandler, store), http.MethodGet))
+	}
+	mux.HandleFunc("/search", makeStoreHandler(searchHandler, store))
+	mux.HandleFunc("/ns/", makeStoreHandler(namespaceHandler, store))
+	mux.HandleFunc("/new", allowMethods(makeStoreHandler(newPageHandler, store), http.MethodGet, http.MethodHead))
+	mux.HandleFunc("/index", allowMethods(makeStoreHandler(indexHandler, store), http.MethodGet, http.MethodHead))
+	mux.HandleFunc("/all", allowMethods(func(w http.ResponseWriter, r *http.Request) {
+		redirect(w, r, "/index?sort=title", http.StatusMovedPermanently)
+	}, http.MethodGet, http.MethodHead))
+	mux.HandleFunc("/random", allowMethods(makeStoreHandler(randomHandler, store), http.MethodGet, http.MethodHead))
+	mux.HandleFunc("/recent", allowMethods(makeStoreHandler(recentHandler, store), http.MethodGet, http.MethodHead))
+	mux.HandleFunc("/watchlist", allowMethods(makeStoreHandler(watchlistHandler, store), http.MethodGet, http.MethodHead, http.MethodPost))
+	mux.HandleFunc("/comments", allowMethods(makeStoreHandler(recentCommentsHandler, store), http.MethodGet, http.MethodHead))
+	mux.HandleFunc("/comments.atom", allowMethods(makeStoreHandler(commentsFeedHandler, store), http.MethodGet, http.MethodHead))
+	mux.HandleFunc("/sitemap.xml", allowMethods(makeStoreHandler(sitemapHandler, store), http.MethodGet, http.MethodHead))
+	mux.HandleFunc("/api/", apiNotFoundHandler)
+	mux.HandleFunc("/api/pages/", makeStoreHandler(apiPagesHandler, store))
+	mux.HandleFunc("/api/titles", allowMethods(makeStoreHandler(apiTitlesHandler, store), http.MethodGet, http.MethodHead))
+	mux.HandleFunc("/logout", allowMethods(logoutHandler, http.MethodPost))
+	mux.HandleFunc("/search/export", makeStoreHandler(searchExportHandler, store))
+
+	// Admin tools
+	mux.HandleFunc("/merge", adminOnly(makeStoreHandler(mergeHandler, store)))
+	mux.HandleFunc("/replace", adminOnly(allowMethods(makeStoreHandler(replaceHandler, store), http.MethodGet, http.MethodHead, http.MethodPost)))
+	mux.HandleFunc("/templates", adminOnly(allowMethods(makeStoreHandler(pageTemplatesHandler, store), http.MethodGet, http.MethodHead, http.MethodPost)))
+	mux.HandleFunc("/views/{title...}", adminOnly(makeHandler(viewsHandler, store)))
+	mux.HandleFunc("/debug/errors", adminOnly(debugErrorsHandler))
+	mux.HandleFunc("/version", allowMethods(versionHandler, http.MethodGet, http.MethodHead))
+	mux.HandleFunc("/healthz", allowMethods(healthzHandler, http.MethodGet, http.MethodHead))
+
+	// accounts, uploads, tags and the admin tools work on the database
+	// itself, which the files and sqlite stores don't have
+	if conn != nil {
+		sessionDB = conn
+		mux.HandleFunc("/login", allowMethods(makeConnHandler(loginHandler, conn), http.MethodGet, http.MethodHead, http.MethodPost))
+		mux.HandleFunc("/signup", allowMethods(makeConnHandler(signupHandler, conn), http.MethodGet, http.MethodHead, http.MethodPost))
+		mux.HandleFunc("/files/", makeConnHandler(filesHandler, conn))
+		mux.HandleFunc("/upload/", makeConnHandler(uploadHandler, conn))
+		mux.HandleFunc("/archive", makeConnHandler(archiveHandler, conn))
+		mux.HandleFunc("/archive/", makeConnHandler(archiveHandler, conn))
+		mux.HandleFunc("/orphans", allowMethods(makeConnHandler(orphansHandler, conn), http.MethodGet, http.MethodHead))
+		mux.HandleFunc("/wanted", allowMethods(makeConnHandler(wantedHandler, conn), http.MethodGet, http.MethodHead))
+		mux.HandleFunc("/tag/", allowMethods(makeConnHandler(tagHandler, conn), http.MethodGet, http.MethodHead))
+		mux.HandleFunc("/tags", allowMethods(makeConnHandler(tagCloudHandler, conn), http.MethodGet, http.MethodHead))
+		mux.HandleFunc("/admin", adminOnly(allowMethods(makeConnHandler(dashboardHandler, conn), http.MethodGet, http.MethodHead, http.MethodPost)))
+		mux.HandleFunc("/tags/rename", adminOnly(makeConnHandler(renameTagHandler, conn)))
+		mux.HandleFunc("/tags/delete", adminOnly(makeConnHandler(deleteTagHandler, conn)))
+		mux.HandleFunc("/users", adminOnly(allowMethods(makeConnHandler(usersHandler, conn), http.MethodGet, http.MethodHead, http.MethodPost)))
+		mux.HandleFunc("/reindex", adminOnly(makeConnHandler(reindexHandler, conn)))
+		mux.HandleFunc("/links", adminOnly(makeConnHandler(brokenLinksHandler, conn)))
+		mux.HandleFunc("/stats/largest", adminOnly(allowMethods(makeConnHandler(largestPagesHandler, conn), http.MethodGet, http.MethodHead)))
+		mux.HandleFunc("/export", adminOnly(allowMethods(makeConnHandler(exportHandler, conn), http.MethodGet, http.MethodHead)))
+		mux.HandleFunc("/readyz", allowMethods(makeConnHandler(readyzHandler, conn), http.MethodGet, http.MethodHead))
+		if config.Metrics {
+			mux.Handle("/metrics", metricsHandler(conn))
+		}
+	} else {
+		mux.HandleFunc("/readyz", allowMethods(healthzHandler, http.MethodGet, http.MethodHead))
+	}
+
+	// home page
+	mux.HandleFunc("/", makeStoreHandler(homeHandler, store))
 }
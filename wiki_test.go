@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestMain sets up what serve does before it serves: the defaults of every
+// setting, the title pattern, the Markdown renderer and the templates.
+func TestMain(m *testing.M) {
+	parseConfig()
+	if err := compileTitlePattern(config.TitlePattern); err != nil {
+		log.Fatal(err)
+	}
+	md, err := newMarkdown(config.MarkdownExtensions, config.IframeHosts, config.ExternalLinksNewTab, config.HighlightStyle)
+	if err != nil {
+		log.Fatal(err)
+	}
+	markdown = md
+	tmplFS, err := templateFS()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if templates, err = parseTemplates(tmplFS); err != nil {
+		log.Fatal(err)
+	}
+	renders = newRenderCache(config.RenderCacheSize, config.RenderCacheTTL)
+	editQuotas = newEditQuota(config.EditQuota, config.EditQuotaWindow)
+	readLimits, writeLimits = newRateLimiter(config.ReadRateLimit), newRateLimiter(config.WriteRateLimit)
+	limitRenders(config.MaxRenders)
+	os.Exit(m.Run())
+}
+
+// keepConfig restores the settings as they are once t is done, so a test
+// can change them.
+func keepConfig(t testing.TB) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+}
+
+// testServer serves the wiki from store, without a database, behind the
+// middleware serve puts it behind.
+func testServer(store PageStore) http.Handler {
+	static, err := staticFS()
+	if err != nil {
+		panic(err)
+	}
+	mux := http.NewServeMux()
+	routes(mux, static, store, nil)
+	var h http.Handler = normalizeURLs(limitQueries(mux))
+	h = withSessions(securityHeaders(limitRates(requireCSRFToken(h))))
+	return withBasePath(h, config.BasePath)
+}
+
+// request sends h a request, with form as its body unless it is nil, and
+// returns the response.
+func request(h http.Handler, method, target string, form url.Values) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest(method, target, form))
+	return w
+}
+
+// adminRequest is request signed in as the admin of -admin-password, which
+// the test sets.
+func adminRequest(h http.Handler, method, target string, form url.Values) *httptest.ResponseRecorder {
+	r := newRequest(method, target, form)
+	r.SetBasicAuth(config.AdminUser, config.AdminPassword)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func newRequest(method, target string, form url.Values) *http.Request {
+	if form == nil {
+		return httptest.NewRequest(method, target, nil)
+	}
+	r := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+// seedStore is a memStore holding pages titled and with the bodies of
+// bodies.
+func seedStore(bodies map[string]string) *memStore {
+	s := newMemStore()
+	for title, body := range bodies {
+		if err := s.Save(&Page{Title: title, Body: []byte(body), UpdatedBy: "Alice"}); err != nil {
+			panic(err)
+		}
+	}
+	return s
+}
+
+func TestAllowMethods(t *testing.T) {
+	called := false
+	h := allowMethods(func(w http.ResponseWriter, r *http.Request) { called = true }, http.MethodGet, http.MethodHead)
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		called = false
+		if h(httptest.NewRecorder(), httptest.NewRequest(method, "/", nil)); !called {
+			t.Errorf("%s wasn't passed on", method)
+		}
+	}
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodDelete} {
+		called = false
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(method, "/", nil))
+		if called || w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s got %d and was passed on: %v", method, w.Code, called)
+		}
+		if allow := w.Header().Get("Allow"); allow != "GET, HEAD" {
+			t.Errorf("%s got Allow %q", method, allow)
+		}
+	}
+}
+
+// TestWrongMethods calls page actions with a method they don't take and
+// checks nothing was done.
+func TestWrongMethods(t *testing.T) {
+	keepConfig(t)
+	config.AnonymousEdits = true
+	store := seedStore(map[string]string{"Home": "home"})
+	h := testServer(store)
+	tests := []struct {
+		method, path string
+		form         url.Values
+		allow        string
+	}{
+		{http.MethodPost, "/view/Home", url.Values{"body": {"changed"}}, "GET, HEAD"},
+		{http.MethodPost, "/edit/Home", url.Values{"body": {"changed"}}, "GET, HEAD"},
+		{http.MethodPost, "/history/Home", url.Values{}, "GET, HEAD"},
+		{http.MethodPut, "/diff/Home", url.Values{}, "GET, HEAD"},
+		{http.MethodGet, "/save/Home?body=changed", nil, "POST"},
+		{http.MethodDelete, "/save/Home", nil, "POST"},
+	}
+	for _, tt := range tests {
+		w := request(h, tt.method, tt.path, tt.form)
+		if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != tt.allow {
+			t.Errorf("%s %s got %d with Allow %q, want 405 with %q", tt.method, tt.path, w.Code, w.Header().Get("Allow"), tt.allow)
+		}
+	}
+	if p, _ := store.Load("Home"); string(p.Body) != "home" || p.Version != 1 {
+		t.Errorf("the page is %q at version %d after the wrong methods", p.Body, p.Version)
+	}
+
+	w := request(h, http.MethodPost, "/api/titles", url.Values{})
+	if w.Code != http.StatusMethodNotAllowed || !strings.Contains(w.Body.String(), `"code":"method_not_allowed"`) {
+		t.Errorf("POST to the API got %d: %s", w.Code, w.Body)
+	}
+}
+
+// BenchmarkLoadPageFields compares loading a page with pageMeta, as Stat
+// does, against pageFull, for pages of a few sizes. It needs a Postgres
+// database to spare in GOWIKI_TEST_DATABASE_URL, where it migrates tables
+// prefixed bench_ and leaves them for the next run.
+func BenchmarkLoadPageFields(b *testing.B) {
+	url := os.Getenv("GOWIKI_TEST_DATABASE_URL")
+	if url == "" {
+		b.Skip("GOWIKI_TEST_DATABASE_URL is not set")
+	}
+	keepConfig(b)
+	config.TablePrefix = "bench_"
+	ctx := context.Background()
+	pool, err := connectPool(ctx, url, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer pool.Close()
+	if _, err := migrate(ctx, pool); err != nil {
+		b.Fatal(err)
+	}
+	for _, size := range []int{1 << 10, 64 << 10, 1 << 20} {
+		title := fmt.Sprintf("Benchmark %dB", size)
+		p := &Page{Title: title, Body: bytes.Repeat([]byte("All work and no play. "), size/22+1)[:size]}
+		if err := p.save(ctx, pool); err != nil {
+			b.Fatal(err)
+		}
+		for _, fields := range []struct {
+			name   string
+			fields pageFields
+		}{{"meta", pageMeta}, {"full", pageFull}} {
+			b.Run(fmt.Sprintf("%dB/%s", size, fields.name), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if _, err := loadPageFields(ctx, title, fields.fields, pool); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+	"net/url"
+)
+
+// wikiLink is a [[Title]] or [[Title|Display Text]] link to another page,
+// optionally to a section of it, [[Title#section]].
+type wikiLink struct {
+	ast.BaseInline
+	Target   []byte
+	Fragment []byte
+	Label    []byte
+}
+
+var kindWikiLink = ast.NewNodeKind("WikiLink")
+
+func (n *wikiLink) Kind() ast.NodeKind { return kindWikiLink }
+
+func (n *wikiLink) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Target": string(n.Target), "Fragment": string(n.Fragment), "Label": string(n.Label)}, nil)
+}
+
+// parseWikiLink splits the inside of [[...]] into its target, fragment and
+// label. The label is the target as written unless given after a |.
+func parseWikiLink(inner []byte) (target, fragment, label []byte, ok bool) {
+	target, label = inner, nil
+	if i := bytes.IndexByte(inner, '|'); i >= 0 {
+		target, label = inner[:i], bytes.TrimSpace(inner[i+1:])
+	}
+	target = bytes.TrimSpace(target)
+	if len(label) == 0 {
+		label = target
+	}
+	if i := bytes.IndexByte(target, '#'); i >= 0 {
+		target, fragment = target[:i], target[i+1:]
+	}
+	target = []byte(canonicalTitle(string(target)))
+	if !validTitle.Match(target) {
+		return nil, nil, nil, false
+	}
+	return target, fragment, label, true
+}
+
+type wikiLinkParser struct{}
+
+func (wikiLinkParser) Trigger() []byte { return []byte{'['} }
+
+func (wikiLinkParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	line, _ := block.PeekLine()
+	if !bytes.HasPrefix(line, []byte("[[")) {
+		return nil
+	}
+	end := bytes.Index(line[2:], []byte("]]"))
+	if end < 0 {
+		return nil
+	}
+	// anything that isn't a valid title is left to the other parsers, so
+	// [[ in code samples or prose stays as written
+	target, fragment, label, ok := parseWikiLink(line[2 : 2+end])
+	if !ok {
+		return nil
+	}
+	block.Advance(2 + end + 2)
+	return &wikiLink{Target: target, Fragment: fragment, Label: label}
+}
+
+type wikiLinkRenderer struct{}
+
+func (wikiLinkRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(kindWikiLink, func(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		link := n.(*wikiLink)
+		w.WriteString(`<a href="`)
+		w.Write(util.EscapeHTML([]byte(config.BasePath)))
+		w.Write(util.EscapeHTML([]byte(pagePath("view", string(link.Target)))))
+		if len(link.Fragment) > 0 {
+			w.WriteByte('#')
+			w.Write(util.EscapeHTML([]byte(url.PathEscape(string(link.Fragment)))))
+		}
+		w.WriteString(`" class="wikilink">`)
+		w.Write(util.EscapeHTML(link.Label))
+		w.WriteString("</a>")
+		return ast.WalkSkipChildren, nil
+	})
+}
+
+// wikiLinks renders [[Title]] and [[Title|Display Text]] as links to
+// /view/Title. It runs before the standard link parser so [[...]] never
+// turns into a reference link.
+type wikiLinks struct{}
+
+func (wikiLinks) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(parser.WithInlineParsers(util.Prioritized(wikiLinkParser{}, 199)))
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(util.Prioritized(wikiLinkRenderer{}, 500)))
+}